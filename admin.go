@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/orian/clicktelligence/models"
+)
+
+// requireAdmin lets requests through only when they carry the admin token
+// as "Authorization: Bearer <token>". Without a configured ADMIN_TOKEN the
+// admin endpoints are disabled.
+func (s *Server) requireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.adminToken == "" {
+			http.Error(w, "admin endpoints are disabled; set ADMIN_TOKEN to enable them", http.StatusForbidden)
+			return
+		}
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(s.adminToken)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "invalid admin token", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// handleGetMigrations lists the storage schema migrations and whether each
+// is applied.
+func (s *Server) handleGetMigrations(w http.ResponseWriter, r *http.Request) {
+	statuses, err := s.storage.GetMigrationStatus(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(statuses)
+}
+
+// handleApplyMigrations applies the pending storage schema migrations and
+// returns the ones applied, for deployments with MIGRATE_ON_STARTUP=false.
+func (s *Server) handleApplyMigrations(w http.ResponseWriter, r *http.Request) {
+	applied, err := s.storage.ApplyMigrations(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"applied": applied})
+}
+
+// handleReset deletes all data and recreates the schema and the main
+// branch. It is for development and only enabled by ALLOW_RESET=true.
+func (s *Server) handleReset(w http.ResponseWriter, r *http.Request) {
+	if !s.allowReset {
+		http.Error(w, "reset is disabled; set ALLOW_RESET=true to enable it", http.StatusForbidden)
+		return
+	}
+
+	slog.WarnContext(r.Context(), "Resetting the database: deleting all branches, versions and tags", "remote_addr", r.RemoteAddr)
+	if err := s.storage.Reset(r.Context()); err != nil {
+		slog.ErrorContext(r.Context(), "Database reset failed", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// Cached responses may name versions that no longer exist
+	if s.idempotency != nil {
+		s.idempotency.clear()
+	}
+	if s.settingsCache != nil {
+		s.settingsCache.clear()
+	}
+	slog.WarnContext(r.Context(), "Database reset complete")
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleOptimize runs the storage maintenance of the periodic optimizer on
+// demand and returns the database size before and after.
+func (s *Server) handleOptimize(w http.ResponseWriter, r *http.Request) {
+	result, err := optimizeStorage(r.Context(), s.storage)
+	if errors.Is(err, ErrCheckpointBusy) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// optimizeStorage runs storage.Optimize, logging the file size before and
+// after.
+func optimizeStorage(ctx context.Context, storage models.Storage) (*models.OptimizeResult, error) {
+	slog.InfoContext(ctx, "Optimizing storage")
+	result, err := storage.Optimize(ctx)
+	if err != nil {
+		slog.WarnContext(ctx, "Storage optimization failed", "error", err)
+		return nil, err
+	}
+	slog.InfoContext(ctx, "Storage optimized",
+		"size_before", result.SizeBefore, "size_after", result.SizeAfter, "duration_ms", result.DurationMs)
+	return result, nil
+}
+
+// runPeriodicOptimize calls optimizeStorage every interval until ctx is
+// done. Failures are logged and retried at the next tick.
+func runPeriodicOptimize(ctx context.Context, storage models.Storage, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			optimizeStorage(ctx, storage)
+		}
+	}
+}
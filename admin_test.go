@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/orian/clicktelligence/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRequireAdmin(t *testing.T) {
+	server := NewServer(newTestStorage(t), nil, nil)
+	r := chi.NewRouter()
+	r.With(server.requireAdmin).Get("/api/admin/migrations", server.handleGetMigrations)
+
+	get := func(authorization string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/api/admin/migrations", nil)
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		return rec
+	}
+
+	assert.Equal(t, http.StatusForbidden, get("Bearer anything").Code, "disabled without a token")
+
+	server.adminToken = "s3cret"
+	assert.Equal(t, http.StatusUnauthorized, get("").Code)
+	assert.Equal(t, http.StatusUnauthorized, get("Bearer wrong").Code)
+	assert.Equal(t, http.StatusUnauthorized, get("s3cret").Code)
+
+	rec := get("Bearer s3cret")
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	var statuses []models.MigrationStatus
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&statuses))
+	assert.Len(t, statuses, len(GetMigrations()))
+}
+
+func TestHandleReset(t *testing.T) {
+	storage := newTestStorage(t)
+	server := NewServer(storage, nil, nil)
+
+	branch, err := storage.CreateBranch(t.Context(), "feature", "", "")
+	require.NoError(t, err)
+	version := saveTestVersion(t, storage, branch.ID, "", "SELECT 1")
+	_, err = storage.AddTag(t.Context(), version.ID, "candidate")
+	require.NoError(t, err)
+
+	reset := func() int {
+		rec := httptest.NewRecorder()
+		server.handleReset(rec, httptest.NewRequest(http.MethodPost, "/api/admin/reset", nil))
+		return rec.Code
+	}
+
+	assert.Equal(t, http.StatusForbidden, reset())
+	_, ok := storage.GetVersion(t.Context(), version.ID)
+	assert.True(t, ok, "nothing deleted while disabled")
+
+	server.idempotency = newIdempotencyCache(DefaultIdempotencyWindow)
+	_, _, err = server.idempotency.do(t.Context(), "key", "request", func() (map[string]interface{}, error) {
+		return map[string]interface{}{"version": version}, nil
+	})
+	require.NoError(t, err)
+	_, _, _, err = server.settingsCache.get(t.Context(), DefaultProfile, []string{"max_threads"}, func(context.Context) (map[string]string, []string, error) {
+		return map[string]string{"max_threads": "8"}, nil, nil
+	})
+	require.NoError(t, err)
+
+	server.allowReset = true
+	assert.Equal(t, http.StatusNoContent, reset())
+	assert.Empty(t, server.idempotency.entries)
+	assert.Empty(t, server.settingsCache.entries)
+
+	branches, err := storage.GetBranches(t.Context(), true)
+	require.NoError(t, err)
+	require.Len(t, branches, 1)
+	assert.Equal(t, "main", branches[0].Name)
+	_, ok = storage.GetVersion(t.Context(), version.ID)
+	assert.False(t, ok)
+
+	statuses, err := storage.GetMigrationStatus(t.Context())
+	require.NoError(t, err)
+	for _, status := range statuses {
+		assert.True(t, status.Applied, "migration %d", status.Version)
+	}
+	saveTestVersion(t, storage, branches[0].ID, "", "SELECT 2")
+}
+
+func TestHandleOptimize(t *testing.T) {
+	server := NewServer(newTestStorage(t), nil, nil)
+
+	rec := httptest.NewRecorder()
+	server.handleOptimize(rec, httptest.NewRequest(http.MethodPost, "/api/admin/optimize", nil))
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	var result models.OptimizeResult
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&result))
+	assert.Positive(t, result.SizeAfter)
+}
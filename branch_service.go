@@ -0,0 +1,311 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/orian/clicktelligence/models"
+)
+
+// ErrInvalidMerge is returned when a merge has nothing to merge, such as a
+// source branch without versions.
+var ErrInvalidMerge = errors.New("invalid merge")
+
+// BranchComparison pairs a branch with its head version for side-by-side review.
+type BranchComparison struct {
+	Branch *models.Branch       `json:"branch"`
+	Head   *models.QueryVersion `json:"head"`
+
+	// Duplicate is true when another compared branch has a head with the
+	// same QueryHash, i.e. the branches haven't diverged.
+	Duplicate bool `json:"duplicate"`
+}
+
+// parseIDList splits a comma-separated list of IDs, dropping empty entries.
+func parseIDList(raw string) []string {
+	var ids []string
+	for _, id := range strings.Split(raw, ",") {
+		id = strings.TrimSpace(id)
+		if id != "" {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// compareBranches loads the head version of each branch in the given order.
+// Head is nil for branches without versions. Returns ErrBranchNotFound if
+// any of the branches doesn't exist or is archived.
+func compareBranches(ctx context.Context, storage models.Storage, branchIDs []string) ([]*BranchComparison, error) {
+	comparisons := make([]*BranchComparison, 0, len(branchIDs))
+	hashCounts := make(map[string]int)
+
+	for _, id := range branchIDs {
+		branch, exists := storage.GetBranch(ctx, id)
+		if !exists || branch.Archived {
+			return nil, fmt.Errorf("%w: %s", ErrBranchNotFound, id)
+		}
+
+		comparison := &BranchComparison{Branch: branch}
+		if branch.CurrentVersionID != "" {
+			if head, ok := storage.GetVersion(ctx, branch.CurrentVersionID); ok {
+				comparison.Head = head
+				hashCounts[head.QueryHash]++
+			}
+		}
+		comparisons = append(comparisons, comparison)
+	}
+
+	for _, comparison := range comparisons {
+		if comparison.Head != nil && hashCounts[comparison.Head.QueryHash] > 1 {
+			comparison.Duplicate = true
+		}
+	}
+
+	return comparisons, nil
+}
+
+// cherryPickVersion copies the query of a version onto the head of another
+// branch as a new version. Explain results are left empty so they are
+// re-run on the next explain.
+func cherryPickVersion(ctx context.Context, storage models.Storage, targetBranchID, sourceVersionID string) (*models.QueryVersion, error) {
+	branch, exists := storage.GetBranch(ctx, targetBranchID)
+	if !exists {
+		return nil, fmt.Errorf("%w: %s", ErrBranchNotFound, targetBranchID)
+	}
+
+	source, exists := storage.GetVersion(ctx, sourceVersionID)
+	if !exists {
+		return nil, fmt.Errorf("%w: %s", ErrVersionNotFound, sourceVersionID)
+	}
+
+	version := &models.QueryVersion{
+		ID:              uuid.New().String(),
+		BranchID:        branch.ID,
+		Query:           source.Query,
+		QueryHash:       hashQuery(source.Query),
+		ExplainResults:  []models.ExplainResult{},
+		Timestamp:       time.Now(),
+		ParentVersionID: branch.CurrentVersionID,
+	}
+
+	if err := storage.SaveVersion(ctx, version); err != nil {
+		return nil, fmt.Errorf("failed to save version: %w", err)
+	}
+
+	return version, nil
+}
+
+// prepareMerge builds the explain request that merges the head of
+// sourceBranchID into targetBranchID: the source head's query, parameters
+// and profile, parented on the target head with the source head as merge
+// parent. Returns ErrInvalidMerge if the branches are the same or the
+// source has no versions.
+func prepareMerge(ctx context.Context, storage models.Storage, targetBranchID, sourceBranchID string) (*ExplainRequest, error) {
+	if targetBranchID == sourceBranchID {
+		return nil, fmt.Errorf("%w: cannot merge branch %s into itself", ErrInvalidMerge, targetBranchID)
+	}
+
+	target, exists := storage.GetBranch(ctx, targetBranchID)
+	if !exists {
+		return nil, fmt.Errorf("%w: %s", ErrBranchNotFound, targetBranchID)
+	}
+	source, exists := storage.GetBranch(ctx, sourceBranchID)
+	if !exists {
+		return nil, fmt.Errorf("%w: %s", ErrBranchNotFound, sourceBranchID)
+	}
+	if source.CurrentVersionID == "" {
+		return nil, fmt.Errorf("%w: branch %s has no versions", ErrInvalidMerge, source.Name)
+	}
+
+	head, exists := storage.GetVersion(ctx, source.CurrentVersionID)
+	if !exists {
+		return nil, fmt.Errorf("%w: %s", ErrVersionNotFound, source.CurrentVersionID)
+	}
+
+	req := &ExplainRequest{
+		BranchID:             target.ID,
+		Query:                head.Query,
+		ParentVersionID:      target.CurrentVersionID,
+		Parameters:           head.ExecutionStats.Parameters,
+		CustomSettings:       head.ExecutionStats.CustomSettings,
+		mergeParentVersionID: head.ID,
+	}
+	if profile := profileFromStats(head.ExecutionStats); profile != DefaultProfile {
+		req.Profile = profile
+	}
+	return req, nil
+}
+
+// duplicateBranch forks a new branch from the current head of sourceBranchID.
+// When copyHead is true and the source has a head, the head is copied as the
+// new branch's first version, parented on the original. The returned version
+// is nil otherwise. If the head can't be copied, the new branch is deleted
+// again.
+func duplicateBranch(ctx context.Context, storage models.Storage, sourceBranchID, name string, copyHead bool) (*models.Branch, *models.QueryVersion, error) {
+	source, exists := storage.GetBranch(ctx, sourceBranchID)
+	if !exists {
+		return nil, nil, fmt.Errorf("%w: %s", ErrBranchNotFound, sourceBranchID)
+	}
+
+	if name == "" {
+		name = fmt.Sprintf("%s-copy-%s", source.Name, time.Now().Format("2006-01-02-15:04:05"))
+	}
+
+	branch, err := storage.CreateBranch(ctx, name, source.ID, source.CurrentVersionID)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create branch: %w", err)
+	}
+
+	if !copyHead || source.CurrentVersionID == "" {
+		return branch, nil, nil
+	}
+
+	head, exists := storage.GetVersion(ctx, source.CurrentVersionID)
+	if !exists {
+		return branch, nil, nil
+	}
+
+	version := &models.QueryVersion{
+		ID:              uuid.New().String(),
+		BranchID:        branch.ID,
+		Query:           head.Query,
+		QueryHash:       head.QueryHash,
+		ExplainResults:  head.ExplainResults,
+		Configs:         head.Configs,
+		ExecutionStats:  head.ExecutionStats,
+		Timestamp:       time.Now(),
+		ParentVersionID: head.ID,
+	}
+	if err := storage.SaveVersion(ctx, version); err != nil {
+		if deleteErr := storage.DeleteBranch(context.WithoutCancel(ctx), branch.ID); deleteErr != nil {
+			slog.Warn("Failed to delete branch after failed copy", "branch_id", branch.ID, "error", deleteErr)
+		}
+		return nil, nil, fmt.Errorf("failed to copy head version: %w", err)
+	}
+	branch.CurrentVersionID = version.ID
+
+	return branch, version, nil
+}
+
+// getBranchHead loads the head version of a branch with its tags. The
+// version is nil when the branch has no versions yet.
+func getBranchHead(ctx context.Context, storage models.Storage, branchID string) (*VersionDetail, error) {
+	branch, exists := storage.GetBranch(ctx, branchID)
+	if !exists {
+		return nil, fmt.Errorf("%w: %s", ErrBranchNotFound, branchID)
+	}
+	if branch.CurrentVersionID == "" {
+		return nil, nil
+	}
+
+	head, err := getVersionDetail(ctx, storage, branch.CurrentVersionID)
+	if errors.Is(err, ErrVersionNotFound) {
+		return nil, nil
+	}
+	return head, err
+}
+
+// EstimatePoint is the EXPLAIN ESTIMATE total of one version.
+type EstimatePoint struct {
+	VersionID  string    `json:"versionId"`
+	Timestamp  time.Time `json:"timestamp"`
+	TotalRows  uint64    `json:"totalRows"`
+	TotalMarks uint64    `json:"totalMarks"`
+	TotalParts uint64    `json:"totalParts"`
+}
+
+// estimateTrend returns the ESTIMATE totals of a branch's versions, oldest
+// first. Versions without a successful ESTIMATE result are skipped.
+func estimateTrend(ctx context.Context, storage models.Storage, branchID string) ([]EstimatePoint, error) {
+	if _, exists := storage.GetBranch(ctx, branchID); !exists {
+		return nil, fmt.Errorf("%w: %s", ErrBranchNotFound, branchID)
+	}
+
+	history, err := storage.GetBranchHistory(ctx, branchID)
+	if err != nil {
+		return nil, err
+	}
+
+	points := []EstimatePoint{}
+	for _, version := range slices.Backward(history) {
+		i := slices.IndexFunc(version.ExplainResults, func(result models.ExplainResult) bool {
+			return result.Type == models.ExplainEstimate && result.Error == ""
+		})
+		if i < 0 {
+			continue
+		}
+		total := models.SumEstimate(version.ExplainResults[i].Estimate)
+		points = append(points, EstimatePoint{
+			VersionID:  version.ID,
+			Timestamp:  version.Timestamp,
+			TotalRows:  total.Rows,
+			TotalMarks: total.Marks,
+			TotalParts: total.Parts,
+		})
+	}
+	return points, nil
+}
+
+// BranchNode is a branch with the branches forked from it, for rendering the
+// branch hierarchy.
+type BranchNode struct {
+	*models.Branch
+	Children []*BranchNode `json:"children"`
+}
+
+// buildBranchTree nests branches under their ParentBranchID, keeping the
+// input order among siblings. Branches without a parent, or whose parent is
+// unknown, are roots. Parent links that form a cycle are cut so that every
+// branch appears exactly once.
+func buildBranchTree(branches []*models.Branch) []*BranchNode {
+	known := make(map[string]bool, len(branches))
+	for _, branch := range branches {
+		known[branch.ID] = true
+	}
+
+	children := make(map[string][]*models.Branch)
+	var roots []*models.Branch
+	for _, branch := range branches {
+		parent := branch.ParentBranchID
+		if parent == "" || parent == branch.ID || !known[parent] {
+			roots = append(roots, branch)
+			continue
+		}
+		children[parent] = append(children[parent], branch)
+	}
+
+	visited := make(map[string]bool, len(branches))
+	var build func(branch *models.Branch) *BranchNode
+	build = func(branch *models.Branch) *BranchNode {
+		visited[branch.ID] = true
+		node := &BranchNode{Branch: branch, Children: []*BranchNode{}}
+		for _, child := range children[branch.ID] {
+			if !visited[child.ID] {
+				node.Children = append(node.Children, build(child))
+			}
+		}
+		return node
+	}
+
+	tree := make([]*BranchNode, 0, len(roots))
+	for _, root := range roots {
+		tree = append(tree, build(root))
+	}
+
+	// Branches still unvisited are only reachable through a cycle; promote
+	// the first of each cycle to a root.
+	for _, branch := range branches {
+		if !visited[branch.ID] {
+			tree = append(tree, build(branch))
+		}
+	}
+
+	return tree
+}
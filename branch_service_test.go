@@ -0,0 +1,375 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/orian/clicktelligence/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseIDList(t *testing.T) {
+	tests := []struct {
+		name string
+		raw  string
+		want []string
+	}{
+		{name: "empty", raw: "", want: nil},
+		{name: "single", raw: "a", want: []string{"a"}},
+		{name: "multiple", raw: "a,b,c", want: []string{"a", "b", "c"}},
+		{name: "trims spaces and drops empty", raw: " a , ,b,", want: []string{"a", "b"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, parseIDList(tt.raw))
+		})
+	}
+}
+
+func TestCompareBranches(t *testing.T) {
+	storage := newTestStorage(t)
+
+	a, err := storage.CreateBranch(t.Context(), "a", "", "")
+	require.NoError(t, err)
+	b, err := storage.CreateBranch(t.Context(), "b", "", "")
+	require.NoError(t, err)
+	c, err := storage.CreateBranch(t.Context(), "c", "", "")
+	require.NoError(t, err)
+	empty, err := storage.CreateBranch(t.Context(), "empty", "", "")
+	require.NoError(t, err)
+
+	saveTestVersion(t, storage, a.ID, "", "SELECT 1")
+	saveTestVersion(t, storage, b.ID, "", "SELECT 1")
+	saveTestVersion(t, storage, c.ID, "", "SELECT 2")
+
+	got, err := compareBranches(t.Context(), storage, []string{a.ID, b.ID, c.ID, empty.ID})
+	require.NoError(t, err)
+	require.Len(t, got, 4)
+
+	assert.Equal(t, a.ID, got[0].Branch.ID)
+	assert.True(t, got[0].Duplicate)
+	assert.True(t, got[1].Duplicate)
+	assert.False(t, got[2].Duplicate)
+	assert.Equal(t, "SELECT 2", got[2].Head.Query)
+	assert.Nil(t, got[3].Head)
+	assert.False(t, got[3].Duplicate)
+}
+
+func TestCompareBranchesUnknownBranch(t *testing.T) {
+	storage := newTestStorage(t)
+
+	_, err := compareBranches(t.Context(), storage, []string{"missing"})
+	assert.ErrorIs(t, err, ErrBranchNotFound)
+}
+
+func TestCompareBranchesArchivedBranch(t *testing.T) {
+	storage := newTestStorage(t)
+
+	active, err := storage.CreateBranch(t.Context(), "active", "", "")
+	require.NoError(t, err)
+	archived, err := storage.CreateBranch(t.Context(), "archived", "", "")
+	require.NoError(t, err)
+	require.NoError(t, storage.ArchiveBranch(t.Context(), archived.ID, true))
+
+	_, err = compareBranches(t.Context(), storage, []string{active.ID, archived.ID})
+	assert.ErrorIs(t, err, ErrBranchNotFound)
+}
+
+func TestCherryPickVersion(t *testing.T) {
+	storage := newTestStorage(t)
+
+	target, err := storage.CreateBranch(t.Context(), "target", "", "")
+	require.NoError(t, err)
+	experiment, err := storage.CreateBranch(t.Context(), "experiment", "", "")
+	require.NoError(t, err)
+
+	head := saveTestVersion(t, storage, target.ID, "", "SELECT 1")
+	source := saveTestVersion(t, storage, experiment.ID, "", "SELECT 42")
+
+	t.Run("copies query onto target head", func(t *testing.T) {
+		got, err := cherryPickVersion(t.Context(), storage, target.ID, source.ID)
+		require.NoError(t, err)
+
+		assert.NotEqual(t, source.ID, got.ID)
+		assert.Equal(t, target.ID, got.BranchID)
+		assert.Equal(t, "SELECT 42", got.Query)
+		assert.Equal(t, hashQuery("SELECT 42"), got.QueryHash)
+		assert.Equal(t, head.ID, got.ParentVersionID)
+		assert.Empty(t, got.ExplainResults)
+
+		branch, ok := storage.GetBranch(t.Context(), target.ID)
+		require.True(t, ok)
+		assert.Equal(t, got.ID, branch.CurrentVersionID)
+	})
+
+	t.Run("unknown branch", func(t *testing.T) {
+		_, err := cherryPickVersion(t.Context(), storage, "missing", source.ID)
+		assert.ErrorIs(t, err, ErrBranchNotFound)
+	})
+
+	t.Run("unknown version", func(t *testing.T) {
+		_, err := cherryPickVersion(t.Context(), storage, target.ID, "missing")
+		assert.ErrorIs(t, err, ErrVersionNotFound)
+	})
+}
+
+func TestPrepareMerge(t *testing.T) {
+	storage := newTestStorage(t)
+
+	target, err := storage.CreateBranch(t.Context(), "target", "", "")
+	require.NoError(t, err)
+	experiment, err := storage.CreateBranch(t.Context(), "experiment", "", "")
+	require.NoError(t, err)
+	empty, err := storage.CreateBranch(t.Context(), "empty", "", "")
+	require.NoError(t, err)
+
+	head := saveTestVersion(t, storage, target.ID, "", "SELECT 1")
+	source := saveTestVersion(t, storage, experiment.ID, "", "SELECT 42")
+
+	t.Run("source head onto target head", func(t *testing.T) {
+		req, err := prepareMerge(t.Context(), storage, target.ID, experiment.ID)
+		require.NoError(t, err)
+		assert.Equal(t, target.ID, req.BranchID)
+		assert.Equal(t, "SELECT 42", req.Query)
+		assert.Equal(t, head.ID, req.ParentVersionID)
+
+		version := createVersion(req.BranchID, req, hashQuery(req.Query), nil, nil)
+		assert.Equal(t, head.ID, version.ParentVersionID)
+		assert.Equal(t, source.ID, version.MergeParentVersionID)
+	})
+
+	t.Run("into itself", func(t *testing.T) {
+		_, err := prepareMerge(t.Context(), storage, target.ID, target.ID)
+		assert.ErrorIs(t, err, ErrInvalidMerge)
+	})
+
+	t.Run("source without versions", func(t *testing.T) {
+		_, err := prepareMerge(t.Context(), storage, target.ID, empty.ID)
+		assert.ErrorIs(t, err, ErrInvalidMerge)
+	})
+
+	t.Run("unknown branch", func(t *testing.T) {
+		_, err := prepareMerge(t.Context(), storage, "missing", experiment.ID)
+		assert.ErrorIs(t, err, ErrBranchNotFound)
+	})
+}
+
+func TestEstimateTrend(t *testing.T) {
+	storage := newTestStorage(t)
+
+	branch, err := storage.CreateBranch(t.Context(), "trend", "", "")
+	require.NoError(t, err)
+
+	save := func(parentID string, results ...models.ExplainResult) *models.QueryVersion {
+		version := createVersion(branch.ID, &ExplainRequest{Query: "SELECT 1"}, hashQuery("SELECT 1"), nil, results)
+		version.ParentVersionID = parentID
+		require.NoError(t, storage.SaveVersion(t.Context(), version))
+		time.Sleep(time.Millisecond)
+		return version
+	}
+	estimate := func(rows ...models.EstimateRow) models.ExplainResult {
+		return models.ExplainResult{Type: models.ExplainEstimate, Estimate: rows}
+	}
+
+	first := save("", estimate(
+		models.EstimateRow{Table: "events", Parts: 3, Rows: 1000, Marks: 10},
+		models.EstimateRow{Table: "users", Parts: 1, Rows: 50, Marks: 1},
+	))
+	noEstimate := save(first.ID, models.ExplainResult{Type: models.ExplainPlan, Output: "plan"})
+	failed := save(noEstimate.ID, models.ExplainResult{Type: models.ExplainEstimate, Error: "timeout"})
+	last := save(failed.ID, estimate(models.EstimateRow{Table: "events", Parts: 1, Rows: 100, Marks: 2}))
+
+	points, err := estimateTrend(t.Context(), storage, branch.ID)
+	require.NoError(t, err)
+	require.Len(t, points, 2)
+	assert.Equal(t, EstimatePoint{VersionID: first.ID, Timestamp: points[0].Timestamp, TotalRows: 1050, TotalMarks: 11, TotalParts: 4}, points[0])
+	assert.Equal(t, last.ID, points[1].VersionID)
+	assert.Equal(t, uint64(100), points[1].TotalRows)
+
+	_, err = estimateTrend(t.Context(), storage, "missing")
+	assert.ErrorIs(t, err, ErrBranchNotFound)
+}
+
+func TestGetBranchHead(t *testing.T) {
+	storage := newTestStorage(t)
+
+	branch, err := storage.CreateBranch(t.Context(), "head", "", "")
+	require.NoError(t, err)
+
+	head, err := getBranchHead(t.Context(), storage, branch.ID)
+	require.NoError(t, err)
+	assert.Nil(t, head)
+
+	first := saveTestVersion(t, storage, branch.ID, "", "SELECT 1")
+	second := saveTestVersion(t, storage, branch.ID, first.ID, "SELECT 2")
+	_, err = storage.AddTag(t.Context(), second.ID, "reviewed")
+	require.NoError(t, err)
+
+	head, err = getBranchHead(t.Context(), storage, branch.ID)
+	require.NoError(t, err)
+	require.NotNil(t, head)
+	assert.Equal(t, second.ID, head.ID)
+	assert.Equal(t, first.QueryHash, head.ParentQueryHash)
+	require.Len(t, head.Tags, 1)
+	assert.Equal(t, "reviewed", head.Tags[0].TagKey)
+
+	_, err = getBranchHead(t.Context(), storage, "missing")
+	assert.ErrorIs(t, err, ErrBranchNotFound)
+}
+
+// failingSaveStorage fails every SaveVersion with err.
+type failingSaveStorage struct {
+	models.Storage
+	err error
+}
+
+func (s failingSaveStorage) SaveVersion(ctx context.Context, version *models.QueryVersion) error {
+	return s.err
+}
+
+func TestDuplicateBranch(t *testing.T) {
+	storage := newTestStorage(t)
+
+	source, err := storage.CreateBranch(t.Context(), "source", "", "")
+	require.NoError(t, err)
+	head := saveTestVersion(t, storage, source.ID, "", "SELECT 1")
+
+	t.Run("without copying head", func(t *testing.T) {
+		branch, version, err := duplicateBranch(t.Context(), storage, source.ID, "risky", false)
+		require.NoError(t, err)
+		assert.Nil(t, version)
+		assert.Equal(t, "risky", branch.Name)
+		assert.Equal(t, source.ID, branch.ParentBranchID)
+		assert.Equal(t, head.ID, branch.BranchFromVersionID)
+		assert.Empty(t, branch.CurrentVersionID)
+	})
+
+	t.Run("copying head", func(t *testing.T) {
+		branch, version, err := duplicateBranch(t.Context(), storage, source.ID, "", true)
+		require.NoError(t, err)
+		require.NotNil(t, version)
+		assert.Contains(t, branch.Name, "source-copy-")
+		assert.Equal(t, branch.ID, version.BranchID)
+		assert.Equal(t, head.Query, version.Query)
+		assert.Equal(t, head.ID, version.ParentVersionID)
+
+		stored, ok := storage.GetBranch(t.Context(), branch.ID)
+		require.True(t, ok)
+		assert.Equal(t, version.ID, stored.CurrentVersionID)
+	})
+
+	t.Run("failed copy deletes branch", func(t *testing.T) {
+		failing := failingSaveStorage{Storage: storage, err: errors.New("disk full")}
+		_, _, err := duplicateBranch(t.Context(), failing, source.ID, "orphan", true)
+		require.ErrorContains(t, err, "disk full")
+
+		branches, err := storage.GetBranches(t.Context(), true)
+		require.NoError(t, err)
+		for _, branch := range branches {
+			assert.NotEqual(t, "orphan", branch.Name)
+		}
+	})
+
+	t.Run("source without versions", func(t *testing.T) {
+		empty, err := storage.CreateBranch(t.Context(), "empty", "", "")
+		require.NoError(t, err)
+
+		branch, version, err := duplicateBranch(t.Context(), storage, empty.ID, "", true)
+		require.NoError(t, err)
+		assert.Nil(t, version)
+		assert.Empty(t, branch.BranchFromVersionID)
+	})
+
+	t.Run("unknown branch", func(t *testing.T) {
+		_, _, err := duplicateBranch(t.Context(), storage, "missing", "", false)
+		assert.ErrorIs(t, err, ErrBranchNotFound)
+	})
+}
+
+func TestBuildBranchTree(t *testing.T) {
+	branch := func(id, parent string) *models.Branch {
+		return &models.Branch{ID: id, Name: id, ParentBranchID: parent}
+	}
+
+	// ids flattens a tree as "id(children...)" for compact assertions.
+	var ids func(nodes []*BranchNode) string
+	ids = func(nodes []*BranchNode) string {
+		var parts []string
+		for _, node := range nodes {
+			part := node.ID
+			if len(node.Children) > 0 {
+				part += "(" + ids(node.Children) + ")"
+			}
+			parts = append(parts, part)
+		}
+		return strings.Join(parts, " ")
+	}
+
+	tests := []struct {
+		name     string
+		branches []*models.Branch
+		want     string
+	}{
+		{name: "empty", branches: nil, want: ""},
+		{
+			name:     "nested",
+			branches: []*models.Branch{branch("main", ""), branch("a", "main"), branch("b", "main"), branch("a1", "a")},
+			want:     "main(a(a1) b)",
+		},
+		{
+			name:     "child listed before parent",
+			branches: []*models.Branch{branch("a", "main"), branch("main", "")},
+			want:     "main(a)",
+		},
+		{
+			name:     "unknown parent becomes root",
+			branches: []*models.Branch{branch("main", ""), branch("orphan", "deleted")},
+			want:     "main orphan",
+		},
+		{
+			name:     "self parent becomes root",
+			branches: []*models.Branch{branch("self", "self")},
+			want:     "self",
+		},
+		{
+			name:     "cycle is broken",
+			branches: []*models.Branch{branch("main", ""), branch("x", "y"), branch("y", "x")},
+			want:     "main x(y)",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tree := buildBranchTree(tt.branches)
+			assert.NotNil(t, tree)
+			assert.Equal(t, tt.want, ids(tree))
+		})
+	}
+}
+
+func TestBuildBranchTreeJSON(t *testing.T) {
+	tree := buildBranchTree([]*models.Branch{
+		{ID: "main", Name: "main"},
+		{ID: "feature", Name: "feature", ParentBranchID: "main", BranchFromVersionID: "v1"},
+	})
+
+	data, err := json.Marshal(tree)
+	require.NoError(t, err)
+
+	var decoded []map[string]interface{}
+	require.NoError(t, json.Unmarshal(data, &decoded))
+	require.Len(t, decoded, 1)
+	assert.Equal(t, "main", decoded[0]["id"])
+
+	children := decoded[0]["children"].([]interface{})
+	require.Len(t, children, 1)
+	child := children[0].(map[string]interface{})
+	assert.Equal(t, "v1", child["branchFromVersionId"])
+	assert.Equal(t, []interface{}{}, child["children"])
+}
@@ -0,0 +1,361 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
+)
+
+// DefaultReconnectInterval is the minimum time between attempts to re-open
+// the ClickHouse connection.
+const DefaultReconnectInterval = 5 * time.Second
+
+// errNotConnected is returned when no ClickHouse connection could be opened.
+var errNotConnected = errors.New("not connected to ClickHouse")
+
+// errNoDatabaseOverride is returned by Database when the manager can't
+// open connections to another database.
+var errNoDatabaseOverride = errors.New("database override not supported for this connection")
+
+// maxDatabaseConns caps the databases a ConnManager keeps connections to,
+// see Database.
+const maxDatabaseConns = 16
+
+// databaseIdleTimeout is how long a Database connection must have been
+// unused before another database may take its place.
+const databaseIdleTimeout = 10 * time.Minute
+
+// databaseConn is a connection kept by Database.
+type databaseConn struct {
+	manager  *ConnManager
+	lastUsed time.Time
+}
+
+// ConnState describes the ClickHouse connection for status endpoints.
+type ConnState struct {
+	Connected bool `json:"connected"`
+
+	// LastError is the error of the last failed ping or reconnect attempt.
+	LastError string `json:"lastError,omitempty"`
+
+	// LastReconnectAt is when a reconnect was last attempted.
+	LastReconnectAt *time.Time `json:"lastReconnectAt,omitempty"`
+
+	// Reconnects counts successful re-opens since startup.
+	Reconnects int `json:"reconnects"`
+}
+
+// ConnManager owns the ClickHouse connection and re-opens it with the stored
+// options after a failed ping or a query failing with a connection error,
+// see MarkFailed. Reconnect attempts are at most one per minInterval so a
+// down server isn't hammered.
+type ConnManager struct {
+	open        func() (driver.Conn, error)
+	minInterval time.Duration
+
+	mu          sync.Mutex
+	conn        driver.Conn
+	healthy     bool
+	lastErr     error
+	lastAttempt time.Time
+	reconnects  int
+
+	// dialing is closed when the reconnect in progress finishes; nil when
+	// there is none. The dial runs without mu held, see reconnect.
+	dialing chan struct{}
+
+	// version caches the server version of conn, see ServerVersion.
+	version string
+
+	// openDatabase opens a connection with another default database, see
+	// SetDatabaseOpener; databases holds the managers it was used for.
+	openDatabase func(database string) (driver.Conn, error)
+	databases    map[string]*databaseConn
+}
+
+// NewConnManager opens the initial connection. A failure is recorded rather
+// than returned, so the service can start while ClickHouse is down.
+func NewConnManager(open func() (driver.Conn, error), minInterval time.Duration) *ConnManager {
+	m := &ConnManager{open: open, minInterval: minInterval}
+	m.conn, m.lastErr = open()
+	m.healthy = m.lastErr == nil
+	return m
+}
+
+// SetDatabaseOpener enables Database, which opens its connections with
+// open. It must be called before the manager is shared.
+func (m *ConnManager) SetDatabaseOpener(open func(database string) (driver.Conn, error)) {
+	m.openDatabase = open
+}
+
+// Database returns the manager of a connection to the same server with
+// database as its default database. ClickHouse has no query setting for
+// the default database, so it takes a connection of its own. An empty
+// database returns m.
+//
+// The connection is opened and pinged on first use, which fails for a
+// database that doesn't exist; only connections that worked are kept for
+// later calls. Once maxDatabaseConns are kept, the least recently used one
+// is closed to make room if it has been idle for databaseIdleTimeout.
+func (m *ConnManager) Database(ctx context.Context, database string) (*ConnManager, error) {
+	if database == "" {
+		return m, nil
+	}
+	if m.openDatabase == nil {
+		return nil, errNoDatabaseOverride
+	}
+
+	m.mu.Lock()
+	if db, ok := m.databases[database]; ok {
+		db.lastUsed = time.Now()
+		m.mu.Unlock()
+		return db.manager, nil
+	}
+	m.mu.Unlock()
+
+	// Dial without m.mu held, so the default connection isn't blocked
+	db := NewConnManager(func() (driver.Conn, error) {
+		return m.openDatabase(database)
+	}, m.minInterval)
+	if err := db.Ping(ctx); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to connect to database %s: %w", database, err)
+	}
+
+	m.mu.Lock()
+	if existing, ok := m.databases[database]; ok {
+		// Opened concurrently by another request
+		existing.lastUsed = time.Now()
+		m.mu.Unlock()
+		db.Close()
+		return existing.manager, nil
+	}
+	var evicted *ConnManager
+	if len(m.databases) >= maxDatabaseConns {
+		name, ok := m.idlestDatabaseLocked()
+		if !ok {
+			m.mu.Unlock()
+			db.Close()
+			return nil, fmt.Errorf("too many databases in use, at most %d per profile", maxDatabaseConns)
+		}
+		evicted = m.databases[name].manager
+		delete(m.databases, name)
+	}
+	if m.databases == nil {
+		m.databases = make(map[string]*databaseConn)
+	}
+	m.databases[database] = &databaseConn{manager: db, lastUsed: time.Now()}
+	m.mu.Unlock()
+
+	if evicted != nil {
+		evicted.Close()
+	}
+	return db, nil
+}
+
+// idlestDatabaseLocked returns the least recently used Database connection
+// if it has been idle for databaseIdleTimeout. m.mu must be held.
+func (m *ConnManager) idlestDatabaseLocked() (string, bool) {
+	var idlest string
+	var lastUsed time.Time
+	for name, db := range m.databases {
+		if idlest == "" || db.lastUsed.Before(lastUsed) {
+			idlest, lastUsed = name, db.lastUsed
+		}
+	}
+	return idlest, idlest != "" && time.Since(lastUsed) >= databaseIdleTimeout
+}
+
+// Conn returns the current connection, first trying to re-open it if the
+// last ping or query failed or no connection was ever opened.
+func (m *ConnManager) Conn(ctx context.Context) (driver.Conn, error) {
+	m.mu.Lock()
+	healthy := m.healthy
+	m.mu.Unlock()
+
+	if !healthy {
+		m.reconnect(ctx)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.conn == nil {
+		return nil, errNotConnected
+	}
+	return m.conn, nil
+}
+
+// Executor returns an ExplainExecutor on the current connection that
+// reports connection errors of its queries with MarkFailed.
+func (m *ConnManager) Executor(ctx context.Context) (*ExplainExecutor, error) {
+	conn, err := m.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	executor := NewExplainExecutor(conn)
+	executor.onConnError = func(err error) { m.MarkFailed(conn, err) }
+	return executor, nil
+}
+
+// MarkFailed records that a query on conn failed with a connection error
+// (see isConnectionError), so the next Conn re-opens the connection. It is
+// ignored if conn was replaced meanwhile.
+func (m *ConnManager) MarkFailed(conn driver.Conn, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if conn != m.conn || !m.healthy {
+		return
+	}
+	slog.Warn("ClickHouse connection failed, re-opening it on next use", "error", err)
+	m.healthy, m.lastErr = false, err
+}
+
+// Ping checks the connection. On failure it re-opens the connection (subject
+// to the rate limit) and pings again before reporting an error.
+func (m *ConnManager) Ping(ctx context.Context) error {
+	m.mu.Lock()
+	conn := m.conn
+	m.mu.Unlock()
+
+	if conn != nil {
+		err := conn.Ping(ctx)
+		m.mu.Lock()
+		if conn == m.conn {
+			m.healthy, m.lastErr = err == nil, err
+		}
+		m.mu.Unlock()
+		if err == nil {
+			return nil
+		}
+	}
+
+	if !m.reconnect(ctx) {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		if m.lastErr == nil {
+			return errNotConnected
+		}
+		return m.lastErr
+	}
+	return nil
+}
+
+// ServerVersion returns the version() of the connected server. It is
+// queried once per connection and cached until a reconnect.
+func (m *ConnManager) ServerVersion(ctx context.Context) (string, error) {
+	m.mu.Lock()
+	version := m.version
+	m.mu.Unlock()
+	if version != "" {
+		return version, nil
+	}
+
+	conn, err := m.Conn(ctx)
+	if err != nil {
+		return "", err
+	}
+	if err := conn.QueryRow(ctx, "SELECT version()").Scan(&version); err != nil {
+		return "", err
+	}
+
+	m.mu.Lock()
+	if m.conn == conn {
+		m.version = version
+	}
+	m.mu.Unlock()
+	return version, nil
+}
+
+// State reports the connection state as of the last ping or reconnect.
+func (m *ConnManager) State() ConnState {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	state := ConnState{Connected: m.conn != nil && m.healthy, Reconnects: m.reconnects}
+	if m.lastErr != nil {
+		state.LastError = m.lastErr.Error()
+	}
+	if !m.lastAttempt.IsZero() {
+		lastAttempt := m.lastAttempt
+		state.LastReconnectAt = &lastAttempt
+	}
+	return state
+}
+
+// Close closes the current connection, if any, and those of Database.
+func (m *ConnManager) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var errs []error
+	for _, db := range m.databases {
+		errs = append(errs, db.manager.Close())
+	}
+	if m.conn != nil {
+		errs = append(errs, m.conn.Close())
+	}
+	return errors.Join(errs...)
+}
+
+// reconnect opens and pings a new connection unless an attempt was made
+// within minInterval, replacing the old connection on success. It reports
+// whether the connection is healthy afterwards.
+//
+// The dial runs without m.mu held, so callers of the current connection
+// aren't blocked by a slow server. Concurrent callers wait for the dial in
+// progress instead of starting their own.
+func (m *ConnManager) reconnect(ctx context.Context) bool {
+	m.mu.Lock()
+	if dialing := m.dialing; dialing != nil {
+		m.mu.Unlock()
+		select {
+		case <-dialing:
+		case <-ctx.Done():
+			return false
+		}
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		return m.healthy
+	}
+	if !m.lastAttempt.IsZero() && time.Since(m.lastAttempt) < m.minInterval {
+		m.mu.Unlock()
+		return false
+	}
+	m.lastAttempt = time.Now()
+	dialing := make(chan struct{})
+	m.dialing = dialing
+	m.mu.Unlock()
+
+	conn, err := m.open()
+	if err == nil {
+		if err = conn.Ping(ctx); err != nil {
+			conn.Close()
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.dialing = nil
+	close(dialing)
+
+	if err != nil {
+		slog.WarnContext(ctx, "ClickHouse reconnect failed", "error", err)
+		m.lastErr = err
+		return false
+	}
+
+	if m.conn != nil {
+		m.conn.Close()
+	}
+	m.conn, m.healthy, m.lastErr = conn, true, nil
+	m.version = ""
+	m.reconnects++
+	slog.InfoContext(ctx, "Reconnected to ClickHouse", "reconnects", m.reconnects)
+	return true
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
+	"github.com/orian/clicktelligence/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// pingConn is a driver.Conn whose Ping returns pingErr.
+type pingConn struct {
+	driver.Conn
+	pingErr error
+	closed  bool
+}
+
+func (c *pingConn) Ping(ctx context.Context) error { return c.pingErr }
+func (c *pingConn) Close() error                   { c.closed = true; return nil }
+
+// fakeOpener returns the queued connections and errors in order.
+type fakeOpener struct {
+	conns []*pingConn
+	errs  []error
+	calls int
+}
+
+func (o *fakeOpener) open() (driver.Conn, error) {
+	i := o.calls
+	o.calls++
+	if o.errs[i] != nil {
+		return nil, o.errs[i]
+	}
+	return o.conns[i], nil
+}
+
+func TestConnManagerStartsWhileDown(t *testing.T) {
+	good := &pingConn{}
+	opener := &fakeOpener{conns: []*pingConn{nil, good}, errs: []error{errors.New("refused"), nil}}
+
+	m := NewConnManager(opener.open, 0)
+	assert.False(t, m.State().Connected)
+	assert.Equal(t, "refused", m.State().LastError)
+
+	conn, err := m.Conn(context.Background())
+	require.NoError(t, err)
+	assert.Same(t, good, conn)
+	assert.True(t, m.State().Connected)
+	assert.Equal(t, 1, m.State().Reconnects)
+}
+
+func TestConnManagerReconnectsAfterFailedPing(t *testing.T) {
+	broken := &pingConn{}
+	fresh := &pingConn{}
+	opener := &fakeOpener{conns: []*pingConn{broken, fresh}, errs: []error{nil, nil}}
+
+	m := NewConnManager(opener.open, 0)
+	broken.pingErr = errors.New("connection reset")
+
+	require.NoError(t, m.Ping(context.Background()))
+	assert.True(t, broken.closed)
+
+	conn, err := m.Conn(context.Background())
+	require.NoError(t, err)
+	assert.Same(t, fresh, conn)
+	assert.Equal(t, 2, opener.calls)
+}
+
+func TestConnManagerRateLimitsReconnects(t *testing.T) {
+	down := errors.New("refused")
+	opener := &fakeOpener{conns: []*pingConn{nil, nil, nil}, errs: []error{down, down, down}}
+
+	m := NewConnManager(opener.open, time.Hour)
+
+	assert.ErrorIs(t, m.Ping(context.Background()), down)
+	assert.ErrorIs(t, m.Ping(context.Background()), down)
+	_, err := m.Conn(context.Background())
+	assert.ErrorIs(t, err, errNotConnected)
+
+	// Initial open plus a single reconnect attempt within the interval
+	assert.Equal(t, 2, opener.calls)
+	assert.NotNil(t, m.State().LastReconnectAt)
+}
+
+// queryErrConn is a pingConn whose queries fail with queryErr.
+type queryErrConn struct {
+	pingConn
+	queryErr error
+}
+
+func (c *queryErrConn) Query(ctx context.Context, query string, args ...any) (driver.Rows, error) {
+	return nil, c.queryErr
+}
+
+func TestConnManagerReconnectsAfterFailedQuery(t *testing.T) {
+	broken := &queryErrConn{queryErr: io.EOF}
+	fresh := &pingConn{}
+	opened := 0
+	m := NewConnManager(func() (driver.Conn, error) {
+		opened++
+		if opened == 1 {
+			return broken, nil
+		}
+		return fresh, nil
+	}, 0)
+
+	executor, err := m.Executor(t.Context())
+	require.NoError(t, err)
+	result := executor.ExecuteConfig(t.Context(), models.ExplainConfig{Type: models.ExplainPlan}, "SELECT 1", ExplainOptions{})
+	assert.NotEmpty(t, result.Error)
+	assert.False(t, m.State().Connected)
+
+	conn, err := m.Conn(t.Context())
+	require.NoError(t, err)
+	assert.Same(t, fresh, conn)
+	assert.True(t, broken.closed)
+
+	// Errors reported by the server leave the connection alone
+	server := &queryErrConn{queryErr: &clickhouse.Exception{Code: 62, Message: "Syntax error"}}
+	m = NewConnManager(func() (driver.Conn, error) { return server, nil }, 0)
+	executor, err = m.Executor(t.Context())
+	require.NoError(t, err)
+	executor.ExecuteConfig(t.Context(), models.ExplainConfig{Type: models.ExplainPlan}, "SELEC 1", ExplainOptions{})
+	assert.True(t, m.State().Connected)
+}
+
+// blockingPingConn is a pingConn whose Ping waits for release.
+type blockingPingConn struct {
+	pingConn
+	release chan struct{}
+}
+
+func (c *blockingPingConn) Ping(ctx context.Context) error {
+	<-c.release
+	return nil
+}
+
+func TestConnManagerDialsWithoutLock(t *testing.T) {
+	slow := &blockingPingConn{release: make(chan struct{})}
+	var opened atomic.Int32
+	m := NewConnManager(func() (driver.Conn, error) {
+		if opened.Add(1) == 1 {
+			return nil, errors.New("refused")
+		}
+		return slow, nil
+	}, 0)
+
+	type connResult struct {
+		conn driver.Conn
+		err  error
+	}
+	results := make(chan connResult, 2)
+	for range 2 {
+		go func() {
+			conn, err := m.Conn(t.Context())
+			results <- connResult{conn, err}
+		}()
+	}
+
+	// The dial is in progress; the manager's state stays readable
+	require.Eventually(t, func() bool { return opened.Load() == 2 }, time.Second, time.Millisecond)
+	assert.False(t, m.State().Connected)
+
+	close(slow.release)
+	for range 2 {
+		result := <-results
+		require.NoError(t, result.err)
+		assert.Same(t, slow, result.conn)
+	}
+	assert.Equal(t, int32(2), opened.Load(), "concurrent callers share one reconnect")
+}
+
+// countingVersionConn counts the version() queries answered by versionConn.
+type countingVersionConn struct {
+	versionConn
+	queries int
+}
+
+func (c *countingVersionConn) QueryRow(ctx context.Context, query string, args ...any) driver.Row {
+	c.queries++
+	return c.versionConn.QueryRow(ctx, query, args...)
+}
+
+func TestConnManagerServerVersionCached(t *testing.T) {
+	conn := &countingVersionConn{versionConn: versionConn{serverVersion: "24.3.2.23"}}
+	m := NewConnManager(func() (driver.Conn, error) { return conn, nil }, 0)
+
+	for range 2 {
+		version, err := m.ServerVersion(t.Context())
+		require.NoError(t, err)
+		assert.Equal(t, "24.3.2.23", version)
+	}
+	assert.Equal(t, 1, conn.queries)
+}
+
+func TestConnManagerDatabase(t *testing.T) {
+	m := NewConnManager(func() (driver.Conn, error) { return &pingConn{}, nil }, 0)
+
+	_, err := m.Database(t.Context(), "analytics")
+	assert.ErrorIs(t, err, errNoDatabaseOverride)
+
+	var opened []string
+	m.SetDatabaseOpener(func(database string) (driver.Conn, error) {
+		opened = append(opened, database)
+		return &pingConn{}, nil
+	})
+
+	same, err := m.Database(t.Context(), "")
+	require.NoError(t, err)
+	assert.Same(t, m, same)
+
+	analytics, err := m.Database(t.Context(), "analytics")
+	require.NoError(t, err)
+	again, err := m.Database(t.Context(), "analytics")
+	require.NoError(t, err)
+	assert.Same(t, analytics, again)
+	assert.Equal(t, []string{"analytics"}, opened)
+
+	conn, err := analytics.Conn(t.Context())
+	require.NoError(t, err)
+	require.NoError(t, m.Close())
+	assert.True(t, conn.(*pingConn).closed)
+}
+
+func TestConnManagerDatabaseEviction(t *testing.T) {
+	m := NewConnManager(func() (driver.Conn, error) { return &pingConn{}, nil }, 0)
+	unknown := errors.New("code: 81, message: Database missing does not exist")
+	m.SetDatabaseOpener(func(database string) (driver.Conn, error) {
+		if database == "missing" {
+			return &pingConn{pingErr: unknown}, nil
+		}
+		return &pingConn{}, nil
+	})
+
+	// Databases that can't be connected to don't take a slot
+	for range maxDatabaseConns + 1 {
+		_, err := m.Database(t.Context(), "missing")
+		assert.ErrorIs(t, err, unknown)
+	}
+	assert.Empty(t, m.databases)
+
+	for i := range maxDatabaseConns {
+		_, err := m.Database(t.Context(), fmt.Sprintf("db%d", i))
+		require.NoError(t, err)
+	}
+	_, err := m.Database(t.Context(), "extra")
+	assert.ErrorContains(t, err, "too many databases")
+
+	// The least recently used one makes room once idle
+	oldest := m.databases["db3"]
+	oldest.lastUsed = time.Now().Add(-databaseIdleTimeout)
+	conn, err := oldest.manager.Conn(t.Context())
+	require.NoError(t, err)
+	_, err = m.Database(t.Context(), "extra")
+	require.NoError(t, err)
+	assert.NotContains(t, m.databases, "db3")
+	assert.True(t, conn.(*pingConn).closed)
+	assert.Len(t, m.databases, maxDatabaseConns)
+}
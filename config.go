@@ -0,0 +1,99 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// getEnv returns the environment variable or def when it is unset or empty.
+func getEnv(name, def string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return def
+}
+
+// getEnvInt parses an integer environment variable, returning def when unset.
+func getEnvInt(name string, def int) (int, error) {
+	v := os.Getenv(name)
+	if v == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s %q: %w", name, v, err)
+	}
+	return n, nil
+}
+
+// getEnvDuration parses a Go duration environment variable (e.g. "30s"),
+// returning def when unset.
+func getEnvDuration(name string, def time.Duration) (time.Duration, error) {
+	v := os.Getenv(name)
+	if v == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s %q: %w", name, v, err)
+	}
+	return d, nil
+}
+
+// getEnvBool parses a boolean environment variable ("true", "1", "false", ...),
+// returning def when unset.
+func getEnvBool(name string, def bool) (bool, error) {
+	v := os.Getenv(name)
+	if v == "" {
+		return def, nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("invalid %s %q: %w", name, v, err)
+	}
+	return b, nil
+}
+
+// DefaultPort is the HTTP port used when PORT is unset.
+const DefaultPort = "8080"
+
+// listenAddress builds the HTTP listen address from BIND_ADDRESS and PORT.
+// An empty bind address listens on all interfaces. The port must be a
+// number between 1 and 65535.
+func listenAddress(bindAddress, port string) (string, error) {
+	n, err := strconv.Atoi(port)
+	if err != nil || n < 1 || n > 65535 {
+		return "", fmt.Errorf("invalid PORT %q: must be a number between 1 and 65535", port)
+	}
+	return net.JoinHostPort(bindAddress, port), nil
+}
+
+// buildTLSConfig creates the TLS configuration for ClickHouse connections.
+// Certificates are verified against the system roots, or against the PEM
+// bundle in caFile when set. serverName overrides the name used for SNI and
+// verification. Verification is skipped only when skipVerify is true.
+func buildTLSConfig(skipVerify bool, caFile, serverName string) (*tls.Config, error) {
+	config := &tls.Config{
+		InsecureSkipVerify: skipVerify,
+		ServerName:         serverName,
+	}
+
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA file %s", caFile)
+		}
+		config.RootCAs = pool
+	}
+
+	return config, nil
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetEnv(t *testing.T) {
+	t.Setenv("TEST_ENV_VALUE", "set")
+	t.Setenv("TEST_ENV_EMPTY", "")
+
+	assert.Equal(t, "set", getEnv("TEST_ENV_VALUE", "default"))
+	assert.Equal(t, "default", getEnv("TEST_ENV_EMPTY", "default"))
+	assert.Equal(t, "default", getEnv("TEST_ENV_UNSET", "default"))
+}
+
+func TestGetEnvInt(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		want    int
+		wantErr bool
+	}{
+		{name: "unset uses default", value: "", want: 7},
+		{name: "parses value", value: "25", want: 25},
+		{name: "invalid", value: "ten", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("TEST_ENV_INT", tt.value)
+			got, err := getEnvInt("TEST_ENV_INT", 7)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestGetEnvDuration(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		want    time.Duration
+		wantErr bool
+	}{
+		{name: "unset uses default", value: "", want: time.Minute},
+		{name: "parses value", value: "90s", want: 90 * time.Second},
+		{name: "invalid", value: "90", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("TEST_ENV_DURATION", tt.value)
+			got, err := getEnvDuration("TEST_ENV_DURATION", time.Minute)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestGetEnvBool(t *testing.T) {
+	t.Setenv("TEST_ENV_BOOL", "")
+	got, err := getEnvBool("TEST_ENV_BOOL", true)
+	assert.NoError(t, err)
+	assert.True(t, got)
+
+	t.Setenv("TEST_ENV_BOOL", "false")
+	got, err = getEnvBool("TEST_ENV_BOOL", true)
+	assert.NoError(t, err)
+	assert.False(t, got)
+
+	t.Setenv("TEST_ENV_BOOL", "nope")
+	_, err = getEnvBool("TEST_ENV_BOOL", true)
+	assert.Error(t, err)
+}
+
+// writeTestCA writes a self-signed CA certificate as PEM and returns its path.
+func writeTestCA(t *testing.T) string {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test-ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+
+	path := filepath.Join(t.TempDir(), "ca.pem")
+	require.NoError(t, os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600))
+	return path
+}
+
+func TestBuildTLSConfig(t *testing.T) {
+	t.Run("verifies by default", func(t *testing.T) {
+		config, err := buildTLSConfig(false, "", "")
+		require.NoError(t, err)
+		assert.False(t, config.InsecureSkipVerify)
+		assert.Nil(t, config.RootCAs)
+	})
+
+	t.Run("skip verify and server name", func(t *testing.T) {
+		config, err := buildTLSConfig(true, "", "ch.internal")
+		require.NoError(t, err)
+		assert.True(t, config.InsecureSkipVerify)
+		assert.Equal(t, "ch.internal", config.ServerName)
+	})
+
+	t.Run("loads CA file", func(t *testing.T) {
+		config, err := buildTLSConfig(false, writeTestCA(t), "")
+		require.NoError(t, err)
+		assert.NotNil(t, config.RootCAs)
+	})
+
+	t.Run("missing CA file", func(t *testing.T) {
+		_, err := buildTLSConfig(false, filepath.Join(t.TempDir(), "missing.pem"), "")
+		assert.Error(t, err)
+	})
+
+	t.Run("CA file without certificates", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "empty.pem")
+		require.NoError(t, os.WriteFile(path, []byte("not a certificate"), 0o600))
+		_, err := buildTLSConfig(false, path, "")
+		assert.ErrorContains(t, err, "no certificates")
+	})
+}
+
+func TestListenAddress(t *testing.T) {
+	tests := []struct {
+		name    string
+		bind    string
+		port    string
+		want    string
+		wantErr bool
+	}{
+		{name: "all interfaces", bind: "", port: "8080", want: ":8080"},
+		{name: "loopback", bind: "127.0.0.1", port: "9000", want: "127.0.0.1:9000"},
+		{name: "ipv6", bind: "::1", port: "8080", want: "[::1]:8080"},
+		{name: "not numeric", bind: "", port: "http", wantErr: true},
+		{name: "zero", bind: "", port: "0", wantErr: true},
+		{name: "out of range", bind: "", port: "70000", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := listenAddress(tt.bind, tt.port)
+			if tt.wantErr {
+				assert.ErrorContains(t, err, "invalid PORT")
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+)
+
+// friendlyExceptionMessages describes common ClickHouse error codes without
+// the names, addresses and stack traces their messages carry.
+var friendlyExceptionMessages = map[int32]string{
+	36:  "bad arguments",
+	43:  "illegal type of argument",
+	46:  "unknown function",
+	47:  "unknown column or identifier",
+	48:  "not supported by this server",
+	53:  "type mismatch",
+	60:  "unknown table",
+	62:  "syntax error",
+	81:  "unknown database",
+	115: "unknown setting",
+	159: "query exceeded max_execution_time",
+	202: "server is busy (too many simultaneous queries)",
+	209: "network error talking to ClickHouse",
+	210: "network error talking to ClickHouse",
+	241: "memory limit exceeded",
+	352: "ambiguous column name",
+	456: "missing value for a query parameter",
+	497: "access denied",
+	516: "authentication failed",
+}
+
+// sanitizeError returns a message for err that is safe to show to users:
+// the error code and name of ClickHouse exceptions with a short
+// description, and a generic message for anything else. Callers log the
+// full error.
+func sanitizeError(err error) string {
+	var exception *clickhouse.Exception
+	switch {
+	case errors.As(err, &exception):
+		message, ok := friendlyExceptionMessages[exception.Code]
+		if !ok {
+			message = "query failed"
+		}
+		return fmt.Sprintf("ClickHouse error %d (%s): %s", exception.Code, exception.Name, message)
+	case errors.Is(err, context.Canceled):
+		return "query canceled"
+	case errors.Is(err, context.DeadlineExceeded):
+		return "query timed out"
+	case isTransientError(err):
+		return "connection to ClickHouse failed"
+	default:
+		return "query failed"
+	}
+}
+
+// internalError logs err and responds with it as shown to clients, with
+// status 500.
+func (s *Server) internalError(w http.ResponseWriter, r *http.Request, err error) {
+	slog.ErrorContext(r.Context(), "Request failed", "path", r.URL.Path, "error", err)
+	http.Error(w, s.errorMessage(err), http.StatusInternalServerError)
+}
+
+// errorMessage returns err as shown to clients: sanitized when
+// SANITIZE_ERRORS is set, in full otherwise.
+func (s *Server) errorMessage(err error) string {
+	if s.sanitizeErrors {
+		return sanitizeError(err)
+	}
+	return err.Error()
+}
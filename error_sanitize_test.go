@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
+	"github.com/go-chi/chi/v5"
+	"github.com/orian/clicktelligence/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSanitizeError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{
+			name: "known code",
+			err:  &clickhouse.Exception{Code: 60, Name: "UNKNOWN_TABLE", Message: "Table secret.payroll does not exist", StackTrace: "0. DB::Exception..."},
+			want: "ClickHouse error 60 (UNKNOWN_TABLE): unknown table",
+		},
+		{
+			name: "wrapped",
+			err:  fmt.Errorf("explain: %w", &clickhouse.Exception{Code: 62, Name: "SYNTAX_ERROR", Message: "Syntax error at position 7"}),
+			want: "ClickHouse error 62 (SYNTAX_ERROR): syntax error",
+		},
+		{
+			name: "unknown code",
+			err:  &clickhouse.Exception{Code: 9999, Name: "SOMETHING", Message: "details"},
+			want: "ClickHouse error 9999 (SOMETHING): query failed",
+		},
+		{name: "canceled", err: context.Canceled, want: "query canceled"},
+		{name: "connection", err: fmt.Errorf("dial tcp 10.0.0.5:9000: %w", clickhouse.ErrAcquireConnTimeout), want: "connection to ClickHouse failed"},
+		{name: "other", err: errors.New("read /var/lib/x: permission denied"), want: "query failed"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, sanitizeError(tt.err))
+		})
+	}
+}
+
+func TestExecuteConfigSanitizesErrors(t *testing.T) {
+	exception := &clickhouse.Exception{Code: 60, Name: "UNKNOWN_TABLE", Message: "Table secret.payroll does not exist"}
+	config := models.ExplainConfig{Type: models.ExplainPlan}
+
+	result := NewExplainExecutor(&fakeConn{rows: &fakeRows{err: exception}}).ExecuteConfig(context.Background(), config, "SELECT 1", ExplainOptions{})
+	assert.Contains(t, result.Error, "secret.payroll")
+
+	result = NewExplainExecutor(&fakeConn{rows: &fakeRows{err: exception}}).ExecuteConfig(context.Background(), config, "SELECT 1", ExplainOptions{SanitizeErrors: true})
+	assert.Equal(t, "Scan error: ClickHouse error 60 (UNKNOWN_TABLE): unknown table", result.Error)
+}
+
+func TestHandleExplainSanitizesErrors(t *testing.T) {
+	storage := newTestStorage(t)
+	conn := NewConnManager(func() (driver.Conn, error) {
+		return &echoConn{versionConn{serverVersion: "25.3"}}, nil
+	}, 0)
+	failing := failingSaveStorage{Storage: storage, err: errors.New("write /var/lib/clicktelligence/secret.db: disk full")}
+	server := NewServer(failing, map[string]*ConnManager{DefaultProfile: conn}, nil)
+	server.sanitizeErrors = true
+
+	branch, err := storage.CreateBranch(t.Context(), "sanitize", "", "")
+	require.NoError(t, err)
+	request := `{"branchId": "` + branch.ID + `", "query": "SELECT 1"`
+	source, err := storage.CreateBranch(t.Context(), "sanitize-source", "", "")
+	require.NoError(t, err)
+	version := saveTestVersion(t, storage, source.ID, "", "SELECT 2")
+
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		params  map[string]string
+		body    string
+	}{
+		{
+			name:    "explain",
+			handler: server.handleExplainQuery,
+			body:    request + `, "explainConfigs": [{"type": "PLAN", "enabled": true}]}`,
+		},
+		{
+			name:    "matrix",
+			handler: server.handleExplainMatrix,
+			body:    request + `, "explainConfigs": [{"type": "PLAN", "enabled": true}], "settings": [{"max_threads": "1"}], "save": true}`,
+		},
+		{
+			name:    "single",
+			handler: server.handleExplainSingle,
+			body:    request + `, "type": "PLAN"}`,
+		},
+		{
+			name:    "merge",
+			handler: server.handleMergeBranch,
+			params:  map[string]string{"branchId": branch.ID},
+			body:    `{"sourceBranchId": "` + source.ID + `"}`,
+		},
+		{
+			name:    "reanalyze",
+			handler: server.handleReanalyzeVersion,
+			params:  map[string]string{"versionId": version.ID},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/api/query/explain?save=true", bytes.NewBufferString(tt.body))
+			rctx := chi.NewRouteContext()
+			for key, value := range tt.params {
+				rctx.URLParams.Add(key, value)
+			}
+			req = req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, rctx))
+			rec := httptest.NewRecorder()
+			tt.handler(rec, req)
+			assert.Equal(t, http.StatusInternalServerError, rec.Code)
+			assert.Equal(t, "query failed\n", rec.Body.String())
+		})
+	}
+}
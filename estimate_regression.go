@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"slices"
+
+	"github.com/orian/clicktelligence/models"
+)
+
+// DefaultEstimateRegressionPercent is by how much a version's estimated
+// rows may exceed its parent's before the explain response reports a
+// regression.
+const DefaultEstimateRegressionPercent = 10
+
+// EstimateRegression reports a version whose EXPLAIN ESTIMATE reads more
+// rows than its parent's.
+type EstimateRegression struct {
+	ParentVersionID string `json:"parentVersionId"`
+	ParentRows      uint64 `json:"parentRows"`
+	Rows            uint64 `json:"rows"`
+
+	// IncreasePercent is the growth over ParentRows; unset when the
+	// parent estimated no rows.
+	IncreasePercent float64 `json:"increasePercent,omitempty"`
+
+	// ThresholdPercent is the growth allowed before reporting.
+	ThresholdPercent int `json:"thresholdPercent"`
+}
+
+// estimateTotal returns the summed successful ESTIMATE result of a version.
+func estimateTotal(version *models.QueryVersion) (models.EstimateRow, bool) {
+	i := slices.IndexFunc(version.ExplainResults, func(result models.ExplainResult) bool {
+		return result.Type == models.ExplainEstimate && result.Error == ""
+	})
+	if i < 0 {
+		return models.EstimateRow{}, false
+	}
+	return models.SumEstimate(version.ExplainResults[i].Estimate), true
+}
+
+// compareEstimates returns the regression of version against parent when
+// its estimated rows grew by more than thresholdPercent, or nil when they
+// didn't or either lacks an ESTIMATE result.
+func compareEstimates(parent, version *models.QueryVersion, thresholdPercent int) *EstimateRegression {
+	parentTotal, ok := estimateTotal(parent)
+	if !ok {
+		return nil
+	}
+	total, ok := estimateTotal(version)
+	if !ok || total.Rows <= parentTotal.Rows {
+		return nil
+	}
+
+	regression := &EstimateRegression{
+		ParentVersionID:  parent.ID,
+		ParentRows:       parentTotal.Rows,
+		Rows:             total.Rows,
+		ThresholdPercent: thresholdPercent,
+	}
+	if parentTotal.Rows > 0 {
+		regression.IncreasePercent = float64(total.Rows-parentTotal.Rows) / float64(parentTotal.Rows) * 100
+		if regression.IncreasePercent <= float64(thresholdPercent) {
+			return nil
+		}
+	}
+	return regression
+}
+
+// estimateRegression compares a newly saved version with its parent, see
+// compareEstimates. It returns nil when the check is disabled, the version
+// has no parent or the parent can't be loaded.
+func (s *Server) estimateRegression(ctx context.Context, version *models.QueryVersion) *EstimateRegression {
+	if s.estimateRegressionPercent < 0 || version.ParentVersionID == "" {
+		return nil
+	}
+	parent, ok := s.storage.GetVersion(ctx, version.ParentVersionID)
+	if !ok {
+		return nil
+	}
+	return compareEstimates(parent, version, s.estimateRegressionPercent)
+}
+
+// addEstimateRegression sets "regression" on the explain response of a new
+// version unless req opts out or there is none.
+func (s *Server) addEstimateRegression(ctx context.Context, req *ExplainRequest, version *models.QueryVersion, response map[string]interface{}) {
+	if req.SkipRegressionCheck {
+		return
+	}
+	if regression := s.estimateRegression(ctx, version); regression != nil {
+		response["regression"] = regression
+	}
+}
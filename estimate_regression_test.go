@@ -0,0 +1,66 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/orian/clicktelligence/models"
+)
+
+// estimateVersion returns a version with an ESTIMATE result of rows per table.
+func estimateVersion(id string, rows ...uint64) *models.QueryVersion {
+	result := models.ExplainResult{Type: models.ExplainEstimate}
+	for _, n := range rows {
+		result.Estimate = append(result.Estimate, models.EstimateRow{Database: "default", Table: "events", Rows: n})
+	}
+	return &models.QueryVersion{ID: id, ExplainResults: []models.ExplainResult{result}}
+}
+
+func TestCompareEstimates(t *testing.T) {
+	parent := estimateVersion("parent", 600, 400)
+
+	regression := compareEstimates(parent, estimateVersion("child", 1500), 10)
+	require.NotNil(t, regression)
+	assert.Equal(t, &EstimateRegression{
+		ParentVersionID:  "parent",
+		ParentRows:       1000,
+		Rows:             1500,
+		IncreasePercent:  50,
+		ThresholdPercent: 10,
+	}, regression)
+
+	assert.Nil(t, compareEstimates(parent, estimateVersion("child", 1100), 10), "within threshold")
+	assert.Nil(t, compareEstimates(parent, estimateVersion("child", 500), 10), "improvement")
+	assert.NotNil(t, compareEstimates(parent, estimateVersion("child", 1001), 0))
+
+	regression = compareEstimates(estimateVersion("parent", 0), estimateVersion("child", 5), 10)
+	require.NotNil(t, regression, "any rows over an empty estimate")
+	assert.Zero(t, regression.IncreasePercent)
+
+	failed := estimateVersion("child", 5000)
+	failed.ExplainResults[0].Error = "timeout"
+	assert.Nil(t, compareEstimates(parent, failed, 10))
+	assert.Nil(t, compareEstimates(&models.QueryVersion{ID: "parent"}, estimateVersion("child", 5000), 10))
+}
+
+func TestServerEstimateRegression(t *testing.T) {
+	storage := newTestStorage(t)
+	server := NewServer(storage, nil, nil)
+	branch, err := storage.CreateBranch(t.Context(), "feature", "", "")
+	require.NoError(t, err)
+
+	parent := saveTestVersion(t, storage, branch.ID, "", "SELECT 1")
+	require.NoError(t, storage.UpdateVersionResults(t.Context(), parent.ID,
+		estimateVersion(parent.ID, 100).ExplainResults, nil, models.ExecutionStats{}))
+
+	version := estimateVersion("child", 200)
+	version.ParentVersionID = parent.ID
+	regression := server.estimateRegression(t.Context(), version)
+	require.NotNil(t, regression)
+	assert.Equal(t, parent.ID, regression.ParentVersionID)
+
+	server.estimateRegressionPercent = -1
+	assert.Nil(t, server.estimateRegression(t.Context(), version), "disabled")
+}
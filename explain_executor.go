@@ -2,17 +2,29 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
+	"reflect"
 	"strings"
+	"time"
+	"unicode/utf8"
 
+	"github.com/ClickHouse/clickhouse-go/v2"
 	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
+	"github.com/google/uuid"
 	"github.com/orian/clicktelligence/models"
 )
 
 // ExplainExecutor handles executing EXPLAIN queries against ClickHouse.
 type ExplainExecutor struct {
 	conn driver.Conn
+
+	// onConnError is called with errors of conn itself, see
+	// ConnManager.Executor; nil ignores them.
+	onConnError func(error)
 }
 
 // NewExplainExecutor creates a new ExplainExecutor with the given connection.
@@ -25,6 +37,37 @@ type ExplainOptions struct {
 	LogComment         string
 	ForceAnalyzer      bool
 	MaxExecutionTimeMs int
+	CustomSettings     map[string]string
+
+	// Parameters are bound to {name:Type} placeholders in the query.
+	Parameters map[string]string
+
+	// Retry controls retries of transient connection failures.
+	Retry RetryPolicy
+
+	// MaxOutputBytes caps the size of a text result's Output (0 = no limit).
+	MaxOutputBytes int
+
+	// SanitizeErrors stores errors in results as sanitizeError describes
+	// them instead of ClickHouse's full messages, which are only logged.
+	SanitizeErrors bool
+}
+
+// errorText formats err for ExplainResult.Error.
+func (o ExplainOptions) errorText(err error) string {
+	if o.SanitizeErrors {
+		return sanitizeError(err)
+	}
+	return err.Error()
+}
+
+// ServerVersion returns the version string of the connected ClickHouse server.
+func (e *ExplainExecutor) ServerVersion(ctx context.Context) (string, error) {
+	var version string
+	if err := e.conn.QueryRow(ctx, "SELECT version()").Scan(&version); err != nil {
+		return "", err
+	}
+	return version, nil
 }
 
 // ExecuteAll executes all enabled EXPLAIN configs and returns the results.
@@ -43,18 +86,64 @@ func (e *ExplainExecutor) ExecuteAll(ctx context.Context, configs []models.Expla
 	return results
 }
 
+// ExecuteConcurrent executes all enabled EXPLAIN configs in parallel and
+// calls onResult from a single goroutine as each one completes. Returns the
+// results in config order once all are done.
+func (e *ExplainExecutor) ExecuteConcurrent(ctx context.Context, configs []models.ExplainConfig, query string, opts ExplainOptions, onResult func(models.ExplainResult)) []models.ExplainResult {
+	type indexedResult struct {
+		index  int
+		result models.ExplainResult
+	}
+
+	var enabled []models.ExplainConfig
+	for _, config := range configs {
+		if config.Enabled {
+			enabled = append(enabled, config)
+		}
+	}
+
+	done := make(chan indexedResult, len(enabled))
+	for i, config := range enabled {
+		go func(i int, config models.ExplainConfig) {
+			done <- indexedResult{index: i, result: e.ExecuteConfig(ctx, config, query, opts)}
+		}(i, config)
+	}
+
+	results := make([]models.ExplainResult, len(enabled))
+	for range enabled {
+		r := <-done
+		results[r.index] = r.result
+		if onResult != nil {
+			onResult(r.result)
+		}
+	}
+
+	return results
+}
+
 // ExecuteConfig executes a single EXPLAIN config and returns the result.
 func (e *ExplainExecutor) ExecuteConfig(ctx context.Context, config models.ExplainConfig, query string, opts ExplainOptions) models.ExplainResult {
-	explainQuery := config.BuildExplainQuery(query, opts.LogComment, opts.ForceAnalyzer, opts.MaxExecutionTimeMs)
-	log.Printf("Running: EXPLAIN %s: %s", config.Type, explainQuery)
+	start := time.Now()
+	result := e.executeConfig(ctx, config, query, opts)
+	observeExplainResult(result, time.Since(start))
+	return result
+}
+
+func (e *ExplainExecutor) executeConfig(ctx context.Context, config models.ExplainConfig, query string, opts ExplainOptions) models.ExplainResult {
+	if config.BothFormats && config.Type == models.ExplainPlan {
+		return e.executePlanBothFormats(ctx, config, query, opts)
+	}
 
-	rows, err := e.conn.Query(ctx, explainQuery)
+	explainQuery := config.BuildExplainQuery(query, opts.LogComment, opts.ForceAnalyzer, opts.MaxExecutionTimeMs, opts.CustomSettings)
+	queryID, rows, err := e.queryWithRetry(ctx, config, explainQuery, opts)
 	if err != nil {
-		errMsg := fmt.Sprintf("Query error: %v", err)
-		log.Printf("Error executing EXPLAIN %s: %v", config.Type, err)
+		errMsg := fmt.Sprintf("Query error: %s", opts.errorText(err))
+		slog.WarnContext(ctx, "Error executing EXPLAIN", "type", config.Type, "query_id", queryID, "error", err)
 		return models.ExplainResult{
-			Type:  config.Type,
-			Error: errMsg,
+			Type:          config.Type,
+			Error:         errMsg,
+			ExecutedQuery: explainQuery,
+			QueryID:       queryID,
 		}
 	}
 	defer rows.Close()
@@ -62,35 +151,137 @@ func (e *ExplainExecutor) ExecuteConfig(ctx context.Context, config models.Expla
 	// ESTIMATE type returns structured data
 	if config.Type == models.ExplainEstimate {
 		estimateRows, err := scanEstimateRows(rows)
-		if err != nil {
-			return models.ExplainResult{
-				Type:  config.Type,
-				Error: fmt.Sprintf("Scan error: %v", err),
-			}
+		e.reportConnError(err)
+		result := models.ExplainResult{
+			Type:          config.Type,
+			Estimate:      estimateRows,
+			ExecutedQuery: explainQuery,
+			QueryID:       queryID,
 		}
-		return models.ExplainResult{
-			Type:     config.Type,
-			Estimate: estimateRows,
+		if len(estimateRows) > 0 {
+			total := models.SumEstimate(estimateRows)
+			result.EstimateTotal = &total
 		}
+		if err != nil {
+			slog.WarnContext(ctx, "Error reading EXPLAIN result", "type", config.Type, "query_id", queryID, "error", err)
+			result.Error = fmt.Sprintf("Scan error: %s", opts.errorText(err))
+		}
+		return result
 	}
 
 	// Other types return text output
 	lines, err := scanTextRows(rows)
+	e.reportConnError(err)
+	output, truncated := truncateOutput(strings.Join(lines, "\n"), opts.MaxOutputBytes)
+	if truncated {
+		slog.WarnContext(ctx, "Truncated EXPLAIN output", "type", config.Type, "query_id", queryID, "limit", opts.MaxOutputBytes)
+	}
+	result := models.ExplainResult{
+		Type:          config.Type,
+		Output:        output,
+		Truncated:     truncated,
+		ExecutedQuery: explainQuery,
+		QueryID:       queryID,
+	}
+	if !truncated {
+		result.Structured = structuredOutput(output)
+	}
 	if err != nil {
-		return models.ExplainResult{
-			Type:  config.Type,
-			Error: fmt.Sprintf("Scan error: %v", err),
+		slog.WarnContext(ctx, "Error reading EXPLAIN result", "type", config.Type, "query_id", queryID, "error", err)
+		result.Error = fmt.Sprintf("Scan error: %s", opts.errorText(err))
+	}
+	return result
+}
+
+// executePlanBothFormats runs a PLAN config as text and as JSON, one after
+// the other. The result is that of the text PLAN, with the JSON plan in
+// Structured; a failed JSON PLAN fails the result too. Its query_id isn't
+// kept, so query_log stats only cover the text PLAN.
+func (e *ExplainExecutor) executePlanBothFormats(ctx context.Context, config models.ExplainConfig, query string, opts ExplainOptions) models.ExplainResult {
+	textConfig, jsonConfig := bothFormatsConfigs(config)
+	result := e.executeConfig(ctx, textConfig, query, opts)
+	if result.Error != "" {
+		return result
+	}
+
+	jsonResult := e.executeConfig(ctx, jsonConfig, query, opts)
+	if jsonResult.Error != "" {
+		result.Error = "JSON plan: " + jsonResult.Error
+		return result
+	}
+	result.Structured = jsonResult.Structured
+	return result
+}
+
+// bothFormatsConfigs splits a BothFormats PLAN config into the text and
+// the JSON PLAN run for it.
+func bothFormatsConfigs(config models.ExplainConfig) (models.ExplainConfig, models.ExplainConfig) {
+	textFormat, jsonFormat := 0, 1
+	config.BothFormats = false
+
+	textConfig, jsonConfig := config, config
+	textConfig.Settings.JSONFormat = &textFormat
+	jsonConfig.Settings.JSONFormat = &jsonFormat
+	return textConfig, jsonConfig
+}
+
+// ExecuteConfigStream executes a single EXPLAIN config and writes its
+// output to w line by line as rows arrive, instead of collecting it like
+// ExecuteConfig. The output is rendered as in ExecuteConfig's text results
+// and is never truncated. BothFormats is ignored: the config runs once, in
+// its own format. Returns the query_id of the query.
+//
+// An error before anything was written means the query failed; after
+// that, the output is incomplete (e.g. on timeout or a failed write).
+func (e *ExplainExecutor) ExecuteConfigStream(ctx context.Context, config models.ExplainConfig, query string, opts ExplainOptions, w io.Writer) (string, error) {
+	explainQuery := config.BuildExplainQuery(query, opts.LogComment, opts.ForceAnalyzer, opts.MaxExecutionTimeMs, opts.CustomSettings)
+	queryID, rows, err := e.queryWithRetry(ctx, config, explainQuery, opts)
+	if err != nil {
+		return queryID, err
+	}
+	defer rows.Close()
+
+	err = eachTextRow(rows, func(line string) error {
+		if _, err := io.WriteString(w, line); err != nil {
+			return err
 		}
+		_, err := io.WriteString(w, "\n")
+		return err
+	})
+	return queryID, err
+}
+
+// structuredOutput returns output as raw JSON when it is a JSON object or
+// array, and nil for plain text.
+func structuredOutput(output string) json.RawMessage {
+	trimmed := strings.TrimSpace(output)
+	if !strings.HasPrefix(trimmed, "{") && !strings.HasPrefix(trimmed, "[") {
+		return nil
 	}
+	if !json.Valid([]byte(trimmed)) {
+		return nil
+	}
+	return json.RawMessage(trimmed)
+}
 
-	return models.ExplainResult{
-		Type:   config.Type,
-		Output: strings.Join(lines, "\n"),
+// truncateOutput cuts output to at most maxBytes bytes, backing off to a
+// UTF-8 rune boundary, and appends a marker. It reports whether it truncated.
+// A maxBytes of 0 or less disables the limit.
+func truncateOutput(output string, maxBytes int) (string, bool) {
+	if maxBytes <= 0 || len(output) <= maxBytes {
+		return output, false
 	}
+
+	cut := maxBytes
+	for cut > 0 && !utf8.RuneStart(output[cut]) {
+		cut--
+	}
+	return output[:cut] + fmt.Sprintf("\n... [output truncated: %d of %d bytes shown]", cut, len(output)), true
 }
 
 // scanEstimateRows scans rows from EXPLAIN ESTIMATE query.
 // Returns structured EstimateRow data with database, table, parts, rows, marks.
+// On timeout, the rows received so far are returned along with the error.
 func scanEstimateRows(rows driver.Rows) ([]models.EstimateRow, error) {
 	var result []models.EstimateRow
 
@@ -101,21 +292,142 @@ func scanEstimateRows(rows driver.Rows) ([]models.EstimateRow, error) {
 		}
 		result = append(result, row)
 	}
+	if err := rows.Err(); err != nil {
+		if isTimeoutError(err) {
+			return result, err
+		}
+		return nil, err
+	}
 
 	return result, nil
 }
 
 // scanTextRows scans rows from EXPLAIN queries that return single text column.
+// Multi-column output (e.g. EXPLAIN CURRENT TRANSACTION, or per-shard
+// results from Distributed tables) is rendered as tab-separated lines
+// preceded by a header line with the column names.
+// On timeout, the lines received so far are returned along with the error.
 func scanTextRows(rows driver.Rows) ([]string, error) {
 	var lines []string
+	err := eachTextRow(rows, func(line string) error {
+		lines = append(lines, line)
+		return nil
+	})
+	if err != nil {
+		if isTimeoutError(err) {
+			return lines, err
+		}
+		return nil, err
+	}
+	return lines, nil
+}
+
+// eachTextRow calls fn with each line of text output, rendered as described
+// for scanTextRows, stopping at the first error fn returns.
+func eachTextRow(rows driver.Rows, fn func(line string) error) error {
+	columnTypes := rows.ColumnTypes()
+	multiColumn := len(columnTypes) > 1
+	if multiColumn {
+		if err := fn(strings.Join(rows.Columns(), "\t")); err != nil {
+			return err
+		}
+	}
 
 	for rows.Next() {
 		var line string
-		if err := rows.Scan(&line); err != nil {
-			return nil, err
+		if multiColumn {
+			var err error
+			if line, err = scanColumnsAsText(rows, columnTypes); err != nil {
+				return err
+			}
+		} else if err := rows.Scan(&line); err != nil {
+			return err
+		}
+		if err := fn(line); err != nil {
+			return err
 		}
-		lines = append(lines, line)
 	}
+	return rows.Err()
+}
 
-	return lines, nil
+// scanColumnsAsText scans the current row into values of each column's scan
+// type and joins their string forms with tabs. Nullable columns scan into
+// pointers, which are dereferenced; NULL prints as NULL.
+func scanColumnsAsText(rows driver.Rows, columnTypes []driver.ColumnType) (string, error) {
+	dest := make([]any, len(columnTypes))
+	for i, columnType := range columnTypes {
+		dest[i] = reflect.New(columnType.ScanType()).Interface()
+	}
+	if err := rows.Scan(dest...); err != nil {
+		return "", err
+	}
+
+	values := make([]string, len(dest))
+	for i, d := range dest {
+		values[i] = columnText(reflect.ValueOf(d).Elem())
+	}
+	return strings.Join(values, "\t"), nil
+}
+
+// columnText returns the string form of a scanned value, following
+// pointers.
+func columnText(value reflect.Value) string {
+	for value.Kind() == reflect.Pointer {
+		if value.IsNil() {
+			return "NULL"
+		}
+		value = value.Elem()
+	}
+	return fmt.Sprint(value.Interface())
+}
+
+// timeoutExceededCode is the ClickHouse TIMEOUT_EXCEEDED error code raised
+// when max_execution_time is hit.
+const timeoutExceededCode = 159
+
+// isTimeoutError reports whether err is ClickHouse aborting the query because
+// max_execution_time was exceeded. Rows streamed before that are still valid.
+func isTimeoutError(err error) bool {
+	var exception *clickhouse.Exception
+	return errors.As(err, &exception) && exception.Code == timeoutExceededCode
+}
+
+// queryWithRetry runs explainQuery, retrying transient failures according to
+// opts.Retry. Each attempt gets a fresh query_id, which is returned alongside
+// the rows (or the error) of the last attempt.
+func (e *ExplainExecutor) queryWithRetry(ctx context.Context, config models.ExplainConfig, explainQuery string, opts ExplainOptions) (string, driver.Rows, error) {
+	for attempt := 0; ; attempt++ {
+		queryID := uuid.New().String()
+		slog.DebugContext(ctx, "Running EXPLAIN", "type", config.Type, "query_id", queryID, "attempt", attempt+1, "query", explainQuery)
+
+		queryOpts := []clickhouse.QueryOption{clickhouse.WithQueryID(queryID)}
+		if len(opts.Parameters) > 0 {
+			queryOpts = append(queryOpts, clickhouse.WithParameters(opts.Parameters))
+		}
+
+		rows, err := e.conn.Query(clickhouse.Context(ctx, queryOpts...), explainQuery)
+		if err == nil || attempt >= opts.Retry.MaxRetries || !isTransientError(err) {
+			e.reportConnError(err)
+			return queryID, rows, err
+		}
+
+		delay := opts.Retry.Backoff(attempt + 1)
+		slog.WarnContext(ctx, "Transient error executing EXPLAIN, retrying", "type", config.Type, "query_id", queryID, "delay", delay, "error", err)
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			e.reportConnError(err)
+			return queryID, nil, err
+		case <-timer.C:
+		}
+	}
+}
+
+// reportConnError passes err to onConnError if it is a connection error.
+func (e *ExplainExecutor) reportConnError(err error) {
+	if e.onConnError != nil && isConnectionError(err) {
+		e.onConnError(err)
+	}
 }
@@ -1,11 +1,19 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
 	"testing"
+	"unicode/utf8"
 
+	"github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
 	"github.com/orian/clicktelligence/models"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestEstimateRowJSON(t *testing.T) {
@@ -82,3 +90,267 @@ func TestExplainResultWithEstimate(t *testing.T) {
 	assert.Equal(t, float64(1000000), first["rows"])
 	assert.Equal(t, float64(5000), first["marks"])
 }
+
+func TestExplainResultExecutedQueryJSON(t *testing.T) {
+	result := models.ExplainResult{
+		Type:          models.ExplainQueryTree,
+		Error:         "Query error: timeout",
+		ExecutedQuery: "EXPLAIN QUERY TREE SELECT 1 SETTINGS enable_analyzer=1",
+	}
+
+	jsonBytes, err := json.Marshal(result)
+	assert.NoError(t, err)
+
+	var parsed map[string]interface{}
+	err = json.Unmarshal(jsonBytes, &parsed)
+	assert.NoError(t, err)
+	assert.Equal(t, "EXPLAIN QUERY TREE SELECT 1 SETTINGS enable_analyzer=1", parsed["executedQuery"])
+
+	var roundTrip models.ExplainResult
+	err = json.Unmarshal(jsonBytes, &roundTrip)
+	assert.NoError(t, err)
+	assert.Equal(t, result, roundTrip)
+}
+
+// fakeRows is a driver.Rows that yields the given rows, then reports err.
+// Column types are taken from the first row; without columns it has a
+// single "explain" column.
+type fakeRows struct {
+	driver.Rows
+	columns []string
+	rows    [][]any
+	pos     int
+	err     error
+}
+
+// fakeColumnType is a driver.ColumnType with a name and scan type.
+type fakeColumnType struct {
+	driver.ColumnType
+	name     string
+	scanType reflect.Type
+}
+
+func (c fakeColumnType) Name() string           { return c.name }
+func (c fakeColumnType) ScanType() reflect.Type { return c.scanType }
+
+func (r *fakeRows) Columns() []string {
+	if len(r.columns) == 0 {
+		return []string{"explain"}
+	}
+	return r.columns
+}
+
+func (r *fakeRows) ColumnTypes() []driver.ColumnType {
+	var types []driver.ColumnType
+	for i, name := range r.Columns() {
+		scanType := reflect.TypeOf("")
+		if len(r.rows) > 0 {
+			scanType = reflect.TypeOf(r.rows[0][i])
+		}
+		types = append(types, fakeColumnType{name: name, scanType: scanType})
+	}
+	return types
+}
+
+func (r *fakeRows) Next() bool {
+	if r.pos >= len(r.rows) {
+		return false
+	}
+	r.pos++
+	return true
+}
+
+func (r *fakeRows) Scan(dest ...any) error {
+	for i, value := range r.rows[r.pos-1] {
+		reflect.ValueOf(dest[i]).Elem().Set(reflect.ValueOf(value))
+	}
+	return nil
+}
+
+func (r *fakeRows) Err() error   { return r.err }
+func (r *fakeRows) Close() error { return nil }
+
+func TestScanTextRowsPartialOnTimeout(t *testing.T) {
+	timeout := &clickhouse.Exception{Code: 159, Name: "TIMEOUT_EXCEEDED"}
+	rows := &fakeRows{rows: [][]any{{"Expression"}, {"  ReadFromMergeTree"}}, err: timeout}
+
+	lines, err := scanTextRows(rows)
+
+	assert.ErrorIs(t, err, timeout)
+	assert.Equal(t, []string{"Expression", "  ReadFromMergeTree"}, lines)
+}
+
+func TestScanTextRowsDiscardsOnOtherErrors(t *testing.T) {
+	rows := &fakeRows{rows: [][]any{{"Expression"}, {"  ReadFromMergeTree"}}, err: errors.New("connection lost")}
+
+	lines, err := scanTextRows(rows)
+
+	assert.Error(t, err)
+	assert.Nil(t, lines)
+}
+
+func TestScanEstimateRowsPartialOnTimeout(t *testing.T) {
+	timeout := &clickhouse.Exception{Code: 159, Name: "TIMEOUT_EXCEEDED"}
+	rows := &fakeRows{
+		rows: [][]any{
+			{"default", "events", uint64(3), uint64(1000), uint64(10)},
+			{"default", "users", uint64(1), uint64(50), uint64(1)},
+		},
+		err: timeout,
+	}
+
+	estimate, err := scanEstimateRows(rows)
+
+	assert.ErrorIs(t, err, timeout)
+	require.Len(t, estimate, 2)
+	assert.Equal(t, "events", estimate[0].Table)
+	assert.Equal(t, uint64(50), estimate[1].Rows)
+}
+
+func TestScanTextRowsMultiColumn(t *testing.T) {
+	rows := &fakeRows{
+		columns: []string{"transaction_id", "hostname", "is_readonly", "state"},
+		rows: [][]any{
+			{"(1,2,'abc')", "ch-1", uint8(1), "RUNNING"},
+		},
+	}
+
+	lines, err := scanTextRows(rows)
+
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		"transaction_id\thostname\tis_readonly\tstate",
+		"(1,2,'abc')\tch-1\t1\tRUNNING",
+	}, lines)
+}
+
+func TestScanTextRowsNullable(t *testing.T) {
+	comment := "primary"
+	rows := &fakeRows{
+		columns: []string{"name", "comment"},
+		rows: [][]any{
+			{"events", &comment},
+			{"users", (*string)(nil)},
+		},
+	}
+
+	lines, err := scanTextRows(rows)
+
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		"name\tcomment",
+		"events\tprimary",
+		"users\tNULL",
+	}, lines)
+}
+
+// fakeConn is a driver.Conn whose queries return rows.
+type fakeConn struct {
+	driver.Conn
+	rows driver.Rows
+}
+
+func (c *fakeConn) Query(ctx context.Context, query string, args ...any) (driver.Rows, error) {
+	return c.rows, nil
+}
+
+func TestTruncateOutput(t *testing.T) {
+	tests := []struct {
+		name          string
+		output        string
+		maxBytes      int
+		wantPrefix    string
+		wantTruncated bool
+	}{
+		{name: "no limit", output: "abcdef", maxBytes: 0, wantPrefix: "abcdef"},
+		{name: "under limit", output: "abc", maxBytes: 3, wantPrefix: "abc"},
+		{name: "ascii", output: "abcdef", maxBytes: 4, wantPrefix: "abcd\n", wantTruncated: true},
+		{name: "backs off to rune start", output: "aé€x", maxBytes: 4, wantPrefix: "aé\n", wantTruncated: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, truncated := truncateOutput(tt.output, tt.maxBytes)
+			assert.Equal(t, tt.wantTruncated, truncated)
+			assert.True(t, strings.HasPrefix(got, tt.wantPrefix), got)
+			assert.True(t, utf8.ValidString(got))
+			if !tt.wantTruncated {
+				assert.Equal(t, tt.output, got)
+			}
+		})
+	}
+}
+
+func TestExecuteConfigTruncatesOversizedOutput(t *testing.T) {
+	line := strings.Repeat("€", 100) // 300 bytes
+	rows := &fakeRows{rows: [][]any{{line}, {line}, {line}}}
+	executor := NewExplainExecutor(&fakeConn{rows: rows})
+
+	result := executor.ExecuteConfig(context.Background(), models.ExplainConfig{Type: models.ExplainPlan}, "SELECT 1", ExplainOptions{MaxOutputBytes: 500})
+
+	assert.Empty(t, result.Error)
+	assert.True(t, result.Truncated)
+	assert.True(t, utf8.ValidString(result.Output))
+	assert.Contains(t, result.Output, "output truncated")
+	assert.True(t, strings.HasPrefix(result.Output, line+"\n"))
+}
+
+func TestExecuteConfigStructuredJSONOutput(t *testing.T) {
+	rows := &fakeRows{rows: [][]any{{`[{"Plan": {"Node Type": "Expression"}}]`}}}
+	executor := NewExplainExecutor(&fakeConn{rows: rows})
+
+	jsonFormat := 1
+	config := models.ExplainConfig{Type: models.ExplainPlan, Settings: models.ExplainSettings{JSONFormat: &jsonFormat}}
+	result := executor.ExecuteConfig(context.Background(), config, "SELECT 1", ExplainOptions{})
+
+	assert.Empty(t, result.Error)
+	assert.JSONEq(t, `[{"Plan": {"Node Type": "Expression"}}]`, string(result.Structured))
+}
+
+// planFormatsConn answers PLAN json=1 queries with a JSON plan and other
+// queries with a text plan, recording the queries.
+type planFormatsConn struct {
+	driver.Conn
+	queries []string
+}
+
+func (c *planFormatsConn) Query(ctx context.Context, query string, args ...any) (driver.Rows, error) {
+	c.queries = append(c.queries, query)
+	if strings.Contains(query, "json=1") {
+		return &fakeRows{rows: [][]any{{`[{"Plan": {"Node Type": "Expression"}}]`}}}, nil
+	}
+	return &fakeRows{rows: [][]any{{"Expression ((Projection + Before ORDER BY))"}}}, nil
+}
+
+func TestExecuteConfigBothFormats(t *testing.T) {
+	conn := &planFormatsConn{}
+	executor := NewExplainExecutor(conn)
+	config := models.ExplainConfig{Type: models.ExplainPlan, BothFormats: true}
+
+	result := executor.ExecuteConfig(t.Context(), config, "SELECT 1", ExplainOptions{})
+
+	assert.Empty(t, result.Error)
+	assert.Equal(t, "Expression ((Projection + Before ORDER BY))", result.Output)
+	assert.JSONEq(t, `[{"Plan": {"Node Type": "Expression"}}]`, string(result.Structured))
+	assert.Equal(t, []string{"EXPLAIN PLAN json=0 SELECT 1", "EXPLAIN PLAN json=1 SELECT 1"}, conn.queries)
+}
+
+func TestStructuredOutput(t *testing.T) {
+	assert.Nil(t, structuredOutput("Expression ((Projection + Before ORDER BY))"))
+	assert.Nil(t, structuredOutput("{not json"))
+	assert.Equal(t, `[{"Plan": {}}]`, string(structuredOutput("  [{\"Plan\": {}}]\n")))
+}
+
+func TestExecuteConfigEstimateTotal(t *testing.T) {
+	rows := &fakeRows{rows: [][]any{
+		{"default", "events", uint64(3), uint64(1000), uint64(10)},
+		{"default", "users", uint64(1), uint64(50), uint64(1)},
+	}}
+	executor := NewExplainExecutor(&fakeConn{rows: rows})
+
+	result := executor.ExecuteConfig(context.Background(), models.ExplainConfig{Type: models.ExplainEstimate}, "SELECT 1", ExplainOptions{})
+
+	assert.Empty(t, result.Error)
+	require.NotNil(t, result.EstimateTotal)
+	assert.Equal(t, models.EstimateRow{Parts: 4, Rows: 1050, Marks: 11}, *result.EstimateTotal)
+}
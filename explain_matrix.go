@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/orian/clicktelligence/models"
+)
+
+// MaxExplainMatrixSize caps the settings combinations of one matrix request.
+const MaxExplainMatrixSize = 32
+
+// explainMatrixConcurrency is how many combinations run at once. Each uses
+// one connection, see DefaultMaxOpenConns.
+const explainMatrixConcurrency = 4
+
+// ErrInvalidMatrix is returned for matrix requests without combinations,
+// with too many, or with the same combination twice.
+var ErrInvalidMatrix = errors.New("invalid explain matrix")
+
+// ExplainMatrixRequest explains one query under several custom settings
+// combinations. Each combination is merged over CustomSettings.
+type ExplainMatrixRequest struct {
+	ExplainRequest
+	Settings []map[string]string `json:"settings"`
+
+	// Save saves a version per combination on BranchID, each the child of
+	// the previous one. By default nothing is saved.
+	Save bool `json:"save,omitempty"`
+}
+
+// ExplainMatrixEntry holds the results of one settings combination.
+type ExplainMatrixEntry struct {
+	// Key is Settings as sorted name=value pairs, e.g. "join_algorithm=hash, max_threads=4".
+	Key       string                 `json:"key"`
+	Settings  map[string]string      `json:"settings"`
+	Results   []models.ExplainResult `json:"results"`
+	Stats     models.ExecutionStats  `json:"stats,omitzero"`
+	VersionID string                 `json:"versionId,omitempty"`
+}
+
+// ExplainMatrixResponse lists the entries in the order of the request's
+// combinations.
+type ExplainMatrixResponse struct {
+	Entries      []ExplainMatrixEntry `json:"entries"`
+	AutoBranched bool                 `json:"autoBranched,omitempty"`
+	NewBranch    *models.Branch       `json:"newBranch,omitempty"`
+	TagWarnings  []string             `json:"tagWarnings,omitempty"`
+}
+
+// settingsKey formats settings as name=value pairs sorted by name.
+func settingsKey(settings map[string]string) string {
+	pairs := make([]string, 0, len(settings))
+	for _, name := range slices.Sorted(maps.Keys(settings)) {
+		pairs = append(pairs, name+"="+settings[name])
+	}
+	return strings.Join(pairs, ", ")
+}
+
+// matrixCombinations merges each combination of req over its custom
+// settings and validates them.
+func matrixCombinations(req *ExplainMatrixRequest) ([]map[string]string, error) {
+	if len(req.Settings) == 0 {
+		return nil, fmt.Errorf("%w: settings required", ErrInvalidMatrix)
+	}
+	if len(req.Settings) > MaxExplainMatrixSize {
+		return nil, fmt.Errorf("%w: %d settings combinations, at most %d allowed", ErrInvalidMatrix, len(req.Settings), MaxExplainMatrixSize)
+	}
+
+	combinations := make([]map[string]string, len(req.Settings))
+	seen := make(map[string]bool)
+	for i, settings := range req.Settings {
+		merged := maps.Clone(req.CustomSettings)
+		if merged == nil {
+			merged = make(map[string]string)
+		}
+		maps.Copy(merged, settings)
+		if err := models.ValidateCustomSettings(merged); err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrInvalidMatrix, err)
+		}
+		key := settingsKey(merged)
+		if seen[key] {
+			return nil, fmt.Errorf("%w: duplicate settings combination %q", ErrInvalidMatrix, key)
+		}
+		seen[key] = true
+		combinations[i] = merged
+	}
+	return combinations, nil
+}
+
+// runExplainMatrix executes the EXPLAINs of req once per settings
+// combination, explainMatrixConcurrency combinations at a time. Versions
+// are saved afterwards in combination order when req.Save is set.
+func (s *Server) runExplainMatrix(ctx context.Context, req *ExplainMatrixRequest) (*ExplainMatrixResponse, error) {
+	combinations, err := matrixCombinations(req)
+	if err != nil {
+		return nil, err
+	}
+
+	defaults := branchExplainDefaults(ctx, s.storage, req.BranchID, s.defaultExplainConfigs)
+	configs := getExplainConfigs(ctx, req.ExplainConfigs, defaults)
+	configs, skipped := s.runnableConfigs(ctx, &req.ExplainRequest, configs)
+	queryHash := hashQuery(req.Query)
+	maxExecutionTimeMs := branchMaxExecutionTimeMs(ctx, s.storage, req.BranchID)
+
+	requests := make([]ExplainRequest, len(combinations))
+	entries := make([]ExplainMatrixEntry, len(combinations))
+	errs := make([]error, len(combinations))
+	sem := make(chan struct{}, explainMatrixConcurrency)
+	done := make(chan struct{})
+	for i, settings := range combinations {
+		requests[i] = req.ExplainRequest
+		requests[i].CustomSettings = settings
+		go func(i int) {
+			defer func() { done <- struct{}{} }()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			combo := &requests[i]
+			results, stats, err := s.executeExplains(ctx, combo, configs, skipped, s.explainOptions(combo, queryHash, maxExecutionTimeMs), nil)
+			entries[i] = ExplainMatrixEntry{Key: settingsKey(combo.CustomSettings), Settings: combo.CustomSettings, Results: results, Stats: stats}
+			errs[i] = err
+		}(i)
+	}
+	for range combinations {
+		<-done
+	}
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+
+	response := &ExplainMatrixResponse{Entries: entries}
+	if !req.Save {
+		return response, nil
+	}
+
+	branchResult, err := checkAutoBranch(ctx, s.storage, req.BranchID, req.ParentVersionID, req.AutoBranchName)
+	if err != nil {
+		return nil, err
+	}
+	response.AutoBranched = branchResult.AutoBranched
+	response.NewBranch = branchResult.NewBranch
+
+	parentID := req.ParentVersionID
+	for i := range entries {
+		requests[i].ParentVersionID = parentID
+		version := createVersion(branchResult.TargetBranchID, &requests[i], queryHash, configs, entries[i].Results)
+		version.ExecutionStats.Merge(entries[i].Stats)
+		version.ExecutionStats.MatrixSettings = entries[i].Settings
+		if err := s.storage.SaveVersion(ctx, version); err != nil {
+			return nil, err
+		}
+		response.TagWarnings = append(response.TagWarnings, applyVersionTags(ctx, s.storage, version, req.Tags)...)
+		entries[i].VersionID = version.ID
+		parentID = version.ID
+	}
+	return response, nil
+}
+
+// handleExplainMatrix explains a query under each settings combination of
+// an ExplainMatrixRequest and returns the results side by side.
+func (s *Server) handleExplainMatrix(w http.ResponseWriter, r *http.Request) {
+	var req ExplainMatrixRequest
+	if err := s.decodeBody(w, r, &req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := checkQueryLength(req.Query, s.maxQueryLength); err != nil {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err := validateExplainRequest(&req.ExplainRequest, s.allowedStatements); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if _, err := s.connManager(req.Profile); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	response, err := s.runExplainMatrix(r.Context(), &req)
+	if errors.Is(err, ErrInvalidMatrix) || errors.Is(err, ErrInvalidParentVersion) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if err != nil {
+		s.internalError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// echoConn is a driver.Conn answering every query with its own text.
+type echoConn struct {
+	versionConn
+}
+
+func (c *echoConn) Query(ctx context.Context, query string, args ...any) (driver.Rows, error) {
+	return &fakeRows{rows: [][]any{{query}}}, nil
+}
+
+func TestMatrixCombinations(t *testing.T) {
+	combinations, err := matrixCombinations(&ExplainMatrixRequest{
+		ExplainRequest: ExplainRequest{CustomSettings: map[string]string{"max_threads": "1", "join_algorithm": "hash"}},
+		Settings:       []map[string]string{{"max_threads": "4"}, {}},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []map[string]string{
+		{"max_threads": "4", "join_algorithm": "hash"},
+		{"max_threads": "1", "join_algorithm": "hash"},
+	}, combinations)
+	assert.Equal(t, "join_algorithm=hash, max_threads=4", settingsKey(combinations[0]))
+
+	for name, settings := range map[string][]map[string]string{
+		"empty":     nil,
+		"duplicate": {{"max_threads": "4"}, {"max_threads": "4"}},
+		"invalid":   {{"max threads": "4"}},
+		"too many":  make([]map[string]string, MaxExplainMatrixSize+1),
+	} {
+		_, err := matrixCombinations(&ExplainMatrixRequest{Settings: settings})
+		assert.ErrorIs(t, err, ErrInvalidMatrix, name)
+	}
+}
+
+func TestHandleExplainMatrix(t *testing.T) {
+	storage := newTestStorage(t)
+	conn := NewConnManager(func() (driver.Conn, error) {
+		return &echoConn{versionConn{serverVersion: "25.3"}}, nil
+	}, 0)
+	server := NewServer(storage, map[string]*ConnManager{DefaultProfile: conn}, nil)
+
+	branch, err := storage.CreateBranch(t.Context(), "matrix", "", "")
+	require.NoError(t, err)
+
+	explain := func(body string) ExplainMatrixResponse {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		server.handleExplainMatrix(rec, httptest.NewRequest(http.MethodPost, "/api/query/explain/matrix", bytes.NewBufferString(body)))
+		require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+		var response ExplainMatrixResponse
+		require.NoError(t, json.NewDecoder(rec.Body).Decode(&response))
+		return response
+	}
+
+	body := `{"branchId": "` + branch.ID + `", "query": "SELECT 1",
+		"explainConfigs": [{"type": "PLAN", "enabled": true}],
+		"settings": [{"max_threads": "1"}, {"max_threads": "8"}, {"max_threads": "8", "join_algorithm": "hash"}]}`
+	response := explain(body)
+	require.Len(t, response.Entries, 3)
+	for i, key := range []string{"max_threads=1", "max_threads=8", "join_algorithm=hash, max_threads=8"} {
+		entry := response.Entries[i]
+		assert.Equal(t, key, entry.Key)
+		require.Len(t, entry.Results, 1)
+		assert.Contains(t, entry.Results[0].Output, "max_threads="+entry.Settings["max_threads"])
+		assert.Empty(t, entry.VersionID)
+	}
+	history, err := storage.GetBranchHistory(t.Context(), branch.ID)
+	require.NoError(t, err)
+	assert.Empty(t, history)
+
+	response = explain(strings.Replace(body, `"query"`, `"save": true, "query"`, 1))
+	history, err = storage.GetBranchHistory(t.Context(), branch.ID)
+	require.NoError(t, err)
+	require.Len(t, history, 3)
+	parentID := ""
+	for _, entry := range response.Entries {
+		version, ok := storage.GetVersion(t.Context(), entry.VersionID)
+		require.True(t, ok)
+		assert.Equal(t, parentID, version.ParentVersionID)
+		assert.Equal(t, "25.3", version.ExecutionStats.ClickHouseVersion)
+		assert.NotEmpty(t, version.ExecutionStats.MatrixSettings)
+		parentID = version.ID
+	}
+
+	rec := httptest.NewRecorder()
+	server.handleExplainMatrix(rec, httptest.NewRequest(http.MethodPost, "/api/query/explain/matrix", bytes.NewBufferString(`{"query": "SELECT 1"}`)))
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
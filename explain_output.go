@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"slices"
+
+	"github.com/orian/clicktelligence/models"
+)
+
+// ExplainErrorTrailer reports an error that interrupted a streamed EXPLAIN
+// output after it started, when the status can no longer change.
+const ExplainErrorTrailer = "X-Explain-Error"
+
+// explainOutputBufferSize is how much output is buffered before it is sent.
+// Errors within the first buffer still get an error status.
+const explainOutputBufferSize = 32 << 10
+
+// handleExplainOutput runs a single EXPLAIN of the type given by the type
+// query parameter and streams its output as plain text while rows arrive,
+// for plans too large to hold in memory. The body is an ExplainRequest;
+// the config of the type in explainConfigs is used if present, and nothing
+// is saved as a version.
+func (s *Server) handleExplainOutput(w http.ResponseWriter, r *http.Request) {
+	typeName := r.URL.Query().Get("type")
+	if typeName == "" {
+		http.Error(w, "type required", http.StatusBadRequest)
+		return
+	}
+	explainType, err := models.ParseExplainType(typeName)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var req ExplainRequest
+	if err := s.decodeBody(w, r, &req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := checkQueryLength(req.Query, s.maxQueryLength); err != nil {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err := validateExplainRequest(&req, s.allowedStatements); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ch, err := s.requestConnManager(r.Context(), &req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	executor, err := ch.Executor(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	config := explainConfigOfType(explainType, req.ExplainConfigs, s.defaultExplainConfigs)
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Trailer", ExplainErrorTrailer)
+
+	sent := &countingWriter{w: w}
+	buf := bufio.NewWriterSize(sent, explainOutputBufferSize)
+	queryID, err := executor.ExecuteConfigStream(r.Context(), config, req.Query, s.explainOptions(&req, hashQuery(req.Query), branchMaxExecutionTimeMs(r.Context(), s.storage, req.BranchID)), buf)
+	if err == nil {
+		err = buf.Flush()
+	}
+	if err == nil {
+		return
+	}
+
+	slog.WarnContext(r.Context(), "Error streaming EXPLAIN output", "type", explainType, "query_id", queryID, "error", err)
+	if sent.n == 0 {
+		http.Error(w, fmt.Sprintf("Query error: %s", s.errorMessage(err)), http.StatusInternalServerError)
+		return
+	}
+	buf.Flush()
+	w.Header().Set(ExplainErrorTrailer, s.errorMessage(err))
+}
+
+// explainConfigOfType returns the first config of type t in configs, then
+// in defaults, falling back to a config with default settings.
+func explainConfigOfType(t models.ExplainType, configs, defaults []models.ExplainConfig) models.ExplainConfig {
+	for _, list := range [][]models.ExplainConfig{configs, defaults} {
+		if i := slices.IndexFunc(list, func(c models.ExplainConfig) bool { return c.Type == t }); i >= 0 {
+			config := list[i]
+			config.Enabled = true
+			return config
+		}
+	}
+	return models.ExplainConfig{Type: t, Enabled: true}
+}
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
+	"github.com/orian/clicktelligence/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExecuteConfigStream(t *testing.T) {
+	rows := &fakeRows{rows: [][]any{{"Expression"}, {"  ReadFromMergeTree"}}}
+	executor := NewExplainExecutor(&fakeConn{rows: rows})
+
+	var out bytes.Buffer
+	queryID, err := executor.ExecuteConfigStream(context.Background(), models.ExplainConfig{Type: models.ExplainPlan}, "SELECT 1", ExplainOptions{MaxOutputBytes: 5}, &out)
+	require.NoError(t, err)
+	assert.NotEmpty(t, queryID)
+	assert.Equal(t, "Expression\n  ReadFromMergeTree\n", out.String(), "output is never truncated")
+}
+
+func TestExplainConfigOfType(t *testing.T) {
+	configs := []models.ExplainConfig{{Type: models.ExplainAST, Enabled: true}}
+	jsonFormat := 1
+	defaults := []models.ExplainConfig{{Type: models.ExplainPlan, Settings: models.ExplainSettings{JSONFormat: &jsonFormat}}}
+
+	assert.Equal(t, configs[0], explainConfigOfType(models.ExplainAST, configs, defaults))
+	assert.Equal(t, models.ExplainConfig{Type: models.ExplainPlan, Settings: defaults[0].Settings, Enabled: true}, explainConfigOfType(models.ExplainPlan, configs, defaults))
+	assert.Equal(t, models.ExplainConfig{Type: models.ExplainPipeline, Enabled: true}, explainConfigOfType(models.ExplainPipeline, configs, defaults))
+}
+
+func TestHandleExplainOutput(t *testing.T) {
+	newServer := func(rows driver.Rows) *Server {
+		conn := NewConnManager(func() (driver.Conn, error) { return &fakeConn{rows: rows}, nil }, 0)
+		return NewServer(newTestStorage(t), map[string]*ConnManager{DefaultProfile: conn}, nil)
+	}
+	explain := func(server *Server, target string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		body := `{"query":"SELECT 1"}`
+		server.handleExplainOutput(rec, httptest.NewRequest(http.MethodPost, target, strings.NewReader(body)))
+		return rec
+	}
+
+	rec := explain(newServer(&fakeRows{rows: [][]any{{"Expression"}}}), "/api/query/explain/output?type=plan")
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "Expression\n", rec.Body.String())
+	assert.Empty(t, rec.Result().Trailer.Get(ExplainErrorTrailer))
+
+	rec = explain(newServer(&fakeRows{}), "/api/query/explain/output?type=bogus")
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	rec = explain(newServer(&fakeRows{err: errors.New("boom")}), "/api/query/explain/output?type=PLAN")
+	assert.Equal(t, http.StatusInternalServerError, rec.Code)
+	assert.Contains(t, rec.Body.String(), "boom")
+
+	line := strings.Repeat("x", explainOutputBufferSize)
+	rec = explain(newServer(&fakeRows{rows: [][]any{{line}, {line}}, err: errors.New("boom")}), "/api/query/explain/output?type=PLAN")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.True(t, strings.HasPrefix(rec.Body.String(), line))
+	assert.Equal(t, "boom", rec.Result().Trailer.Get(ExplainErrorTrailer))
+}
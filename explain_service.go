@@ -1,14 +1,38 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
+	"maps"
+	"regexp"
+	"slices"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/orian/clicktelligence/models"
 )
 
+// ErrEmptyQuery is returned for a query that is empty or only whitespace.
+var ErrEmptyQuery = errors.New("query must not be empty")
+
+// DefaultMaxQueryLength caps the size of a query in bytes.
+const DefaultMaxQueryLength = 100 << 10
+
+// ErrQueryTooLong is returned for a query over the configured length limit.
+var ErrQueryTooLong = errors.New("query too long")
+
+// checkQueryLength returns ErrQueryTooLong if query, without surrounding
+// whitespace, is longer than limit bytes. A limit of 0 disables the check.
+func checkQueryLength(query string, limit int) error {
+	if n := len(strings.TrimSpace(query)); limit > 0 && n > limit {
+		return fmt.Errorf("%w: %d bytes (limit %d bytes)", ErrQueryTooLong, n, limit)
+	}
+	return nil
+}
+
 // ExplainRequest represents the incoming request for explaining a query.
 type ExplainRequest struct {
 	BranchID           string                 `json:"branchId"`
@@ -18,54 +42,277 @@ type ExplainRequest struct {
 	ForceAnalyzer      bool                   `json:"forceAnalyzer,omitempty"`
 	ServerSettings     map[string]string      `json:"serverSettings,omitempty"`
 	MaxExecutionTimeMs int                    `json:"maxExecutionTimeMs,omitempty"`
+	CollectStats       bool                   `json:"collectStats,omitempty"`
+	CustomSettings     map[string]string      `json:"customSettings,omitempty"`
+	Parameters         map[string]string      `json:"parameters,omitempty"`
+
+	// AutoBranchName names the branch created when editing a non-head
+	// version. Defaults to branch-<timestamp>.
+	AutoBranchName string `json:"autoBranchName,omitempty"`
+
+	// Profile selects the ClickHouse connection profile to explain against.
+	// Empty means DefaultProfile.
+	Profile string `json:"profile,omitempty"`
+
+	// Database is the default database of the EXPLAINs, resolving
+	// unqualified table names, instead of the profile's. The EXPLAINs run
+	// on a connection of their own for it, see ConnManager.Database.
+	Database string `json:"database,omitempty"`
+
+	// ReuseAcrossBranches borrows the results of any recent version, on any
+	// branch, that ran the same query with the same EXPLAIN configs and
+	// settings without errors, instead of executing the EXPLAINs.
+	ReuseAcrossBranches bool `json:"reuseAcrossBranches,omitempty"`
+
+	// ForceRefresh executes the EXPLAINs and saves a new version even when
+	// the query is unchanged from the parent, e.g. after a data load
+	// changed the estimates. It also disables ReuseAcrossBranches.
+	ForceRefresh bool `json:"forceRefresh,omitempty"`
+
+	// Tags are added to the new version once it is saved. Tags it already
+	// has are skipped; other failures are reported as tagWarnings in the
+	// response instead of failing the explain.
+	Tags []string `json:"tags,omitempty"`
+
+	// SkipRegressionCheck leaves out the regression the response reports
+	// when the new version's estimated rows grew over its parent's, see
+	// Server.estimateRegression.
+	SkipRegressionCheck bool `json:"skipRegressionCheck,omitempty"`
+
+	// mergeParentVersionID is set for merges, see prepareMerge. It becomes
+	// the new version's MergeParentVersionID and bypasses the unchanged
+	// query cache, since a merge always records a new version.
+	mergeParentVersionID string
+
+	// rerun bypasses the unchanged query cache, for re-running the
+	// EXPLAINs of a version as its child, see prepareReanalyze.
+	rerun bool
 }
 
+// databaseNamePattern matches the database names explain requests accept.
+var databaseNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// validateExplainRequest checks an explain request before anything is executed.
+// allowedStatements lists the accepted leading statement keywords.
+func validateExplainRequest(req *ExplainRequest, allowedStatements []string) error {
+	if strings.TrimSpace(req.Query) == "" {
+		return ErrEmptyQuery
+	}
+	if err := checkStatementKind(req.Query, allowedStatements); err != nil {
+		return err
+	}
+	if req.Database != "" && !databaseNamePattern.MatchString(req.Database) {
+		return fmt.Errorf("invalid database name %q", req.Database)
+	}
+	for _, config := range req.ExplainConfigs {
+		if err := config.ValidateBothFormats(); err != nil {
+			return err
+		}
+	}
+	return models.ValidateCustomSettings(req.CustomSettings)
+}
+
+// skippedAnalyzerDisabled explains a QUERY TREE result that wasn't executed.
+const skippedAnalyzerDisabled = "skipped: enable_analyzer=0 and forceAnalyzer not set"
+
 // filterExplainConfigs filters out EXPLAIN QUERY TREE when the analyzer is disabled
-// and forceAnalyzer is false. Returns the filtered list of configs.
-func filterExplainConfigs(configs []models.ExplainConfig, serverSettings map[string]string, forceAnalyzer bool) []models.ExplainConfig {
+// and forceAnalyzer is false. Returns the filtered list of configs and a
+// Skipped result for each config that was dropped.
+func filterExplainConfigs(ctx context.Context, configs []models.ExplainConfig, serverSettings map[string]string, forceAnalyzer bool) ([]models.ExplainConfig, []models.ExplainResult) {
 	if forceAnalyzer {
-		return configs
+		return configs, nil
 	}
 
 	analyzerValue, ok := serverSettings["enable_analyzer"]
 	if !ok || analyzerValue != "0" {
-		return configs
+		return configs, nil
 	}
 
 	// Filter out QUERY TREE
 	var filtered []models.ExplainConfig
+	var skipped []models.ExplainResult
 	for _, config := range configs {
 		if config.Type != models.ExplainQueryTree {
 			filtered = append(filtered, config)
 		} else {
-			log.Println("Skipping EXPLAIN QUERY TREE because enable_analyzer=0")
+			slog.DebugContext(ctx, "Skipping EXPLAIN QUERY TREE because enable_analyzer=0")
+			skipped = append(skipped, models.ExplainResult{
+				Type:    config.Type,
+				Error:   skippedAnalyzerDisabled,
+				Skipped: true,
+			})
+		}
+	}
+	return filtered, skipped
+}
+
+// filterUnsupportedConfigs filters out configs of EXPLAIN types a server of
+// version serverVersion doesn't support, see models.ExplainType.SupportedBy.
+// Returns the supported configs and a Skipped result for each dropped one.
+func filterUnsupportedConfigs(ctx context.Context, configs []models.ExplainConfig, serverVersion string) ([]models.ExplainConfig, []models.ExplainResult) {
+	var supported []models.ExplainConfig
+	var skipped []models.ExplainResult
+	for _, config := range configs {
+		if config.Type.SupportedBy(serverVersion) {
+			supported = append(supported, config)
+			continue
+		}
+		slog.DebugContext(ctx, "Skipping EXPLAIN type the server doesn't support", "type", config.Type, "server_version", serverVersion)
+		skipped = append(skipped, models.ExplainResult{
+			Type:    config.Type,
+			Error:   fmt.Sprintf("skipped: EXPLAIN %s requires ClickHouse %s or newer, the server runs %s", config.Type, config.Type.MinServerVersion(), serverVersion),
+			Skipped: true,
+		})
+	}
+	return supported, skipped
+}
+
+// DryRunQuery is an EXPLAIN statement an explain request would run.
+type DryRunQuery struct {
+	Type models.ExplainType `json:"type"`
+	SQL  string             `json:"sql"`
+}
+
+// dryRunQueries builds the EXPLAIN statements of the enabled configs, in
+// order, as the executor would send them. A BothFormats PLAN yields both
+// of its statements.
+func dryRunQueries(configs []models.ExplainConfig, query string, opts ExplainOptions) []DryRunQuery {
+	queries := []DryRunQuery{}
+	for _, config := range configs {
+		if !config.Enabled {
+			continue
+		}
+		run := []models.ExplainConfig{config}
+		if config.BothFormats && config.Type == models.ExplainPlan {
+			textConfig, jsonConfig := bothFormatsConfigs(config)
+			run = []models.ExplainConfig{textConfig, jsonConfig}
+		}
+		for _, c := range run {
+			queries = append(queries, DryRunQuery{
+				Type: c.Type,
+				SQL:  c.BuildExplainQuery(query, opts.LogComment, opts.ForceAnalyzer, opts.MaxExecutionTimeMs, opts.CustomSettings),
+			})
 		}
 	}
-	return filtered
+	return queries
+}
+
+// hasFailedResult reports whether an executed result has an error.
+func hasFailedResult(results []models.ExplainResult) bool {
+	return slices.ContainsFunc(executedResults(results), func(result models.ExplainResult) bool {
+		return result.Error != ""
+	})
+}
+
+// executedResults returns the results that were actually executed, dropping
+// Skipped annotations.
+func executedResults(results []models.ExplainResult) []models.ExplainResult {
+	return slices.DeleteFunc(slices.Clone(results), func(result models.ExplainResult) bool {
+		return result.Skipped
+	})
 }
 
-// getExplainConfigs returns the provided configs or default configs if none provided.
-func getExplainConfigs(configs []models.ExplainConfig) []models.ExplainConfig {
+// getExplainConfigs returns the provided configs or defaults if none provided.
+func getExplainConfigs(ctx context.Context, configs, defaults []models.ExplainConfig) []models.ExplainConfig {
 	if len(configs) == 0 {
-		log.Println("No EXPLAIN configurations provided, using default set")
-		return models.GetDefaultExplainConfigs()
+		slog.DebugContext(ctx, "No EXPLAIN configurations provided, using default set")
+		return defaults
 	}
 	return configs
 }
 
+// branchExplainDefaults returns the default EXPLAIN configs stored on a
+// branch, or fallback when the branch has none or doesn't exist.
+func branchExplainDefaults(ctx context.Context, storage models.Storage, branchID string, fallback []models.ExplainConfig) []models.ExplainConfig {
+	if branch, ok := storage.GetBranch(ctx, branchID); ok && len(branch.DefaultExplainConfigs) > 0 {
+		slog.DebugContext(ctx, "Using branch default EXPLAIN configurations", "branch_id", branchID)
+		return branch.DefaultExplainConfigs
+	}
+	return fallback
+}
+
+// branchMaxExecutionTimeMs returns the default max_execution_time stored
+// on a branch, or DefaultMaxExecutionTimeMs when the branch has none or
+// doesn't exist.
+func branchMaxExecutionTimeMs(ctx context.Context, storage models.Storage, branchID string) int {
+	if branch, ok := storage.GetBranch(ctx, branchID); ok && branch.DefaultMaxExecutionTimeMs > 0 {
+		return branch.DefaultMaxExecutionTimeMs
+	}
+	return DefaultMaxExecutionTimeMs
+}
+
+// normalizeExplainConfigs validates configs to be stored as defaults,
+// canonicalizing type names (e.g. "query tree" becomes "QUERY TREE").
+func normalizeExplainConfigs(configs []models.ExplainConfig) ([]models.ExplainConfig, error) {
+	normalized := make([]models.ExplainConfig, 0, len(configs))
+	for _, config := range configs {
+		explainType, err := models.ParseExplainType(string(config.Type))
+		if err != nil {
+			return nil, err
+		}
+		config.Type = explainType
+		if err := config.ValidateBothFormats(); err != nil {
+			return nil, err
+		}
+		normalized = append(normalized, config)
+	}
+	return normalized, nil
+}
+
+// parseDefaultExplainConfigs builds the default configs from a comma-separated
+// list of EXPLAIN types, in the given order. Types that are part of
+// models.GetDefaultExplainConfigs keep their default settings; others run
+// without settings. Unknown type names are an error.
+func parseDefaultExplainConfigs(raw string) ([]models.ExplainConfig, error) {
+	builtin := make(map[models.ExplainType]models.ExplainConfig)
+	for _, config := range models.GetDefaultExplainConfigs() {
+		builtin[config.Type] = config
+	}
+
+	var configs []models.ExplainConfig
+	seen := make(map[models.ExplainType]bool)
+	for _, name := range strings.Split(raw, ",") {
+		if strings.TrimSpace(name) == "" {
+			continue
+		}
+		explainType, err := models.ParseExplainType(name)
+		if err != nil {
+			return nil, err
+		}
+		if seen[explainType] {
+			continue
+		}
+		seen[explainType] = true
+
+		config, ok := builtin[explainType]
+		if !ok {
+			config = models.ExplainConfig{Type: explainType}
+		}
+		config.Enabled = true
+		configs = append(configs, config)
+	}
+
+	if len(configs) == 0 {
+		return nil, fmt.Errorf("no EXPLAIN types in %q", raw)
+	}
+	return configs, nil
+}
+
 // checkCachedVersion checks if the parent version can be reused.
 // Returns the parent version and true if:
 // - parentVersionID is not empty
 // - parent version exists
 // - query hash matches
+// - query parameters and custom settings match
+// - connection profile and database match
 // - parent has explain results
 // - parent has no errors
-func checkCachedVersion(storage models.Storage, parentVersionID, queryHash string) (*models.QueryVersion, bool) {
+func checkCachedVersion(ctx context.Context, storage models.Storage, parentVersionID, queryHash string, parameters, customSettings map[string]string, profile, database string) (*models.QueryVersion, bool) {
 	if parentVersionID == "" {
 		return nil, false
 	}
 
-	parentVersion, exists := storage.GetVersion(parentVersionID)
+	parentVersion, exists := storage.GetVersion(ctx, parentVersionID)
 	if !exists {
 		return nil, false
 	}
@@ -74,32 +321,143 @@ func checkCachedVersion(storage models.Storage, parentVersionID, queryHash strin
 		return nil, false
 	}
 
-	if len(parentVersion.ExplainResults) == 0 {
+	if !maps.Equal(parentVersion.ExecutionStats.Parameters, parameters) {
+		slog.DebugContext(ctx, "Query unchanged but parameters differ, re-executing EXPLAIN")
 		return nil, false
 	}
 
-	// Check if parent has any errors
-	for _, result := range parentVersion.ExplainResults {
+	if !maps.Equal(parentVersion.ExecutionStats.CustomSettings, customSettings) {
+		slog.DebugContext(ctx, "Query unchanged but custom settings differ, re-executing EXPLAIN")
+		return nil, false
+	}
+
+	if profileFromStats(parentVersion.ExecutionStats) != normalizeProfile(profile) {
+		slog.DebugContext(ctx, "Query unchanged but connection profile differs, re-executing EXPLAIN")
+		return nil, false
+	}
+
+	if parentVersion.ExecutionStats.Database != database {
+		slog.DebugContext(ctx, "Query unchanged but database differs, re-executing EXPLAIN")
+		return nil, false
+	}
+
+	if len(executedResults(parentVersion.ExplainResults)) == 0 {
+		return nil, false
+	}
+
+	// Check if parent has any errors; skipped results aren't failures
+	for _, result := range executedResults(parentVersion.ExplainResults) {
 		if result.Error != "" {
-			log.Printf("Query unchanged but parent had errors, re-executing EXPLAIN")
+			slog.DebugContext(ctx, "Query unchanged but parent had errors, re-executing EXPLAIN")
 			return nil, false
 		}
 	}
 
-	log.Printf("Query unchanged, returning existing version %s (no new version created)", parentVersionID)
+	slog.DebugContext(ctx, "Query unchanged, returning existing version (no new version created)", "version_id", parentVersionID)
+	observeCachedResults(parentVersion.ExplainResults)
 	return parentVersion, true
 }
 
+// maxReuseCandidates bounds how many versions sharing a query hash are
+// checked by findReusableVersion, newest first.
+const maxReuseCandidates = 20
+
+// findReusableVersion looks for a version on any branch whose results can
+// stand in for executing configs now: same query hash, parameters,
+// profile and database, no errors, and exactly the EXPLAIN statements that would be
+// executed, compared through each result's ExecutedQuery.
+func findReusableVersion(ctx context.Context, storage models.Storage, queryHash, query string, configs []models.ExplainConfig, opts ExplainOptions, profile, database string) (*models.QueryVersion, bool) {
+	candidates, err := storage.GetVersionsByHash(ctx, queryHash)
+	if err != nil {
+		slog.WarnContext(ctx, "Failed to look up versions for reuse", "query_hash", queryHash, "error", err)
+		return nil, false
+	}
+
+	want := make([]string, 0, len(configs))
+	for _, config := range configs {
+		want = append(want, config.BuildExplainQuery(query, opts.LogComment, opts.ForceAnalyzer, opts.MaxExecutionTimeMs, opts.CustomSettings))
+	}
+	slices.Sort(want)
+
+	for i, candidate := range candidates {
+		if i == maxReuseCandidates {
+			break
+		}
+		results := executedResults(candidate.ExplainResults)
+		if len(results) != len(want) {
+			continue
+		}
+		if !maps.Equal(candidate.ExecutionStats.Parameters, opts.Parameters) {
+			continue
+		}
+		if profileFromStats(candidate.ExecutionStats) != normalizeProfile(profile) {
+			continue
+		}
+		if candidate.ExecutionStats.Database != database {
+			continue
+		}
+
+		executed := make([]string, 0, len(results))
+		failed := false
+		for _, result := range results {
+			if result.Error != "" {
+				failed = true
+				break
+			}
+			executed = append(executed, result.ExecutedQuery)
+		}
+		if failed {
+			continue
+		}
+		slices.Sort(executed)
+		if slices.Equal(executed, want) {
+			slog.DebugContext(ctx, "Reusing EXPLAIN results from another version", "version_id", candidate.ID, "branch_id", candidate.BranchID)
+			return candidate, true
+		}
+	}
+
+	return nil, false
+}
+
+// borrowVersion creates a version on branchID that copies the executed
+// results and execution stats of source, recording source in
+// BorrowedFrom. configs are the configs the results stand in for;
+// skipped is appended in place of the source's own Skipped results.
+func borrowVersion(branchID string, req *ExplainRequest, source *models.QueryVersion, configs []models.ExplainConfig, skipped []models.ExplainResult) *models.QueryVersion {
+	version := createVersion(branchID, req, source.QueryHash, configs, append(executedResults(source.ExplainResults), skipped...))
+	version.ExecutionStats.Merge(source.ExecutionStats)
+	version.ExecutionStats.BorrowedFrom = source.ID
+	return version
+}
+
+// normalizeProfile maps an empty profile name to DefaultProfile.
+func normalizeProfile(profile string) string {
+	if profile == "" {
+		return DefaultProfile
+	}
+	return profile
+}
+
+// profileFromStats returns the connection profile recorded in execution
+// stats. Versions without one ran against DefaultProfile.
+func profileFromStats(stats models.ExecutionStats) string {
+	return normalizeProfile(stats.Profile)
+}
+
 // AutoBranchResult contains the result of auto-branch check.
 type AutoBranchResult struct {
 	TargetBranchID string
 	NewBranch      *models.Branch
 	AutoBranched   bool
+
+	// BranchName is the name the new branch was created with.
+	BranchName string
 }
 
 // checkAutoBranch checks if editing a non-head version and creates a new branch if needed.
-// Returns the target branch ID and optionally the new branch.
-func checkAutoBranch(storage models.Storage, branchID, parentVersionID string) (*AutoBranchResult, error) {
+// The new branch is called name when given and not already taken, otherwise
+// branch-<timestamp>. Returns the target branch ID and optionally the new branch.
+func checkAutoBranch(ctx context.Context, storage models.Storage, branchID, parentVersionID, name string) (*AutoBranchResult, error) {
 	result := &AutoBranchResult{
 		TargetBranchID: branchID,
 		AutoBranched:   false,
@@ -109,11 +467,22 @@ func checkAutoBranch(storage models.Storage, branchID, parentVersionID string) (
 		return result, nil
 	}
 
-	branch, exists := storage.GetBranch(branchID)
+	branch, exists := storage.GetBranch(ctx, branchID)
 	if !exists {
 		return result, nil
 	}
 
+	// A parent from an unrelated branch would fork this branch from it
+	if parentVersionID != branch.CurrentVersionID && parentVersionID != branch.BranchFromVersionID {
+		parent, exists := storage.GetVersion(ctx, parentVersionID)
+		if !exists {
+			return nil, fmt.Errorf("%w: %s does not exist", ErrInvalidParentVersion, parentVersionID)
+		}
+		if parent.BranchID != branchID {
+			return nil, fmt.Errorf("%w: %s is on branch %s, not %s", ErrInvalidParentVersion, parentVersionID, parent.BranchID, branchID)
+		}
+	}
+
 	// Check if editing non-head version
 	if branch.CurrentVersionID == "" || branch.CurrentVersionID == parentVersionID {
 		return result, nil
@@ -121,26 +490,54 @@ func checkAutoBranch(storage models.Storage, branchID, parentVersionID string) (
 
 	// User is editing a non-head version, auto-create new branch
 	newBranchName := fmt.Sprintf("branch-%s", time.Now().Format("2006-01-02-15:04:05"))
-	newBranch, err := storage.CreateBranch(newBranchName, branchID, parentVersionID)
+	if name = strings.TrimSpace(name); name != "" {
+		if taken, err := branchNameTaken(ctx, storage, name); err != nil {
+			slog.WarnContext(ctx, "Failed to check branch name, using generated name", "name", name, "error", err)
+		} else if taken {
+			slog.InfoContext(ctx, "Branch name already taken, using generated name", "name", name)
+		} else {
+			newBranchName = name
+		}
+	}
+	newBranch, err := storage.CreateBranch(ctx, newBranchName, branchID, parentVersionID)
 	if err != nil {
-		log.Printf("Failed to auto-create branch: %v", err)
+		slog.WarnContext(ctx, "Failed to auto-create branch", "error", err)
 		return result, nil // Don't fail, just use original branch
 	}
 
-	log.Printf("Auto-created branch '%s' (ID: %s) from version %s", newBranchName, newBranch.ID, parentVersionID)
+	slog.InfoContext(ctx, "Auto-created branch", "name", newBranchName, "branch_id", newBranch.ID, "from_version_id", parentVersionID)
+	autoBranchesTotal.Inc()
 	return &AutoBranchResult{
 		TargetBranchID: newBranch.ID,
 		NewBranch:      newBranch,
 		AutoBranched:   true,
+		BranchName:     newBranchName,
 	}, nil
 }
 
+// branchNameTaken reports whether any branch, archived or not, is called name.
+func branchNameTaken(ctx context.Context, storage models.Storage, name string) (bool, error) {
+	branches, err := storage.GetBranches(ctx, true)
+	if err != nil {
+		return false, err
+	}
+	for _, branch := range branches {
+		if branch.Name == name {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
 // buildExplainResponse builds the JSON response for an explain query.
-func buildExplainResponse(version *models.QueryVersion, autoBranched bool, newBranch *models.Branch, resultsReused bool) map[string]interface{} {
+// serverTime is the server's current time, letting clients compute relative
+// times without depending on their own clock.
+func buildExplainResponse(version *models.QueryVersion, autoBranched bool, newBranch *models.Branch, resultsReused bool, serverTime time.Time) map[string]interface{} {
 	response := map[string]interface{}{
 		"version":       version,
 		"autoBranched":  autoBranched,
 		"resultsReused": resultsReused,
+		"serverTime":    formatServerTime(serverTime),
 	}
 
 	if autoBranched && newBranch != nil {
@@ -150,16 +547,56 @@ func buildExplainResponse(version *models.QueryVersion, autoBranched bool, newBr
 	return response
 }
 
-// createVersion creates a new QueryVersion from the request and explain results.
-func createVersion(branchID string, req *ExplainRequest, queryHash string, results []models.ExplainResult) *models.QueryVersion {
+// applyVersionTags adds tags to a saved version and appends the created ones
+// to version.Tags. Duplicates are skipped silently; other failures are
+// returned as warnings.
+func applyVersionTags(ctx context.Context, storage models.Storage, version *models.QueryVersion, tags []string) []string {
+	var warnings []string
+	for _, tag := range tags {
+		created, err := storage.AddTag(ctx, version.ID, tag)
+		if errors.Is(err, ErrTagExists) {
+			continue
+		} else if err != nil {
+			warnings = append(warnings, fmt.Sprintf("tag %q not added: %v", tag, err))
+			continue
+		}
+		version.Tags = append(version.Tags, created)
+	}
+	return warnings
+}
+
+// formatServerTime formats t as RFC 3339 in UTC for serverTime fields and
+// the ServerTimeHeader.
+func formatServerTime(t time.Time) string {
+	return t.UTC().Format(time.RFC3339)
+}
+
+// createVersion creates a new QueryVersion from the request and explain
+// results, recording the configs that produced them.
+func createVersion(branchID string, req *ExplainRequest, queryHash string, configs []models.ExplainConfig, results []models.ExplainResult) *models.QueryVersion {
+	var stats models.ExecutionStats
+	if len(req.Parameters) > 0 {
+		stats.Parameters = req.Parameters
+	}
+	if len(req.CustomSettings) > 0 {
+		stats.CustomSettings = req.CustomSettings
+	}
+	if profile := normalizeProfile(req.Profile); profile != DefaultProfile {
+		stats.Profile = profile
+	}
+	stats.Database = req.Database
+
 	return &models.QueryVersion{
 		ID:              uuid.New().String(),
 		BranchID:        branchID,
 		Query:           req.Query,
 		QueryHash:       queryHash,
 		ExplainResults:  results,
-		ExecutionStats:  make(map[string]interface{}),
+		Configs:         configs,
+		ExecutionStats:  stats,
 		Timestamp:       time.Now(),
 		ParentVersionID: req.ParentVersionID,
+
+		MergeParentVersionID: req.mergeParentVersionID,
 	}
 }
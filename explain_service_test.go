@@ -1,10 +1,14 @@
 package main
 
 import (
+	"context"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/orian/clicktelligence/models"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestFilterExplainConfigs(t *testing.T) {
@@ -14,6 +18,7 @@ func TestFilterExplainConfigs(t *testing.T) {
 		serverSettings map[string]string
 		forceAnalyzer  bool
 		wantTypes      []models.ExplainType
+		wantSkipped    []models.ExplainType
 	}{
 		{
 			name: "no filtering when forceAnalyzer is true",
@@ -55,6 +60,7 @@ func TestFilterExplainConfigs(t *testing.T) {
 			serverSettings: map[string]string{"enable_analyzer": "0"},
 			forceAnalyzer:  false,
 			wantTypes:      []models.ExplainType{models.ExplainPlan, models.ExplainPipeline},
+			wantSkipped:    []models.ExplainType{models.ExplainQueryTree},
 		},
 		{
 			name:           "empty configs returns empty",
@@ -76,7 +82,14 @@ func TestFilterExplainConfigs(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got := filterExplainConfigs(tt.configs, tt.serverSettings, tt.forceAnalyzer)
+			got, skipped := filterExplainConfigs(context.Background(), tt.configs, tt.serverSettings, tt.forceAnalyzer)
+
+			assert.Len(t, skipped, len(tt.wantSkipped))
+			for i, result := range skipped {
+				assert.Equal(t, tt.wantSkipped[i], result.Type)
+				assert.True(t, result.Skipped)
+				assert.Equal(t, skippedAnalyzerDisabled, result.Error)
+			}
 
 			if tt.wantTypes == nil {
 				assert.Nil(t, got)
@@ -91,6 +104,81 @@ func TestFilterExplainConfigs(t *testing.T) {
 	}
 }
 
+func TestFilterUnsupportedConfigs(t *testing.T) {
+	configs := []models.ExplainConfig{
+		{Type: models.ExplainPlan, Enabled: true},
+		{Type: models.ExplainQueryTree, Enabled: true},
+	}
+
+	supported, skipped := filterUnsupportedConfigs(t.Context(), configs, "22.8.5.29")
+	require.Len(t, supported, 1)
+	assert.Equal(t, models.ExplainPlan, supported[0].Type)
+	require.Len(t, skipped, 1)
+	assert.Equal(t, models.ExplainQueryTree, skipped[0].Type)
+	assert.True(t, skipped[0].Skipped)
+	assert.Contains(t, skipped[0].Error, "requires ClickHouse 22.10")
+
+	supported, skipped = filterUnsupportedConfigs(t.Context(), configs, "24.3.2.23")
+	assert.Len(t, supported, 2)
+	assert.Empty(t, skipped)
+}
+
+func TestValidateExplainRequest(t *testing.T) {
+	tests := []struct {
+		name    string
+		req     ExplainRequest
+		wantErr error
+	}{
+		{name: "valid", req: ExplainRequest{Query: "SELECT 1"}},
+		{name: "empty query", req: ExplainRequest{Query: ""}, wantErr: ErrEmptyQuery},
+		{name: "whitespace query", req: ExplainRequest{Query: " \n\t "}, wantErr: ErrEmptyQuery},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateExplainRequest(&tt.req, DefaultAllowedStatements)
+			if tt.wantErr == nil {
+				assert.NoError(t, err)
+				return
+			}
+			assert.ErrorIs(t, err, tt.wantErr)
+		})
+	}
+
+	t.Run("database", func(t *testing.T) {
+		assert.NoError(t, validateExplainRequest(&ExplainRequest{Query: "SELECT 1", Database: "analytics_v2"}, DefaultAllowedStatements))
+		assert.Error(t, validateExplainRequest(&ExplainRequest{Query: "SELECT 1", Database: "db; DROP TABLE t"}, DefaultAllowedStatements))
+		assert.Error(t, validateExplainRequest(&ExplainRequest{Query: "SELECT 1", Database: "`quoted`"}, DefaultAllowedStatements))
+	})
+}
+
+func TestCheckQueryLength(t *testing.T) {
+	tests := []struct {
+		name    string
+		query   string
+		limit   int
+		wantErr bool
+	}{
+		{name: "under limit", query: "SELECT 1", limit: 10},
+		{name: "at limit", query: "SELECT 123", limit: 10},
+		{name: "over limit", query: "SELECT 1234", limit: 10, wantErr: true},
+		{name: "surrounding whitespace ignored", query: "\n  SELECT 123  \n", limit: 10},
+		{name: "disabled", query: strings.Repeat("x", 1000), limit: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkQueryLength(tt.query, tt.limit)
+			if !tt.wantErr {
+				assert.NoError(t, err)
+				return
+			}
+			assert.ErrorIs(t, err, ErrQueryTooLong)
+			assert.Contains(t, err.Error(), "limit 10 bytes")
+		})
+	}
+}
+
 func TestGetExplainConfigs(t *testing.T) {
 	tests := []struct {
 		name    string
@@ -116,7 +204,7 @@ func TestGetExplainConfigs(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got := getExplainConfigs(tt.configs)
+			got := getExplainConfigs(context.Background(), tt.configs, models.GetDefaultExplainConfigs())
 			assert.Len(t, got, tt.wantLen)
 		})
 	}
@@ -150,7 +238,7 @@ func TestBuildExplainResponse(t *testing.T) {
 			autoBranched:  false,
 			newBranch:     nil,
 			resultsReused: false,
-			wantKeys:      []string{"version", "autoBranched", "resultsReused"},
+			wantKeys:      []string{"version", "autoBranched", "resultsReused", "serverTime"},
 			checkBranch:   false,
 		},
 		{
@@ -184,7 +272,9 @@ func TestBuildExplainResponse(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got := buildExplainResponse(tt.version, tt.autoBranched, tt.newBranch, tt.resultsReused)
+			now := time.Date(2026, 3, 1, 12, 30, 0, 0, time.FixedZone("CET", 3600))
+			got := buildExplainResponse(tt.version, tt.autoBranched, tt.newBranch, tt.resultsReused, now)
+			assert.Equal(t, "2026-03-01T11:30:00Z", got["serverTime"])
 
 			// Check all expected keys exist
 			for _, key := range tt.wantKeys {
@@ -217,7 +307,7 @@ func TestCreateVersion(t *testing.T) {
 		{Type: models.ExplainPlan, Output: "plan output"},
 	}
 
-	version := createVersion("target-branch", req, "hash123", results)
+	version := createVersion("target-branch", req, "hash123", nil, results)
 
 	assert.NotEmpty(t, version.ID)
 	assert.Equal(t, "target-branch", version.BranchID)
@@ -225,6 +315,354 @@ func TestCreateVersion(t *testing.T) {
 	assert.Equal(t, "hash123", version.QueryHash)
 	assert.Equal(t, results, version.ExplainResults)
 	assert.Equal(t, "parent-id", version.ParentVersionID)
-	assert.NotNil(t, version.ExecutionStats)
+	assert.True(t, version.ExecutionStats.IsZero())
 	assert.False(t, version.Timestamp.IsZero())
 }
+
+func TestCreateVersionRecordsParameters(t *testing.T) {
+	req := &ExplainRequest{
+		Query:      "SELECT * FROM t WHERE id = {id:UInt64}",
+		Parameters: map[string]string{"id": "42"},
+	}
+
+	version := createVersion("branch", req, "hash", nil, nil)
+
+	assert.Equal(t, "SELECT * FROM t WHERE id = {id:UInt64}", version.Query)
+	assert.Equal(t, map[string]string{"id": "42"}, version.ExecutionStats.Parameters)
+}
+
+func TestCheckCachedVersionParameters(t *testing.T) {
+	storage := newTestStorage(t)
+
+	branch, err := storage.CreateBranch(t.Context(), "params", "", "")
+	require.NoError(t, err)
+
+	query := "SELECT * FROM t WHERE id = {id:UInt64}"
+	req := &ExplainRequest{Query: query, Parameters: map[string]string{"id": "1"}}
+	parent := createVersion(branch.ID, req, hashQuery(query), nil, []models.ExplainResult{{Type: models.ExplainPlan, Output: "plan"}})
+	require.NoError(t, storage.SaveVersion(t.Context(), parent))
+
+	_, ok := checkCachedVersion(context.Background(), storage, parent.ID, hashQuery(query), map[string]string{"id": "1"}, nil, "", "")
+	assert.True(t, ok, "same parameters reuse results")
+
+	_, ok = checkCachedVersion(context.Background(), storage, parent.ID, hashQuery(query), map[string]string{"id": "2"}, nil, "", "")
+	assert.False(t, ok, "different parameters re-execute")
+
+	_, ok = checkCachedVersion(context.Background(), storage, parent.ID, hashQuery(query), nil, nil, "", "")
+	assert.False(t, ok, "missing parameters re-execute")
+}
+
+func TestCheckCachedVersionCustomSettings(t *testing.T) {
+	storage := newTestStorage(t)
+
+	branch, err := storage.CreateBranch(t.Context(), "custom-settings", "", "")
+	require.NoError(t, err)
+
+	query := "SELECT count() FROM events"
+	req := &ExplainRequest{Query: query, CustomSettings: map[string]string{"max_threads": "1"}}
+	parent := createVersion(branch.ID, req, hashQuery(query), nil, []models.ExplainResult{{Type: models.ExplainPlan, Output: "plan"}})
+	require.NoError(t, storage.SaveVersion(t.Context(), parent))
+
+	_, ok := checkCachedVersion(t.Context(), storage, parent.ID, hashQuery(query), nil, map[string]string{"max_threads": "1"}, "", "")
+	assert.True(t, ok, "same custom settings reuse results")
+
+	_, ok = checkCachedVersion(t.Context(), storage, parent.ID, hashQuery(query), nil, map[string]string{"max_threads": "8"}, "", "")
+	assert.False(t, ok, "different custom settings re-execute")
+
+	_, ok = checkCachedVersion(t.Context(), storage, parent.ID, hashQuery(query), nil, nil, "", "")
+	assert.False(t, ok, "missing custom settings re-execute")
+}
+
+func TestCheckCachedVersionSkipped(t *testing.T) {
+	storage := newTestStorage(t)
+
+	branch, err := storage.CreateBranch(t.Context(), "skipped", "", "")
+	require.NoError(t, err)
+
+	query := "SELECT 1"
+	_, skipped := filterExplainConfigs(context.Background(),
+		[]models.ExplainConfig{{Type: models.ExplainQueryTree, Enabled: true}}, map[string]string{"enable_analyzer": "0"}, false)
+	results := append([]models.ExplainResult{{Type: models.ExplainPlan, Output: "plan"}}, skipped...)
+	parent := createVersion(branch.ID, &ExplainRequest{Query: query}, hashQuery(query), nil, results)
+	require.NoError(t, storage.SaveVersion(t.Context(), parent))
+
+	_, ok := checkCachedVersion(context.Background(), storage, parent.ID, hashQuery(query), nil, nil, "", "")
+	assert.True(t, ok, "skipped results are not errors")
+
+	onlySkipped := createVersion(branch.ID, &ExplainRequest{Query: query}, hashQuery(query), nil, skipped)
+	require.NoError(t, storage.SaveVersion(t.Context(), onlySkipped))
+
+	_, ok = checkCachedVersion(context.Background(), storage, onlySkipped.ID, hashQuery(query), nil, nil, "", "")
+	assert.False(t, ok, "nothing was executed")
+}
+
+func TestCheckCachedVersionProfile(t *testing.T) {
+	storage := newTestStorage(t)
+
+	branch, err := storage.CreateBranch(t.Context(), "profiles", "", "")
+	require.NoError(t, err)
+
+	query := "SELECT 1"
+	req := &ExplainRequest{Query: query, Profile: "prod"}
+	parent := createVersion(branch.ID, req, hashQuery(query), nil, []models.ExplainResult{{Type: models.ExplainPlan, Output: "plan"}})
+	require.NoError(t, storage.SaveVersion(t.Context(), parent))
+
+	_, ok := checkCachedVersion(context.Background(), storage, parent.ID, hashQuery(query), nil, nil, "prod", "")
+	assert.True(t, ok, "same profile reuses results")
+
+	_, ok = checkCachedVersion(context.Background(), storage, parent.ID, hashQuery(query), nil, nil, "", "")
+	assert.False(t, ok, "default profile re-executes")
+}
+
+func TestCheckCachedVersionDatabase(t *testing.T) {
+	storage := newTestStorage(t)
+
+	branch, err := storage.CreateBranch(t.Context(), "databases", "", "")
+	require.NoError(t, err)
+
+	query := "SELECT count() FROM events"
+	req := &ExplainRequest{Query: query, Database: "staging"}
+	parent := createVersion(branch.ID, req, hashQuery(query), nil, []models.ExplainResult{{Type: models.ExplainPlan, Output: "plan"}})
+	require.NoError(t, storage.SaveVersion(t.Context(), parent))
+	assert.Equal(t, "staging", parent.ExecutionStats.Database)
+
+	_, ok := checkCachedVersion(t.Context(), storage, parent.ID, hashQuery(query), nil, nil, "", "staging")
+	assert.True(t, ok, "same database reuses results")
+
+	_, ok = checkCachedVersion(t.Context(), storage, parent.ID, hashQuery(query), nil, nil, "", "production")
+	assert.False(t, ok, "other database re-executes")
+}
+
+func TestParseDefaultExplainConfigs(t *testing.T) {
+	t.Run("keeps builtin settings in given order", func(t *testing.T) {
+		configs, err := parseDefaultExplainConfigs("estimate, PLAN")
+		require.NoError(t, err)
+		require.Len(t, configs, 2)
+		assert.Equal(t, models.ExplainEstimate, configs[0].Type)
+		assert.Equal(t, models.ExplainPlan, configs[1].Type)
+		assert.True(t, configs[1].Enabled)
+		require.NotNil(t, configs[1].Settings.Indexes)
+		assert.Equal(t, 1, *configs[1].Settings.Indexes)
+	})
+
+	t.Run("multi-word and non-builtin types", func(t *testing.T) {
+		configs, err := parseDefaultExplainConfigs("query tree,TABLE OVERRIDE,PLAN,plan")
+		require.NoError(t, err)
+		require.Len(t, configs, 3)
+		assert.Equal(t, models.ExplainQueryTree, configs[0].Type)
+		assert.Equal(t, models.ExplainTableOverride, configs[1].Type)
+		assert.True(t, configs[1].Enabled)
+	})
+
+	t.Run("unknown type", func(t *testing.T) {
+		_, err := parseDefaultExplainConfigs("PLAN,PLAM")
+		assert.ErrorContains(t, err, "PLAM")
+	})
+
+	t.Run("empty list", func(t *testing.T) {
+		_, err := parseDefaultExplainConfigs(" , ")
+		assert.Error(t, err)
+	})
+}
+
+func TestBranchExplainDefaults(t *testing.T) {
+	storage := newTestStorage(t)
+	ctx := context.Background()
+
+	fallback := []models.ExplainConfig{{Type: models.ExplainPlan, Enabled: true}}
+	branch, err := storage.CreateBranch(ctx, "defaults", "", "")
+	require.NoError(t, err)
+
+	assert.Equal(t, fallback, branchExplainDefaults(ctx, storage, branch.ID, fallback))
+	assert.Equal(t, fallback, branchExplainDefaults(ctx, storage, "missing", fallback))
+
+	custom := []models.ExplainConfig{{Type: models.ExplainSyntax, Enabled: true}}
+	require.NoError(t, storage.SetBranchExplainConfigs(ctx, branch.ID, custom))
+	assert.Equal(t, custom, branchExplainDefaults(ctx, storage, branch.ID, fallback))
+}
+
+func TestMaxExecutionTimePrecedence(t *testing.T) {
+	storage := newTestStorage(t)
+	server := NewServer(storage, nil, nil)
+
+	heavy, err := storage.CreateBranch(t.Context(), "heavy", "", "")
+	require.NoError(t, err)
+	require.NoError(t, storage.SetBranchMaxExecutionTime(t.Context(), heavy.ID, 30000))
+	plain, err := storage.CreateBranch(t.Context(), "plain", "", "")
+	require.NoError(t, err)
+
+	tests := []struct {
+		name     string
+		branchID string
+		reqMs    int
+		want     int
+	}{
+		{name: "request overrides branch", branchID: heavy.ID, reqMs: 500, want: 500},
+		{name: "branch default", branchID: heavy.ID, want: 30000},
+		{name: "global default", branchID: plain.ID, want: DefaultMaxExecutionTimeMs},
+		{name: "unknown branch", branchID: "missing", want: DefaultMaxExecutionTimeMs},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := &ExplainRequest{BranchID: tt.branchID, MaxExecutionTimeMs: tt.reqMs}
+			opts := server.explainOptions(req, "hash", branchMaxExecutionTimeMs(t.Context(), storage, tt.branchID))
+			assert.Equal(t, tt.want, opts.MaxExecutionTimeMs)
+		})
+	}
+}
+
+func TestNormalizeExplainConfigs(t *testing.T) {
+	configs, err := normalizeExplainConfigs([]models.ExplainConfig{{Type: "query tree", Enabled: true}})
+	require.NoError(t, err)
+	assert.Equal(t, models.ExplainQueryTree, configs[0].Type)
+
+	_, err = normalizeExplainConfigs([]models.ExplainConfig{{Type: "PLAM"}})
+	assert.ErrorContains(t, err, "PLAM")
+}
+
+func TestCheckAutoBranchName(t *testing.T) {
+	storage := newTestStorage(t)
+	ctx := context.Background()
+
+	branch, err := storage.CreateBranch(t.Context(), "feature", "", "")
+	require.NoError(t, err)
+	first := saveTestVersion(t, storage, branch.ID, "", "SELECT 1")
+	head := saveTestVersion(t, storage, branch.ID, first.ID, "SELECT 2")
+
+	t.Run("head edit does not branch", func(t *testing.T) {
+		result, err := checkAutoBranch(ctx, storage, branch.ID, head.ID, "ignored")
+		require.NoError(t, err)
+		assert.False(t, result.AutoBranched)
+	})
+
+	t.Run("uses requested name", func(t *testing.T) {
+		result, err := checkAutoBranch(ctx, storage, branch.ID, first.ID, " try-prewhere ")
+		require.NoError(t, err)
+		require.True(t, result.AutoBranched)
+		assert.Equal(t, "try-prewhere", result.BranchName)
+		assert.Equal(t, "try-prewhere", result.NewBranch.Name)
+		assert.Equal(t, first.ID, result.NewBranch.BranchFromVersionID)
+	})
+
+	t.Run("falls back on collision", func(t *testing.T) {
+		result, err := checkAutoBranch(ctx, storage, branch.ID, first.ID, "feature")
+		require.NoError(t, err)
+		require.True(t, result.AutoBranched)
+		assert.True(t, strings.HasPrefix(result.BranchName, "branch-"), result.BranchName)
+	})
+
+	t.Run("generated name by default", func(t *testing.T) {
+		result, err := checkAutoBranch(ctx, storage, branch.ID, first.ID, "")
+		require.NoError(t, err)
+		assert.True(t, strings.HasPrefix(result.BranchName, "branch-"), result.BranchName)
+	})
+
+	t.Run("rejects parents of other branches", func(t *testing.T) {
+		other, err := storage.CreateBranch(t.Context(), "other", "", "")
+		require.NoError(t, err)
+		foreign := saveTestVersion(t, storage, other.ID, "", "SELECT 3")
+
+		_, err = checkAutoBranch(ctx, storage, branch.ID, foreign.ID, "")
+		assert.ErrorIs(t, err, ErrInvalidParentVersion)
+		_, err = checkAutoBranch(ctx, storage, branch.ID, "does-not-exist", "")
+		assert.ErrorIs(t, err, ErrInvalidParentVersion)
+	})
+}
+
+func TestFindReusableVersion(t *testing.T) {
+	storage := newTestStorage(t)
+
+	mainBranch, err := storage.CreateBranch(t.Context(), "main", "", "")
+	require.NoError(t, err)
+	other, err := storage.CreateBranch(t.Context(), "other", "", "")
+	require.NoError(t, err)
+
+	query := "SELECT count() FROM events"
+	queryHash := hashQuery(query)
+	configs := []models.ExplainConfig{{Type: models.ExplainPlan, Enabled: true}, {Type: models.ExplainAST, Enabled: true}}
+	opts := ExplainOptions{LogComment: buildLogComment(queryHash), MaxExecutionTimeMs: DefaultMaxExecutionTimeMs}
+
+	resultsFor := func(configs []models.ExplainConfig, opts ExplainOptions) []models.ExplainResult {
+		var results []models.ExplainResult
+		for _, config := range configs {
+			results = append(results, models.ExplainResult{
+				Type:          config.Type,
+				Output:        "output",
+				ExecutedQuery: config.BuildExplainQuery(query, opts.LogComment, opts.ForceAnalyzer, opts.MaxExecutionTimeMs, opts.CustomSettings),
+			})
+		}
+		return results
+	}
+
+	source := createVersion(other.ID, &ExplainRequest{Query: query}, queryHash, nil, resultsFor(configs, opts))
+	require.NoError(t, storage.SaveVersion(t.Context(), source))
+
+	t.Run("same configs on another branch", func(t *testing.T) {
+		got, ok := findReusableVersion(t.Context(), storage, queryHash, query, configs, opts, "", "")
+		require.True(t, ok)
+		assert.Equal(t, source.ID, got.ID)
+
+		borrowed := borrowVersion(mainBranch.ID, &ExplainRequest{Query: query}, got, nil, nil)
+		assert.Equal(t, mainBranch.ID, borrowed.BranchID)
+		assert.Equal(t, source.ID, borrowed.ExecutionStats.BorrowedFrom)
+		assert.Equal(t, source.ExplainResults, borrowed.ExplainResults)
+	})
+
+	t.Run("different config set", func(t *testing.T) {
+		_, ok := findReusableVersion(t.Context(), storage, queryHash, query, configs[:1], opts, "", "")
+		assert.False(t, ok)
+	})
+
+	t.Run("different settings", func(t *testing.T) {
+		withSettings := opts
+		withSettings.CustomSettings = map[string]string{"max_threads": "2"}
+		_, ok := findReusableVersion(t.Context(), storage, queryHash, query, configs, withSettings, "", "")
+		assert.False(t, ok)
+	})
+
+	t.Run("different profile", func(t *testing.T) {
+		_, ok := findReusableVersion(t.Context(), storage, queryHash, query, configs, opts, "prod", "")
+		assert.False(t, ok)
+	})
+
+	t.Run("errored results are not reused", func(t *testing.T) {
+		errQuery := "SELECT 2"
+		errHash := hashQuery(errQuery)
+		errOpts := ExplainOptions{LogComment: buildLogComment(errHash), MaxExecutionTimeMs: DefaultMaxExecutionTimeMs}
+		results := []models.ExplainResult{{
+			Type:          models.ExplainPlan,
+			Error:         "timeout",
+			ExecutedQuery: configs[0].BuildExplainQuery(errQuery, errOpts.LogComment, false, errOpts.MaxExecutionTimeMs, nil),
+		}}
+		require.NoError(t, storage.SaveVersion(t.Context(), createVersion(other.ID, &ExplainRequest{Query: errQuery}, errHash, nil, results)))
+
+		_, ok := findReusableVersion(t.Context(), storage, errHash, errQuery, configs[:1], errOpts, "", "")
+		assert.False(t, ok)
+	})
+}
+
+func TestApplyVersionTags(t *testing.T) {
+	storage := newTestStorage(t)
+
+	branch, err := storage.CreateBranch(t.Context(), "tags", "", "")
+	require.NoError(t, err)
+	version := saveTestVersion(t, storage, branch.ID, "", "SELECT 1")
+	_, err = storage.AddTag(t.Context(), version.ID, "existing")
+	require.NoError(t, err)
+
+	warnings := applyVersionTags(t.Context(), storage, version,
+		[]string{"optimized", "reviewer=alice", "optimized", "existing", "=nokey", "system:starred"})
+
+	require.Len(t, warnings, 2)
+	assert.Contains(t, warnings[0], `"=nokey"`)
+	assert.Contains(t, warnings[1], `"system:starred"`)
+
+	require.Len(t, version.Tags, 2, "only newly created tags are attached")
+	assert.Equal(t, "optimized", version.Tags[0].FormatTag())
+	assert.Equal(t, "reviewer=alice", version.Tags[1].FormatTag())
+
+	stored, err := storage.GetVersionTags(t.Context(), version.ID)
+	require.NoError(t, err)
+	assert.Len(t, stored, 3)
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+
+	"github.com/orian/clicktelligence/models"
+)
+
+// ExplainSingleRequest is the body of the single EXPLAIN endpoint: an
+// ExplainRequest whose one config is given inline instead of in
+// explainConfigs, so no defaults apply.
+type ExplainSingleRequest struct {
+	ExplainRequest
+	Type     models.ExplainType     `json:"type"`
+	Settings models.ExplainSettings `json:"settings"`
+}
+
+// ExplainSingleResponse holds the result of a single EXPLAIN.
+type ExplainSingleResponse struct {
+	Result models.ExplainResult `json:"result"`
+
+	// Version is the version the result was saved in, only set for
+	// ?save=true. It is the parent when the query was unchanged and the
+	// parent ran the same EXPLAIN.
+	Version *models.QueryVersion `json:"version,omitempty"`
+}
+
+// handleExplainSingle runs exactly the one EXPLAIN given in the body, for
+// quick inspections. Nothing is saved unless ?save=true, which saves a
+// version like the explain endpoint.
+func (s *Server) handleExplainSingle(w http.ResponseWriter, r *http.Request) {
+	var req ExplainSingleRequest
+	if err := s.decodeBody(w, r, &req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Type == "" {
+		http.Error(w, "type required", http.StatusBadRequest)
+		return
+	}
+	explainType, err := models.ParseExplainType(string(req.Type))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(req.ExplainConfigs) > 0 {
+		http.Error(w, "explainConfigs not supported, set type and settings instead", http.StatusBadRequest)
+		return
+	}
+	req.ExplainConfigs = []models.ExplainConfig{{
+		Type:     explainType,
+		Settings: req.Settings,
+		Enabled:  true,
+	}}
+
+	if err := checkQueryLength(req.Query, s.maxQueryLength); err != nil {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err := validateExplainRequest(&req.ExplainRequest, s.allowedStatements); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if _, err := s.connManager(req.Profile); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	response, err := s.runExplainSingle(r.Context(), &req.ExplainRequest, r.URL.Query().Get("save") == "true")
+	if errors.Is(err, ErrInvalidParentVersion) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if err != nil {
+		s.internalError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// runExplainSingle runs the one config of req, saving a version with
+// runExplain if save is set.
+func (s *Server) runExplainSingle(ctx context.Context, req *ExplainRequest, save bool) (*ExplainSingleResponse, error) {
+	var results []models.ExplainResult
+	var version *models.QueryVersion
+	if save {
+		response, err := s.runExplain(ctx, req, nil)
+		observeExplainRequest(response, err)
+		if err != nil {
+			return nil, err
+		}
+		version = response["version"].(*models.QueryVersion)
+		results = version.ExplainResults
+
+		// Reused results are those of another version's configs, which
+		// needn't include this one; without it, it runs as a new version.
+		if reused, _ := response["resultsReused"].(bool); reused {
+			result, ok := s.reusedResult(ctx, req, version)
+			if ok {
+				return &ExplainSingleResponse{Result: result, Version: version}, nil
+			}
+			req.ForceRefresh = true
+			return s.runExplainSingle(ctx, req, save)
+		}
+	} else {
+		configs, skipped := s.runnableConfigs(ctx, req, req.ExplainConfigs)
+		opts := s.explainOptions(req, hashQuery(req.Query), branchMaxExecutionTimeMs(ctx, s.storage, req.BranchID))
+		var err error
+		results, _, err = s.executeExplains(ctx, req, configs, skipped, opts, nil)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(results) == 0 {
+		return nil, fmt.Errorf("EXPLAIN %s returned no result", req.ExplainConfigs[0].Type)
+	}
+	return &ExplainSingleResponse{Result: results[0], Version: version}, nil
+}
+
+// reusedResult finds the result of req's one config among the results of a
+// version reused for it, by the EXPLAIN query it would run.
+func (s *Server) reusedResult(ctx context.Context, req *ExplainRequest, version *models.QueryVersion) (models.ExplainResult, bool) {
+	config := req.ExplainConfigs[0]
+	if config.BothFormats {
+		// The result holds the query of the text PLAN
+		config, _ = bothFormatsConfigs(config)
+	}
+	opts := s.explainOptions(req, hashQuery(req.Query), branchMaxExecutionTimeMs(ctx, s.storage, req.BranchID))
+	want := config.BuildExplainQuery(req.Query, opts.LogComment, opts.ForceAnalyzer, opts.MaxExecutionTimeMs, opts.CustomSettings)
+
+	i := slices.IndexFunc(version.ExplainResults, func(result models.ExplainResult) bool {
+		return result.Type == config.Type && result.ExecutedQuery == want
+	})
+	if i < 0 {
+		return models.ExplainResult{}, false
+	}
+	return version.ExplainResults[i], true
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/orian/clicktelligence/models"
+)
+
+func TestHandleExplainSingle(t *testing.T) {
+	storage := newTestStorage(t)
+	conn := NewConnManager(func() (driver.Conn, error) {
+		return &echoConn{versionConn{serverVersion: "25.3"}}, nil
+	}, 0)
+	server := NewServer(storage, map[string]*ConnManager{DefaultProfile: conn}, nil)
+
+	branch, err := storage.CreateBranch(t.Context(), "single", "", "")
+	require.NoError(t, err)
+
+	explain := func(target, body string) *httptest.ResponseRecorder {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		server.handleExplainSingle(rec, httptest.NewRequest(http.MethodPost, target, bytes.NewBufferString(body)))
+		return rec
+	}
+
+	body := `{"branchId": "` + branch.ID + `", "query": "SELECT 1", "type": "PLAN", "settings": {"indexes": 1}}`
+	rec := explain("/api/query/explain/single", body)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	var response ExplainSingleResponse
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&response))
+	assert.Equal(t, models.ExplainPlan, response.Result.Type)
+	assert.Contains(t, response.Result.Output, "EXPLAIN PLAN indexes=1 SELECT 1")
+	assert.Nil(t, response.Version)
+	history, err := storage.GetBranchHistory(t.Context(), branch.ID)
+	require.NoError(t, err)
+	assert.Empty(t, history)
+
+	rec = explain("/api/query/explain/single?save=true", body)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	response = ExplainSingleResponse{}
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&response))
+	require.NotNil(t, response.Version)
+	require.Len(t, response.Version.ExplainResults, 1)
+	assert.Contains(t, response.Result.Output, "EXPLAIN PLAN indexes=1 SELECT 1")
+	history, err = storage.GetBranchHistory(t.Context(), branch.ID)
+	require.NoError(t, err)
+	assert.Len(t, history, 1)
+
+	for name, body := range map[string]string{
+		"missing type": `{"branchId": "` + branch.ID + `", "query": "SELECT 1"}`,
+		"unknown type": `{"branchId": "` + branch.ID + `", "query": "SELECT 1", "type": "NOPE"}`,
+		"configs":      `{"branchId": "` + branch.ID + `", "query": "SELECT 1", "type": "AST", "explainConfigs": [{"type": "PLAN", "enabled": true}]}`,
+	} {
+		assert.Equal(t, http.StatusBadRequest, explain("/api/query/explain/single", body).Code, name)
+	}
+}
+
+func TestHandleExplainSingleUnchangedParent(t *testing.T) {
+	storage := newTestStorage(t)
+	conn := NewConnManager(func() (driver.Conn, error) {
+		return &echoConn{versionConn{serverVersion: "25.3"}}, nil
+	}, 0)
+	server := NewServer(storage, map[string]*ConnManager{DefaultProfile: conn}, nil)
+
+	branch, err := storage.CreateBranch(t.Context(), "single", "", "")
+	require.NoError(t, err)
+	parent, err := server.runExplain(t.Context(), &ExplainRequest{
+		BranchID: branch.ID,
+		Query:    "SELECT 1",
+		ExplainConfigs: []models.ExplainConfig{
+			{Type: models.ExplainAST, Enabled: true},
+			{Type: models.ExplainPlan, Enabled: true},
+			{Type: models.ExplainSyntax, Enabled: true},
+		},
+	}, nil)
+	require.NoError(t, err)
+	parentID := parent["version"].(*models.QueryVersion).ID
+
+	explain := func(explainType string) ExplainSingleResponse {
+		t.Helper()
+		body := `{"branchId": "` + branch.ID + `", "parentVersionId": "` + parentID + `", "query": "SELECT 1", "type": "` + explainType + `"}`
+		rec := httptest.NewRecorder()
+		server.handleExplainSingle(rec, httptest.NewRequest(http.MethodPost, "/api/query/explain/single?save=true", bytes.NewBufferString(body)))
+		require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+		var response ExplainSingleResponse
+		require.NoError(t, json.NewDecoder(rec.Body).Decode(&response))
+		return response
+	}
+
+	// The parent ran PLAN, so its result is returned without a new version
+	response := explain("PLAN")
+	assert.Equal(t, models.ExplainPlan, response.Result.Type)
+	assert.Contains(t, response.Result.Output, "EXPLAIN PLAN SELECT 1")
+	assert.Equal(t, parentID, response.Version.ID)
+
+	// The parent didn't run PIPELINE, so it runs as a new version
+	response = explain("PIPELINE")
+	assert.Equal(t, models.ExplainPipeline, response.Result.Type)
+	assert.Contains(t, response.Result.Output, "EXPLAIN PIPELINE SELECT 1")
+	assert.NotEqual(t, parentID, response.Version.ID)
+	history, err := storage.GetBranchHistory(t.Context(), branch.ID)
+	require.NoError(t, err)
+	assert.Len(t, history, 2)
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/orian/clicktelligence/models"
+)
+
+// handleExplainStream runs an explain request and reports progress as
+// Server-Sent Events. The ExplainRequest is passed JSON-encoded in the
+// "request" query parameter since EventSource only supports GET.
+//
+// Events:
+//   - result: one per EXPLAIN, with the ExplainResult, as it completes
+//   - done: the explain response with the saved version
+//   - error: {"error": "..."} if the request fails
+//
+// When the client disconnects the request context is canceled, which
+// aborts the in-flight ClickHouse queries and skips saving the version.
+func (s *Server) handleExplainStream(w http.ResponseWriter, r *http.Request) {
+	var req ExplainRequest
+	if err := decodeStrictJSON(strings.NewReader(r.URL.Query().Get("request")), &req); err != nil {
+		http.Error(w, fmt.Sprintf("invalid request parameter: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	if err := checkQueryLength(req.Query, s.maxQueryLength); err != nil {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	if err := validateExplainRequest(&req, s.allowedStatements); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if _, err := s.connManager(req.Profile); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	response, err := s.runExplain(r.Context(), &req, func(result models.ExplainResult) {
+		if err := writeSSE(w, "result", result); err != nil {
+			slog.WarnContext(r.Context(), "Failed to write explain stream event", "error", err)
+			return
+		}
+		flusher.Flush()
+	})
+	observeExplainRequest(response, err)
+	if err != nil {
+		if r.Context().Err() != nil {
+			slog.InfoContext(r.Context(), "Explain stream client disconnected", "error", err)
+			return
+		}
+		slog.ErrorContext(r.Context(), "Explain stream failed", "error", err)
+		writeSSE(w, "error", map[string]string{"error": s.errorMessage(err)})
+		flusher.Flush()
+		return
+	}
+
+	writeSSE(w, "done", response)
+	flusher.Flush()
+}
+
+// writeSSE writes a single Server-Sent Event with a JSON-encoded payload.
+func writeSSE(w http.ResponseWriter, event string, payload interface{}) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, data)
+	return err
+}
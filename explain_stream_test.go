@@ -0,0 +1,43 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/orian/clicktelligence/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteSSE(t *testing.T) {
+	rec := httptest.NewRecorder()
+
+	err := writeSSE(rec, "result", models.ExplainResult{Type: models.ExplainAST, Output: "line1\nline2"})
+	assert.NoError(t, err)
+
+	// Newlines inside the payload are JSON-escaped, so the event stays on one data line
+	assert.Equal(t, "event: result\ndata: {\"type\":\"AST\",\"output\":\"line1\\nline2\"}\n\n", rec.Body.String())
+}
+
+func TestHandleExplainStreamBadRequest(t *testing.T) {
+	server := NewServer(newTestStorage(t), nil, nil)
+
+	tests := []struct {
+		name string
+		url  string
+	}{
+		{name: "missing request", url: "/api/query/explain/stream"},
+		{name: "malformed json", url: "/api/query/explain/stream?request=%7Bnope"},
+		{name: "non-select statement", url: "/api/query/explain/stream?request=%7B%22query%22%3A%22DROP%20TABLE%20t%22%7D"},
+		{name: "blank query", url: "/api/query/explain/stream?request=%7B%22query%22%3A%22%20%5Cn%22%7D"},
+		{name: "invalid custom setting", url: `/api/query/explain/stream?request=%7B%22query%22%3A%22SELECT%201%22%2C%22customSettings%22%3A%7B%22a%20b%22%3A%221%22%7D%7D`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			server.handleExplainStream(rec, httptest.NewRequest(http.MethodGet, tt.url, nil))
+			assert.Equal(t, http.StatusBadRequest, rec.Code)
+		})
+	}
+}
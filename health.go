@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net/http"
+	"time"
+)
+
+// DependencyStatus reports the health of a single dependency.
+type DependencyStatus struct {
+	Healthy bool   `json:"healthy"`
+	Error   string `json:"error,omitempty"`
+}
+
+// HealthReport is the JSON body returned by the health endpoint.
+type HealthReport struct {
+	Healthy      bool                        `json:"healthy"`
+	Dependencies map[string]DependencyStatus `json:"dependencies"`
+	Timestamp    int64                       `json:"timestamp"`
+}
+
+// newDependencyStatus converts a check error into a DependencyStatus.
+func newDependencyStatus(err error) DependencyStatus {
+	if err != nil {
+		return DependencyStatus{Healthy: false, Error: err.Error()}
+	}
+	return DependencyStatus{Healthy: true}
+}
+
+// buildHealthReport combines dependency check results into a report and
+// the HTTP status to respond with: 200 when all checks are healthy, 503
+// otherwise. The informational checks are reported too but don't affect
+// the overall health.
+func buildHealthReport(checks, informational map[string]error) (*HealthReport, int) {
+	report := &HealthReport{
+		Healthy:      true,
+		Dependencies: make(map[string]DependencyStatus, len(checks)+len(informational)),
+		Timestamp:    time.Now().Unix(),
+	}
+
+	for name, err := range informational {
+		report.Dependencies[name] = newDependencyStatus(err)
+	}
+	for name, err := range checks {
+		status := newDependencyStatus(err)
+		report.Dependencies[name] = status
+		if !status.Healthy {
+			report.Healthy = false
+		}
+	}
+
+	if !report.Healthy {
+		return report, http.StatusServiceUnavailable
+	}
+	return report, http.StatusOK
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBuildHealthReport(t *testing.T) {
+	tests := []struct {
+		name        string
+		checks      map[string]error
+		info        map[string]error
+		wantStatus  int
+		wantHealthy bool
+	}{
+		{
+			name:        "all healthy",
+			checks:      map[string]error{"clickhouse": nil, "duckdb": nil},
+			wantStatus:  http.StatusOK,
+			wantHealthy: true,
+		},
+		{
+			name:        "clickhouse down",
+			checks:      map[string]error{"clickhouse": errors.New("connection refused"), "duckdb": nil},
+			wantStatus:  http.StatusServiceUnavailable,
+			wantHealthy: false,
+		},
+		{
+			name:        "duckdb down",
+			checks:      map[string]error{"clickhouse": nil, "duckdb": errors.New("database is locked")},
+			wantStatus:  http.StatusServiceUnavailable,
+			wantHealthy: false,
+		},
+		{
+			name:        "other profile down",
+			checks:      map[string]error{"clickhouse": nil, "duckdb": nil},
+			info:        map[string]error{"clickhouse:staging": errors.New("connection refused")},
+			wantStatus:  http.StatusOK,
+			wantHealthy: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			report, status := buildHealthReport(tt.checks, tt.info)
+			assert.Equal(t, tt.wantStatus, status)
+			assert.Equal(t, tt.wantHealthy, report.Healthy)
+			assert.Len(t, report.Dependencies, len(tt.checks)+len(tt.info))
+			for _, checks := range []map[string]error{tt.checks, tt.info} {
+				for name, err := range checks {
+					dep := report.Dependencies[name]
+					assert.Equal(t, err == nil, dep.Healthy)
+					if err != nil {
+						assert.Equal(t, err.Error(), dep.Error)
+					}
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/orian/clicktelligence/models"
+)
+
+// historyCSVHeader names the columns of historyCSVRow.
+var historyCSVHeader = []string{"version_id", "timestamp", "query_hash", "estimated_rows", "estimated_marks", "explain_duration_ms"}
+
+// historyCSVRow formats a version for the history CSV export. The estimate
+// cells are empty without a successful ESTIMATE result, the duration cell
+// without query_log stats.
+func historyCSVRow(version *models.QueryVersion) []string {
+	row := []string{version.ID, version.Timestamp.UTC().Format(time.RFC3339), version.QueryHash, "", "", ""}
+
+	i := slices.IndexFunc(version.ExplainResults, func(result models.ExplainResult) bool {
+		return result.Type == models.ExplainEstimate && result.Error == "" && !result.Skipped
+	})
+	if i >= 0 {
+		total := models.SumEstimate(version.ExplainResults[i].Estimate)
+		row[3] = strconv.FormatUint(total.Rows, 10)
+		row[4] = strconv.FormatUint(total.Marks, 10)
+	}
+	if ms, ok := version.ExecutionStats.TotalQueryDurationMs(); ok {
+		row[5] = strconv.FormatInt(ms, 10)
+	}
+	return row
+}
+
+// handleGetHistoryCSV streams a branch's versions, oldest first, as CSV
+// for spreadsheets: their estimate totals and EXPLAIN durations.
+func (s *Server) handleGetHistoryCSV(w http.ResponseWriter, r *http.Request) {
+	branchID := chi.URLParam(r, "branchId")
+
+	if _, exists := s.storage.GetBranch(r.Context(), branchID); !exists {
+		err := fmt.Errorf("%w: %s", ErrBranchNotFound, branchID)
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	history, err := s.storage.GetBranchHistory(r.Context(), branchID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", "history-"+branchID+".csv"))
+
+	cw := csv.NewWriter(w)
+	err = cw.Write(historyCSVHeader)
+	for _, version := range slices.Backward(history) {
+		if err != nil {
+			break
+		}
+		err = cw.Write(historyCSVRow(version))
+	}
+	cw.Flush()
+	if err = errors.Join(err, cw.Error()); err != nil {
+		// The status is already sent; the client sees a truncated file.
+		slog.WarnContext(r.Context(), "Failed to write history CSV", "branch_id", branchID, "error", err)
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/orian/clicktelligence/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandleGetHistoryCSV(t *testing.T) {
+	storage := newTestStorage(t)
+	server := NewServer(storage, nil, nil)
+
+	branch, err := storage.CreateBranch(t.Context(), "csv", "", "")
+	require.NoError(t, err)
+	first := saveTestVersion(t, storage, branch.ID, "", "SELECT 1")
+	req := &ExplainRequest{Query: "SELECT 2", ParentVersionID: first.ID}
+	second := createVersion(branch.ID, req, hashQuery(req.Query), nil, []models.ExplainResult{
+		{Type: models.ExplainEstimate, Estimate: []models.EstimateRow{{Rows: 100, Marks: 3}, {Rows: 20, Marks: 1}}},
+	})
+	second.ExecutionStats.QueryLog = map[models.ExplainType]models.QueryLogStats{
+		models.ExplainPlan:     {QueryDurationMs: 4},
+		models.ExplainEstimate: {QueryDurationMs: 6},
+	}
+	require.NoError(t, storage.SaveVersion(t.Context(), second))
+
+	get := func(branchID string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/api/branches/"+branchID+"/history.csv", nil)
+		rctx := chi.NewRouteContext()
+		rctx.URLParams.Add("branchId", branchID)
+		req = req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, rctx))
+		rec := httptest.NewRecorder()
+		server.handleGetHistoryCSV(rec, req)
+		return rec
+	}
+
+	rec := get(branch.ID)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	assert.Equal(t, "text/csv; charset=utf-8", rec.Header().Get("Content-Type"))
+	assert.Contains(t, rec.Header().Get("Content-Disposition"), "attachment")
+
+	records, err := csv.NewReader(rec.Body).ReadAll()
+	require.NoError(t, err)
+	require.Len(t, records, 3)
+	assert.Equal(t, historyCSVHeader, records[0])
+	assert.Equal(t, []string{first.ID, first.QueryHash, "", "", ""}, append(records[1][:1:1], records[1][2:]...))
+	assert.Equal(t, []string{second.ID, second.QueryHash, "120", "4", "10"}, append(records[2][:1:1], records[2][2:]...))
+
+	assert.Equal(t, http.StatusNotFound, get("missing").Code)
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+)
+
+// IdempotencyKeyHeader lets clients retry an explain request without
+// creating a second version.
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+// DefaultIdempotencyWindow is how long a completed request can be replayed
+// by its idempotency key.
+const DefaultIdempotencyWindow = 5 * time.Minute
+
+// errIdempotencyKeyReused is returned when a key is sent again with a
+// different request.
+var errIdempotencyKeyReused = errors.New("idempotency key was already used for a different request")
+
+// idempotencyCache remembers the responses of recent requests by their
+// idempotency key. A request arriving while the first one with its key is
+// still running waits for it rather than running again.
+type idempotencyCache struct {
+	window time.Duration
+	now    func() time.Time
+
+	mu      sync.Mutex
+	entries map[string]*idempotencyEntry
+}
+
+type idempotencyEntry struct {
+	fingerprint string
+
+	// done is closed once the first request finished; response is nil if
+	// it failed. expires is zero while it runs.
+	done     chan struct{}
+	response map[string]interface{}
+	expires  time.Time
+}
+
+func newIdempotencyCache(window time.Duration) *idempotencyCache {
+	return &idempotencyCache{
+		window:  window,
+		now:     time.Now,
+		entries: make(map[string]*idempotencyEntry),
+	}
+}
+
+// requestFingerprint identifies a request body, so a key reused for a
+// different request can be told apart from a retry.
+func requestFingerprint(req any) string {
+	data, _ := json.Marshal(req)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// do runs run once per key within the window and returns its response,
+// with replayed set when the response is one of an earlier request. Failed
+// runs aren't remembered, so a retry after an error runs again.
+func (c *idempotencyCache) do(ctx context.Context, key, fingerprint string, run func() (map[string]interface{}, error)) (map[string]interface{}, bool, error) {
+	for {
+		c.mu.Lock()
+		c.sweepLocked()
+		entry, ok := c.entries[key]
+		if !ok {
+			entry = &idempotencyEntry{fingerprint: fingerprint, done: make(chan struct{})}
+			c.entries[key] = entry
+			c.mu.Unlock()
+
+			response, err := run()
+
+			c.mu.Lock()
+			if err != nil {
+				if c.entries[key] == entry {
+					delete(c.entries, key)
+				}
+			} else {
+				entry.response = response
+				entry.expires = c.now().Add(c.window)
+			}
+			close(entry.done)
+			c.mu.Unlock()
+			return response, false, err
+		}
+		c.mu.Unlock()
+
+		if entry.fingerprint != fingerprint {
+			return nil, false, errIdempotencyKeyReused
+		}
+
+		select {
+		case <-entry.done:
+		case <-ctx.Done():
+			return nil, false, ctx.Err()
+		}
+		if entry.response != nil {
+			return entry.response, true, nil
+		}
+		// The first request failed and was forgotten; run this one
+	}
+}
+
+// sweepLocked drops expired entries. Callers hold mu.
+func (c *idempotencyCache) sweepLocked() {
+	now := c.now()
+	for key, entry := range c.entries {
+		if !entry.expires.IsZero() && now.After(entry.expires) {
+			delete(c.entries, key)
+		}
+	}
+}
+
+// clear forgets every response, e.g. after the versions they refer to
+// were deleted. Requests in flight finish but aren't remembered.
+func (c *idempotencyCache) clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	clear(c.entries)
+}
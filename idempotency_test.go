@@ -0,0 +1,101 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIdempotencyCacheReplay(t *testing.T) {
+	cache := newIdempotencyCache(time.Minute)
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	cache.now = func() time.Time { return now }
+
+	calls := 0
+	run := func() (map[string]interface{}, error) {
+		calls++
+		return map[string]interface{}{"call": calls}, nil
+	}
+
+	first, replayed, err := cache.do(t.Context(), "key", "fp", run)
+	require.NoError(t, err)
+	assert.False(t, replayed)
+
+	second, replayed, err := cache.do(t.Context(), "key", "fp", run)
+	require.NoError(t, err)
+	assert.True(t, replayed)
+	assert.Equal(t, first, second)
+	assert.Equal(t, 1, calls)
+
+	_, _, err = cache.do(t.Context(), "key", "other", run)
+	assert.ErrorIs(t, err, errIdempotencyKeyReused)
+
+	now = now.Add(2 * time.Minute)
+	third, replayed, err := cache.do(t.Context(), "key", "other", run)
+	require.NoError(t, err)
+	assert.False(t, replayed)
+	assert.Equal(t, 2, third["call"])
+}
+
+func TestIdempotencyCacheFailedRun(t *testing.T) {
+	cache := newIdempotencyCache(time.Minute)
+
+	_, _, err := cache.do(t.Context(), "key", "fp", func() (map[string]interface{}, error) {
+		return nil, errors.New("boom")
+	})
+	require.Error(t, err)
+
+	response, replayed, err := cache.do(t.Context(), "key", "fp", func() (map[string]interface{}, error) {
+		return map[string]interface{}{"ok": true}, nil
+	})
+	require.NoError(t, err)
+	assert.False(t, replayed)
+	assert.Equal(t, true, response["ok"])
+}
+
+func TestIdempotencyCacheConcurrent(t *testing.T) {
+	cache := newIdempotencyCache(time.Minute)
+
+	var calls atomic.Int32
+	release := make(chan struct{})
+	run := func() (map[string]interface{}, error) {
+		calls.Add(1)
+		<-release
+		return map[string]interface{}{"ok": true}, nil
+	}
+
+	var wg sync.WaitGroup
+	replays := make([]bool, 5)
+	for i := range replays {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, replayed, err := cache.do(t.Context(), "key", "fp", run)
+			assert.NoError(t, err)
+			replays[i] = replayed
+		}()
+	}
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	assert.Equal(t, int32(1), calls.Load())
+	replayed := 0
+	for _, r := range replays {
+		if r {
+			replayed++
+		}
+	}
+	assert.Equal(t, 4, replayed)
+}
+
+func TestRequestFingerprint(t *testing.T) {
+	a := requestFingerprint(&ExplainRequest{BranchID: "b", Query: "SELECT 1"})
+	assert.Equal(t, a, requestFingerprint(&ExplainRequest{BranchID: "b", Query: "SELECT 1"}))
+	assert.NotEqual(t, a, requestFingerprint(&ExplainRequest{BranchID: "b", Query: "SELECT 2"}))
+}
@@ -3,13 +3,22 @@ package main
 import (
 	"context"
 	"crypto/sha256"
-	"crypto/tls"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"log"
+	"log/slog"
+	"maps"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"slices"
+	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/ClickHouse/clickhouse-go/v2"
@@ -18,23 +27,109 @@ import (
 	"github.com/go-chi/chi/v5/middleware"
 	"github.com/google/uuid"
 	"github.com/orian/clicktelligence/models"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 // Server handles HTTP requests and coordinates between ClickHouse and storage.
 type Server struct {
 	storage models.Storage
-	chConn  driver.Conn
+
+	// conns holds a ClickHouse connection per profile name; profiles holds
+	// the settings they were opened with.
+	conns    map[string]*ConnManager
+	profiles map[string]ConnProfile
+
+	// readConns holds the read replica connection of the profiles that
+	// have one; EXPLAINs of other profiles use conns.
+	readConns map[string]*ConnManager
+
+	// allowedStatements lists the statement kinds accepted for EXPLAIN.
+	allowedStatements []string
+
+	// retryPolicy controls retries of EXPLAIN queries on transient errors.
+	retryPolicy RetryPolicy
+
+	// defaultExplainConfigs run when a request doesn't specify any.
+	defaultExplainConfigs []models.ExplainConfig
+
+	// maxOutputBytes caps the stored size of each EXPLAIN output.
+	maxOutputBytes int
+
+	// maxBodyBytes caps the size of JSON request bodies.
+	maxBodyBytes int64
+
+	// maxQueryLength caps the size of explained and initial branch
+	// queries; 0 disables it.
+	maxQueryLength int
+
+	// now returns the current time reported to clients; time.Now outside
+	// of tests.
+	now func() time.Time
+
+	// idempotency replays explain responses by Idempotency-Key; nil
+	// disables it.
+	idempotency *idempotencyCache
+
+	// settingsCache holds fetched server settings; nil disables caching.
+	settingsCache *serverSettingsCache
+
+	// sanitizeErrors replaces ClickHouse error messages shown to clients
+	// with sanitizeError's summaries; the full errors are logged.
+	sanitizeErrors bool
+
+	// adminToken guards the /api/admin endpoints; empty disables them.
+	adminToken string
+
+	// allowReset enables POST /api/admin/reset, see handleReset.
+	allowReset bool
+
+	// estimateRegressionPercent is the growth of estimated rows over the
+	// parent version reported as a regression; negative disables the
+	// check, see estimateRegression.
+	estimateRegressionPercent int
 }
 
-func NewServer(storage models.Storage, chConn driver.Conn) *Server {
+// ServerTimeHeader carries the server's current time on responses that
+// can't hold a serverTime field, such as JSON arrays.
+const ServerTimeHeader = "X-Server-Time"
+
+func NewServer(storage models.Storage, conns map[string]*ConnManager, profiles map[string]ConnProfile) *Server {
 	return &Server{
-		storage: storage,
-		chConn:  chConn,
+		storage:                   storage,
+		conns:                     conns,
+		profiles:                  profiles,
+		allowedStatements:         DefaultAllowedStatements,
+		retryPolicy:               RetryPolicy{MaxRetries: DefaultRetryMaxAttempts, BaseDelay: DefaultRetryBaseDelay},
+		defaultExplainConfigs:     models.GetDefaultExplainConfigs(),
+		maxOutputBytes:            DefaultMaxExplainOutputBytes,
+		maxBodyBytes:              DefaultMaxRequestBodyBytes,
+		maxQueryLength:            DefaultMaxQueryLength,
+		now:                       time.Now,
+		idempotency:               newIdempotencyCache(DefaultIdempotencyWindow),
+		settingsCache:             newServerSettingsCache(DefaultServerSettingsTTL),
+		estimateRegressionPercent: DefaultEstimateRegressionPercent,
 	}
 }
 
+// handleGetBranches lists branches with a weak ETag derived from the
+// storage digest, answering 304 Not Modified to a matching If-None-Match so
+// pollers skip loading and sending an unchanged list.
 func (s *Server) handleGetBranches(w http.ResponseWriter, r *http.Request) {
-	branches, err := s.storage.GetBranches()
+	includeArchived := r.URL.Query().Get("includeArchived") == "true"
+
+	digest, err := s.storage.GetBranchesDigest(r.Context(), includeArchived)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	etag := fmt.Sprintf(`W/"%s-%t"`, digest, includeArchived)
+	w.Header().Set("ETag", etag)
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	branches, err := s.storage.GetBranches(r.Context(), includeArchived)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -43,20 +138,56 @@ func (s *Server) handleGetBranches(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(branches)
 }
 
+// etagMatches reports whether an If-None-Match header lists etag, using the
+// weak comparison of RFC 9110: W/ prefixes are ignored.
+func etagMatches(ifNoneMatch, etag string) bool {
+	if strings.TrimSpace(ifNoneMatch) == "*" {
+		return true
+	}
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		if strings.TrimPrefix(strings.TrimSpace(candidate), "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Server) handleGetBranchTree(w http.ResponseWriter, r *http.Request) {
+	branches, err := s.storage.GetBranches(r.Context(), false)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(buildBranchTree(branches))
+}
+
 func (s *Server) handleCreateBranch(w http.ResponseWriter, r *http.Request) {
 	var req struct {
-		Name                string `json:"name"`
-		ParentBranchID      string `json:"parentBranchId"`
-		BranchFromVersionID string `json:"branchFromVersionId,omitempty"`
-		InitialQuery        string `json:"initialQuery,omitempty"`
-		CreateInitialVer    bool   `json:"createInitialVersion,omitempty"`
+		Name                string  `json:"name"`
+		ParentBranchID      string  `json:"parentBranchId"`
+		BranchFromVersionID string  `json:"branchFromVersionId,omitempty"`
+		InitialQuery        *string `json:"initialQuery,omitempty"`
+		CreateInitialVer    bool    `json:"createInitialVersion,omitempty"`
 	}
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+	if err := s.decodeBody(w, r, &req); err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	// An omitted initialQuery gets a placeholder; an explicit blank one is
+	// a mistake rather than a request for an empty version.
+	if req.CreateInitialVer && req.InitialQuery != nil && strings.TrimSpace(*req.InitialQuery) == "" {
+		http.Error(w, fmt.Sprintf("initialQuery: %v", ErrEmptyQuery), http.StatusBadRequest)
+		return
+	}
+	if req.InitialQuery != nil {
+		if err := checkQueryLength(*req.InitialQuery, s.maxQueryLength); err != nil {
+			http.Error(w, fmt.Sprintf("initialQuery: %v", err), http.StatusRequestEntityTooLarge)
+			return
+		}
+	}
 
-	branch, err := s.storage.CreateBranch(req.Name, req.ParentBranchID, req.BranchFromVersionID)
+	branch, err := s.storage.CreateBranch(r.Context(), req.Name, req.ParentBranchID, req.BranchFromVersionID)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -64,9 +195,9 @@ func (s *Server) handleCreateBranch(w http.ResponseWriter, r *http.Request) {
 
 	// Create initial version if requested
 	if req.CreateInitialVer {
-		placeholderQuery := req.InitialQuery
-		if placeholderQuery == "" {
-			placeholderQuery = "-- New query branch\n-- Start writing your ClickHouse query here\n\nSELECT 1"
+		placeholderQuery := "-- New query branch\n-- Start writing your ClickHouse query here\n\nSELECT 1"
+		if req.InitialQuery != nil {
+			placeholderQuery = *req.InitialQuery
 		}
 
 		// Create a placeholder version
@@ -77,11 +208,10 @@ func (s *Server) handleCreateBranch(w http.ResponseWriter, r *http.Request) {
 			Query:          placeholderQuery,
 			QueryHash:      queryHash,
 			ExplainResults: []models.ExplainResult{},
-			ExecutionStats: make(map[string]interface{}),
 			Timestamp:      time.Now(),
 		}
 
-		if err := s.storage.SaveVersion(version); err != nil {
+		if err := s.storage.SaveVersion(r.Context(), version); err != nil {
 			log.Printf("Warning: failed to create initial version: %v", err)
 		} else {
 			log.Printf("Created initial version for new tree branch '%s'", branch.Name)
@@ -92,154 +222,1247 @@ func (s *Server) handleCreateBranch(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(branch)
 }
 
-// Default max execution time for EXPLAIN queries (in milliseconds)
-const DefaultMaxExecutionTimeMs = 1345 // 1.345 seconds
+func (s *Server) handleCompareBranches(w http.ResponseWriter, r *http.Request) {
+	ids := parseIDList(r.URL.Query().Get("ids"))
+	if len(ids) == 0 {
+		http.Error(w, "ids required", http.StatusBadRequest)
+		return
+	}
 
-func (s *Server) handleExplainQuery(w http.ResponseWriter, r *http.Request) {
-	// 1. Parse request
-	var req ExplainRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+	comparisons, err := compareBranches(r.Context(), s.storage, ids)
+	if errors.Is(err, ErrBranchNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(comparisons)
+}
+
+func (s *Server) handlePinBranch(w http.ResponseWriter, r *http.Request) {
+	branchID := chi.URLParam(r, "branchId")
+
+	// An explicit {"pinned": bool} sets the flag; an empty body toggles it
+	var req struct {
+		Pinned *bool `json:"pinned"`
+	}
+	if err := s.decodeBody(w, r, &req); err != nil && !errors.Is(err, io.EOF) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	pinned := false
+	if req.Pinned != nil {
+		pinned = *req.Pinned
+	} else {
+		branch, exists := s.storage.GetBranch(r.Context(), branchID)
+		if !exists {
+			http.Error(w, ErrBranchNotFound.Error(), http.StatusNotFound)
+			return
+		}
+		pinned = !branch.Pinned
+	}
+
+	if err := s.storage.SetBranchPinned(r.Context(), branchID, pinned); errors.Is(err, ErrBranchNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]bool{"pinned": pinned})
+}
+
+func (s *Server) handleArchiveBranch(w http.ResponseWriter, r *http.Request) {
+	branchID := chi.URLParam(r, "branchId")
+
+	// An explicit {"archived": bool} sets the flag; an empty body toggles it
+	var req struct {
+		Archived *bool `json:"archived"`
+	}
+	if err := s.decodeBody(w, r, &req); err != nil && !errors.Is(err, io.EOF) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	archived := false
+	if req.Archived != nil {
+		archived = *req.Archived
+	} else {
+		branch, exists := s.storage.GetBranch(r.Context(), branchID)
+		if !exists {
+			http.Error(w, ErrBranchNotFound.Error(), http.StatusNotFound)
+			return
+		}
+		archived = !branch.Archived
+	}
+
+	if err := s.storage.ArchiveBranch(r.Context(), branchID, archived); errors.Is(err, ErrBranchNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]bool{"archived": archived})
+}
+
+// branchExplainConfigs is the body of the branch explain-configs endpoints.
+// Custom is false when the branch uses the server-wide defaults.
+type branchExplainConfigs struct {
+	ExplainConfigs []models.ExplainConfig `json:"explainConfigs"`
+	Custom         bool                   `json:"custom"`
+}
+
+func (s *Server) handleGetBranchExplainConfigs(w http.ResponseWriter, r *http.Request) {
+	branchID := chi.URLParam(r, "branchId")
+
+	branch, exists := s.storage.GetBranch(r.Context(), branchID)
+	if !exists {
+		http.Error(w, fmt.Sprintf("%v: %s", ErrBranchNotFound, branchID), http.StatusNotFound)
+		return
+	}
+
+	response := branchExplainConfigs{ExplainConfigs: s.defaultExplainConfigs}
+	if len(branch.DefaultExplainConfigs) > 0 {
+		response = branchExplainConfigs{ExplainConfigs: branch.DefaultExplainConfigs, Custom: true}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// handleSetBranchExplainConfigs replaces the branch's default EXPLAIN
+// configs. An empty or missing list reverts to the server-wide defaults.
+func (s *Server) handleSetBranchExplainConfigs(w http.ResponseWriter, r *http.Request) {
+	branchID := chi.URLParam(r, "branchId")
+
+	var req struct {
+		ExplainConfigs []models.ExplainConfig `json:"explainConfigs"`
+	}
+	if err := s.decodeBody(w, r, &req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	configs, err := normalizeExplainConfigs(req.ExplainConfigs)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = s.storage.SetBranchExplainConfigs(r.Context(), branchID, configs)
+	if errors.Is(err, ErrBranchNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	response := branchExplainConfigs{ExplainConfigs: s.defaultExplainConfigs}
+	if len(configs) > 0 {
+		response = branchExplainConfigs{ExplainConfigs: configs, Custom: true}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// branchSettings is the body of the branch settings endpoints.
+// DefaultMaxExecutionTimeMs is 0 in requests to revert to the server-wide
+// default, and the effective value in responses. Custom is false when the
+// branch uses the server-wide default.
+type branchSettings struct {
+	DefaultMaxExecutionTimeMs int  `json:"defaultMaxExecutionTimeMs"`
+	Custom                    bool `json:"custom"`
+}
+
+func newBranchSettings(maxExecutionTimeMs int) branchSettings {
+	if maxExecutionTimeMs > 0 {
+		return branchSettings{DefaultMaxExecutionTimeMs: maxExecutionTimeMs, Custom: true}
+	}
+	return branchSettings{DefaultMaxExecutionTimeMs: DefaultMaxExecutionTimeMs}
+}
+
+func (s *Server) handleGetBranchSettings(w http.ResponseWriter, r *http.Request) {
+	branchID := chi.URLParam(r, "branchId")
+
+	branch, exists := s.storage.GetBranch(r.Context(), branchID)
+	if !exists {
+		http.Error(w, fmt.Sprintf("%v: %s", ErrBranchNotFound, branchID), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(newBranchSettings(branch.DefaultMaxExecutionTimeMs))
+}
+
+// handleSetBranchSettings replaces the branch's settings. A missing or 0
+// defaultMaxExecutionTimeMs reverts to the server-wide default.
+func (s *Server) handleSetBranchSettings(w http.ResponseWriter, r *http.Request) {
+	branchID := chi.URLParam(r, "branchId")
+
+	var req branchSettings
+	if err := s.decodeBody(w, r, &req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.DefaultMaxExecutionTimeMs < 0 {
+		http.Error(w, "defaultMaxExecutionTimeMs must not be negative", http.StatusBadRequest)
+		return
+	}
+
+	err := s.storage.SetBranchMaxExecutionTime(r.Context(), branchID, req.DefaultMaxExecutionTimeMs)
+	if errors.Is(err, ErrBranchNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(newBranchSettings(req.DefaultMaxExecutionTimeMs))
+}
+
+func (s *Server) handleCherryPick(w http.ResponseWriter, r *http.Request) {
+	branchID := chi.URLParam(r, "branchId")
+
+	var req struct {
+		VersionID string `json:"versionId"`
+	}
+	if err := s.decodeBody(w, r, &req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.VersionID == "" {
+		http.Error(w, "versionId required", http.StatusBadRequest)
+		return
+	}
+
+	version, err := cherryPickVersion(r.Context(), s.storage, branchID, req.VersionID)
+	if errors.Is(err, ErrBranchNotFound) || errors.Is(err, ErrVersionNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(version)
+}
+
+// handleGetChildBranches lists the branches forked from a branch, oldest
+// first. ?includeArchived=true includes archived children.
+func (s *Server) handleGetChildBranches(w http.ResponseWriter, r *http.Request) {
+	branchID := chi.URLParam(r, "branchId")
+	if _, exists := s.storage.GetBranch(r.Context(), branchID); !exists {
+		http.Error(w, fmt.Sprintf("%v: %s", ErrBranchNotFound, branchID), http.StatusNotFound)
+		return
+	}
+
+	includeArchived := r.URL.Query().Get("includeArchived") == "true"
+	children, err := s.storage.GetChildBranches(r.Context(), branchID, includeArchived)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(children)
+}
+
+// handleGetBranchHead returns the head version of a branch with its tags,
+// or 204 No Content if the branch has no versions yet.
+func (s *Server) handleGetBranchHead(w http.ResponseWriter, r *http.Request) {
+	branchID := chi.URLParam(r, "branchId")
+
+	head, err := getBranchHead(r.Context(), s.storage, branchID)
+	if errors.Is(err, ErrBranchNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if head == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(head)
+}
+
+// handleSetBranchHead makes the version in the body the head of the branch
+// and returns it like handleGetBranchHead. Versions of other branches are
+// rejected.
+func (s *Server) handleSetBranchHead(w http.ResponseWriter, r *http.Request) {
+	branchID := chi.URLParam(r, "branchId")
+
+	var req struct {
+		VersionID string `json:"versionId"`
+	}
+	if err := s.decodeBody(w, r, &req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.VersionID == "" {
+		http.Error(w, "versionId required", http.StatusBadRequest)
+		return
+	}
+
+	err := s.storage.SetBranchHead(r.Context(), branchID, req.VersionID)
+	if errors.Is(err, ErrBranchNotFound) || errors.Is(err, ErrVersionNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	} else if errors.Is(err, ErrVersionNotOnBranch) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	head, err := getBranchHead(r.Context(), s.storage, branchID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(head)
+}
+
+// handleGetEstimateTrend returns the ESTIMATE totals across a branch's
+// history, oldest first.
+func (s *Server) handleGetEstimateTrend(w http.ResponseWriter, r *http.Request) {
+	branchID := chi.URLParam(r, "branchId")
+
+	points, err := estimateTrend(r.Context(), s.storage, branchID)
+	if errors.Is(err, ErrBranchNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(points)
+}
+
+// handleMergeBranch merges the head of another branch into the branch in the
+// URL: the source head's query becomes a new version with both heads as
+// parents, and its EXPLAINs are run again.
+func (s *Server) handleMergeBranch(w http.ResponseWriter, r *http.Request) {
+	targetID := chi.URLParam(r, "branchId")
+
+	var body struct {
+		SourceBranchID string                 `json:"sourceBranchId"`
+		ExplainConfigs []models.ExplainConfig `json:"explainConfigs,omitempty"`
+		ForceAnalyzer  bool                   `json:"forceAnalyzer,omitempty"`
+		ServerSettings map[string]string      `json:"serverSettings,omitempty"`
+	}
+	if err := s.decodeBody(w, r, &body); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if body.SourceBranchID == "" {
+		http.Error(w, "sourceBranchId required", http.StatusBadRequest)
+		return
+	}
+
+	req, err := prepareMerge(r.Context(), s.storage, targetID, body.SourceBranchID)
+	if errors.Is(err, ErrBranchNotFound) || errors.Is(err, ErrVersionNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	} else if errors.Is(err, ErrInvalidMerge) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	req.ExplainConfigs = body.ExplainConfigs
+	req.ForceAnalyzer = body.ForceAnalyzer
+	req.ServerSettings = body.ServerSettings
+
+	if err := validateExplainRequest(req, s.allowedStatements); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if _, err := s.connManager(req.Profile); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	response, err := s.runExplain(r.Context(), req, nil)
+	observeExplainRequest(response, err)
+	if err != nil {
+		s.internalError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func (s *Server) handleDuplicateBranch(w http.ResponseWriter, r *http.Request) {
+	branchID := chi.URLParam(r, "branchId")
+	copyHead := r.URL.Query().Get("copyHead") == "true"
+
+	var req struct {
+		Name string `json:"name"`
+	}
+	if err := s.decodeBody(w, r, &req); err != nil && !errors.Is(err, io.EOF) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	branch, version, err := duplicateBranch(r.Context(), s.storage, branchID, req.Name, copyHead)
+	if errors.Is(err, ErrBranchNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	response := map[string]interface{}{"branch": branch}
+	if version != nil {
+		response["version"] = version
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// Default max execution time for EXPLAIN queries (in milliseconds)
+const DefaultMaxExecutionTimeMs = 1345 // 1.345 seconds
+
+// Default cap on the stored size of a single EXPLAIN output
+const DefaultMaxExplainOutputBytes = 512 * 1024
+
+// Default grace period for in-flight requests during shutdown
+const DefaultShutdownTimeout = 30 * time.Second
+
+// DefaultOptimizeInterval is how often DuckDB storage is optimized in the
+// background, see DuckDBStorage.Optimize.
+const DefaultOptimizeInterval = 24 * time.Hour
+
+// Default ClickHouse connection pool settings. EXPLAINs can run
+// concurrently, so allow a few connections per request.
+const (
+	DefaultMaxOpenConns    = 10
+	DefaultMaxIdleConns    = 5
+	DefaultConnMaxLifetime = time.Hour
+)
+
+func (s *Server) handleExplainQuery(w http.ResponseWriter, r *http.Request) {
+	// 1. Parse request
+	var req ExplainRequest
+	if err := s.decodeBody(w, r, &req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := checkQueryLength(req.Query, s.maxQueryLength); err != nil {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err := validateExplainRequest(&req, s.allowedStatements); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if _, err := s.connManager(req.Profile); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// A dry run only previews the statements; nothing runs or is saved
+	if r.URL.Query().Get("dryRun") == "true" {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s.dryRunExplain(r.Context(), &req))
+		return
+	}
+
+	run := func() (map[string]interface{}, error) {
+		response, err := s.runExplain(r.Context(), &req, nil)
+		observeExplainRequest(response, err)
+		return response, err
+	}
+
+	var response map[string]interface{}
+	var err error
+	if key := r.Header.Get(IdempotencyKeyHeader); key != "" && s.idempotency != nil {
+		var replayed bool
+		response, replayed, err = s.idempotency.do(r.Context(), key, requestFingerprint(&req), run)
+		if errors.Is(err, errIdempotencyKeyReused) {
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+		if replayed {
+			w.Header().Set("Idempotent-Replayed", "true")
+			// The replay is the original response as of now; the cached
+			// map is shared, so it is copied first.
+			response = maps.Clone(response)
+			response["serverTime"] = formatServerTime(s.now())
+		}
+	} else {
+		response, err = run()
+	}
+	if errors.Is(err, ErrInvalidParentVersion) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if err != nil {
+		s.internalError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// runExplain executes a validated explain request and saves the new version.
+//
+// When onResult is nil the EXPLAINs run sequentially; otherwise they run
+// concurrently and onResult is called as each one completes. Returns an
+// error without saving if ctx is canceled mid-run.
+func (s *Server) runExplain(ctx context.Context, req *ExplainRequest, onResult func(models.ExplainResult)) (map[string]interface{}, error) {
+	// 2. Check auto-branching
+	branchResult, err := checkAutoBranch(ctx, s.storage, req.BranchID, req.ParentVersionID, req.AutoBranchName)
+	if err != nil {
+		return nil, err
+	}
+
+	// 3. Get and filter configs
+	defaults := branchExplainDefaults(ctx, s.storage, req.BranchID, s.defaultExplainConfigs)
+	configs := getExplainConfigs(ctx, req.ExplainConfigs, defaults)
+	configs, skipped := s.runnableConfigs(ctx, req, configs)
+
+	// 4. Generate query hash
+	queryHash := hashQuery(req.Query)
+
+	// 5. Check cache - return early if query unchanged
+	if req.mergeParentVersionID == "" && !req.rerun && !req.ForceRefresh {
+		if cached, ok := checkCachedVersion(ctx, s.storage, req.ParentVersionID, queryHash, req.Parameters, req.CustomSettings, req.Profile, req.Database); ok {
+			response := buildExplainResponse(cached, false, nil, true, s.now())
+			if len(req.Tags) > 0 {
+				response["tagWarnings"] = []string{"tags not added: query unchanged, no new version was saved"}
+			}
+			return response, nil
+		}
+	}
+
+	// 6. Prepare execution options
+	opts := s.explainOptions(req, queryHash, branchMaxExecutionTimeMs(ctx, s.storage, req.BranchID))
+
+	// 7. Optionally borrow identical results from another branch
+	if req.ReuseAcrossBranches && !req.ForceRefresh {
+		if source, ok := findReusableVersion(ctx, s.storage, queryHash, req.Query, configs, opts, req.Profile, req.Database); ok {
+			version := borrowVersion(branchResult.TargetBranchID, req, source, configs, skipped)
+			if onResult != nil {
+				for _, result := range version.ExplainResults {
+					onResult(result)
+				}
+			}
+			if err := s.storage.SaveVersion(ctx, version); err != nil {
+				return nil, err
+			}
+			tagWarnings := applyVersionTags(ctx, s.storage, version, req.Tags)
+			response := buildExplainResponse(version, branchResult.AutoBranched, branchResult.NewBranch, true, s.now())
+			response["borrowedFrom"] = source.ID
+			if len(tagWarnings) > 0 {
+				response["tagWarnings"] = tagWarnings
+			}
+			s.addEstimateRegression(ctx, req, version, response)
+			return response, nil
+		}
+	}
+
+	slog.InfoContext(ctx, "Executing EXPLAINs", "count", len(configs), "query_hash", queryHash,
+		"force_analyzer", req.ForceAnalyzer, "max_execution_time_ms", opts.MaxExecutionTimeMs)
+
+	// 8. Execute EXPLAINs
+	results, stats, err := s.executeExplains(ctx, req, configs, skipped, opts, onResult)
+	if err != nil {
+		return nil, err
+	}
+
+	// 9. Create and save version
+	version := createVersion(branchResult.TargetBranchID, req, queryHash, configs, results)
+	version.ExecutionStats.Merge(stats)
+	if err := s.storage.SaveVersion(ctx, version); err != nil {
+		return nil, err
+	}
+	tagWarnings := applyVersionTags(ctx, s.storage, version, req.Tags)
+
+	// 10. Build response
+	response := buildExplainResponse(version, branchResult.AutoBranched, branchResult.NewBranch, false, s.now())
+	if len(tagWarnings) > 0 {
+		response["tagWarnings"] = tagWarnings
+	}
+	s.addEstimateRegression(ctx, req, version, response)
+	return response, nil
+}
+
+func (s *Server) handleGetHistory(w http.ResponseWriter, r *http.Request) {
+	branchID := r.URL.Query().Get("branchId")
+	if branchID == "" {
+		http.Error(w, "branchId required", http.StatusBadRequest)
+		return
+	}
+
+	// sort=tagged orders versions filtered by tag by when they were tagged
+	sort := r.URL.Query().Get("sort")
+	if sort != "" && sort != "tagged" && sort != "timestamp" {
+		http.Error(w, fmt.Sprintf("invalid sort %q: must be tagged or timestamp", sort), http.StatusBadRequest)
+		return
+	}
+
+	var history []*models.QueryVersion
+	var err error
+	if tag := r.URL.Query().Get("tag"); tag != "" {
+		history, err = s.storage.GetVersionsByTag(r.Context(), branchID, tag, sort == "tagged")
+	} else if sort == "tagged" {
+		http.Error(w, "sort=tagged requires a tag", http.StatusBadRequest)
+		return
+	} else {
+		history, err = s.storage.GetBranchHistory(r.Context(), branchID)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// History stays a plain array for existing clients; the server time
+	// goes in a header instead
+	w.Header().Set(ServerTimeHeader, formatServerTime(s.now()))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(history)
+}
+
+// handleNotFoundJSON replaces the static file fallback in API-only deployments.
+func handleNotFoundJSON(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusNotFound)
+	json.NewEncoder(w).Encode(map[string]string{"error": "not found"})
+}
+
+func (s *Server) handleGetExplainConfigs(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.defaultExplainConfigs)
+}
+
+func (s *Server) handleGetExplainSchema(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(models.ExplainSchema())
+}
+
+// connManager returns the connection of the named profile; an empty name
+// selects DefaultProfile.
+func (s *Server) connManager(profile string) (*ConnManager, error) {
+	profile = normalizeProfile(profile)
+	ch, ok := s.conns[profile]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownProfile, profile)
+	}
+	return ch, nil
+}
+
+// reanalyzeInPlace runs the EXPLAINs of req, prepared by prepareReanalyze,
+// and replaces the results of version with them.
+func (s *Server) reanalyzeInPlace(ctx context.Context, version *models.QueryVersion, req *ExplainRequest) (map[string]interface{}, error) {
+	defaults := branchExplainDefaults(ctx, s.storage, version.BranchID, s.defaultExplainConfigs)
+	configs := getExplainConfigs(ctx, req.ExplainConfigs, defaults)
+	configs, skipped := s.runnableConfigs(ctx, req, configs)
+
+	opts := s.explainOptions(req, version.QueryHash, branchMaxExecutionTimeMs(ctx, s.storage, version.BranchID))
+	results, stats, err := s.executeExplains(ctx, req, configs, skipped, opts, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	stats = reanalyzedStats(version.ExecutionStats, stats, s.now())
+	if err := s.storage.UpdateVersionResults(ctx, version.ID, results, configs, stats); err != nil {
+		return nil, err
+	}
+
+	detail, err := getVersionDetail(ctx, s.storage, version.ID)
+	if err != nil {
+		return nil, err
+	}
+	return buildExplainResponse(detail.QueryVersion, false, nil, false, s.now()), nil
+}
+
+// executeExplains runs configs for req on the EXPLAIN connection of its
+// profile and appends the skipped results. onResult, if set, is called as
+// each result completes. The returned stats hold the server version and,
+// if req.CollectStats is set, the query_log stats of the EXPLAINs.
+func (s *Server) executeExplains(ctx context.Context, req *ExplainRequest, configs []models.ExplainConfig, skipped []models.ExplainResult, opts ExplainOptions, onResult func(models.ExplainResult)) ([]models.ExplainResult, models.ExecutionStats, error) {
+	ch, err := s.requestConnManager(ctx, req)
+	if err != nil {
+		return nil, models.ExecutionStats{}, err
+	}
+	executor, err := ch.Executor(ctx)
+	if err != nil {
+		return nil, models.ExecutionStats{}, err
+	}
+	var results []models.ExplainResult
+	if onResult != nil {
+		results = executor.ExecuteConcurrent(ctx, configs, req.Query, opts, onResult)
+	} else {
+		results = executor.ExecuteAll(ctx, configs, req.Query, opts)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, models.ExecutionStats{}, fmt.Errorf("explain canceled: %w", err)
+	}
+	for _, result := range skipped {
+		if onResult != nil {
+			onResult(result)
+		}
+		results = append(results, result)
+	}
+
+	var stats models.ExecutionStats
+	if req.CollectStats {
+		stats.SetQueryLog(executor.CollectStats(ctx, results, opts.LogComment))
+	}
+	if serverVersion, err := executor.ServerVersion(ctx); err != nil {
+		slog.WarnContext(ctx, "Failed to get ClickHouse version", "error", err)
+	} else {
+		stats.ClickHouseVersion = serverVersion
+	}
+	return results, stats, nil
+}
+
+// dryRunExplain returns the EXPLAIN statements runExplain would send for
+// req, without running them. Types are filtered for the server settings
+// given in req but not for the server version, which would need a query.
+func (s *Server) dryRunExplain(ctx context.Context, req *ExplainRequest) []DryRunQuery {
+	defaults := branchExplainDefaults(ctx, s.storage, req.BranchID, s.defaultExplainConfigs)
+	configs := getExplainConfigs(ctx, req.ExplainConfigs, defaults)
+	configs, _ = filterExplainConfigs(ctx, configs, req.ServerSettings, req.ForceAnalyzer)
+
+	queryHash := hashQuery(req.Query)
+	opts := s.explainOptions(req, queryHash, branchMaxExecutionTimeMs(ctx, s.storage, req.BranchID))
+	return dryRunQueries(configs, req.Query, opts)
+}
+
+// explainOptions returns the options EXPLAINs of req run with.
+// defaultMaxExecutionTimeMs applies when req doesn't set a limit, see
+// branchMaxExecutionTimeMs.
+func (s *Server) explainOptions(req *ExplainRequest, queryHash string, defaultMaxExecutionTimeMs int) ExplainOptions {
+	maxExecutionTimeMs := req.MaxExecutionTimeMs
+	if maxExecutionTimeMs <= 0 {
+		maxExecutionTimeMs = defaultMaxExecutionTimeMs
+	}
+	return ExplainOptions{
+		LogComment:         buildLogComment(queryHash),
+		ForceAnalyzer:      req.ForceAnalyzer,
+		MaxExecutionTimeMs: maxExecutionTimeMs,
+		CustomSettings:     req.CustomSettings,
+		Parameters:         req.Parameters,
+		Retry:              s.retryPolicy,
+		MaxOutputBytes:     s.maxOutputBytes,
+		SanitizeErrors:     s.sanitizeErrors,
+	}
+}
+
+// runnableConfigs filters the configs of req with filterExplainConfigs and
+// filterUnsupportedConfigs, for the server version of req's profile. When
+// the version can't be read, no type is filtered for it.
+func (s *Server) runnableConfigs(ctx context.Context, req *ExplainRequest, configs []models.ExplainConfig) ([]models.ExplainConfig, []models.ExplainResult) {
+	configs, skipped := filterExplainConfigs(ctx, configs, req.ServerSettings, req.ForceAnalyzer)
+
+	ch, err := s.explainConnManager(req.Profile)
+	if err != nil {
+		return configs, skipped
+	}
+	serverVersion, err := ch.ServerVersion(ctx)
+	if err != nil {
+		slog.DebugContext(ctx, "Failed to get ClickHouse version for filtering EXPLAIN types", "error", err)
+		return configs, skipped
+	}
+	configs, unsupported := filterUnsupportedConfigs(ctx, configs, serverVersion)
+	return configs, append(skipped, unsupported...)
+}
+
+// requestConnManager returns the EXPLAIN connection of req's profile with
+// req.Database as the default database, see explainConnManager.
+func (s *Server) requestConnManager(ctx context.Context, req *ExplainRequest) (*ConnManager, error) {
+	ch, err := s.explainConnManager(req.Profile)
+	if err != nil {
+		return nil, err
+	}
+	return ch.Database(ctx, req.Database)
+}
+
+// explainConnManager returns the connection EXPLAINs of the named profile
+// run on: its read replica if configured, the primary otherwise.
+func (s *Server) explainConnManager(profile string) (*ConnManager, error) {
+	if ch, ok := s.readConns[normalizeProfile(profile)]; ok {
+		return ch, nil
+	}
+	return s.connManager(profile)
+}
+
+// handleGetProfiles lists the configured connection profile names.
+func (s *Server) handleGetProfiles(w http.ResponseWriter, r *http.Request) {
+	names := slices.Sorted(maps.Keys(s.conns))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(names)
+}
+
+// handleRefreshServerSettings drops the cached settings of the profile and
+// responds like handleGetServerSettings with freshly fetched values.
+func (s *Server) handleRefreshServerSettings(w http.ResponseWriter, r *http.Request) {
+	if s.settingsCache != nil {
+		s.settingsCache.invalidate(normalizeProfile(r.URL.Query().Get("profile")))
+	}
+	s.handleGetServerSettings(w, r)
+}
+
+func (s *Server) handleGetServerSettings(w http.ResponseWriter, r *http.Request) {
+	profileName := normalizeProfile(r.URL.Query().Get("profile"))
+	ch, err := s.connManager(profileName)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	names, err := parseSettingNames(r.URL.Query().Get("names"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// enable_analyzer is always fetched for the top-level field
+	query := names
+	if !slices.Contains(query, "enable_analyzer") {
+		query = append(slices.Clone(names), "enable_analyzer")
+	}
+
+	// Connection host and database of the profile
+	profile := s.profiles[profileName]
+	response := ServerSettings{
+		Profile:        profileName,
+		Host:           profile.Host,
+		Database:       profile.Database,
+		EnableAnalyzer: "0",
+		Settings:       map[string]string{},
+		NotFound:       []string{},
+	}
+
+	fetch := func(ctx context.Context) (map[string]string, []string, error) {
+		conn, err := ch.Conn(ctx)
+		if err != nil {
+			return nil, nil, err
+		}
+		settings, notFound, err := fetchServerSettings(ctx, conn, query)
+		if isConnectionError(err) {
+			ch.MarkFailed(conn, err)
+		}
+		return settings, notFound, err
+	}
+
+	var settings map[string]string
+	var fetchedAt time.Time
+	if s.settingsCache != nil {
+		settings, response.NotFound, fetchedAt, err = s.settingsCache.get(r.Context(), profileName, query, fetch)
+	} else {
+		settings, response.NotFound, err = fetch(r.Context())
+		fetchedAt = s.now()
+	}
+	if err != nil {
+		// enable_analyzer defaults to 0 if we can't fetch it
+		log.Printf("Failed to get server settings: %v", err)
+		response.Error = s.errorMessage(err)
+		response.NotFound = []string{}
+	} else {
+		if value, ok := settings["enable_analyzer"]; ok {
+			response.EnableAnalyzer = value
+		}
+		for _, name := range names {
+			if value, ok := settings[name]; ok {
+				response.Settings[name] = value
+			}
+		}
+		response.NotFound = slices.DeleteFunc(slices.Clone(response.NotFound), func(name string) bool {
+			return !slices.Contains(names, name)
+		})
+		response.FetchedAt = &fetchedAt
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func (s *Server) handlePing(w http.ResponseWriter, r *http.Request) {
+	ch, err := s.connManager(r.URL.Query().Get("profile"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	// Try to ping ClickHouse
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	err = ch.Ping(ctx)
+
+	response := map[string]interface{}{
+		"connected":  err == nil,
+		"timestamp":  time.Now().Unix(),
+		"connection": ch.State(),
+	}
+
+	if err != nil {
+		response["error"] = err.Error()
+		log.Printf("ClickHouse ping failed: %v", err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	// Only the default profile must be reachable; the others are reported
+	// as clickhouse:<name> without making the server unhealthy.
+	checks := map[string]error{
+		"duckdb":        s.storage.Ping(ctx),
+		"duckdb:schema": s.storage.CheckSchemaVersion(ctx),
+	}
+	profiles := map[string]error{}
+	for name, ch := range s.conns {
+		if name == DefaultProfile {
+			checks["clickhouse"] = ch.Ping(ctx)
+		} else {
+			profiles["clickhouse:"+name] = ch.Ping(ctx)
+		}
+	}
+	report, status := buildHealthReport(checks, profiles)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(report)
+}
+
+func (s *Server) handleGetVersion(w http.ResponseWriter, r *http.Request) {
+	versionID := chi.URLParam(r, "versionId")
+
+	detail, err := getVersionDetail(r.Context(), s.storage, versionID)
+	if errors.Is(err, ErrVersionNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(detail)
+}
+
+// handleGetVersionCommands returns clickhouse-client commands reproducing
+// the EXPLAINs of a version against the profile it ran on.
+func (s *Server) handleGetVersionCommands(w http.ResponseWriter, r *http.Request) {
+	versionID := chi.URLParam(r, "versionId")
+
+	version, exists := s.storage.GetVersion(r.Context(), versionID)
+	if !exists {
+		http.Error(w, fmt.Sprintf("%v: %s", ErrVersionNotFound, versionID), http.StatusNotFound)
+		return
+	}
+
+	profile := s.profiles[profileFromStats(version.ExecutionStats)]
+	configs := version.Configs
+	if len(configs) == 0 {
+		configs = s.defaultExplainConfigs
+	}
+	commands := buildVersionCommands(version, profile, configs)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(commands)
+}
+
+func (s *Server) handleAmendVersion(w http.ResponseWriter, r *http.Request) {
+	versionID := chi.URLParam(r, "versionId")
+
+	var req struct {
+		Query string `json:"query"`
+	}
+	if err := s.decodeBody(w, r, &req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if strings.TrimSpace(req.Query) == "" {
+		http.Error(w, "query required", http.StatusBadRequest)
+		return
+	}
+	if err := checkStatementKind(req.Query, s.allowedStatements); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	version, err := amendVersion(r.Context(), s.storage, versionID, req.Query)
+	if errors.Is(err, ErrVersionNotHead) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	} else if errors.Is(err, ErrVersionNotFound) || errors.Is(err, ErrBranchNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(version)
+}
+
+// handleReanalyzeVersion runs the EXPLAINs of a version again against the
+// current server, e.g. after a ClickHouse upgrade. By default the results
+// are saved as a new child version, which like any explain of a non-head
+// version goes to a new branch; ?inPlace=true replaces the version's
+// results instead. The optional body takes forceAnalyzer and
+// serverSettings as in explain requests.
+func (s *Server) handleReanalyzeVersion(w http.ResponseWriter, r *http.Request) {
+	versionID := chi.URLParam(r, "versionId")
+	inPlace := r.URL.Query().Get("inPlace") == "true"
+
+	var body struct {
+		ForceAnalyzer  bool              `json:"forceAnalyzer,omitempty"`
+		ServerSettings map[string]string `json:"serverSettings,omitempty"`
+	}
+	if err := s.decodeBody(w, r, &body); err != nil && !errors.Is(err, io.EOF) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	version, req, err := prepareReanalyze(r.Context(), s.storage, versionID)
+	if errors.Is(err, ErrVersionNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	req.ForceAnalyzer = body.ForceAnalyzer
+	req.ServerSettings = body.ServerSettings
+
+	if _, err := s.connManager(req.Profile); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var response map[string]interface{}
+	if inPlace {
+		response, err = s.reanalyzeInPlace(r.Context(), version, req)
+	} else {
+		response, err = s.runExplain(r.Context(), req, nil)
+	}
+	observeExplainRequest(response, err)
+	if err != nil {
+		s.internalError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// handleGetPlanAnalysis returns the node count, depth and read steps of a
+// version's JSON plan, see models.AnalyzePlan.
+func (s *Server) handleGetPlanAnalysis(w http.ResponseWriter, r *http.Request) {
+	versionID := chi.URLParam(r, "versionId")
+
+	analysis, err := versionPlanAnalysis(r.Context(), s.storage, versionID)
+	if errors.Is(err, ErrVersionNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	} else if errors.Is(err, ErrNoPlanJSON) {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(analysis)
+}
+
+// handleGetParentDiff diffs each EXPLAIN type of a version against its
+// parent, or responds 204 No Content when it has no parent.
+func (s *Server) handleGetParentDiff(w http.ResponseWriter, r *http.Request) {
+	versionID := chi.URLParam(r, "versionId")
+
+	diff, err := versionParentDiff(r.Context(), s.storage, versionID)
+	if errors.Is(err, ErrVersionNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	} else if errors.Is(err, ErrNoParentVersion) {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(diff)
+}
+
+// handleSetVersionNotes replaces the notes of a version and returns the
+// version. An empty string clears them.
+func (s *Server) handleSetVersionNotes(w http.ResponseWriter, r *http.Request) {
+	versionID := chi.URLParam(r, "versionId")
+
+	var req struct {
+		Notes *string `json:"notes"`
+	}
+	if err := s.decodeBody(w, r, &req); err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	if req.Notes == nil {
+		http.Error(w, "notes required", http.StatusBadRequest)
+		return
+	}
 
-	// 2. Check auto-branching
-	branchResult, err := checkAutoBranch(s.storage, req.BranchID, req.ParentVersionID)
+	if err := s.storage.SetVersionNotes(r.Context(), versionID, *req.Notes); errors.Is(err, ErrVersionNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	detail, err := getVersionDetail(r.Context(), s.storage, versionID)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	// 3. Get and filter configs
-	configs := getExplainConfigs(req.ExplainConfigs)
-	configs = filterExplainConfigs(configs, req.ServerSettings, req.ForceAnalyzer)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(detail)
+}
 
-	// 4. Generate query hash
-	queryHash := hashQuery(req.Query)
+func (s *Server) handleDeleteVersion(w http.ResponseWriter, r *http.Request) {
+	versionID := chi.URLParam(r, "versionId")
 
-	// 5. Check cache - return early if query unchanged
-	if cached, ok := checkCachedVersion(s.storage, req.ParentVersionID, queryHash); ok {
-		response := buildExplainResponse(cached, false, nil, true)
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(response)
+	err := s.storage.DeleteVersion(r.Context(), versionID)
+	if errors.Is(err, ErrVersionNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	// 6. Prepare execution options
-	maxExecutionTimeMs := req.MaxExecutionTimeMs
-	if maxExecutionTimeMs <= 0 {
-		maxExecutionTimeMs = DefaultMaxExecutionTimeMs
-	}
-
-	log.Printf("Executing %d EXPLAIN(s) for query hash: %s (forceAnalyzer=%v, maxExecutionTimeMs=%d)",
-		len(configs), queryHash, req.ForceAnalyzer, maxExecutionTimeMs)
+	w.WriteHeader(http.StatusNoContent)
+}
 
-	// 7. Execute EXPLAINs
-	executor := NewExplainExecutor(s.chConn)
-	opts := ExplainOptions{
-		LogComment:         buildLogComment(queryHash),
-		ForceAnalyzer:      req.ForceAnalyzer,
-		MaxExecutionTimeMs: maxExecutionTimeMs,
-	}
-	results := executor.ExecuteAll(r.Context(), configs, req.Query, opts)
+func (s *Server) handleGetVersionsByHash(w http.ResponseWriter, r *http.Request) {
+	hash := chi.URLParam(r, "hash")
 
-	// 8. Create and save version
-	version := createVersion(branchResult.TargetBranchID, &req, queryHash, results)
-	if err := s.storage.SaveVersion(version); err != nil {
+	versions, err := s.storage.GetVersionsByHash(r.Context(), hash)
+	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	// 9. Build and send response
-	response := buildExplainResponse(version, branchResult.AutoBranched, branchResult.NewBranch, false)
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(response)
+	json.NewEncoder(w).Encode(versions)
 }
 
-func (s *Server) handleGetHistory(w http.ResponseWriter, r *http.Request) {
-	branchID := r.URL.Query().Get("branchId")
-	if branchID == "" {
-		http.Error(w, "branchId required", http.StatusBadRequest)
+// handleLookupQuery reports how many versions analyzed the query with the
+// "hash" parameter, or the hash of the "query" parameter, and the newest of
+// them. It reads only storage, as a cheap check before explaining a query.
+func (s *Server) handleLookupQuery(w http.ResponseWriter, r *http.Request) {
+	hash, query := r.URL.Query().Get("hash"), r.URL.Query().Get("query")
+	switch {
+	case hash != "" && query != "":
+		http.Error(w, "set either hash or query, not both", http.StatusBadRequest)
+		return
+	case query != "":
+		hash = hashQuery(query)
+	case hash == "":
+		http.Error(w, "hash or query is required", http.StatusBadRequest)
 		return
 	}
 
-	history, err := s.storage.GetBranchHistory(branchID)
+	lookup, err := s.storage.LookupQueryHash(r.Context(), hash)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(history)
-}
 
-func (s *Server) handleGetExplainConfigs(w http.ResponseWriter, r *http.Request) {
-	configs := models.GetDefaultExplainConfigs()
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(configs)
+	json.NewEncoder(w).Encode(lookup)
 }
 
-func (s *Server) handleGetServerSettings(w http.ResponseWriter, r *http.Request) {
-	// Query specific settings we need
-	settings := make(map[string]string)
-
-	// Check enable_analyzer setting
-	var value string
-	err := s.chConn.QueryRow(context.Background(),
-		"SELECT value FROM system.settings WHERE name = 'enable_analyzer'").Scan(&value)
-
-	if err != nil {
-		log.Printf("Failed to get enable_analyzer setting: %v", err)
-		// Default to 0 if we can't fetch it
-		settings["enable_analyzer"] = "0"
-	} else {
-		settings["enable_analyzer"] = value
-	}
-
-	// Get connection host info from environment
-	settings["host"] = os.Getenv("CLICKHOUSE_HOST")
-	if settings["host"] == "" {
-		settings["host"] = "localhost:9000"
-	}
+func (s *Server) handleGetVersionAncestry(w http.ResponseWriter, r *http.Request) {
+	versionID := chi.URLParam(r, "versionId")
 
-	// Get database name
-	settings["database"] = os.Getenv("CLICKHOUSE_DATABASE")
-	if settings["database"] == "" {
-		settings["database"] = "default"
+	ancestry, err := s.storage.GetVersionAncestry(r.Context(), versionID)
+	if errors.Is(err, ErrVersionNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(settings)
+	json.NewEncoder(w).Encode(ancestry)
 }
 
-func (s *Server) handlePing(w http.ResponseWriter, r *http.Request) {
-	// Try to ping ClickHouse
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
+// TotalCountHeader carries the number of items across all pages of a
+// paginated list.
+const TotalCountHeader = "X-Total-Count"
 
-	err := s.chConn.Ping(ctx)
+// handleGetVersionTags lists the tags of a version, oldest first.
+// ?prefix= keeps tags whose key starts with it, ?excludeSystem=true drops
+// system tags, and ?limit= and ?offset= select a page. The number of
+// matching tags is returned in the X-Total-Count header.
+func (s *Server) handleGetVersionTags(w http.ResponseWriter, r *http.Request) {
+	versionID := chi.URLParam(r, "versionId")
 
-	response := map[string]interface{}{
-		"connected": err == nil,
-		"timestamp": time.Now().Unix(),
+	limit, err := parseLimit(r, 0, 0)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
-
+	offset, err := parseOffset(r)
 	if err != nil {
-		response["error"] = err.Error()
-		log.Printf("ClickHouse ping failed: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	filter := models.TagFilter{
+		KeyPrefix:     r.URL.Query().Get("prefix"),
+		ExcludeSystem: r.URL.Query().Get("excludeSystem") == "true",
+		Limit:         limit,
+		Offset:        offset,
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(response)
-}
-
-func (s *Server) handleGetVersionTags(w http.ResponseWriter, r *http.Request) {
-	versionID := chi.URLParam(r, "versionId")
-
-	tags, err := s.storage.GetVersionTags(versionID)
+	tags, total, err := s.storage.GetVersionTagsFiltered(r.Context(), versionID, filter)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	w.Header().Set(TotalCountHeader, strconv.Itoa(total))
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(tags)
 }
@@ -250,13 +1473,16 @@ func (s *Server) handleAddTag(w http.ResponseWriter, r *http.Request) {
 	var req struct {
 		Tag string `json:"tag"`
 	}
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+	if err := s.decodeBody(w, r, &req); err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	tag, err := s.storage.AddTag(versionID, req.Tag)
-	if err != nil {
+	tag, err := s.storage.AddTag(r.Context(), versionID, req.Tag)
+	if errors.Is(err, models.ErrReservedTag) {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	} else if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
@@ -268,7 +1494,11 @@ func (s *Server) handleAddTag(w http.ResponseWriter, r *http.Request) {
 func (s *Server) handleDeleteTag(w http.ResponseWriter, r *http.Request) {
 	tagID := chi.URLParam(r, "tagId")
 
-	if err := s.storage.RemoveTag(tagID); err != nil {
+	err := s.storage.RemoveTag(r.Context(), tagID)
+	if errors.Is(err, models.ErrReservedTag) {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	} else if err != nil {
 		http.Error(w, err.Error(), http.StatusNotFound)
 		return
 	}
@@ -276,10 +1506,112 @@ func (s *Server) handleDeleteTag(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusNoContent)
 }
 
+// DefaultStarredLimit is the number of starred versions listed when the
+// request doesn't set a limit.
+const DefaultStarredLimit = 50
+
+// Limits of the activity feed: the default page size and the largest
+// accepted limit.
+const (
+	DefaultActivityLimit = 50
+	MaxActivityLimit     = 500
+)
+
+// parseLimit reads the "limit" query parameter, returning def when it is
+// unset. Values above maxLimit are capped; maxLimit <= 0 means no cap.
+func parseLimit(r *http.Request, def, maxLimit int) (int, error) {
+	v := r.URL.Query().Get("limit")
+	if v == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n <= 0 {
+		return 0, errors.New("limit must be a positive integer")
+	}
+	if maxLimit > 0 && n > maxLimit {
+		n = maxLimit
+	}
+	return n, nil
+}
+
+// parseOffset reads the "offset" query parameter, 0 when it is unset.
+func parseOffset(r *http.Request) (int, error) {
+	v := r.URL.Query().Get("offset")
+	if v == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		return 0, errors.New("offset must be a non-negative integer")
+	}
+	return n, nil
+}
+
+func (s *Server) handleGetActivity(w http.ResponseWriter, r *http.Request) {
+	limit, err := parseLimit(r, DefaultActivityLimit, MaxActivityLimit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	versions, err := s.storage.GetRecentVersions(r.Context(), limit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if versions == nil {
+		versions = []*models.QueryVersion{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(versions)
+}
+
+func (s *Server) handleGetStarred(w http.ResponseWriter, r *http.Request) {
+	limit, err := parseLimit(r, DefaultStarredLimit, 0)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	versions, err := s.storage.GetStarredVersions(r.Context(), limit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if versions == nil {
+		versions = []*models.QueryVersion{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(versions)
+}
+
+// handleGetErrored lists versions whose EXPLAINs failed, for triage. An
+// optional ?branchId= limits it to one branch.
+func (s *Server) handleGetErrored(w http.ResponseWriter, r *http.Request) {
+	branchID := r.URL.Query().Get("branchId")
+	if branchID != "" {
+		if _, exists := s.storage.GetBranch(r.Context(), branchID); !exists {
+			http.Error(w, fmt.Sprintf("%v: %s", ErrBranchNotFound, branchID), http.StatusNotFound)
+			return
+		}
+	}
+
+	versions, err := s.storage.GetErroredVersions(r.Context(), branchID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(versions)
+}
+
 func (s *Server) handleToggleStar(w http.ResponseWriter, r *http.Request) {
 	versionID := chi.URLParam(r, "versionId")
 
-	isStarred, err := s.storage.ToggleStarred(versionID)
+	isStarred, err := s.storage.ToggleStarred(r.Context(), versionID)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -302,8 +1634,10 @@ func maskPassword(password string) string {
 	return string(password[0]) + strings.Repeat("*", len(password)-2) + string(password[len(password)-1])
 }
 
+// hashQuery hashes the normalized form of query, so whitespace and keyword
+// case changes don't defeat the unchanged-query cache.
 func hashQuery(query string) string {
-	hash := sha256.Sum256([]byte(query))
+	hash := sha256.Sum256([]byte(NormalizeQuery(query)))
 	return hex.EncodeToString(hash[:])
 }
 
@@ -316,133 +1650,461 @@ func buildLogComment(queryHash string) string {
 	return string(commentJSON)
 }
 
+// databaseOpener opens connections like options with another default
+// database, for ConnManager.SetDatabaseOpener.
+func databaseOpener(options *clickhouse.Options) func(database string) (driver.Conn, error) {
+	return func(database string) (driver.Conn, error) {
+		dbOptions := *options
+		dbOptions.Auth.Database = database
+		return clickhouse.Open(&dbOptions)
+	}
+}
+
 func main() {
-	// Get ClickHouse credentials from environment
-	chUser := os.Getenv("CLICKHOUSE_USER")
-	chPassword := os.Getenv("CLICKHOUSE_PASSWORD")
-	chHost := os.Getenv("CLICKHOUSE_HOST")
-	chDatabase := os.Getenv("CLICKHOUSE_DATABASE")
-
-	if chHost == "" {
-		chHost = "localhost:9000"
-	}
-	if chUser == "" {
-		chUser = "default"
-	}
-	if chDatabase == "" {
-		chDatabase = "default"
-	}
-
-	// Detect if we need secure connection (port 9440 or CLICKHOUSE_SECURE=true)
-	useSecure := strings.Contains(chHost, ":9440") || os.Getenv("CLICKHOUSE_SECURE") == "true"
-
-	// Print connection details
-	log.Println("=== ClickHouse Connection Details ===")
-	log.Printf("Host: %s", chHost)
-	log.Printf("Database: %s", chDatabase)
-	log.Printf("User: %s", chUser)
-	log.Printf("Password: %s", maskPassword(chPassword))
-	log.Printf("Secure: %v", useSecure)
-	log.Println("=====================================")
-
-	// Configure ClickHouse connection options
-	options := &clickhouse.Options{
-		Addr: []string{chHost},
-		Auth: clickhouse.Auth{
-			Database: chDatabase,
-			Username: chUser,
-			Password: chPassword,
-		},
-		ClientInfo: clickhouse.ClientInfo{
-			Products: []struct {
-				Name    string
-				Version string
-			}{
-				{Name: "clicktelligence", Version: "1.0"},
-			},
-		},
-		// Disable debug logging which might expose workstation info
-		Debug: false,
-		// Disable sending workstation/OS metadata
-		Settings: clickhouse.Settings{
-			"send_logs_level": "none",
-		},
-	}
-
-	// Configure TLS for secure connections
-	if useSecure {
-		options.TLS = &tls.Config{
-			InsecureSkipVerify: true, // Equivalent to --accept-invalid-certificate
-		}
-		log.Printf("Using secure connection to ClickHouse (TLS enabled, accepting invalid certificates)")
+	// Configure leveled logging
+	logLevel, err := parseLogLevel(os.Getenv("LOG_LEVEL"))
+	if err != nil {
+		log.Fatalf("Invalid LOG_LEVEL: %v", err)
+	}
+	slog.SetDefault(newLogger(os.Stderr, logLevel))
+
+	// Connection pool settings, shared by all profiles
+	maxOpenConns, err := getEnvInt("CLICKHOUSE_MAX_OPEN_CONNS", DefaultMaxOpenConns)
+	if err != nil {
+		log.Fatal(err)
+	}
+	maxIdleConns, err := getEnvInt("CLICKHOUSE_MAX_IDLE_CONNS", DefaultMaxIdleConns)
+	if err != nil {
+		log.Fatal(err)
+	}
+	connMaxLifetime, err := getEnvDuration("CLICKHOUSE_CONN_MAX_LIFETIME", DefaultConnMaxLifetime)
+	if err != nil {
+		log.Fatal(err)
+	}
+	pool := PoolSettings{
+		MaxOpenConns:    maxOpenConns,
+		MaxIdleConns:    maxIdleConns,
+		ConnMaxLifetime: connMaxLifetime,
 	}
 
-	// Connect to ClickHouse
-	conn, err := clickhouse.Open(options)
+	reconnectInterval, err := getEnvDuration("CLICKHOUSE_RECONNECT_INTERVAL", DefaultReconnectInterval)
 	if err != nil {
-		log.Fatalf("Failed to connect to ClickHouse: %v", err)
+		log.Fatal(err)
 	}
 
-	// Test connection
-	if err := conn.Ping(context.Background()); err != nil {
-		log.Printf("Warning: ClickHouse ping failed: %v", err)
-	} else {
-		log.Println("Successfully connected to ClickHouse")
+	profileNames, err := parseProfileNames(os.Getenv("CLICKHOUSE_PROFILES"))
+	if err != nil {
+		log.Fatalf("Invalid CLICKHOUSE_PROFILES: %v", err)
+	}
+
+	conns := make(map[string]*ConnManager, len(profileNames))
+	readConns := make(map[string]*ConnManager)
+	profiles := make(map[string]ConnProfile, len(profileNames))
+	for _, name := range profileNames {
+		profile, err := loadConnProfile(name, os.Getenv)
+		if err != nil {
+			log.Fatal(err)
+		}
+		options, err := profile.Options(pool)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		// Print connection details
+		log.Printf("=== ClickHouse Connection Details (%s) ===", name)
+		log.Printf("Host: %s", profile.Host)
+		if profile.ReadHost != "" {
+			log.Printf("Read host (EXPLAINs): %s", profile.ReadHost)
+		} else {
+			log.Printf("Read host: not set, EXPLAINs use %s", profile.Host)
+		}
+		log.Printf("Database: %s", profile.Database)
+		log.Printf("User: %s", profile.User)
+		log.Printf("Password: %s", maskPassword(profile.Password))
+		log.Printf("Secure: %v", profile.Secure)
+		if profile.Secure {
+			switch {
+			case profile.TLSSkipVerify:
+				// Equivalent to --accept-invalid-certificate
+				log.Printf("TLS certificate verification DISABLED")
+			case profile.TLSCAFile != "":
+				log.Printf("TLS verifying against CA file %s", profile.TLSCAFile)
+			default:
+				log.Printf("TLS verifying against system roots")
+			}
+			if profile.TLSServerName != "" {
+				log.Printf("TLS server name override: %s", profile.TLSServerName)
+			}
+		}
+		log.Println("=====================================")
+
+		// Connect to ClickHouse; the connection is re-opened after failed pings
+		conn := NewConnManager(func() (driver.Conn, error) {
+			return clickhouse.Open(options)
+		}, reconnectInterval)
+		conn.SetDatabaseOpener(databaseOpener(options))
+
+		// Test connection
+		if err := conn.Ping(context.Background()); err != nil {
+			log.Printf("Warning: ClickHouse ping failed for profile %s: %v", name, err)
+		} else {
+			log.Printf("Successfully connected to ClickHouse (profile %s)", name)
+			if serverVersion, err := conn.ServerVersion(context.Background()); err == nil {
+				log.Printf("ClickHouse version %s (profile %s)", serverVersion, name)
+			}
+		}
+
+		conns[name] = conn
+		profiles[name] = profile
+
+		if readProfile, ok := profile.ReadProfile(); ok {
+			readOptions, err := readProfile.Options(pool)
+			if err != nil {
+				log.Fatal(err)
+			}
+			readConn := NewConnManager(func() (driver.Conn, error) {
+				return clickhouse.Open(readOptions)
+			}, reconnectInterval)
+			readConn.SetDatabaseOpener(databaseOpener(readOptions))
+			if err := readConn.Ping(context.Background()); err != nil {
+				log.Printf("Warning: ClickHouse read replica ping failed for profile %s: %v", name, err)
+			} else {
+				log.Printf("Successfully connected to ClickHouse read replica (profile %s)", name)
+				if serverVersion, err := readConn.ServerVersion(context.Background()); err == nil {
+					log.Printf("ClickHouse read replica version %s (profile %s)", serverVersion, name)
+				}
+			}
+			readConns[name] = readConn
+		}
 	}
+	log.Printf("Max open conns: %d", maxOpenConns)
+	log.Printf("Max idle conns: %d", maxIdleConns)
+	log.Printf("Conn max lifetime: %v", connMaxLifetime)
 
 	// Initialize DuckDB storage
 	dbPath := os.Getenv("DUCKDB_PATH")
 	if dbPath == "" {
 		dbPath = "./clicktelligence.db"
 	}
-	storage, err := NewDuckDBStorage(dbPath)
+	readOnly, err := getEnvBool("DUCKDB_READONLY", false)
+	if err != nil {
+		log.Fatal(err)
+	}
+	migrateOnStartup, err := getEnvBool("MIGRATE_ON_STARTUP", true)
 	if err != nil {
+		log.Fatal(err)
+	}
+	var storage *DuckDBStorage
+	if readOnly {
+		storage, err = NewReadOnlyDuckDBStorage(dbPath)
+	} else if migrateOnStartup {
+		storage, err = NewDuckDBStorage(dbPath)
+	} else {
+		storage, err = NewDuckDBStorageWithoutMigrations(dbPath)
+	}
+	if errors.Is(err, ErrDatabaseLocked) {
+		log.Fatalf("Cannot open DuckDB database %s: another process has it open. "+
+			"Only one read-write process can use the file; stop the other instance, "+
+			"or run every instance with DUCKDB_READONLY=true.\n%v", dbPath, err)
+	} else if err != nil {
 		log.Fatalf("Failed to initialize storage: %v", err)
 	}
-	defer storage.Close()
-	log.Printf("DuckDB storage initialized at: %s", dbPath)
+	storageTimeout, err := getEnvDuration("STORAGE_TIMEOUT", DefaultStorageTimeout)
+	if err != nil {
+		log.Fatal(err)
+	}
+	storage.SetTimeout(storageTimeout)
+	compress, err := getEnvBool("DUCKDB_COMPRESS", false)
+	if err != nil {
+		log.Fatal(err)
+	}
+	storage.SetCompression(compress)
+	storage.SetReservedTagPrefixes(models.ParseReservedTagPrefixes(os.Getenv("RESERVED_TAG_PREFIXES")))
+	if readOnly {
+		log.Printf("DuckDB storage opened read-only at: %s", dbPath)
+	} else {
+		log.Printf("DuckDB storage initialized at: %s", dbPath)
+	}
+
+	optimizeInterval, err := getEnvDuration("DUCKDB_OPTIMIZE_INTERVAL", DefaultOptimizeInterval)
+	if err != nil {
+		log.Fatal(err)
+	}
+	optimizeCtx, stopOptimize := context.WithCancel(context.Background())
+	optimizeDone := make(chan struct{})
+	if optimizeInterval > 0 && !readOnly {
+		log.Printf("DuckDB optimize interval: %v", optimizeInterval)
+		go func() {
+			defer close(optimizeDone)
+			runPeriodicOptimize(optimizeCtx, storage, optimizeInterval)
+		}()
+	} else {
+		log.Printf("Periodic DuckDB optimization disabled")
+		close(optimizeDone)
+	}
+	// stopOptimizer cancels a running optimization and waits for it, so
+	// storage isn't closed under it.
+	stopOptimizer := func() {
+		stopOptimize()
+		<-optimizeDone
+	}
 
 	// Initialize server
-	server := NewServer(storage, conn)
+	server := NewServer(storage, conns, profiles)
+	server.readConns = readConns
+	if v := os.Getenv("EXPLAIN_ALLOWED_STATEMENTS"); v != "" {
+		server.allowedStatements = parseStatementList(v)
+	}
+	log.Printf("Allowed EXPLAIN statements: %s", strings.Join(server.allowedStatements, ", "))
+
+	if v := os.Getenv("DEFAULT_EXPLAIN_TYPES"); v != "" {
+		configs, err := parseDefaultExplainConfigs(v)
+		if err != nil {
+			log.Fatalf("Invalid DEFAULT_EXPLAIN_TYPES: %v", err)
+		}
+		server.defaultExplainConfigs = configs
+	}
+
+	server.maxOutputBytes, err = getEnvInt("EXPLAIN_MAX_OUTPUT_BYTES", DefaultMaxExplainOutputBytes)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	maxBodyBytes, err := getEnvInt("MAX_REQUEST_BODY_BYTES", DefaultMaxRequestBodyBytes)
+	if err != nil {
+		log.Fatal(err)
+	}
+	server.maxBodyBytes = int64(maxBodyBytes)
+
+	server.maxQueryLength, err = getEnvInt("MAX_QUERY_LENGTH", DefaultMaxQueryLength)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	server.sanitizeErrors, err = getEnvBool("SANITIZE_ERRORS", false)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	server.adminToken = os.Getenv("ADMIN_TOKEN")
+	server.allowReset, err = getEnvBool("ALLOW_RESET", false)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if server.allowReset {
+		slog.Warn("ALLOW_RESET is set: POST /api/admin/reset deletes all data; use it for development only")
+	}
+
+	settingsTTL, err := getEnvDuration("SERVER_SETTINGS_TTL", DefaultServerSettingsTTL)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if settingsTTL > 0 {
+		server.settingsCache = newServerSettingsCache(settingsTTL)
+	} else {
+		server.settingsCache = nil
+	}
+
+	idempotencyWindow, err := getEnvDuration("IDEMPOTENCY_WINDOW", DefaultIdempotencyWindow)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if idempotencyWindow > 0 {
+		server.idempotency = newIdempotencyCache(idempotencyWindow)
+		log.Printf("Explain idempotency window: %v", idempotencyWindow)
+	} else {
+		server.idempotency = nil
+		log.Printf("Explain idempotency keys disabled")
+	}
+
+	server.estimateRegressionPercent, err = getEnvInt("ESTIMATE_REGRESSION_THRESHOLD_PERCENT", DefaultEstimateRegressionPercent)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	retryMax, err := getEnvInt("CLICKHOUSE_RETRY_MAX", DefaultRetryMaxAttempts)
+	if err != nil {
+		log.Fatal(err)
+	}
+	retryBaseDelay, err := getEnvDuration("CLICKHOUSE_RETRY_BASE_DELAY", DefaultRetryBaseDelay)
+	if err != nil {
+		log.Fatal(err)
+	}
+	server.retryPolicy = RetryPolicy{MaxRetries: retryMax, BaseDelay: retryBaseDelay}
 
 	// Setup chi router
 	r := chi.NewRouter()
 
 	// Middleware
+	r.Use(middleware.RequestID)
 	r.Use(middleware.Logger)
 	r.Use(middleware.Recoverer)
-	r.Use(middleware.RequestID)
 
 	// API routes
 	r.Route("/api", func(r chi.Router) {
 		// Branches
 		r.Get("/branches", server.handleGetBranches)
 		r.Post("/branches", server.handleCreateBranch)
+		r.Get("/branches/compare", server.handleCompareBranches)
+		r.Get("/branches/tree", server.handleGetBranchTree)
+		r.Post("/branches/{branchId}/pin", server.handlePinBranch)
+		r.Post("/branches/{branchId}/archive", server.handleArchiveBranch)
+		r.Get("/branches/{branchId}/head", server.handleGetBranchHead)
+		r.Post("/branches/{branchId}/head", server.handleSetBranchHead)
+		r.Get("/branches/{branchId}/children", server.handleGetChildBranches)
+		r.Get("/branches/{branchId}/explain-configs", server.handleGetBranchExplainConfigs)
+		r.Put("/branches/{branchId}/explain-configs", server.handleSetBranchExplainConfigs)
+		r.Get("/branches/{branchId}/settings", server.handleGetBranchSettings)
+		r.Put("/branches/{branchId}/settings", server.handleSetBranchSettings)
+		r.Post("/branches/{branchId}/cherry-pick", server.handleCherryPick)
+		r.Post("/branches/{branchId}/duplicate", server.handleDuplicateBranch)
+		r.Post("/branches/{branchId}/merge", server.handleMergeBranch)
+		r.Get("/branches/{branchId}/estimate-trend", server.handleGetEstimateTrend)
+		r.Get("/branches/{branchId}/history.csv", server.handleGetHistoryCSV)
 
 		// Query execution
 		r.Post("/query/explain", server.handleExplainQuery)
+		r.Get("/query/explain/stream", server.handleExplainStream)
+		r.Post("/query/explain/output", server.handleExplainOutput)
+		r.Post("/query/explain/matrix", server.handleExplainMatrix)
+		r.Post("/query/explain/single", server.handleExplainSingle)
+		r.Post("/query/format", server.handleFormatQuery)
+		r.Get("/query/lookup", server.handleLookupQuery)
 		r.Get("/explain/configs", server.handleGetExplainConfigs)
+		r.Get("/explain/schema", server.handleGetExplainSchema)
 		r.Get("/history", server.handleGetHistory)
+		r.Get("/server/profiles", server.handleGetProfiles)
 		r.Get("/server/settings", server.handleGetServerSettings)
+		r.Post("/server/settings/refresh", server.handleRefreshServerSettings)
 		r.Get("/server/ping", server.handlePing)
+		r.Get("/server/health", server.handleHealth)
+
+		r.Get("/versions/by-hash/{hash}", server.handleGetVersionsByHash)
+
+		// Administration
+		r.Route("/admin", func(r chi.Router) {
+			r.Use(server.requireAdmin)
+			r.Get("/migrations", server.handleGetMigrations)
+			r.Post("/migrate", server.handleApplyMigrations)
+			r.Post("/reset", server.handleReset)
+			r.Post("/optimize", server.handleOptimize)
+		})
 
 		// Version tags
 		r.Route("/versions/{versionId}", func(r chi.Router) {
+			r.Get("/", server.handleGetVersion)
+			r.Delete("/", server.handleDeleteVersion)
+			r.Get("/ancestry", server.handleGetVersionAncestry)
+			r.Get("/commands", server.handleGetVersionCommands)
+			r.Get("/plan-analysis", server.handleGetPlanAnalysis)
+			r.Get("/parent-diff", server.handleGetParentDiff)
+			r.Post("/amend", server.handleAmendVersion)
+			r.Put("/notes", server.handleSetVersionNotes)
+			r.Post("/reanalyze", server.handleReanalyzeVersion)
 			r.Get("/tags", server.handleGetVersionTags)
 			r.Post("/tags", server.handleAddTag)
 			r.Post("/star", server.handleToggleStar)
 		})
 
+		r.Get("/starred", server.handleGetStarred)
+		r.Get("/errors", server.handleGetErrored)
+		r.Get("/activity", server.handleGetActivity)
+
 		// Tag deletion
 		r.Delete("/tags/{tagId}", server.handleDeleteTag)
 	})
 
+	// Prometheus metrics
+	r.Handle("/metrics", promhttp.Handler())
+
 	// Static files
-	r.Handle("/*", http.FileServer(http.Dir("./static")))
+	disableStatic, err := getEnvBool("DISABLE_STATIC", false)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if disableStatic {
+		log.Println("Static file serving disabled")
+		r.NotFound(handleNotFoundJSON)
+	} else {
+		staticDir := getEnv("STATIC_DIR", "./static")
+		log.Printf("Serving static files from: %s", staticDir)
+		r.Handle("/*", http.FileServer(http.Dir(staticDir)))
+	}
+
+	// Grace period for in-flight requests on shutdown
+	shutdownTimeout, err := getEnvDuration("SHUTDOWN_TIMEOUT", DefaultShutdownTimeout)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	addr, err := listenAddress(os.Getenv("BIND_ADDRESS"), getEnv("PORT", DefaultPort))
+	if err != nil {
+		log.Fatal(err)
+	}
+	httpServer := &http.Server{
+		Addr:    addr,
+		Handler: r,
+	}
+
+	// Listen before serving so bind errors fail fast and the actual
+	// address is logged
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Fatalf("Failed to listen on %s: %v", addr, err)
+	}
+
+	serverErr := make(chan error, 1)
+	go func() {
+		log.Printf("Starting server on http://%s", listener.Addr())
+		if err := httpServer.Serve(listener); err != nil && err != http.ErrServerClosed {
+			serverErr <- err
+		}
+	}()
+
+	// Wait for a shutdown signal or a server failure
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case sig := <-stop:
+		log.Printf("Received %v, shutting down (grace period %v)", sig, shutdownTimeout)
+	case err := <-serverErr:
+		log.Printf("Server failed: %v", err)
+		stopOptimizer()
+		closeConnections(conns, readConns, storage)
+		os.Exit(1)
+	}
+
+	// Stop accepting new connections and drain in-flight requests
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	shutdownErr := httpServer.Shutdown(ctx)
+	if shutdownErr != nil {
+		log.Printf("Graceful shutdown failed: %v", shutdownErr)
+	}
 
-	port := "8080"
-	log.Printf("Starting server on http://localhost:%s", port)
-	if err := http.ListenAndServe(":"+port, r); err != nil {
-		log.Fatalf("Server failed: %v", err)
+	stopOptimizer()
+	closeConnections(conns, readConns, storage)
+
+	if shutdownErr != nil {
+		os.Exit(1)
+	}
+	log.Println("Server stopped")
+}
+
+// closeConnections releases the ClickHouse connections, including read
+// replicas, and DuckDB storage.
+func closeConnections(conns, readConns map[string]*ConnManager, storage models.Storage) {
+	for name, conn := range conns {
+		if err := conn.Close(); err != nil {
+			log.Printf("Failed to close ClickHouse connection %s: %v", name, err)
+		}
+	}
+	for name, conn := range readConns {
+		if err := conn.Close(); err != nil {
+			log.Printf("Failed to close ClickHouse read replica connection %s: %v", name, err)
+		}
+	}
+	if err := storage.Close(); err != nil {
+		log.Printf("Failed to close storage: %v", err)
 	}
 }
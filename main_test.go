@@ -0,0 +1,429 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
+	"github.com/go-chi/chi/v5"
+	"github.com/orian/clicktelligence/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseLimit(t *testing.T) {
+	tests := []struct {
+		name    string
+		query   string
+		want    int
+		wantErr bool
+	}{
+		{name: "unset uses default", query: "", want: 50},
+		{name: "explicit", query: "?limit=10", want: 10},
+		{name: "capped", query: "?limit=10000", want: 500},
+		{name: "zero", query: "?limit=0", wantErr: true},
+		{name: "not a number", query: "?limit=ten", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/api/activity"+tt.query, nil)
+			got, err := parseLimit(r, DefaultActivityLimit, MaxActivityLimit)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestParseOffset(t *testing.T) {
+	for query, want := range map[string]int{"": 0, "?offset=0": 0, "?offset=20": 20} {
+		got, err := parseOffset(httptest.NewRequest(http.MethodGet, "/api/versions/v/tags"+query, nil))
+		require.NoError(t, err)
+		assert.Equal(t, want, got, query)
+	}
+	for _, query := range []string{"?offset=-1", "?offset=ten"} {
+		_, err := parseOffset(httptest.NewRequest(http.MethodGet, "/api/versions/v/tags"+query, nil))
+		assert.Error(t, err, query)
+	}
+}
+
+func TestHandleGetVersionTagsPage(t *testing.T) {
+	storage := newTestStorage(t)
+	server := NewServer(storage, nil, nil)
+
+	branch, err := storage.CreateBranch(t.Context(), "tags", "", "")
+	require.NoError(t, err)
+	version := saveTestVersion(t, storage, branch.ID, "", "SELECT 1")
+	for _, tag := range []string{"env:prod", "env:staging", "env:dev", "candidate"} {
+		_, err := storage.AddTag(t.Context(), version.ID, tag)
+		require.NoError(t, err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/api/versions/"+version.ID+"/tags?prefix=env:&limit=2&offset=1", nil)
+	rctx := chi.NewRouteContext()
+	rctx.URLParams.Add("versionId", version.ID)
+	req = req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, rctx))
+	rec := httptest.NewRecorder()
+	server.handleGetVersionTags(rec, req)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	assert.Equal(t, "3", rec.Header().Get(TotalCountHeader))
+
+	var tags []*models.VersionTag
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&tags))
+	assert.Len(t, tags, 2)
+}
+
+func TestHandleReservedTags(t *testing.T) {
+	storage := newTestStorage(t)
+	storage.SetReservedTagPrefixes(models.ReservedTagPrefixes{"ci:"})
+	server := NewServer(storage, nil, nil)
+
+	branch, err := storage.CreateBranch(t.Context(), "tags", "", "")
+	require.NoError(t, err)
+	version := saveTestVersion(t, storage, branch.ID, "", "SELECT 1")
+
+	req := httptest.NewRequest(http.MethodPost, "/api/versions/"+version.ID+"/tags", strings.NewReader(`{"tag": "ci:build=42"}`))
+	rctx := chi.NewRouteContext()
+	rctx.URLParams.Add("versionId", version.ID)
+	req = req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, rctx))
+	rec := httptest.NewRecorder()
+	server.handleAddTag(rec, req)
+	assert.Equal(t, http.StatusForbidden, rec.Code, rec.Body.String())
+
+	ciTag, err := storage.addTagLocked(t.Context(), version.ID, "ci:build=42")
+	require.NoError(t, err)
+	req = httptest.NewRequest(http.MethodDelete, "/api/tags/"+ciTag.ID, nil)
+	rctx = chi.NewRouteContext()
+	rctx.URLParams.Add("tagId", ciTag.ID)
+	req = req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, rctx))
+	rec = httptest.NewRecorder()
+	server.handleDeleteTag(rec, req)
+	assert.Equal(t, http.StatusForbidden, rec.Code, rec.Body.String())
+}
+
+func TestHandleLookupQuery(t *testing.T) {
+	storage := newTestStorage(t)
+	server := NewServer(storage, nil, nil)
+
+	mainBranch, err := storage.CreateBranch(t.Context(), "main", "", "")
+	require.NoError(t, err)
+	other, err := storage.CreateBranch(t.Context(), "other", "", "")
+	require.NoError(t, err)
+	saveTestVersion(t, storage, mainBranch.ID, "", "SELECT 1")
+	saveTestVersion(t, storage, mainBranch.ID, "", "SELECT 2")
+	latest := saveTestVersion(t, storage, other.ID, "", "SELECT  1")
+
+	lookup := func(params string) (*httptest.ResponseRecorder, models.HashLookup) {
+		rec := httptest.NewRecorder()
+		server.handleLookupQuery(rec, httptest.NewRequest(http.MethodGet, "/api/query/lookup?"+params, nil))
+		var result models.HashLookup
+		if rec.Code == http.StatusOK {
+			require.NoError(t, json.NewDecoder(rec.Body).Decode(&result))
+		}
+		return rec, result
+	}
+
+	rec, result := lookup("query=" + url.QueryEscape("SELECT 1"))
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	assert.Equal(t, 2, result.Count)
+	assert.Equal(t, latest.ID, result.LatestVersionID)
+	assert.Equal(t, other.ID, result.LatestBranchID)
+	assert.NotNil(t, result.LatestTimestamp)
+
+	rec, result = lookup("hash=" + hashQuery("SELECT 3"))
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	assert.Zero(t, result.Count)
+	assert.Empty(t, result.LatestVersionID)
+
+	rec, _ = lookup("")
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	rec, _ = lookup("hash=abc&query=SELECT+1")
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
+
+func TestHandleSetBranchHead(t *testing.T) {
+	storage := newTestStorage(t)
+	server := NewServer(storage, nil, nil)
+
+	branch, err := storage.CreateBranch(t.Context(), "head", "", "")
+	require.NoError(t, err)
+	first := saveTestVersion(t, storage, branch.ID, "", "SELECT 1")
+	saveTestVersion(t, storage, branch.ID, first.ID, "SELECT 2")
+	other, err := storage.CreateBranch(t.Context(), "other", "", "")
+	require.NoError(t, err)
+	foreign := saveTestVersion(t, storage, other.ID, "", "SELECT 3")
+
+	setHead := func(versionID string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/api/branches/"+branch.ID+"/head", strings.NewReader(`{"versionId": "`+versionID+`"}`))
+		rctx := chi.NewRouteContext()
+		rctx.URLParams.Add("branchId", branch.ID)
+		req = req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, rctx))
+		rec := httptest.NewRecorder()
+		server.handleSetBranchHead(rec, req)
+		return rec
+	}
+
+	rec := setHead(first.ID)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	var head VersionDetail
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&head))
+	assert.Equal(t, first.ID, head.ID)
+
+	assert.Equal(t, http.StatusBadRequest, setHead(foreign.ID).Code)
+	assert.Equal(t, http.StatusNotFound, setHead("missing").Code)
+	assert.Equal(t, http.StatusBadRequest, setHead("").Code)
+}
+
+func TestHandleCreateBranchInitialQuery(t *testing.T) {
+	storage := newTestStorage(t)
+	server := NewServer(storage, nil, nil)
+
+	tests := []struct {
+		name      string
+		body      string
+		wantCode  int
+		wantQuery string
+	}{
+		{name: "blank initial query", body: `{"name":"blank","createInitialVersion":true,"initialQuery":"  "}`, wantCode: http.StatusBadRequest},
+		{name: "explicit initial query", body: `{"name":"explicit","createInitialVersion":true,"initialQuery":"SELECT 2"}`, wantCode: http.StatusOK, wantQuery: "SELECT 2"},
+		{name: "omitted initial query uses placeholder", body: `{"name":"placeholder","createInitialVersion":true}`, wantCode: http.StatusOK, wantQuery: "SELECT 1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			server.handleCreateBranch(rec, httptest.NewRequest(http.MethodPost, "/api/branches", strings.NewReader(tt.body)))
+			require.Equal(t, tt.wantCode, rec.Code)
+			if tt.wantQuery == "" {
+				return
+			}
+
+			var created models.Branch
+			require.NoError(t, json.NewDecoder(rec.Body).Decode(&created))
+			branch, ok := storage.GetBranch(t.Context(), created.ID)
+			require.True(t, ok)
+			version, ok := storage.GetVersion(t.Context(), branch.CurrentVersionID)
+			require.True(t, ok)
+			assert.Contains(t, version.Query, tt.wantQuery)
+		})
+	}
+}
+
+func TestMaxQueryLength(t *testing.T) {
+	server := NewServer(newTestStorage(t), nil, nil)
+	server.maxQueryLength = 16
+
+	rec := httptest.NewRecorder()
+	body := `{"branchId":"main","query":"SELECT 1234567890"}`
+	server.handleExplainQuery(rec, httptest.NewRequest(http.MethodPost, "/api/query/explain", strings.NewReader(body)))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, rec.Code)
+	assert.Contains(t, rec.Body.String(), "limit 16 bytes")
+
+	rec = httptest.NewRecorder()
+	body = `{"name":"long","createInitialVersion":true,"initialQuery":"SELECT 1234567890"}`
+	server.handleCreateBranch(rec, httptest.NewRequest(http.MethodPost, "/api/branches", strings.NewReader(body)))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, rec.Code)
+
+	rec = httptest.NewRecorder()
+	body = `{"name":"exact","createInitialVersion":true,"initialQuery":" SELECT 123456789 "}`
+	server.handleCreateBranch(rec, httptest.NewRequest(http.MethodPost, "/api/branches", strings.NewReader(body)))
+	assert.Equal(t, http.StatusOK, rec.Code)
+}
+
+func TestHandleExplainQueryForceRefresh(t *testing.T) {
+	storage := newTestStorage(t)
+	conn := NewConnManager(func() (driver.Conn, error) {
+		return &echoConn{versionConn{serverVersion: "25.3"}}, nil
+	}, 0)
+	server := NewServer(storage, map[string]*ConnManager{DefaultProfile: conn}, nil)
+
+	branch, err := storage.CreateBranch(t.Context(), "refresh", "", "")
+	require.NoError(t, err)
+
+	explain := func(parentID string, forceRefresh bool) map[string]interface{} {
+		t.Helper()
+		body, err := json.Marshal(ExplainRequest{
+			BranchID:        branch.ID,
+			Query:           "SELECT 1",
+			ParentVersionID: parentID,
+			ExplainConfigs:  []models.ExplainConfig{{Type: models.ExplainPlan, Enabled: true}},
+			ForceRefresh:    forceRefresh,
+		})
+		require.NoError(t, err)
+		rec := httptest.NewRecorder()
+		server.handleExplainQuery(rec, httptest.NewRequest(http.MethodPost, "/api/query/explain", bytes.NewReader(body)))
+		require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+		var response map[string]interface{}
+		require.NoError(t, json.NewDecoder(rec.Body).Decode(&response))
+		return response
+	}
+	versionID := func(response map[string]interface{}) string {
+		return response["version"].(map[string]interface{})["id"].(string)
+	}
+
+	first := explain("", false)
+	cached := explain(versionID(first), false)
+	assert.Equal(t, true, cached["resultsReused"])
+	assert.Equal(t, versionID(first), versionID(cached))
+
+	refreshed := explain(versionID(first), true)
+	assert.Equal(t, false, refreshed["resultsReused"])
+	assert.NotEqual(t, versionID(first), versionID(refreshed))
+
+	history, err := storage.GetBranchHistory(t.Context(), branch.ID)
+	require.NoError(t, err)
+	assert.Len(t, history, 2)
+}
+
+func TestHandleExplainQueryIdempotentReplay(t *testing.T) {
+	storage := newTestStorage(t)
+	conn := NewConnManager(func() (driver.Conn, error) {
+		return &echoConn{versionConn{serverVersion: "25.3"}}, nil
+	}, 0)
+	server := NewServer(storage, map[string]*ConnManager{DefaultProfile: conn}, nil)
+	server.idempotency = newIdempotencyCache(DefaultIdempotencyWindow)
+	now := time.Date(2026, 3, 1, 12, 30, 0, 0, time.UTC)
+	server.now = func() time.Time { return now }
+
+	body, err := json.Marshal(ExplainRequest{
+		BranchID:       "main",
+		Query:          "SELECT 1",
+		ExplainConfigs: []models.ExplainConfig{{Type: models.ExplainPlan, Enabled: true}},
+	})
+	require.NoError(t, err)
+	explain := func() (*httptest.ResponseRecorder, map[string]interface{}) {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodPost, "/api/query/explain", bytes.NewReader(body))
+		req.Header.Set(IdempotencyKeyHeader, "retry-1")
+		rec := httptest.NewRecorder()
+		server.handleExplainQuery(rec, req)
+		require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+		var response map[string]interface{}
+		require.NoError(t, json.NewDecoder(rec.Body).Decode(&response))
+		return rec, response
+	}
+
+	_, first := explain()
+	assert.Equal(t, "2026-03-01T12:30:00Z", first["serverTime"])
+
+	now = now.Add(time.Minute)
+	rec, replayed := explain()
+	assert.Equal(t, "true", rec.Header().Get("Idempotent-Replayed"))
+	assert.Equal(t, "2026-03-01T12:31:00Z", replayed["serverTime"])
+	assert.Equal(t, first["version"], replayed["version"])
+}
+
+func TestHandleExplainQueryDryRun(t *testing.T) {
+	storage := newTestStorage(t)
+	conn := NewConnManager(func() (driver.Conn, error) {
+		return nil, errors.New("dry runs must not connect")
+	}, 0)
+	server := NewServer(storage, map[string]*ConnManager{DefaultProfile: conn}, nil)
+
+	branch, err := storage.CreateBranch(t.Context(), "preview", "", "")
+	require.NoError(t, err)
+
+	body, err := json.Marshal(ExplainRequest{
+		BranchID:           branch.ID,
+		Query:              "SELECT 1",
+		MaxExecutionTimeMs: 2000,
+		ExplainConfigs: []models.ExplainConfig{
+			{Type: models.ExplainPlan, Enabled: true, BothFormats: true},
+			{Type: models.ExplainPipeline, Enabled: false},
+			{Type: models.ExplainEstimate, Enabled: true},
+		},
+	})
+	require.NoError(t, err)
+	rec := httptest.NewRecorder()
+	server.handleExplainQuery(rec, httptest.NewRequest(http.MethodPost, "/api/query/explain?dryRun=true", bytes.NewReader(body)))
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+	var queries []DryRunQuery
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&queries))
+	require.Len(t, queries, 3)
+	assert.Equal(t, models.ExplainPlan, queries[0].Type)
+	assert.True(t, strings.HasPrefix(queries[0].SQL, "EXPLAIN PLAN json=0 SELECT 1 SETTINGS log_comment="))
+	assert.Contains(t, queries[1].SQL, "EXPLAIN PLAN json=1 SELECT 1")
+	assert.Equal(t, models.ExplainEstimate, queries[2].Type)
+	assert.Contains(t, queries[2].SQL, "max_execution_time=2.000")
+
+	history, err := storage.GetBranchHistory(t.Context(), branch.ID)
+	require.NoError(t, err)
+	assert.Empty(t, history)
+}
+
+func TestHandleGetBranchesETag(t *testing.T) {
+	storage := newTestStorage(t)
+	server := NewServer(storage, nil, nil)
+
+	get := func(ifNoneMatch string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/api/branches", nil)
+		if ifNoneMatch != "" {
+			req.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		rec := httptest.NewRecorder()
+		server.handleGetBranches(rec, req)
+		return rec
+	}
+
+	first := get("")
+	require.Equal(t, http.StatusOK, first.Code)
+	etag := first.Header().Get("ETag")
+	require.True(t, strings.HasPrefix(etag, `W/"`), etag)
+
+	rec := get(etag)
+	assert.Equal(t, http.StatusNotModified, rec.Code)
+	assert.Empty(t, rec.Body.String())
+	assert.Equal(t, http.StatusNotModified, get(`"other", `+strings.TrimPrefix(etag, "W/")).Code)
+
+	_, err := storage.CreateBranch(t.Context(), "feature", "", "")
+	require.NoError(t, err)
+	rec = get(etag)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.NotEqual(t, etag, rec.Header().Get("ETag"))
+}
+
+func TestHandleGetHistoryServerTime(t *testing.T) {
+	server := NewServer(newTestStorage(t), nil, nil)
+	server.now = func() time.Time { return time.Date(2026, 3, 1, 12, 30, 0, 0, time.UTC) }
+
+	rec := httptest.NewRecorder()
+	server.handleGetHistory(rec, httptest.NewRequest(http.MethodGet, "/api/history?branchId=main", nil))
+
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "2026-03-01T12:30:00Z", rec.Header().Get(ServerTimeHeader))
+}
+
+func TestHandleGetHistorySort(t *testing.T) {
+	server := NewServer(newTestStorage(t), nil, nil)
+
+	tests := []struct {
+		url  string
+		want int
+	}{
+		{"/api/history?branchId=main&tag=released&sort=tagged", http.StatusOK},
+		{"/api/history?branchId=main&sort=timestamp", http.StatusOK},
+		{"/api/history?branchId=main&sort=tagged", http.StatusBadRequest},
+		{"/api/history?branchId=main&tag=released&sort=name", http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.url, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			server.handleGetHistory(rec, httptest.NewRequest(http.MethodGet, tt.url, nil))
+			assert.Equal(t, tt.want, rec.Code, rec.Body.String())
+		})
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"time"
+
+	"github.com/orian/clicktelligence/models"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Outcome label values for explain metrics.
+const (
+	outcomeSuccess = "success"
+	outcomeError   = "error"
+	outcomeCached  = "cached"
+)
+
+// Metrics are registered with the default Prometheus registry at package
+// initialization and served on /metrics.
+var (
+	explainRequestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "clicktelligence_explain_requests_total",
+		Help: "Explain requests handled, by outcome.",
+	}, []string{"outcome"})
+
+	explainExecutionsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "clicktelligence_explain_executions_total",
+		Help: "EXPLAIN results produced, by EXPLAIN type and outcome.",
+	}, []string{"type", "outcome"})
+
+	explainDurationSeconds = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "clicktelligence_explain_duration_seconds",
+		Help:    "Latency of EXPLAIN queries against ClickHouse, by EXPLAIN type.",
+		Buckets: prometheus.ExponentialBuckets(0.005, 2, 12),
+	}, []string{"type"})
+
+	autoBranchesTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "clicktelligence_auto_branches_total",
+		Help: "Branches created automatically when editing a non-head version.",
+	})
+)
+
+// observeExplainResult records the outcome and latency of one EXPLAIN execution.
+func observeExplainResult(result models.ExplainResult, elapsed time.Duration) {
+	outcome := outcomeSuccess
+	if result.Error != "" {
+		outcome = outcomeError
+	}
+	explainExecutionsTotal.WithLabelValues(string(result.Type), outcome).Inc()
+	explainDurationSeconds.WithLabelValues(string(result.Type)).Observe(elapsed.Seconds())
+}
+
+// observeCachedResults counts the results of a version reused from cache.
+func observeCachedResults(results []models.ExplainResult) {
+	for _, result := range results {
+		if result.Skipped {
+			continue
+		}
+		explainExecutionsTotal.WithLabelValues(string(result.Type), outcomeCached).Inc()
+	}
+}
+
+// observeExplainRequest records the outcome of an explain request.
+func observeExplainRequest(response map[string]interface{}, err error) {
+	outcome := outcomeSuccess
+	if err != nil {
+		outcome = outcomeError
+	} else if reused, _ := response["resultsReused"].(bool); reused {
+		outcome = outcomeCached
+	}
+	explainRequestsTotal.WithLabelValues(outcome).Inc()
+}
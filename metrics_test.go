@@ -0,0 +1,47 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/orian/clicktelligence/models"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestObserveExplainResult(t *testing.T) {
+	success := explainExecutionsTotal.WithLabelValues("AST", outcomeSuccess)
+	failure := explainExecutionsTotal.WithLabelValues("AST", outcomeError)
+	beforeSuccess, beforeFailure := testutil.ToFloat64(success), testutil.ToFloat64(failure)
+
+	observeExplainResult(models.ExplainResult{Type: models.ExplainAST}, 10*time.Millisecond)
+	observeExplainResult(models.ExplainResult{Type: models.ExplainAST, Error: "boom"}, 10*time.Millisecond)
+
+	assert.Equal(t, beforeSuccess+1, testutil.ToFloat64(success))
+	assert.Equal(t, beforeFailure+1, testutil.ToFloat64(failure))
+}
+
+func TestObserveExplainRequest(t *testing.T) {
+	tests := []struct {
+		name     string
+		response map[string]interface{}
+		err      error
+		outcome  string
+	}{
+		{name: "executed", response: map[string]interface{}{"resultsReused": false}, outcome: outcomeSuccess},
+		{name: "reused", response: map[string]interface{}{"resultsReused": true}, outcome: outcomeCached},
+		{name: "failed", err: errors.New("boom"), outcome: outcomeError},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			counter := explainRequestsTotal.WithLabelValues(tt.outcome)
+			before := testutil.ToFloat64(counter)
+
+			observeExplainRequest(tt.response, tt.err)
+
+			assert.Equal(t, before+1, testutil.ToFloat64(counter))
+		})
+	}
+}
@@ -1,10 +1,16 @@
 package main
 
 import (
+	"context"
 	"database/sql"
+	"encoding/json"
 	"fmt"
 	"log"
+	"maps"
+	"slices"
 	"time"
+
+	"github.com/orian/clicktelligence/models"
 )
 
 // Migration represents a database migration
@@ -12,6 +18,26 @@ type Migration struct {
 	Version     int
 	Description string
 	SQL         string
+
+	// DownSQL reverts SQL. Empty means the migration is not reversible.
+	DownSQL string
+
+	// Backfill, if set, runs after SQL in the same transaction, for data
+	// changes SQL can't express.
+	Backfill func(ctx context.Context, tx *sql.Tx) error
+
+	// Rewrite, if set, runs on the database before the migration's
+	// transaction, for changes DuckDB can't make within one transaction,
+	// such as updating indexed columns of tagged versions. It must be
+	// idempotent: if the migration fails afterwards, it runs again on the
+	// next attempt. A migration with only a Rewrite is reversible without
+	// DownSQL; rolling it back keeps the rewritten data.
+	Rewrite func(ctx context.Context, db *sql.DB) error
+}
+
+// reversible reports whether RollbackMigration can revert the migration.
+func (m Migration) reversible() bool {
+	return m.DownSQL != "" || (m.SQL == "" && m.Rewrite != nil)
 }
 
 // GetMigrations returns all migrations in order
@@ -31,13 +57,182 @@ func GetMigrations() []Migration {
 				);
 			`,
 		},
+		{
+			Version:     2,
+			Description: "Add pinned flag to branches",
+			SQL: `
+				ALTER TABLE branches ADD COLUMN IF NOT EXISTS pinned BOOLEAN DEFAULT false;
+			`,
+			DownSQL: `
+				ALTER TABLE branches DROP COLUMN IF EXISTS pinned;
+			`,
+		},
+		{
+			// DuckDB only uses single-column ART indexes for filter lookups, so
+			// branch history is indexed on branch_id alone and the few matching
+			// rows are sorted by timestamp after the lookup.
+			//
+			// DuckDB refuses to DROP COLUMN on an indexed table or one
+			// referenced by a foreign key, which rules it out for
+			// query_versions; see migration 7 for the alternative.
+			Version:     3,
+			Description: "Index query_versions by branch and parent",
+			SQL: `
+				CREATE INDEX IF NOT EXISTS idx_versions_branch ON query_versions(branch_id);
+				CREATE INDEX IF NOT EXISTS idx_versions_parent ON query_versions(parent_version_id);
+			`,
+			DownSQL: `
+				DROP INDEX IF EXISTS idx_versions_parent;
+				DROP INDEX IF EXISTS idx_versions_branch;
+			`,
+		},
+		{
+			Version:     4,
+			Description: "Index query_versions by query hash",
+			SQL: `
+				CREATE INDEX IF NOT EXISTS idx_versions_hash ON query_versions(query_hash);
+			`,
+			DownSQL: `
+				DROP INDEX IF EXISTS idx_versions_hash;
+			`,
+		},
+		{
+			Version:     5,
+			Description: "Add archived flag to branches",
+			SQL: `
+				ALTER TABLE branches ADD COLUMN IF NOT EXISTS archived BOOLEAN DEFAULT false;
+			`,
+			DownSQL: `
+				ALTER TABLE branches DROP COLUMN IF EXISTS archived;
+			`,
+		},
+		{
+			Version:     6,
+			Description: "Add per-branch default EXPLAIN configs",
+			SQL: `
+				ALTER TABLE branches ADD COLUMN IF NOT EXISTS explain_configs TEXT;
+			`,
+			DownSQL: `
+				ALTER TABLE branches DROP COLUMN IF EXISTS explain_configs;
+			`,
+		},
+		{
+			Version:     7,
+			Description: "Add merge parent to query_versions",
+			SQL: `
+				ALTER TABLE query_versions ADD COLUMN IF NOT EXISTS merge_parent_version_id VARCHAR;
+			`,
+			// The version_tags foreign key keeps DuckDB from altering
+			// query_versions even with the indexes dropped, so rolling back
+			// clears the column instead of dropping it. SQL re-applies
+			// cleanly thanks to IF NOT EXISTS.
+			DownSQL: `
+				UPDATE query_versions SET merge_parent_version_id = NULL;
+			`,
+		},
+		{
+			Version:     8,
+			Description: "Record EXPLAIN configs per version",
+			SQL: `
+				ALTER TABLE query_versions ADD COLUMN IF NOT EXISTS explain_configs TEXT;
+			`,
+			// Cleared rather than dropped, see migration 7
+			DownSQL: `
+				UPDATE query_versions SET explain_configs = NULL;
+			`,
+		},
+		{
+			Version:     9,
+			Description: "Add notes to query_versions",
+			SQL: `
+				ALTER TABLE query_versions ADD COLUMN IF NOT EXISTS notes TEXT;
+			`,
+			// Cleared rather than dropped, see migration 7
+			DownSQL: `
+				UPDATE query_versions SET notes = NULL;
+			`,
+		},
+		{
+			Version:     10,
+			Description: "Add per-branch default max_execution_time",
+			SQL: `
+				ALTER TABLE branches ADD COLUMN IF NOT EXISTS max_execution_time_ms INTEGER;
+			`,
+			DownSQL: `
+				ALTER TABLE branches DROP COLUMN IF EXISTS max_execution_time_ms;
+			`,
+		},
+		{
+			Version:     11,
+			Description: "Add has_error and result_count to query_versions",
+			SQL: `
+				ALTER TABLE query_versions ADD COLUMN IF NOT EXISTS has_error BOOLEAN;
+				ALTER TABLE query_versions ADD COLUMN IF NOT EXISTS result_count INTEGER;
+			`,
+			// The results may be compressed, so they are decoded in Go
+			Backfill: backfillResultColumns,
+			// Cleared rather than dropped, see migration 7
+			DownSQL: `
+				UPDATE query_versions SET has_error = NULL, result_count = NULL;
+			`,
+		},
+		{
+			Version:     12,
+			Description: "Add detached_tags for tags set aside during version rewrites",
+			SQL: `
+				CREATE TABLE IF NOT EXISTS detached_tags (
+					id VARCHAR PRIMARY KEY,
+					version_id VARCHAR NOT NULL,
+					tag_key VARCHAR NOT NULL,
+					tag_value VARCHAR,
+					created_at TIMESTAMP NOT NULL
+				);
+			`,
+			DownSQL: `
+				DROP TABLE IF EXISTS detached_tags;
+			`,
+		},
+		{
+			Version:     13,
+			Description: "Re-hash version queries in normalized form",
+			// Older binaries hash the verbatim query, so after a rollback
+			// the rewritten hashes only miss the unchanged-query cache.
+			Rewrite: rehashQueries,
+		},
+		{
+			// The index on both columns of the branch history query, WHERE
+			// branch_id = ? ORDER BY timestamp DESC. DuckDB accepts but
+			// ignores the DESC, and only uses single-column indexes for
+			// lookups, so idx_versions_branch of migration 3 stays to serve
+			// the query.
+			Version:     14,
+			Description: "Index query_versions by branch and timestamp",
+			SQL: `
+				CREATE INDEX IF NOT EXISTS idx_versions_branch_ts ON query_versions(branch_id, timestamp DESC);
+			`,
+			DownSQL: `
+				DROP INDEX IF EXISTS idx_versions_branch_ts;
+			`,
+		},
+		{
+			// NormalizeQuery stopped lowercasing words that can also be
+			// identifiers, so the hashes of migration 13 are redone.
+			Version:     15,
+			Description: "Re-hash version queries without lowercasing identifiers",
+			Rewrite:     rehashQueries,
+		},
 	}
 }
 
 // RunMigrations executes all pending migrations
 func RunMigrations(db *sql.DB) error {
-	// Create migrations table if it doesn't exist
-	_, err := db.Exec(`
+	_, err := applyMigrations(context.Background(), db)
+	return err
+}
+
+// ensureMigrationsTable creates the table recording applied migrations.
+func ensureMigrationsTable(ctx context.Context, db *sql.DB) error {
+	_, err := db.ExecContext(ctx, `
 		CREATE TABLE IF NOT EXISTS schema_migrations (
 			version INTEGER PRIMARY KEY,
 			description VARCHAR NOT NULL,
@@ -47,64 +242,305 @@ func RunMigrations(db *sql.DB) error {
 	if err != nil {
 		return fmt.Errorf("failed to create migrations table: %w", err)
 	}
+	return nil
+}
+
+// applyMigrations executes all pending migrations, each in its own
+// transaction, and returns the ones applied. On failure the migrations
+// applied before the failing one stay applied.
+func applyMigrations(ctx context.Context, db *sql.DB) ([]Migration, error) {
+	if err := ensureMigrationsTable(ctx, db); err != nil {
+		return nil, err
+	}
 
 	// Get current schema version
 	var currentVersion int
-	err = db.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_migrations").Scan(&currentVersion)
+	err := db.QueryRowContext(ctx, "SELECT COALESCE(MAX(version), 0) FROM schema_migrations").Scan(&currentVersion)
 	if err != nil {
-		return fmt.Errorf("failed to get current schema version: %w", err)
+		return nil, fmt.Errorf("failed to get current schema version: %w", err)
 	}
 
 	log.Printf("Current schema version: %d", currentVersion)
 
 	// Apply pending migrations
-	migrations := GetMigrations()
-	appliedCount := 0
-
-	for _, migration := range migrations {
+	var applied []Migration
+	for _, migration := range GetMigrations() {
 		if migration.Version <= currentVersion {
 			continue
 		}
 
 		log.Printf("Applying migration %d: %s", migration.Version, migration.Description)
 
+		if migration.Rewrite != nil {
+			if err := migration.Rewrite(ctx, db); err != nil {
+				return applied, fmt.Errorf("failed to rewrite for migration %d: %w", migration.Version, err)
+			}
+		}
+
 		// Start transaction
-		tx, err := db.Begin()
+		tx, err := db.BeginTx(ctx, nil)
 		if err != nil {
-			return fmt.Errorf("failed to begin transaction for migration %d: %w", migration.Version, err)
+			return applied, fmt.Errorf("failed to begin transaction for migration %d: %w", migration.Version, err)
 		}
 
 		// Execute migration SQL
-		_, err = tx.Exec(migration.SQL)
+		if migration.SQL != "" {
+			_, err = tx.ExecContext(ctx, migration.SQL)
+		}
+		if err == nil && migration.Backfill != nil {
+			err = migration.Backfill(ctx, tx)
+		}
 		if err != nil {
 			tx.Rollback()
-			return fmt.Errorf("failed to execute migration %d: %w", migration.Version, err)
+			return applied, fmt.Errorf("failed to execute migration %d: %w", migration.Version, err)
 		}
 
 		// Record migration
-		_, err = tx.Exec(
+		_, err = tx.ExecContext(ctx,
 			"INSERT INTO schema_migrations (version, description, applied_at) VALUES (?, ?, ?)",
 			migration.Version, migration.Description, time.Now(),
 		)
 		if err != nil {
 			tx.Rollback()
-			return fmt.Errorf("failed to record migration %d: %w", migration.Version, err)
+			return applied, fmt.Errorf("failed to record migration %d: %w", migration.Version, err)
 		}
 
 		// Commit transaction
 		if err := tx.Commit(); err != nil {
-			return fmt.Errorf("failed to commit migration %d: %w", migration.Version, err)
+			return applied, fmt.Errorf("failed to commit migration %d: %w", migration.Version, err)
 		}
 
 		log.Printf("Successfully applied migration %d", migration.Version)
-		appliedCount++
+		applied = append(applied, migration)
 	}
 
-	if appliedCount > 0 {
-		log.Printf("Applied %d migration(s)", appliedCount)
+	if len(applied) > 0 {
+		log.Printf("Applied %d migration(s)", len(applied))
 	} else {
 		log.Println("No pending migrations")
 	}
 
+	return applied, nil
+}
+
+// backfillResultColumns sets has_error and result_count of every version
+// from its stored results, see resultColumns.
+func backfillResultColumns(ctx context.Context, tx *sql.Tx) error {
+	rows, err := tx.QueryContext(ctx, "SELECT id, COALESCE(explain_results, '[]') FROM query_versions")
+	if err != nil {
+		return err
+	}
+	type versionResults struct{ id, stored string }
+	var versions []versionResults
+	for rows.Next() {
+		var v versionResults
+		if err := rows.Scan(&v.id, &v.stored); err != nil {
+			rows.Close()
+			return err
+		}
+		versions = append(versions, v)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, v := range versions {
+		var results []models.ExplainResult
+		if text := decompressVersionColumn(v.id, "explain_results", v.stored); text != "" {
+			if err := json.Unmarshal([]byte(text), &results); err != nil {
+				log.Printf("Warning: failed to unmarshal explain results for version %s: %v", v.id, err)
+			}
+		}
+		hasError, resultCount := resultColumns(results)
+		if _, err := tx.ExecContext(ctx, "UPDATE query_versions SET has_error = ?, result_count = ? WHERE id = ?", hasError, resultCount, v.id); err != nil {
+			return err
+		}
+	}
+	log.Printf("Backfilled has_error and result_count of %d version(s)", len(versions))
+	return nil
+}
+
+// rehashQueries sets query_hash of every version to hashQuery of its
+// query, which hashes the normalized form since hashes were first stored
+// verbatim. query_hash is indexed, so the tags of the versions to update
+// are detached first, in their own transaction; reattaching runs even if
+// the update fails, and at the next startup if the process dies.
+func rehashQueries(ctx context.Context, db *sql.DB) error {
+	rows, err := db.QueryContext(ctx, "SELECT id, query, query_hash FROM query_versions")
+	if err != nil {
+		return err
+	}
+	hashes := map[string]string{}
+	for rows.Next() {
+		var id, stored, hash string
+		if err := rows.Scan(&id, &stored, &hash); err != nil {
+			rows.Close()
+			return err
+		}
+		query := decompressVersionColumn(id, "query", stored)
+		if query == "" {
+			continue
+		}
+		if rehashed := hashQuery(query); rehashed != hash {
+			hashes[id] = rehashed
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if len(hashes) == 0 {
+		return nil
+	}
+
+	if err := detachTags(ctx, db, slices.Collect(maps.Keys(hashes))); err != nil {
+		return err
+	}
+	err = updateQueryHashes(ctx, db, hashes)
+	if reattachErr := reattachTags(context.WithoutCancel(ctx), db); err == nil {
+		err = reattachErr
+	}
+	if err != nil {
+		return err
+	}
+	log.Printf("Re-hashed the query of %d version(s)", len(hashes))
+	return nil
+}
+
+// updateQueryHashes sets query_hash of each version in hashes, by ID, in
+// one transaction.
+func updateQueryHashes(ctx context.Context, db *sql.DB, hashes map[string]string) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for id, hash := range hashes {
+		if _, err := tx.ExecContext(ctx, "UPDATE query_versions SET query_hash = ? WHERE id = ?", hash, id); err != nil {
+			return fmt.Errorf("failed to update query hash of version %s: %w", id, err)
+		}
+	}
+	return tx.Commit()
+}
+
+// checkSchemaVersion returns an error wrapping ErrSchemaAhead if a
+// migration newer than the last of GetMigrations is applied. A schema
+// behind the binary is fine; its migrations are pending.
+func checkSchemaVersion(ctx context.Context, db *sql.DB) error {
+	var currentVersion int
+	err := db.QueryRowContext(ctx, "SELECT COALESCE(MAX(version), 0) FROM schema_migrations").Scan(&currentVersion)
+	if err != nil {
+		return fmt.Errorf("failed to get current schema version: %w", err)
+	}
+
+	migrations := GetMigrations()
+	latest := migrations[len(migrations)-1].Version
+	if currentVersion > latest {
+		return fmt.Errorf("%w: database is at migration %d, this binary knows up to %d; upgrade clicktelligence or roll the database back", ErrSchemaAhead, currentVersion, latest)
+	}
+	return nil
+}
+
+// migrationStatus lists every known migration and whether it is applied,
+// oldest first.
+func migrationStatus(ctx context.Context, db *sql.DB) ([]models.MigrationStatus, error) {
+	rows, err := db.QueryContext(ctx, "SELECT version, applied_at FROM schema_migrations")
+	if err != nil {
+		return nil, fmt.Errorf("failed to query applied migrations: %w", err)
+	}
+	defer rows.Close()
+
+	appliedAt := make(map[int]time.Time)
+	for rows.Next() {
+		var version int
+		var at time.Time
+		if err := rows.Scan(&version, &at); err != nil {
+			return nil, fmt.Errorf("failed to scan migration: %w", err)
+		}
+		appliedAt[version] = at
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	migrations := GetMigrations()
+	statuses := make([]models.MigrationStatus, len(migrations))
+	for i, migration := range migrations {
+		statuses[i] = models.MigrationStatus{
+			Version:     migration.Version,
+			Description: migration.Description,
+			Reversible:  migration.reversible(),
+		}
+		if at, ok := appliedAt[migration.Version]; ok {
+			statuses[i].Applied = true
+			statuses[i].AppliedAt = &at
+		}
+	}
+	return statuses, nil
+}
+
+// RollbackMigration reverts applied migrations in reverse order until the
+// schema is at targetVersion. It refuses to start if any migration in the
+// range has no DownSQL.
+func RollbackMigration(db *sql.DB, targetVersion int) error {
+	if targetVersion < 0 {
+		return fmt.Errorf("invalid target version %d", targetVersion)
+	}
+
+	var currentVersion int
+	err := db.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_migrations").Scan(&currentVersion)
+	if err != nil {
+		return fmt.Errorf("failed to get current schema version: %w", err)
+	}
+
+	if targetVersion >= currentVersion {
+		log.Printf("Schema version %d is not above target %d, nothing to roll back", currentVersion, targetVersion)
+		return nil
+	}
+
+	// Collect migrations to revert, newest first
+	migrations := GetMigrations()
+	var pending []Migration
+	for i := len(migrations) - 1; i >= 0; i-- {
+		migration := migrations[i]
+		if migration.Version > targetVersion && migration.Version <= currentVersion {
+			if !migration.reversible() {
+				return fmt.Errorf("migration %d (%s) is not reversible", migration.Version, migration.Description)
+			}
+			pending = append(pending, migration)
+		}
+	}
+
+	for _, migration := range pending {
+		log.Printf("Rolling back migration %d: %s", migration.Version, migration.Description)
+
+		tx, err := db.Begin()
+		if err != nil {
+			return fmt.Errorf("failed to begin transaction for rollback %d: %w", migration.Version, err)
+		}
+
+		// A migration with only a Rewrite has nothing to revert
+		if migration.DownSQL != "" {
+			if _, err := tx.Exec(migration.DownSQL); err != nil {
+				tx.Rollback()
+				return fmt.Errorf("failed to roll back migration %d: %w", migration.Version, err)
+			}
+		}
+
+		if _, err := tx.Exec("DELETE FROM schema_migrations WHERE version = ?", migration.Version); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to unrecord migration %d: %w", migration.Version, err)
+		}
+
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("failed to commit rollback %d: %w", migration.Version, err)
+		}
+
+		log.Printf("Successfully rolled back migration %d", migration.Version)
+	}
+
+	log.Printf("Rolled back %d migration(s), schema version is now %d", len(pending), targetVersion)
 	return nil
 }
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/orian/clicktelligence/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// schemaVersion returns the highest applied migration version.
+func schemaVersion(t *testing.T, storage *DuckDBStorage) int {
+	t.Helper()
+	var version int
+	require.NoError(t, storage.db.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_migrations").Scan(&version))
+	return version
+}
+
+func TestMigrationVersionsAreSequential(t *testing.T) {
+	for i, migration := range GetMigrations() {
+		assert.Equal(t, i+1, migration.Version)
+		assert.NotEmpty(t, migration.Description)
+		assert.True(t, migration.SQL != "" || migration.Rewrite != nil, "migration %d does nothing", migration.Version)
+	}
+}
+
+func TestRollbackMigration(t *testing.T) {
+	latest := len(GetMigrations())
+
+	t.Run("rolls back to target and can re-apply", func(t *testing.T) {
+		storage := newTestStorage(t)
+		require.Equal(t, latest, schemaVersion(t, storage))
+
+		require.NoError(t, RollbackMigration(storage.db, 1))
+		assert.Equal(t, 1, schemaVersion(t, storage))
+
+		var count int
+		require.NoError(t, storage.db.QueryRow(
+			"SELECT COUNT(*) FROM information_schema.columns WHERE table_name = 'branches' AND column_name = 'pinned'",
+		).Scan(&count))
+		assert.Equal(t, 0, count)
+
+		require.NoError(t, RunMigrations(storage.db))
+		assert.Equal(t, latest, schemaVersion(t, storage))
+	})
+
+	t.Run("target at or above current is a no-op", func(t *testing.T) {
+		storage := newTestStorage(t)
+		require.NoError(t, RollbackMigration(storage.db, latest))
+		assert.Equal(t, latest, schemaVersion(t, storage))
+	})
+
+	t.Run("refuses irreversible migration", func(t *testing.T) {
+		storage := newTestStorage(t)
+		err := RollbackMigration(storage.db, 0)
+		assert.ErrorContains(t, err, "not reversible")
+		assert.Equal(t, latest, schemaVersion(t, storage))
+	})
+
+	t.Run("negative target", func(t *testing.T) {
+		storage := newTestStorage(t)
+		assert.Error(t, RollbackMigration(storage.db, -1))
+	})
+}
+
+func TestHistoryQueryUsesBranchIndex(t *testing.T) {
+	storage := newTestStorage(t)
+
+	// DuckDB picks index scans at runtime for selective filters, so the
+	// table needs enough rows for the lookup to beat a sequential scan.
+	_, err := storage.db.Exec(`
+		INSERT INTO query_versions (id, branch_id, query, query_hash, timestamp)
+		SELECT 'v' || i, 'b' || (i % 100), 'SELECT 1', 'hash', TIMESTAMP '2024-01-01' + INTERVAL (i) SECOND
+		FROM range(10000) t(i)
+	`)
+	require.NoError(t, err)
+
+	// The query of GetBranchHistory
+	var plan string
+	rows, err := storage.db.Query(`
+		EXPLAIN ANALYZE
+		SELECT id, branch_id, query, query_hash, COALESCE(explain_results, '[]'), COALESCE(execution_stats, '{}'), timestamp, COALESCE(parent_version_id, ''), COALESCE(merge_parent_version_id, ''), COALESCE(explain_configs, ''), COALESCE(notes, '')
+		FROM query_versions
+		WHERE branch_id = 'b5'
+		ORDER BY timestamp DESC
+	`)
+	require.NoError(t, err)
+	defer rows.Close()
+	for rows.Next() {
+		var kind, text string
+		require.NoError(t, rows.Scan(&kind, &text))
+		plan += text
+	}
+	require.NoError(t, rows.Err())
+
+	assert.Contains(t, plan, "Index Scan")
+	assert.NotContains(t, plan, "Sequential Scan")
+
+	history, err := storage.GetBranchHistory(t.Context(), "b5")
+	require.NoError(t, err)
+	require.Len(t, history, 100)
+	assert.Equal(t, "v9905", history[0].ID)
+	assert.Equal(t, "v5", history[99].ID)
+}
+
+func TestApplyMigrations(t *testing.T) {
+	latest := len(GetMigrations())
+	storage, err := NewDuckDBStorageWithoutMigrations(filepath.Join(t.TempDir(), "test.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() { storage.Close() })
+
+	statuses, err := storage.GetMigrationStatus(t.Context())
+	require.NoError(t, err)
+	require.Len(t, statuses, latest)
+	for _, status := range statuses {
+		assert.False(t, status.Applied, status.Version)
+		assert.Nil(t, status.AppliedAt)
+	}
+
+	applied, err := storage.ApplyMigrations(t.Context())
+	require.NoError(t, err)
+	require.Len(t, applied, latest)
+	assert.Equal(t, 1, applied[0].Version)
+	assert.True(t, applied[0].Applied)
+	assert.NotNil(t, applied[0].AppliedAt)
+	assert.Equal(t, latest, schemaVersion(t, storage))
+
+	applied, err = storage.ApplyMigrations(t.Context())
+	require.NoError(t, err)
+	assert.Empty(t, applied)
+
+	require.NoError(t, RollbackMigration(storage.db, latest-1))
+	statuses, err = storage.GetMigrationStatus(t.Context())
+	require.NoError(t, err)
+	assert.True(t, statuses[latest-2].Applied)
+	assert.False(t, statuses[latest-1].Applied)
+}
+
+func TestSchemaAheadOfBinary(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "ahead.db")
+	storage, err := NewDuckDBStorage(dbPath)
+	require.NoError(t, err)
+	require.NoError(t, storage.CheckSchemaVersion(t.Context()))
+
+	// A newer binary applied a migration this one doesn't know
+	_, err = storage.db.Exec("INSERT INTO schema_migrations (version, description, applied_at) VALUES (?, 'from the future', now())", len(GetMigrations())+1)
+	require.NoError(t, err)
+	assert.ErrorIs(t, storage.CheckSchemaVersion(t.Context()), ErrSchemaAhead)
+
+	server := NewServer(storage, nil, nil)
+	rec := httptest.NewRecorder()
+	server.handleHealth(rec, httptest.NewRequest(http.MethodGet, "/api/server/health", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	assert.Contains(t, rec.Body.String(), "database schema is newer than this binary")
+	require.NoError(t, storage.Close())
+
+	_, err = NewDuckDBStorage(dbPath)
+	assert.ErrorIs(t, err, ErrSchemaAhead)
+	_, err = NewReadOnlyDuckDBStorage(dbPath)
+	assert.ErrorIs(t, err, ErrSchemaAhead)
+}
+
+func TestBackfillResultColumns(t *testing.T) {
+	storage := newTestStorage(t)
+	storage.SetCompression(true)
+
+	branch, err := storage.CreateBranch(t.Context(), "backfill", "", "")
+	require.NoError(t, err)
+	failed := saveTestVersion(t, storage, branch.ID, "", "SELECT broken")
+	require.NoError(t, storage.UpdateVersionResults(t.Context(), failed.ID, []models.ExplainResult{
+		{Type: models.ExplainPlan, Output: "plan"},
+		{Type: models.ExplainEstimate, Error: "Query error: unknown table"},
+	}, nil, models.ExecutionStats{}))
+	skipped := saveTestVersion(t, storage, branch.ID, failed.ID, "SELECT 1")
+	require.NoError(t, storage.UpdateVersionResults(t.Context(), skipped.ID, []models.ExplainResult{
+		{Type: models.ExplainQueryTree, Error: skippedAnalyzerDisabled, Skipped: true},
+	}, nil, models.ExecutionStats{}))
+
+	columns := func(id string) (hasError sql.NullBool, resultCount sql.NullInt64) {
+		t.Helper()
+		require.NoError(t, storage.db.QueryRow("SELECT has_error, result_count FROM query_versions WHERE id = ?", id).Scan(&hasError, &resultCount))
+		return hasError, resultCount
+	}
+
+	require.NoError(t, RollbackMigration(storage.db, 10))
+	hasError, resultCount := columns(failed.ID)
+	assert.False(t, hasError.Valid)
+	assert.False(t, resultCount.Valid)
+
+	_, err = storage.ApplyMigrations(t.Context())
+	require.NoError(t, err)
+	hasError, resultCount = columns(failed.ID)
+	assert.True(t, hasError.Bool)
+	assert.Equal(t, int64(2), resultCount.Int64)
+	hasError, resultCount = columns(skipped.ID)
+	assert.True(t, hasError.Valid)
+	assert.False(t, hasError.Bool)
+	assert.Equal(t, int64(1), resultCount.Int64)
+}
+
+func TestRehashQueries(t *testing.T) {
+	storage := newTestStorage(t)
+	storage.SetCompression(true)
+
+	branch, err := storage.CreateBranch(t.Context(), "rehash", "", "")
+	require.NoError(t, err)
+	version := saveTestVersion(t, storage, branch.ID, "", "select  1")
+	_, err = storage.AddTag(t.Context(), version.ID, "reviewed")
+	require.NoError(t, err)
+
+	// Hashes stored before normalization were of the verbatim query
+	require.NoError(t, RollbackMigration(storage.db, 12))
+	require.NoError(t, detachTags(t.Context(), storage.db, []string{version.ID}))
+	verbatim := sha256.Sum256([]byte("select  1"))
+	_, err = storage.db.Exec("UPDATE query_versions SET query_hash = ? WHERE id = ?", hex.EncodeToString(verbatim[:]), version.ID)
+	require.NoError(t, err)
+	require.NoError(t, reattachTags(t.Context(), storage.db))
+
+	_, err = storage.ApplyMigrations(t.Context())
+	require.NoError(t, err)
+
+	found, err := storage.GetVersionsByHash(t.Context(), hashQuery("SELECT 1"))
+	require.NoError(t, err)
+	require.Len(t, found, 1)
+	assert.Equal(t, version.ID, found[0].ID)
+	require.Len(t, found[0].Tags, 1)
+	assert.Equal(t, "reviewed", found[0].Tags[0].TagKey)
+}
@@ -0,0 +1,183 @@
+package models
+
+import (
+	"fmt"
+	"strings"
+)
+
+// DiffOp says how a line of a diff relates the old and the new text.
+type DiffOp string
+
+const (
+	DiffEqual  DiffOp = "equal"
+	DiffDelete DiffOp = "delete"
+	DiffInsert DiffOp = "insert"
+)
+
+// DiffLine is a line of the old text (DiffDelete), the new text
+// (DiffInsert) or both (DiffEqual).
+type DiffLine struct {
+	Op   DiffOp `json:"op"`
+	Text string `json:"text"`
+}
+
+// maxDiffCells caps the lines compared pairwise by DiffLines, i.e. the
+// product of the changed lines of both texts. Larger changes are reported
+// as the old lines deleted and the new ones inserted.
+const maxDiffCells = 4_000_000
+
+// DiffLines returns a line diff turning old into new, based on their
+// longest common subsequence of lines.
+func DiffLines(old, new string) []DiffLine {
+	a, b := splitLines(old), splitLines(new)
+
+	// Common prefix and suffix lines don't need the quadratic comparison.
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+
+	lines := make([]DiffLine, 0, len(a)+len(b)-prefix-suffix)
+	for _, line := range a[:prefix] {
+		lines = append(lines, DiffLine{Op: DiffEqual, Text: line})
+	}
+	lines = append(lines, diffMiddle(a[prefix:len(a)-suffix], b[prefix:len(b)-suffix])...)
+	for _, line := range a[len(a)-suffix:] {
+		lines = append(lines, DiffLine{Op: DiffEqual, Text: line})
+	}
+	return lines
+}
+
+func splitLines(text string) []string {
+	if text == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(text, "\n"), "\n")
+}
+
+// diffMiddle diffs a and b with a longest common subsequence table.
+func diffMiddle(a, b []string) []DiffLine {
+	var lines []DiffLine
+	if len(a)*len(b) > maxDiffCells {
+		for _, line := range a {
+			lines = append(lines, DiffLine{Op: DiffDelete, Text: line})
+		}
+		for _, line := range b {
+			lines = append(lines, DiffLine{Op: DiffInsert, Text: line})
+		}
+		return lines
+	}
+
+	// lcs[i][j] is the length of the common subsequence of a[i:] and b[j:].
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] == b[j]:
+			lines = append(lines, DiffLine{Op: DiffEqual, Text: a[i]})
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			lines = append(lines, DiffLine{Op: DiffDelete, Text: a[i]})
+			i++
+		default:
+			lines = append(lines, DiffLine{Op: DiffInsert, Text: b[j]})
+			j++
+		}
+	}
+	for ; i < len(a); i++ {
+		lines = append(lines, DiffLine{Op: DiffDelete, Text: a[i]})
+	}
+	for ; j < len(b); j++ {
+		lines = append(lines, DiffLine{Op: DiffInsert, Text: b[j]})
+	}
+	return lines
+}
+
+// ExplainDiff compares the results of one EXPLAIN type of two versions.
+type ExplainDiff struct {
+	Type ExplainType `json:"type"`
+
+	// Changed is true when the outputs or errors differ.
+	Changed bool `json:"changed"`
+
+	// Lines diffs the old output into the new one, see diffText. An output
+	// missing on one side, e.g. for an EXPLAIN type only one version ran,
+	// is empty.
+	Lines []DiffLine `json:"lines"`
+
+	OldError string `json:"oldError,omitempty"`
+	NewError string `json:"newError,omitempty"`
+}
+
+// DiffExplainResults diffs the first executed result of each EXPLAIN type
+// in old and new. Types are ordered as in new, followed by those only in
+// old.
+func DiffExplainResults(old, new []ExplainResult) []ExplainDiff {
+	oldByType := firstResultByType(old)
+	newByType := firstResultByType(new)
+
+	var types []ExplainType
+	seen := make(map[ExplainType]bool)
+	for _, results := range [][]ExplainResult{new, old} {
+		for _, result := range results {
+			if !result.Skipped && !seen[result.Type] {
+				seen[result.Type] = true
+				types = append(types, result.Type)
+			}
+		}
+	}
+
+	diffs := make([]ExplainDiff, 0, len(types))
+	for _, t := range types {
+		o, n := oldByType[t], newByType[t]
+		diffs = append(diffs, ExplainDiff{
+			Type:     t,
+			Changed:  diffText(o) != diffText(n) || o.Error != n.Error,
+			Lines:    DiffLines(diffText(o), diffText(n)),
+			OldError: o.Error,
+			NewError: n.Error,
+		})
+	}
+	return diffs
+}
+
+func firstResultByType(results []ExplainResult) map[ExplainType]ExplainResult {
+	byType := make(map[ExplainType]ExplainResult)
+	for _, result := range results {
+		if _, ok := byType[result.Type]; !ok && !result.Skipped {
+			byType[result.Type] = result
+		}
+	}
+	return byType
+}
+
+// diffText is the text of a result compared by DiffExplainResults: the
+// output, or a line per table for ESTIMATE results, which have none.
+func diffText(result ExplainResult) string {
+	if result.Type != ExplainEstimate {
+		return result.Output
+	}
+	var b strings.Builder
+	for _, row := range result.Estimate {
+		fmt.Fprintf(&b, "%s.%s parts=%d rows=%d marks=%d\n", row.Database, row.Table, row.Parts, row.Rows, row.Marks)
+	}
+	return b.String()
+}
@@ -0,0 +1,49 @@
+package models
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiffLines(t *testing.T) {
+	lines := DiffLines("Expression\n  Filter\n    ReadFromMergeTree\n", "Expression\n  ReadFromMergeTree\n  Limit")
+	assert.Equal(t, []DiffLine{
+		{Op: DiffEqual, Text: "Expression"},
+		{Op: DiffDelete, Text: "  Filter"},
+		{Op: DiffDelete, Text: "    ReadFromMergeTree"},
+		{Op: DiffInsert, Text: "  ReadFromMergeTree"},
+		{Op: DiffInsert, Text: "  Limit"},
+	}, lines)
+
+	assert.Equal(t, []DiffLine{{Op: DiffInsert, Text: "Expression"}}, DiffLines("", "Expression"))
+	assert.Empty(t, DiffLines("", ""))
+	assert.NotNil(t, DiffLines("", ""))
+}
+
+func TestDiffExplainResults(t *testing.T) {
+	old := []ExplainResult{
+		{Type: ExplainPlan, Output: "Expression\nReadFromMergeTree"},
+		{Type: ExplainSyntax, Output: "SELECT 1"},
+		{Type: ExplainPipeline, Skipped: true, Error: "skipped"},
+	}
+	new := []ExplainResult{
+		{Type: ExplainEstimate, Estimate: []EstimateRow{{Database: "db", Table: "t", Parts: 1, Rows: 10, Marks: 2}}},
+		{Type: ExplainPlan, Output: "Expression\nReadFromMergeTree"},
+		{Type: ExplainPlan, Output: "ignored, only the first result of a type is diffed"},
+	}
+
+	diffs := DiffExplainResults(old, new)
+	assert.Len(t, diffs, 3)
+
+	assert.Equal(t, ExplainEstimate, diffs[0].Type)
+	assert.True(t, diffs[0].Changed)
+	assert.Equal(t, []DiffLine{{Op: DiffInsert, Text: "db.t parts=1 rows=10 marks=2"}}, diffs[0].Lines)
+
+	assert.Equal(t, ExplainPlan, diffs[1].Type)
+	assert.False(t, diffs[1].Changed)
+
+	assert.Equal(t, ExplainSyntax, diffs[2].Type)
+	assert.True(t, diffs[2].Changed)
+	assert.Equal(t, []DiffLine{{Op: DiffDelete, Text: "SELECT 1"}}, diffs[2].Lines)
+}
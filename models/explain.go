@@ -1,7 +1,11 @@
 package models
 
 import (
+	"encoding/json"
 	"fmt"
+	"regexp"
+	"slices"
+	"sort"
 	"strings"
 )
 
@@ -31,8 +35,51 @@ const (
 
 	// ExplainTableOverride shows table override information.
 	ExplainTableOverride ExplainType = "TABLE OVERRIDE"
+
+	// ExplainCurrentTransaction shows the state of the current transaction.
+	// It doesn't take a query; the query is omitted from the statement.
+	ExplainCurrentTransaction ExplainType = "CURRENT TRANSACTION"
 )
 
+// TakesQuery reports whether the EXPLAIN type is followed by a query.
+func (t ExplainType) TakesQuery() bool {
+	return t != ExplainCurrentTransaction
+}
+
+// explainMinVersions lists the first ClickHouse release (major, minor)
+// supporting the EXPLAIN types that older servers reject. Types missing
+// here are supported by every server clicktelligence works with.
+var explainMinVersions = map[ExplainType][2]int{
+	ExplainTableOverride:      {22, 1},
+	ExplainCurrentTransaction: {22, 4},
+	ExplainQueryTree:          {22, 10},
+}
+
+// MinServerVersion returns the first ClickHouse version supporting t, e.g.
+// "22.10", or "" if every server does.
+func (t ExplainType) MinServerVersion() string {
+	minVersion, ok := explainMinVersions[t]
+	if !ok {
+		return ""
+	}
+	return fmt.Sprintf("%d.%d", minVersion[0], minVersion[1])
+}
+
+// SupportedBy reports whether a ClickHouse server of version serverVersion,
+// as returned by version() (e.g. "23.8.2.7"), supports t. Versions that
+// don't parse are assumed to support every type.
+func (t ExplainType) SupportedBy(serverVersion string) bool {
+	minVersion, ok := explainMinVersions[t]
+	if !ok {
+		return true
+	}
+	var major, minor int
+	if _, err := fmt.Sscanf(serverVersion, "%d.%d", &major, &minor); err != nil {
+		return true
+	}
+	return major > minVersion[0] || major == minVersion[0] && minor >= minVersion[1]
+}
+
 // ExplainSettings contains configuration options for EXPLAIN queries.
 // Different settings apply to different ExplainTypes.
 type ExplainSettings struct {
@@ -45,6 +92,7 @@ type ExplainSettings struct {
 	Projections *int `json:"projections,omitempty"` // Show projections
 	Actions     *int `json:"actions,omitempty"`     // Show detailed actions
 	JSONFormat  *int `json:"json,omitempty"`        // Output as JSON
+	Distributed *int `json:"distributed,omitempty"` // Include the plans of remote shards
 
 	// PIPELINE specific settings
 	Graph   *int `json:"graph,omitempty"`   // Output DOT graph format
@@ -74,6 +122,22 @@ type ExplainConfig struct {
 
 	// Enabled indicates if this configuration should be executed.
 	Enabled bool `json:"enabled"`
+
+	// BothFormats runs a PLAN twice, as text and with json = 1, keeping
+	// the text in the result's Output and the JSON in Structured. Opt-in
+	// as it doubles the EXPLAINs run; see ValidateBothFormats.
+	BothFormats bool `json:"bothFormats,omitempty"`
+}
+
+// ValidateBothFormats checks that BothFormats, if set, is on a PLAN config.
+func (c *ExplainConfig) ValidateBothFormats() error {
+	if !c.BothFormats {
+		return nil
+	}
+	if c.Type != ExplainPlan {
+		return fmt.Errorf("bothFormats is only supported for EXPLAIN PLAN, not %s", c.Type)
+	}
+	return nil
 }
 
 // EstimateRow represents a single row from EXPLAIN ESTIMATE output.
@@ -85,6 +149,18 @@ type EstimateRow struct {
 	Marks    uint64 `json:"marks"`
 }
 
+// SumEstimate adds up parts, rows and marks across all tables. Database and
+// Table are left blank in the total.
+func SumEstimate(rows []EstimateRow) EstimateRow {
+	var total EstimateRow
+	for _, row := range rows {
+		total.Parts += row.Parts
+		total.Rows += row.Rows
+		total.Marks += row.Marks
+	}
+	return total
+}
+
 // ExplainResult stores the output from an EXPLAIN execution.
 type ExplainResult struct {
 	// Type identifies which EXPLAIN type produced this result.
@@ -98,21 +174,48 @@ type ExplainResult struct {
 	// Empty on success.
 	Error string `json:"error,omitempty"`
 
+	// ExecutedQuery is the full EXPLAIN statement sent to ClickHouse,
+	// including the generated SETTINGS clause.
+	ExecutedQuery string `json:"executedQuery,omitempty"`
+
+	// QueryID is the ClickHouse query_id the EXPLAIN ran with, usable to
+	// look it up in system.query_log.
+	QueryID string `json:"queryId,omitempty"`
+
+	// Truncated is true when Output was cut to the configured size limit.
+	Truncated bool `json:"truncated,omitempty"`
+
+	// Skipped is true when the EXPLAIN was not executed; Error then says
+	// why. Skipped results don't count as failures when reusing results.
+	Skipped bool `json:"skipped,omitempty"`
+
+	// Structured holds Output parsed as JSON when it is a JSON document,
+	// e.g. PLAN json=1 output.
+	Structured json.RawMessage `json:"structured,omitempty"`
+
 	// Estimate contains structured data for EXPLAIN ESTIMATE results.
 	// Only populated when Type is ExplainEstimate.
 	Estimate []EstimateRow `json:"estimate,omitempty"`
+
+	// EstimateTotal sums Estimate across all tables (see SumEstimate).
+	// Only populated when Estimate has rows.
+	EstimateTotal *EstimateRow `json:"estimateTotal,omitempty"`
 }
 
 // BuildExplainQuery constructs the full EXPLAIN query string.
 //
 // Parameters:
 //   - query: The SQL query to explain
-//   - logComment: JSON comment to add to log_comment setting for tracking
+//   - logComment: JSON comment to add to log_comment setting for tracking (escaped)
 //   - forceAnalyzer: If true, adds enable_analyzer=1 for QUERY TREE type
 //   - maxExecutionTimeMs: Maximum execution time in milliseconds (0 = no limit)
+//   - customSettings: Extra query-level settings appended to the SETTINGS clause,
+//     sorted by name. A custom setting replaces a generated one of the same name,
+//     except log_comment which is reserved. Invalid names are skipped; callers
+//     should reject them up front with ValidateCustomSettings.
 //
 // Returns the complete EXPLAIN query ready for execution.
-func (c *ExplainConfig) BuildExplainQuery(query string, logComment string, forceAnalyzer bool, maxExecutionTimeMs int) string {
+func (c *ExplainConfig) BuildExplainQuery(query string, logComment string, forceAnalyzer bool, maxExecutionTimeMs int, customSettings map[string]string) string {
 	var parts []string
 
 	// Add EXPLAIN keyword and type
@@ -129,20 +232,23 @@ func (c *ExplainConfig) BuildExplainQuery(query string, logComment string, force
 	}
 
 	// Add the actual query
-	parts = append(parts, query)
+	if c.Type.TakesQuery() {
+		parts = append(parts, query)
+	}
 
 	// Build SETTINGS clause
 	var settingsClause []string
 	if logComment != "" {
-		settingsClause = append(settingsClause, fmt.Sprintf("log_comment='%s'", logComment))
+		settingsClause = append(settingsClause, "log_comment="+quoteString(logComment))
 	}
-	if forceAnalyzer && c.Type == ExplainQueryTree {
+	if _, overridden := customSettings["enable_analyzer"]; forceAnalyzer && c.Type == ExplainQueryTree && !overridden {
 		settingsClause = append(settingsClause, "enable_analyzer=1")
 	}
-	if maxExecutionTimeMs > 0 {
+	if _, overridden := customSettings["max_execution_time"]; maxExecutionTimeMs > 0 && !overridden {
 		// ClickHouse max_execution_time is in seconds (supports decimals)
 		settingsClause = append(settingsClause, fmt.Sprintf("max_execution_time=%.3f", float64(maxExecutionTimeMs)/1000.0))
 	}
+	settingsClause = append(settingsClause, buildCustomSettings(customSettings)...)
 
 	if len(settingsClause) > 0 {
 		parts = append(parts, "SETTINGS", strings.Join(settingsClause, ", "))
@@ -151,64 +257,185 @@ func (c *ExplainConfig) BuildExplainQuery(query string, logComment string, force
 	return strings.Join(parts, " ")
 }
 
-// buildSettings constructs the settings string for EXPLAIN based on type.
-func (c *ExplainConfig) buildSettings() string {
-	var settings []string
+// settingNamePattern matches names that are safe to splice into a SETTINGS clause.
+var settingNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
 
-	s := c.Settings
+// numericValuePattern matches values that can be passed unquoted.
+var numericValuePattern = regexp.MustCompile(`^-?[0-9]+(\.[0-9]+)?$`)
 
-	// Add applicable settings based on type
-	if s.Header != nil {
-		settings = append(settings, fmt.Sprintf("header=%d", *s.Header))
-	}
-	if s.Description != nil && c.Type == ExplainPlan {
-		settings = append(settings, fmt.Sprintf("description=%d", *s.Description))
-	}
-	if s.Indexes != nil && c.Type == ExplainPlan {
-		settings = append(settings, fmt.Sprintf("indexes=%d", *s.Indexes))
-	}
-	if s.Projections != nil && c.Type == ExplainPlan {
-		settings = append(settings, fmt.Sprintf("projections=%d", *s.Projections))
-	}
-	if s.Actions != nil && c.Type == ExplainPlan {
-		settings = append(settings, fmt.Sprintf("actions=%d", *s.Actions))
-	}
-	if s.JSONFormat != nil && c.Type == ExplainPlan {
-		settings = append(settings, fmt.Sprintf("json=%d", *s.JSONFormat))
-	}
-	if s.Graph != nil && c.Type == ExplainPipeline {
-		settings = append(settings, fmt.Sprintf("graph=%d", *s.Graph))
-	}
-	if s.Compact != nil && c.Type == ExplainPipeline {
-		settings = append(settings, fmt.Sprintf("compact=%d", *s.Compact))
-	}
-	if s.OneLine != nil && c.Type == ExplainSyntax {
-		settings = append(settings, fmt.Sprintf("oneline=%d", *s.OneLine))
+// reservedSettings cannot be set through custom settings.
+var reservedSettings = map[string]bool{
+	"log_comment": true,
+}
+
+// ValidateCustomSettings checks that every custom setting name consists only of
+// letters, digits and underscores and is not reserved.
+func ValidateCustomSettings(settings map[string]string) error {
+	for name := range settings {
+		if !settingNamePattern.MatchString(name) {
+			return fmt.Errorf("invalid setting name %q", name)
+		}
+		if reservedSettings[name] {
+			return fmt.Errorf("setting %q is reserved", name)
+		}
 	}
-	if s.RunQueryTreePasses != nil && c.Type == ExplainSyntax {
-		settings = append(settings, fmt.Sprintf("run_query_tree_passes=%d", *s.RunQueryTreePasses))
+	return nil
+}
+
+// ValidateSettingNames checks that every name consists only of letters,
+// digits and underscores, so it can't inject SQL where it is used.
+func ValidateSettingNames(names []string) error {
+	for _, name := range names {
+		if !settingNamePattern.MatchString(name) {
+			return fmt.Errorf("invalid setting name %q", name)
+		}
 	}
-	if s.QueryTreePasses != nil && c.Type == ExplainSyntax {
-		settings = append(settings, fmt.Sprintf("query_tree_passes=%d", *s.QueryTreePasses))
+	return nil
+}
+
+// buildCustomSettings formats custom settings as name=value pairs sorted by
+// name, skipping invalid and reserved names.
+func buildCustomSettings(settings map[string]string) []string {
+	names := make([]string, 0, len(settings))
+	for name := range settings {
+		if settingNamePattern.MatchString(name) && !reservedSettings[name] {
+			names = append(names, name)
+		}
 	}
-	if s.RunPasses != nil && c.Type == ExplainQueryTree {
-		settings = append(settings, fmt.Sprintf("run_passes=%d", *s.RunPasses))
+	sort.Strings(names)
+
+	result := make([]string, 0, len(names))
+	for _, name := range names {
+		result = append(result, fmt.Sprintf("%s=%s", name, formatSettingValue(settings[name])))
 	}
-	if s.DumpPasses != nil && c.Type == ExplainQueryTree {
-		settings = append(settings, fmt.Sprintf("dump_passes=%d", *s.DumpPasses))
+	return result
+}
+
+// formatSettingValue leaves numeric values as-is and quotes everything else.
+func formatSettingValue(value string) string {
+	if numericValuePattern.MatchString(value) {
+		return value
 	}
-	if s.Passes != nil && c.Type == ExplainQueryTree {
-		settings = append(settings, fmt.Sprintf("passes=%d", *s.Passes))
+	return quoteString(value)
+}
+
+// quoteString wraps s in single quotes, escaping backslashes and doubling
+// embedded single quotes as ClickHouse expects.
+func quoteString(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, "'", "''")
+	return "'" + s + "'"
+}
+
+// ExplainTypes lists every supported EXPLAIN type.
+var ExplainTypes = []ExplainType{
+	ExplainAST,
+	ExplainSyntax,
+	ExplainQueryTree,
+	ExplainPlan,
+	ExplainPipeline,
+	ExplainEstimate,
+	ExplainTableOverride,
+	ExplainCurrentTransaction,
+}
+
+// ParseExplainType matches name case-insensitively against ExplainTypes,
+// ignoring surrounding and repeated whitespace (e.g. "query  tree").
+func ParseExplainType(name string) (ExplainType, error) {
+	normalized := strings.ToUpper(strings.Join(strings.Fields(name), " "))
+	for _, t := range ExplainTypes {
+		if string(t) == normalized {
+			return t, nil
+		}
 	}
-	if s.DumpTree != nil && c.Type == ExplainQueryTree {
-		settings = append(settings, fmt.Sprintf("dump_tree=%d", *s.DumpTree))
+	return "", fmt.Errorf("unknown EXPLAIN type %q", name)
+}
+
+// explainSettingSpec describes one ExplainSettings field: the ClickHouse
+// setting it maps to and the EXPLAIN types it applies to.
+type explainSettingSpec struct {
+	name        string
+	description string
+	types       []ExplainType // nil means all types that take a query
+	value       func(s *ExplainSettings) *int
+}
+
+// appliesTo reports whether the setting is valid for the given type.
+func (spec explainSettingSpec) appliesTo(t ExplainType) bool {
+	if spec.types == nil {
+		return t.TakesQuery()
 	}
-	if s.DumpAST != nil && c.Type == ExplainQueryTree {
-		settings = append(settings, fmt.Sprintf("dump_ast=%d", *s.DumpAST))
+	return slices.Contains(spec.types, t)
+}
+
+// explainSettingSpecs is the single source of truth for which settings apply
+// to which EXPLAIN type. It drives both buildSettings and ExplainSchema, in
+// the order settings are emitted.
+var explainSettingSpecs = []explainSettingSpec{
+	{name: "header", description: "Include output headers", value: func(s *ExplainSettings) *int { return s.Header }},
+	{name: "description", description: "Include step descriptions", types: []ExplainType{ExplainPlan}, value: func(s *ExplainSettings) *int { return s.Description }},
+	{name: "indexes", description: "Show index usage", types: []ExplainType{ExplainPlan}, value: func(s *ExplainSettings) *int { return s.Indexes }},
+	{name: "projections", description: "Show analyzed projections", types: []ExplainType{ExplainPlan}, value: func(s *ExplainSettings) *int { return s.Projections }},
+	{name: "actions", description: "Show detailed step actions", types: []ExplainType{ExplainPlan}, value: func(s *ExplainSettings) *int { return s.Actions }},
+	{name: "json", description: "Output the plan as JSON", types: []ExplainType{ExplainPlan}, value: func(s *ExplainSettings) *int { return s.JSONFormat }},
+	{name: "distributed", description: "Include the plans run on remote shards of Distributed tables", types: []ExplainType{ExplainPlan}, value: func(s *ExplainSettings) *int { return s.Distributed }},
+	{name: "graph", description: "Output the pipeline as a DOT graph", types: []ExplainType{ExplainPipeline}, value: func(s *ExplainSettings) *int { return s.Graph }},
+	{name: "compact", description: "Compact graph output", types: []ExplainType{ExplainPipeline}, value: func(s *ExplainSettings) *int { return s.Compact }},
+	{name: "oneline", description: "Print the query on a single line", types: []ExplainType{ExplainSyntax}, value: func(s *ExplainSettings) *int { return s.OneLine }},
+	{name: "run_query_tree_passes", description: "Run query tree passes before printing", types: []ExplainType{ExplainSyntax}, value: func(s *ExplainSettings) *int { return s.RunQueryTreePasses }},
+	{name: "query_tree_passes", description: "Number of query tree passes to run", types: []ExplainType{ExplainSyntax}, value: func(s *ExplainSettings) *int { return s.QueryTreePasses }},
+	{name: "run_passes", description: "Run all query tree passes", types: []ExplainType{ExplainQueryTree}, value: func(s *ExplainSettings) *int { return s.RunPasses }},
+	{name: "dump_passes", description: "Show information about the passes run", types: []ExplainType{ExplainQueryTree}, value: func(s *ExplainSettings) *int { return s.DumpPasses }},
+	{name: "passes", description: "Number of passes to run (-1 = all)", types: []ExplainType{ExplainQueryTree}, value: func(s *ExplainSettings) *int { return s.Passes }},
+	{name: "dump_tree", description: "Display the query tree", types: []ExplainType{ExplainQueryTree}, value: func(s *ExplainSettings) *int { return s.DumpTree }},
+	{name: "dump_ast", description: "Show the AST generated from the query tree", types: []ExplainType{ExplainQueryTree}, value: func(s *ExplainSettings) *int { return s.DumpAST }},
+}
+
+// ExplainSettingInfo describes a setting available for an EXPLAIN type.
+type ExplainSettingInfo struct {
+	// Name is the ClickHouse EXPLAIN setting name.
+	Name string `json:"name"`
+
+	// JSONKey is the key of the setting in ExplainSettings.
+	JSONKey string `json:"jsonKey"`
+
+	Description string `json:"description"`
+}
+
+// ExplainTypeSchema lists the settings applicable to an EXPLAIN type.
+type ExplainTypeSchema struct {
+	Type     ExplainType          `json:"type"`
+	Settings []ExplainSettingInfo `json:"settings"`
+}
+
+// ExplainSchema returns, for each EXPLAIN type, the settings buildSettings
+// will emit for it.
+func ExplainSchema() []ExplainTypeSchema {
+	schema := make([]ExplainTypeSchema, 0, len(ExplainTypes))
+	for _, t := range ExplainTypes {
+		entry := ExplainTypeSchema{Type: t, Settings: []ExplainSettingInfo{}}
+		for _, spec := range explainSettingSpecs {
+			if spec.appliesTo(t) {
+				entry.Settings = append(entry.Settings, ExplainSettingInfo{
+					Name:        spec.name,
+					JSONKey:     spec.name,
+					Description: spec.description,
+				})
+			}
+		}
+		schema = append(schema, entry)
 	}
+	return schema
+}
 
-	if len(settings) == 0 {
-		return ""
+// buildSettings constructs the settings string for EXPLAIN based on type.
+func (c *ExplainConfig) buildSettings() string {
+	var settings []string
+
+	for _, spec := range explainSettingSpecs {
+		if v := spec.value(&c.Settings); v != nil && spec.appliesTo(c.Type) {
+			settings = append(settings, fmt.Sprintf("%s=%d", spec.name, *v))
+		}
 	}
 
 	return strings.Join(settings, ", ")
@@ -1,9 +1,11 @@
 package models
 
 import (
+	"encoding/json"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 // intPtr is a helper to create int pointers for settings
@@ -17,6 +19,7 @@ func TestBuildExplainQuery(t *testing.T) {
 		logComment         string
 		forceAnalyzer      bool
 		maxExecutionTimeMs int
+		customSettings     map[string]string
 		want               string
 	}{
 		// Basic EXPLAIN types
@@ -70,6 +73,23 @@ func TestBuildExplainQuery(t *testing.T) {
 		},
 
 		// PLAN-specific settings
+		// Queries with a WITH clause are explained as is
+		{
+			name:   "PLAN of multi-CTE query",
+			config: ExplainConfig{Type: ExplainPlan},
+			query:  "WITH a AS (SELECT 1 AS n), b AS (SELECT n FROM a) SELECT * FROM b",
+			want:   "EXPLAIN PLAN WITH a AS (SELECT 1 AS n), b AS (SELECT n FROM a) SELECT * FROM b",
+		},
+		{
+			name: "PLAN settings before CTE named like a keyword",
+			config: ExplainConfig{
+				Type:     ExplainPlan,
+				Settings: ExplainSettings{Indexes: intPtr(1)},
+			},
+			query:              "WITH select AS (SELECT 1) SELECT * FROM select",
+			maxExecutionTimeMs: 1000,
+			want:               "EXPLAIN PLAN indexes=1 WITH select AS (SELECT 1) SELECT * FROM select SETTINGS max_execution_time=1.000",
+		},
 		{
 			name: "PLAN with indexes",
 			config: ExplainConfig{
@@ -446,6 +466,42 @@ func TestBuildExplainQuery(t *testing.T) {
 			want:   "EXPLAIN PLAN SELECT *\nFROM table\nWHERE id = 1",
 		},
 
+		// Distributed tables and transactions
+		{
+			name: "PLAN with distributed",
+			config: ExplainConfig{
+				Type:     ExplainPlan,
+				Settings: ExplainSettings{Indexes: intPtr(1), Distributed: intPtr(1)},
+			},
+			query: "SELECT * FROM dist_events",
+			want:  "EXPLAIN PLAN indexes=1, distributed=1 SELECT * FROM dist_events",
+		},
+		{
+			name: "distributed ignored for PIPELINE",
+			config: ExplainConfig{
+				Type:     ExplainPipeline,
+				Settings: ExplainSettings{Distributed: intPtr(1)},
+			},
+			query: "SELECT * FROM dist_events",
+			want:  "EXPLAIN PIPELINE SELECT * FROM dist_events",
+		},
+		{
+			name:   "CURRENT TRANSACTION omits the query",
+			config: ExplainConfig{Type: ExplainCurrentTransaction},
+			query:  "SELECT 1",
+			want:   "EXPLAIN CURRENT TRANSACTION",
+		},
+		{
+			name: "CURRENT TRANSACTION ignores type settings",
+			config: ExplainConfig{
+				Type:     ExplainCurrentTransaction,
+				Settings: ExplainSettings{Header: intPtr(1)},
+			},
+			query:      "SELECT 1",
+			logComment: "test",
+			want:       "EXPLAIN CURRENT TRANSACTION SETTINGS log_comment='test'",
+		},
+
 		// Default configs test
 		{
 			name: "default PLAN config",
@@ -463,11 +519,87 @@ func TestBuildExplainQuery(t *testing.T) {
 			maxExecutionTimeMs: 30000,
 			want:               `EXPLAIN PLAN description=1, indexes=1, json=1 SELECT 1 SETTINGS log_comment='{"query_version":"abc123","product":"clicktelligence"}', max_execution_time=30.000`,
 		},
+
+		// log_comment escaping
+		{
+			name:       "log comment with single quote",
+			config:     ExplainConfig{Type: ExplainPlan},
+			query:      "SELECT 1",
+			logComment: `{"owner":"O'Brien"}`,
+			want:       `EXPLAIN PLAN SELECT 1 SETTINGS log_comment='{"owner":"O''Brien"}'`,
+		},
+		{
+			name:       "log comment with backslash",
+			config:     ExplainConfig{Type: ExplainPlan},
+			query:      "SELECT 1",
+			logComment: `{"q":"a\"b"}`,
+			want:       `EXPLAIN PLAN SELECT 1 SETTINGS log_comment='{"q":"a\\"b"}'`,
+		},
+		{
+			name:       "log comment cannot terminate the string",
+			config:     ExplainConfig{Type: ExplainPlan},
+			query:      "SELECT 1",
+			logComment: `x', max_threads=1000 --`,
+			want:       `EXPLAIN PLAN SELECT 1 SETTINGS log_comment='x'', max_threads=1000 --'`,
+		},
+
+		// Custom settings
+		{
+			name:   "custom settings sorted by name",
+			config: ExplainConfig{Type: ExplainPlan},
+			query:  "SELECT 1",
+			customSettings: map[string]string{
+				"optimize_move_to_prewhere":   "0",
+				"max_threads":                 "8",
+				"allow_experimental_analyzer": "1",
+			},
+			want: "EXPLAIN PLAN SELECT 1 SETTINGS allow_experimental_analyzer=1, max_threads=8, optimize_move_to_prewhere=0",
+		},
+		{
+			name:               "custom settings after generated ones",
+			config:             ExplainConfig{Type: ExplainPlan},
+			query:              "SELECT 1",
+			logComment:         "test",
+			maxExecutionTimeMs: 1000,
+			customSettings:     map[string]string{"max_threads": "4"},
+			want:               "EXPLAIN PLAN SELECT 1 SETTINGS log_comment='test', max_execution_time=1.000, max_threads=4",
+		},
+		{
+			name:           "string values are quoted and escaped",
+			config:         ExplainConfig{Type: ExplainPlan},
+			query:          "SELECT 1",
+			customSettings: map[string]string{"join_algorithm": "hash", "format_csv_delimiter": `it's \`},
+			want:           `EXPLAIN PLAN SELECT 1 SETTINGS format_csv_delimiter='it''s \\', join_algorithm='hash'`,
+		},
+		{
+			name:           "decimal and negative numbers are unquoted",
+			config:         ExplainConfig{Type: ExplainPlan},
+			query:          "SELECT 1",
+			customSettings: map[string]string{"a": "-1", "b": "0.5", "c": "1e5"},
+			want:           "EXPLAIN PLAN SELECT 1 SETTINGS a=-1, b=0.5, c='1e5'",
+		},
+		{
+			name:               "custom setting overrides generated one",
+			config:             ExplainConfig{Type: ExplainQueryTree},
+			query:              "SELECT 1",
+			forceAnalyzer:      true,
+			maxExecutionTimeMs: 1000,
+			customSettings:     map[string]string{"enable_analyzer": "0", "max_execution_time": "5"},
+			want:               "EXPLAIN QUERY TREE SELECT 1 SETTINGS enable_analyzer=0, max_execution_time=5",
+		},
+		{
+			name:           "invalid and reserved names are skipped",
+			config:         ExplainConfig{Type: ExplainPlan},
+			query:          "SELECT 1",
+			logComment:     "test",
+			customSettings: map[string]string{"x=1, y": "2", "log_comment": "evil", "max_threads": "2"},
+			want:           "EXPLAIN PLAN SELECT 1 SETTINGS log_comment='test', max_threads=2",
+		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got := tt.config.BuildExplainQuery(tt.query, tt.logComment, tt.forceAnalyzer, tt.maxExecutionTimeMs)
+			got := tt.config.BuildExplainQuery(tt.query, tt.logComment, tt.forceAnalyzer, tt.maxExecutionTimeMs, tt.customSettings)
 			assert.Equal(t, tt.want, got)
 		})
 	}
@@ -528,3 +660,127 @@ func TestBuildSettings(t *testing.T) {
 		})
 	}
 }
+
+func TestValidateCustomSettings(t *testing.T) {
+	tests := []struct {
+		name     string
+		settings map[string]string
+		wantErr  bool
+	}{
+		{name: "nil", settings: nil, wantErr: false},
+		{name: "valid names", settings: map[string]string{"max_threads": "8", "_x1": "a"}, wantErr: false},
+		{name: "injection attempt", settings: map[string]string{"max_threads=1; DROP TABLE t; --": "1"}, wantErr: true},
+		{name: "space in name", settings: map[string]string{"max threads": "1"}, wantErr: true},
+		{name: "leading digit", settings: map[string]string{"1abc": "1"}, wantErr: true},
+		{name: "empty name", settings: map[string]string{"": "1"}, wantErr: true},
+		{name: "reserved log_comment", settings: map[string]string{"log_comment": "x"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateCustomSettings(tt.settings)
+			if tt.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestExplainSchema(t *testing.T) {
+	schema := ExplainSchema()
+	require.Len(t, schema, len(ExplainTypes))
+
+	byType := make(map[ExplainType][]string)
+	for _, entry := range schema {
+		for _, setting := range entry.Settings {
+			byType[entry.Type] = append(byType[entry.Type], setting.Name)
+		}
+	}
+
+	assert.Equal(t, []string{"header", "description", "indexes", "projections", "actions", "json", "distributed"}, byType[ExplainPlan])
+	assert.Equal(t, []string{"header", "graph", "compact"}, byType[ExplainPipeline])
+	assert.Equal(t, []string{"header"}, byType[ExplainEstimate])
+	assert.Empty(t, byType[ExplainCurrentTransaction])
+}
+
+func TestExplainSchemaMatchesBuildSettings(t *testing.T) {
+	for _, entry := range ExplainSchema() {
+		for _, setting := range entry.Settings {
+			t.Run(string(entry.Type)+"/"+setting.Name, func(t *testing.T) {
+				// The JSON key must decode into the field buildSettings reads.
+				var settings ExplainSettings
+				require.NoError(t, json.Unmarshal([]byte(`{"`+setting.JSONKey+`":1}`), &settings))
+
+				config := ExplainConfig{Type: entry.Type, Settings: settings}
+				assert.Equal(t, setting.Name+"=1", config.buildSettings())
+			})
+		}
+	}
+}
+
+func TestSumEstimate(t *testing.T) {
+	tests := []struct {
+		name string
+		rows []EstimateRow
+		want EstimateRow
+	}{
+		{name: "empty", rows: nil, want: EstimateRow{}},
+		{
+			name: "single table",
+			rows: []EstimateRow{{Database: "default", Table: "events", Parts: 3, Rows: 1000, Marks: 12}},
+			want: EstimateRow{Parts: 3, Rows: 1000, Marks: 12},
+		},
+		{
+			name: "multiple tables",
+			rows: []EstimateRow{
+				{Database: "default", Table: "events", Parts: 3, Rows: 1000, Marks: 12},
+				{Database: "default", Table: "users", Parts: 1, Rows: 50, Marks: 1},
+				{Database: "other", Table: "events", Parts: 2, Rows: 8192, Marks: 4},
+			},
+			want: EstimateRow{Parts: 6, Rows: 9242, Marks: 17},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, SumEstimate(tt.rows))
+		})
+	}
+}
+
+func TestExplainTypeSupportedBy(t *testing.T) {
+	tests := []struct {
+		explainType   ExplainType
+		serverVersion string
+		want          bool
+	}{
+		{ExplainPlan, "21.8.1.1", true},
+		{ExplainQueryTree, "22.9.3.18", false},
+		{ExplainQueryTree, "22.10.1.1", true},
+		{ExplainQueryTree, "24.3.2.23", true},
+		{ExplainCurrentTransaction, "21.12.1.1", false},
+		{ExplainTableOverride, "22.1.3.7", true},
+		{ExplainQueryTree, "unknown", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.explainType)+" "+tt.serverVersion, func(t *testing.T) {
+			assert.Equal(t, tt.want, tt.explainType.SupportedBy(tt.serverVersion))
+		})
+	}
+}
+
+func TestExplainTypeMinServerVersion(t *testing.T) {
+	assert.Equal(t, "22.10", ExplainQueryTree.MinServerVersion())
+	assert.Empty(t, ExplainPlan.MinServerVersion())
+}
+
+func TestValidateBothFormats(t *testing.T) {
+	plan := ExplainConfig{Type: ExplainPlan, BothFormats: true}
+	assert.NoError(t, plan.ValidateBothFormats())
+
+	pipeline := ExplainConfig{Type: ExplainPipeline, BothFormats: true}
+	assert.Error(t, pipeline.ValidateBothFormats())
+}
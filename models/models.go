@@ -4,6 +4,23 @@ package models
 
 import "time"
 
+// MigrationStatus reports whether a storage schema migration is applied.
+type MigrationStatus struct {
+	Version     int        `json:"version"`
+	Description string     `json:"description"`
+	Reversible  bool       `json:"reversible"`
+	Applied     bool       `json:"applied"`
+	AppliedAt   *time.Time `json:"appliedAt,omitempty"`
+}
+
+// OptimizeResult reports a storage maintenance run. Sizes are in bytes and
+// include the write-ahead log.
+type OptimizeResult struct {
+	SizeBefore int64 `json:"sizeBefore"`
+	SizeAfter  int64 `json:"sizeAfter"`
+	DurationMs int64 `json:"durationMs"`
+}
+
 // QueryVersion represents a single version of a query with its analysis results.
 // Each version is immutable and linked to its parent version, forming a
 // version history similar to git commits.
@@ -17,16 +34,22 @@ type QueryVersion struct {
 	// Query is the SQL query text.
 	Query string `json:"query"`
 
-	// QueryHash is the SHA-256 hash of the query text, used for
-	// detecting unchanged queries and deduplication.
+	// QueryHash is the SHA-256 hash of the normalized query text, used for
+	// detecting unchanged queries and deduplication. Query itself is
+	// stored verbatim.
 	QueryHash string `json:"queryHash"`
 
 	// ExplainResults contains the output from various EXPLAIN query types
 	// (PLAN, PIPELINE, ESTIMATE, AST, SYNTAX, QUERY TREE).
 	ExplainResults []ExplainResult `json:"explainResults"`
 
-	// ExecutionStats contains flexible execution statistics as key-value pairs.
-	ExecutionStats map[string]interface{} `json:"executionStats"`
+	// Configs are the EXPLAIN configs that produced ExplainResults, without
+	// any that were skipped. Empty for versions saved before configs were
+	// recorded and for versions whose EXPLAINs haven't run.
+	Configs []ExplainConfig `json:"configs,omitempty"`
+
+	// ExecutionStats records how the EXPLAINs ran, see ExecutionStats.
+	ExecutionStats ExecutionStats `json:"executionStats"`
 
 	// Timestamp is when this version was created.
 	Timestamp time.Time `json:"timestamp"`
@@ -35,8 +58,24 @@ type QueryVersion struct {
 	// Empty for the first version in a branch.
 	ParentVersionID string `json:"parentVersionId,omitempty"`
 
+	// MergeParentVersionID references the head of the branch that was merged
+	// to create this version. Empty for versions that aren't merges.
+	MergeParentVersionID string `json:"mergeParentVersionId,omitempty"`
+
+	// Notes is free-form text about the version, such as why it mattered.
+	// Unlike the query, it can be changed after the version is saved.
+	Notes string `json:"notes,omitempty"`
+
 	// Tags contains all tags associated with this version.
 	Tags []*VersionTag `json:"tags,omitempty"`
+
+	// BranchName is the name of the version's branch. Only set by listings
+	// spanning branches, such as GetStarredVersions.
+	BranchName string `json:"branchName,omitempty"`
+
+	// TaggedAt is when the tag a listing filtered by was first added to
+	// the version. Only set by GetVersionsByTag.
+	TaggedAt *time.Time `json:"taggedAt,omitempty"`
 }
 
 // Branch represents a line of query development, similar to a git branch.
@@ -59,6 +98,38 @@ type Branch struct {
 	// CurrentVersionID points to the latest (head) version on this branch.
 	CurrentVersionID string `json:"currentVersionId,omitempty"`
 
+	// Pinned marks a branch to be listed before unpinned ones.
+	Pinned bool `json:"pinned"`
+
+	// Archived hides a branch from listings without deleting its history.
+	Archived bool `json:"archived"`
+
+	// DefaultExplainConfigs run for explain requests on this branch that
+	// don't specify any. Empty means the server-wide defaults.
+	DefaultExplainConfigs []ExplainConfig `json:"defaultExplainConfigs,omitempty"`
+
+	// DefaultMaxExecutionTimeMs limits EXPLAINs on this branch whose
+	// request doesn't set maxExecutionTimeMs. 0 means the server-wide
+	// default.
+	DefaultMaxExecutionTimeMs int `json:"defaultMaxExecutionTimeMs,omitempty"`
+
 	// CreatedAt is when this branch was created.
 	CreatedAt time.Time `json:"createdAt"`
+
+	// VersionCount is the number of versions on this branch.
+	// Only populated by Storage.GetBranches.
+	VersionCount int `json:"versionCount"`
+}
+
+// HashLookup counts the versions sharing a query hash, i.e. how often the
+// same normalized query was analyzed, without loading them.
+type HashLookup struct {
+	QueryHash string `json:"queryHash"`
+	Count     int    `json:"count"`
+
+	// The Latest fields describe the newest matching version. They are
+	// empty when Count is 0.
+	LatestVersionID string     `json:"latestVersionId,omitempty"`
+	LatestBranchID  string     `json:"latestBranchId,omitempty"`
+	LatestTimestamp *time.Time `json:"latestTimestamp,omitempty"`
 }
@@ -0,0 +1,141 @@
+package models
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// PlanNode is a step of the plan printed by EXPLAIN PLAN json = 1.
+type PlanNode struct {
+	NodeType    string      `json:"Node Type"`
+	Description string      `json:"Description,omitempty"`
+	Indexes     []PlanIndex `json:"Indexes,omitempty"`
+	Plans       []*PlanNode `json:"Plans,omitempty"`
+}
+
+// PlanIndex is one index applied by a read step, with the parts and
+// granules left before and after it. ClickHouse applies the indexes of a
+// step in order, so each one starts from what the previous one selected.
+type PlanIndex struct {
+	Type             string   `json:"Type"`
+	Name             string   `json:"Name,omitempty"`
+	Keys             []string `json:"Keys,omitempty"`
+	Condition        string   `json:"Condition,omitempty"`
+	InitialParts     uint64   `json:"Initial Parts"`
+	SelectedParts    uint64   `json:"Selected Parts"`
+	InitialGranules  uint64   `json:"Initial Granules"`
+	SelectedGranules uint64   `json:"Selected Granules"`
+}
+
+// ParsePlanJSON parses the output of EXPLAIN PLAN json = 1, a one-element
+// array holding the root step under "Plan".
+func ParsePlanJSON(data []byte) (*PlanNode, error) {
+	var plans []struct {
+		Plan *PlanNode `json:"Plan"`
+	}
+	if err := json.Unmarshal(data, &plans); err != nil {
+		return nil, fmt.Errorf("invalid plan JSON: %w", err)
+	}
+	if len(plans) == 0 || plans[0].Plan == nil {
+		return nil, errors.New("invalid plan JSON: no Plan")
+	}
+	return plans[0].Plan, nil
+}
+
+// PlanRead is a step reading from a table.
+type PlanRead struct {
+	NodeType    string `json:"nodeType"`
+	Description string `json:"description,omitempty"`
+
+	// Path lists the node types from the root down to this step.
+	Path []string `json:"path"`
+
+	// Indexes lists the types of the indexes that pruned parts or granules.
+	Indexes []string `json:"indexes,omitempty"`
+
+	// InitialGranules and SelectedGranules are the granules before the
+	// first and after the last index. Both are 0 for steps without index
+	// information.
+	InitialGranules  uint64 `json:"initialGranules"`
+	SelectedGranules uint64 `json:"selectedGranules"`
+}
+
+// PlanAnalysis summarizes the shape of a plan and how its steps read data.
+type PlanAnalysis struct {
+	NodeCount int `json:"nodeCount"`
+	MaxDepth  int `json:"maxDepth"`
+
+	// DeepestPath lists the node types from the root to the first of the
+	// deepest steps.
+	DeepestPath []string `json:"deepestPath"`
+
+	// IndexedReads are read steps where an index pruned parts or
+	// granules; FullScans are the other read steps.
+	IndexedReads []PlanRead `json:"indexedReads"`
+	FullScans    []PlanRead `json:"fullScans"`
+
+	// HeaviestRead is the read step selecting the most granules, nil for
+	// plans without granule counts.
+	HeaviestRead *PlanRead `json:"heaviestRead,omitempty"`
+}
+
+// AnalyzePlan walks the plan rooted at root depth first. Read steps are
+// those whose node type starts with "ReadFrom".
+func AnalyzePlan(root *PlanNode) PlanAnalysis {
+	analysis := PlanAnalysis{DeepestPath: []string{}, IndexedReads: []PlanRead{}, FullScans: []PlanRead{}}
+
+	var path []string
+	var walk func(node *PlanNode)
+	walk = func(node *PlanNode) {
+		path = append(path, node.NodeType)
+		defer func() { path = path[:len(path)-1] }()
+
+		analysis.NodeCount++
+		if len(path) > analysis.MaxDepth {
+			analysis.MaxDepth = len(path)
+			analysis.DeepestPath = append([]string{}, path...)
+		}
+
+		if strings.HasPrefix(node.NodeType, "ReadFrom") {
+			read := planRead(node, path)
+			if len(read.Indexes) > 0 {
+				analysis.IndexedReads = append(analysis.IndexedReads, read)
+			} else {
+				analysis.FullScans = append(analysis.FullScans, read)
+			}
+			if read.SelectedGranules > 0 && (analysis.HeaviestRead == nil || read.SelectedGranules > analysis.HeaviestRead.SelectedGranules) {
+				analysis.HeaviestRead = &read
+			}
+		}
+
+		for _, child := range node.Plans {
+			if child != nil {
+				walk(child)
+			}
+		}
+	}
+	if root != nil {
+		walk(root)
+	}
+	return analysis
+}
+
+func planRead(node *PlanNode, path []string) PlanRead {
+	read := PlanRead{
+		NodeType:    node.NodeType,
+		Description: node.Description,
+		Path:        append([]string{}, path...),
+	}
+	for _, index := range node.Indexes {
+		if index.SelectedParts < index.InitialParts || index.SelectedGranules < index.InitialGranules {
+			read.Indexes = append(read.Indexes, index.Type)
+		}
+	}
+	if len(node.Indexes) > 0 {
+		read.InitialGranules = node.Indexes[0].InitialGranules
+		read.SelectedGranules = node.Indexes[len(node.Indexes)-1].SelectedGranules
+	}
+	return read
+}
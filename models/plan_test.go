@@ -0,0 +1,89 @@
+package models
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testPlanJSON = `[
+  {
+    "Plan": {
+      "Node Type": "Expression",
+      "Description": "(Project names + Projection)",
+      "Plans": [
+        {
+          "Node Type": "Join",
+          "Plans": [
+            {
+              "Node Type": "Expression",
+              "Plans": [
+                {
+                  "Node Type": "ReadFromMergeTree",
+                  "Description": "default.events",
+                  "Indexes": [
+                    {"Type": "MinMax", "Keys": ["day"], "Condition": "(day in [19000, +Inf))", "Initial Parts": 10, "Selected Parts": 4, "Initial Granules": 100, "Selected Granules": 40},
+                    {"Type": "PrimaryKey", "Keys": ["user_id"], "Condition": "true", "Initial Parts": 4, "Selected Parts": 4, "Initial Granules": 40, "Selected Granules": 40}
+                  ]
+                }
+              ]
+            },
+            {
+              "Node Type": "ReadFromMergeTree",
+              "Description": "default.users",
+              "Indexes": [
+                {"Type": "PrimaryKey", "Condition": "true", "Initial Parts": 2, "Selected Parts": 2, "Initial Granules": 300, "Selected Granules": 300}
+              ]
+            }
+          ]
+        }
+      ]
+    }
+  }
+]`
+
+func TestParsePlanJSON(t *testing.T) {
+	root, err := ParsePlanJSON([]byte(testPlanJSON))
+	require.NoError(t, err)
+	assert.Equal(t, "Expression", root.NodeType)
+	require.Len(t, root.Plans, 1)
+	require.Len(t, root.Plans[0].Plans, 2)
+	read := root.Plans[0].Plans[0].Plans[0]
+	assert.Equal(t, "default.events", read.Description)
+	require.Len(t, read.Indexes, 2)
+	assert.Equal(t, PlanIndex{Type: "MinMax", Keys: []string{"day"}, Condition: "(day in [19000, +Inf))", InitialParts: 10, SelectedParts: 4, InitialGranules: 100, SelectedGranules: 40}, read.Indexes[0])
+
+	_, err = ParsePlanJSON([]byte(`[]`))
+	assert.Error(t, err)
+	_, err = ParsePlanJSON([]byte(`Expression`))
+	assert.Error(t, err)
+}
+
+func TestAnalyzePlan(t *testing.T) {
+	root, err := ParsePlanJSON([]byte(testPlanJSON))
+	require.NoError(t, err)
+
+	analysis := AnalyzePlan(root)
+	assert.Equal(t, 5, analysis.NodeCount)
+	assert.Equal(t, 4, analysis.MaxDepth)
+	assert.Equal(t, []string{"Expression", "Join", "Expression", "ReadFromMergeTree"}, analysis.DeepestPath)
+
+	require.Len(t, analysis.IndexedReads, 1)
+	assert.Equal(t, "default.events", analysis.IndexedReads[0].Description)
+	assert.Equal(t, []string{"MinMax"}, analysis.IndexedReads[0].Indexes)
+	assert.Equal(t, uint64(100), analysis.IndexedReads[0].InitialGranules)
+	assert.Equal(t, uint64(40), analysis.IndexedReads[0].SelectedGranules)
+
+	require.Len(t, analysis.FullScans, 1)
+	assert.Equal(t, "default.users", analysis.FullScans[0].Description)
+	assert.Equal(t, []string{"Expression", "Join", "ReadFromMergeTree"}, analysis.FullScans[0].Path)
+
+	require.NotNil(t, analysis.HeaviestRead)
+	assert.Equal(t, "default.users", analysis.HeaviestRead.Description)
+
+	empty := AnalyzePlan(nil)
+	assert.Zero(t, empty.NodeCount)
+	assert.Empty(t, empty.IndexedReads)
+	assert.Nil(t, empty.HeaviestRead)
+}
@@ -0,0 +1,267 @@
+package models
+
+import (
+	"encoding/json"
+	"errors"
+	"maps"
+	"slices"
+	"time"
+)
+
+// JSON keys of the ExecutionStats fields. The stats are stored and served
+// as one flat object, in the format older versions stored a free-form map
+// in, so existing rows keep decoding.
+const (
+	// StatClickHouseVersion holds the ClickHouse server version that
+	// produced a version's EXPLAIN results.
+	StatClickHouseVersion = "clickhouse_version"
+
+	// StatParameters holds the query parameter values ({name:Type}
+	// substitutions) the EXPLAINs ran with.
+	StatParameters = "parameters"
+
+	// StatCustomSettings holds the customSettings of the request the
+	// EXPLAINs ran with.
+	StatCustomSettings = "custom_settings"
+
+	// StatProfile holds the ClickHouse connection profile the EXPLAINs ran
+	// against. Absent for the default profile.
+	StatProfile = "profile"
+
+	// StatDatabase holds the database the EXPLAINs used as the default one.
+	// Absent when it was the connection's own.
+	StatDatabase = "database"
+
+	// StatBorrowedFrom holds the ID of the version whose EXPLAIN results
+	// were copied instead of executing them again.
+	StatBorrowedFrom = "borrowed_from"
+
+	// StatReanalyzedAt holds when a version's EXPLAIN results were last
+	// replaced by running them again (RFC 3339, UTC). Absent for versions
+	// whose results are from when they were saved.
+	StatReanalyzedAt = "reanalyzed_at"
+
+	// StatMatrixSettings holds the custom settings of the combination a
+	// version was saved for by the explain matrix endpoint.
+	StatMatrixSettings = "matrix_settings"
+
+	// StatReadRows, StatReadBytes, StatMemoryUsage and StatQueryDurationMs
+	// hold the query_log stats aggregated over all EXPLAIN types, see
+	// SetQueryLog.
+	StatReadRows        = "read_rows"
+	StatReadBytes       = "read_bytes"
+	StatMemoryUsage     = "memory_usage"
+	StatQueryDurationMs = "query_duration_ms"
+)
+
+// QueryLogStats are the system.query_log totals of the EXPLAINs of one
+// type. They are stored under the EXPLAIN type's name, e.g. "PLAN".
+type QueryLogStats struct {
+	QueryDurationMs int64 `json:"durationMs"`
+	MemoryUsage     int64 `json:"memoryUsage"`
+	ReadRows        int64 `json:"readRows"`
+	ReadBytes       int64 `json:"readBytes"`
+	ResultRows      int64 `json:"resultRows"`
+}
+
+// ExecutionStats records how a version's EXPLAINs ran. Zero fields are
+// left out of the JSON object; see the Stat* constants for their keys.
+type ExecutionStats struct {
+	ClickHouseVersion string
+	Parameters        map[string]string
+	CustomSettings    map[string]string
+	Profile           string
+	Database          string
+	BorrowedFrom      string
+	ReanalyzedAt      time.Time
+	MatrixSettings    map[string]string
+
+	// QueryLog holds the query_log stats by EXPLAIN type, only collected
+	// for requests setting collectStats.
+	QueryLog map[ExplainType]QueryLogStats
+
+	// ReadRows, ReadBytes and QueryDurationMs are the totals of QueryLog,
+	// MemoryUsage its peak.
+	ReadRows        int64
+	ReadBytes       int64
+	MemoryUsage     int64
+	QueryDurationMs int64
+
+	// Extra keeps keys without a field, so they survive a round trip.
+	Extra map[string]interface{}
+}
+
+// IsZero reports whether no stats are set.
+func (s ExecutionStats) IsZero() bool {
+	return s.ClickHouseVersion == "" && len(s.Parameters) == 0 && len(s.CustomSettings) == 0 &&
+		s.Profile == "" && s.Database == "" && s.BorrowedFrom == "" && s.ReanalyzedAt.IsZero() &&
+		len(s.MatrixSettings) == 0 && len(s.QueryLog) == 0 && s.ReadRows == 0 && s.ReadBytes == 0 && s.MemoryUsage == 0 &&
+		s.QueryDurationMs == 0 && len(s.Extra) == 0
+}
+
+// SetQueryLog sets the query_log stats by EXPLAIN type and the aggregates
+// over them.
+func (s *ExecutionStats) SetQueryLog(queryLog map[ExplainType]QueryLogStats) {
+	s.QueryLog = queryLog
+	s.ReadRows, s.ReadBytes, s.MemoryUsage, s.QueryDurationMs = 0, 0, 0, 0
+	for _, stats := range queryLog {
+		s.ReadRows += stats.ReadRows
+		s.ReadBytes += stats.ReadBytes
+		s.MemoryUsage = max(s.MemoryUsage, stats.MemoryUsage)
+		s.QueryDurationMs += stats.QueryDurationMs
+	}
+}
+
+// Merge copies the set fields of other over s. Map fields are merged key
+// by key into new maps.
+func (s *ExecutionStats) Merge(other ExecutionStats) {
+	if other.ClickHouseVersion != "" {
+		s.ClickHouseVersion = other.ClickHouseVersion
+	}
+	if other.Profile != "" {
+		s.Profile = other.Profile
+	}
+	if other.Database != "" {
+		s.Database = other.Database
+	}
+	if other.BorrowedFrom != "" {
+		s.BorrowedFrom = other.BorrowedFrom
+	}
+	if !other.ReanalyzedAt.IsZero() {
+		s.ReanalyzedAt = other.ReanalyzedAt
+	}
+	s.Parameters = mergeMap(s.Parameters, other.Parameters)
+	s.CustomSettings = mergeMap(s.CustomSettings, other.CustomSettings)
+	s.MatrixSettings = mergeMap(s.MatrixSettings, other.MatrixSettings)
+	s.QueryLog = mergeMap(s.QueryLog, other.QueryLog)
+	s.Extra = mergeMap(s.Extra, other.Extra)
+
+	// The aggregates follow the merged query_log stats
+	if len(other.QueryLog) > 0 {
+		s.SetQueryLog(s.QueryLog)
+	}
+}
+
+// mergeMap returns dst with src copied over it. dst is copied first, since
+// it may be shared, e.g. with the request the stats were built from.
+func mergeMap[K comparable, V any](dst, src map[K]V) map[K]V {
+	if len(src) == 0 {
+		return dst
+	}
+	merged := make(map[K]V, len(dst)+len(src))
+	maps.Copy(merged, dst)
+	maps.Copy(merged, src)
+	return merged
+}
+
+// TotalQueryDurationMs sums the query_log durations of all EXPLAIN types.
+// ok is false when no query_log stats were collected.
+func (s ExecutionStats) TotalQueryDurationMs() (total int64, ok bool) {
+	for _, stats := range s.QueryLog {
+		total += stats.QueryDurationMs
+	}
+	return total, len(s.QueryLog) > 0
+}
+
+// MarshalJSON encodes the stats as one flat object.
+func (s ExecutionStats) MarshalJSON() ([]byte, error) {
+	object := make(map[string]interface{}, len(s.Extra)+len(s.QueryLog)+12)
+	maps.Copy(object, s.Extra)
+	for explainType, stats := range s.QueryLog {
+		object[string(explainType)] = stats
+	}
+	set := func(key string, value interface{}, isSet bool) {
+		if isSet {
+			object[key] = value
+		}
+	}
+	set(StatClickHouseVersion, s.ClickHouseVersion, s.ClickHouseVersion != "")
+	set(StatParameters, s.Parameters, len(s.Parameters) > 0)
+	set(StatCustomSettings, s.CustomSettings, len(s.CustomSettings) > 0)
+	set(StatProfile, s.Profile, s.Profile != "")
+	set(StatDatabase, s.Database, s.Database != "")
+	set(StatBorrowedFrom, s.BorrowedFrom, s.BorrowedFrom != "")
+	set(StatReanalyzedAt, s.ReanalyzedAt, !s.ReanalyzedAt.IsZero())
+	set(StatMatrixSettings, s.MatrixSettings, len(s.MatrixSettings) > 0)
+	set(StatReadRows, s.ReadRows, s.ReadRows != 0)
+	set(StatReadBytes, s.ReadBytes, s.ReadBytes != 0)
+	set(StatMemoryUsage, s.MemoryUsage, s.MemoryUsage != 0)
+	set(StatQueryDurationMs, s.QueryDurationMs, s.QueryDurationMs != 0)
+	return json.Marshal(object)
+}
+
+// UnmarshalJSON decodes a flat stats object. Keys without a field, and
+// known keys whose value doesn't have the expected type, go to Extra.
+func (s *ExecutionStats) UnmarshalJSON(data []byte) error {
+	var object map[string]json.RawMessage
+	if err := json.Unmarshal(data, &object); err != nil {
+		return err
+	}
+
+	*s = ExecutionStats{}
+	for key, raw := range object {
+		var err error
+		switch {
+		case key == StatClickHouseVersion:
+			err = decodeStat(raw, &s.ClickHouseVersion)
+		case key == StatParameters:
+			err = decodeStat(raw, &s.Parameters)
+		case key == StatCustomSettings:
+			err = decodeStat(raw, &s.CustomSettings)
+		case key == StatProfile:
+			err = decodeStat(raw, &s.Profile)
+		case key == StatDatabase:
+			err = decodeStat(raw, &s.Database)
+		case key == StatBorrowedFrom:
+			err = decodeStat(raw, &s.BorrowedFrom)
+		case key == StatReanalyzedAt:
+			err = decodeStat(raw, &s.ReanalyzedAt)
+		case key == StatMatrixSettings:
+			err = decodeStat(raw, &s.MatrixSettings)
+		case key == StatReadRows:
+			err = decodeStat(raw, &s.ReadRows)
+		case key == StatReadBytes:
+			err = decodeStat(raw, &s.ReadBytes)
+		case key == StatMemoryUsage:
+			err = decodeStat(raw, &s.MemoryUsage)
+		case key == StatQueryDurationMs:
+			err = decodeStat(raw, &s.QueryDurationMs)
+		case slices.Contains(ExplainTypes, ExplainType(key)):
+			var stats QueryLogStats
+			if err = decodeStat(raw, &stats); err == nil {
+				if s.QueryLog == nil {
+					s.QueryLog = make(map[ExplainType]QueryLogStats)
+				}
+				s.QueryLog[ExplainType(key)] = stats
+			}
+		default:
+			err = errUnknownStat
+		}
+		if err == nil {
+			continue
+		}
+
+		var value interface{}
+		if err := json.Unmarshal(raw, &value); err != nil {
+			return err
+		}
+		if s.Extra == nil {
+			s.Extra = make(map[string]interface{})
+		}
+		s.Extra[key] = value
+	}
+	return nil
+}
+
+// errUnknownStat routes keys without a field to Extra in UnmarshalJSON.
+var errUnknownStat = errors.New("unknown execution stat")
+
+// decodeStat sets *dst only if raw decodes completely.
+func decodeStat[T any](raw json.RawMessage, dst *T) error {
+	var value T
+	if err := json.Unmarshal(raw, &value); err != nil {
+		return err
+	}
+	*dst = value
+	return nil
+}
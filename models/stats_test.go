@@ -0,0 +1,103 @@
+package models
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExecutionStatsUnmarshalStored(t *testing.T) {
+	// A blob as stored before the stats were typed.
+	stored := `{
+		"clickhouse_version": "25.3",
+		"parameters": {"id": "7"},
+		"profile": "replica",
+		"reanalyzed_at": "2026-05-01T10:00:00Z",
+		"PLAN": {"durationMs": 5, "memoryUsage": 1024, "readRows": 0, "readBytes": 0, "resultRows": 10},
+		"read_rows": 10,
+		"borrowed_from": 42
+	}`
+
+	var stats ExecutionStats
+	require.NoError(t, json.Unmarshal([]byte(stored), &stats))
+	assert.Equal(t, ExecutionStats{
+		ClickHouseVersion: "25.3",
+		Parameters:        map[string]string{"id": "7"},
+		Profile:           "replica",
+		ReanalyzedAt:      time.Date(2026, 5, 1, 10, 0, 0, 0, time.UTC),
+		QueryLog:          map[ExplainType]QueryLogStats{ExplainPlan: {QueryDurationMs: 5, MemoryUsage: 1024, ResultRows: 10}},
+		ReadRows:          10,
+		Extra:             map[string]interface{}{"borrowed_from": float64(42)},
+	}, stats)
+
+	total, ok := stats.TotalQueryDurationMs()
+	assert.True(t, ok)
+	assert.Equal(t, int64(5), total)
+}
+
+func TestExecutionStatsRoundTrip(t *testing.T) {
+	stats := ExecutionStats{
+		ClickHouseVersion: "25.3",
+		CustomSettings:    map[string]string{"max_threads": "4"},
+		Database:          "analytics",
+		MatrixSettings:    map[string]string{"max_threads": "4"},
+		QueryLog:          map[ExplainType]QueryLogStats{ExplainPipeline: {QueryDurationMs: 2}},
+		Extra:             map[string]interface{}{"note": "kept"},
+	}
+	data, err := json.Marshal(stats)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{
+		"clickhouse_version": "25.3",
+		"custom_settings": {"max_threads": "4"},
+		"database": "analytics",
+		"matrix_settings": {"max_threads": "4"},
+		"PIPELINE": {"durationMs": 2, "memoryUsage": 0, "readRows": 0, "readBytes": 0, "resultRows": 0},
+		"note": "kept"
+	}`, string(data))
+
+	var decoded ExecutionStats
+	require.NoError(t, json.Unmarshal(data, &decoded))
+	assert.Equal(t, stats, decoded)
+
+	data, err = json.Marshal(ExecutionStats{})
+	require.NoError(t, err)
+	assert.Equal(t, "{}", string(data))
+	assert.True(t, ExecutionStats{}.IsZero())
+}
+
+func TestExecutionStatsSetQueryLog(t *testing.T) {
+	var stats ExecutionStats
+	stats.SetQueryLog(map[ExplainType]QueryLogStats{
+		ExplainPlan:     {QueryDurationMs: 5, MemoryUsage: 1024, ReadRows: 10, ReadBytes: 100},
+		ExplainEstimate: {QueryDurationMs: 3, MemoryUsage: 4096, ReadRows: 2, ReadBytes: 20},
+	})
+	assert.Equal(t, int64(12), stats.ReadRows)
+	assert.Equal(t, int64(120), stats.ReadBytes)
+	assert.Equal(t, int64(4096), stats.MemoryUsage)
+	assert.Equal(t, int64(8), stats.QueryDurationMs)
+
+	data, err := json.Marshal(stats)
+	require.NoError(t, err)
+	var object map[string]interface{}
+	require.NoError(t, json.Unmarshal(data, &object))
+	assert.Equal(t, float64(12), object["read_rows"])
+	assert.Equal(t, float64(120), object["read_bytes"])
+	assert.Equal(t, float64(4096), object["memory_usage"])
+	assert.Equal(t, float64(8), object["query_duration_ms"])
+
+	var decoded ExecutionStats
+	require.NoError(t, json.Unmarshal(data, &decoded))
+	assert.Equal(t, stats, decoded)
+}
+
+func TestExecutionStatsMerge(t *testing.T) {
+	stats := ExecutionStats{Parameters: map[string]string{"id": "1"}, ClickHouseVersion: "23.8"}
+	stats.Merge(ExecutionStats{ClickHouseVersion: "25.3", Parameters: map[string]string{"limit": "10"}})
+	assert.Equal(t, ExecutionStats{
+		Parameters:        map[string]string{"id": "1", "limit": "10"},
+		ClickHouseVersion: "25.3",
+	}, stats)
+}
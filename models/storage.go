@@ -1,5 +1,7 @@
 package models
 
+import "context"
+
 // Storage defines the persistence layer for clicktelligence.
 //
 // It provides methods for managing query branches, versions, and tags.
@@ -7,11 +9,22 @@ package models
 // local persistent storage.
 //
 // The interface is organized into three categories:
-//   - Branch management: CreateBranch, GetBranches, GetBranch
-//   - Version management: GetVersion, SaveVersion, GetBranchHistory
-//   - Tag management: AddTag, RemoveTag, GetVersionTags, GetVersionsByTag, ToggleStarred
+//   - Branch management: CreateBranch, GetBranches, GetBranchesDigest,
+//     GetChildBranches, GetBranch, SetBranchPinned, SetBranchHead, ArchiveBranch,
+//     DeleteBranch, SetBranchExplainConfigs, SetBranchMaxExecutionTime
+//   - Version management: GetVersion, SaveVersion, AmendVersion, UpdateVersionResults, SetVersionNotes,
+//     DeleteVersion, GetBranchHistory,
+//     GetVersionAncestry, GetVersionsByHash, LookupQueryHash, GetRecentVersions,
+//     GetErroredVersions
+//   - Tag management: AddTag, RemoveTag, GetVersionTags, GetVersionTagsFiltered, GetVersionsByTag, ToggleStarred, GetStarredVersions
+//
+// Ping, CheckSchemaVersion, GetMigrationStatus, ApplyMigrations, Reset and
+// Optimize support operating the storage itself.
+//
+// Every method except Close takes a context; implementations stop the
+// operation and return its error once ctx is done.
 //
-// Thread Safety: Implementations should be safe for concurrent use.
+// Thread Safety: Implementations must be safe for concurrent use.
 type Storage interface {
 	// CreateBranch creates a new branch with the given name.
 	//
@@ -21,15 +34,67 @@ type Storage interface {
 	//   - branchFromVersionID: ID of the version this branch forks from
 	//
 	// Returns the created branch or an error if creation fails.
-	CreateBranch(name, parentBranchID, branchFromVersionID string) (*Branch, error)
+	CreateBranch(ctx context.Context, name, parentBranchID, branchFromVersionID string) (*Branch, error)
 
-	// GetBranches returns all branches ordered by creation time (newest first).
-	GetBranches() ([]*Branch, error)
+	// GetBranches returns all branches, pinned first, then ordered by
+	// creation time (newest first). Each branch has VersionCount set.
+	// Archived branches are skipped unless includeArchived is true.
+	GetBranches(ctx context.Context, includeArchived bool) ([]*Branch, error)
+
+	// GetChildBranches returns the branches whose ParentBranchID is
+	// parentID, oldest first, with VersionCount set. Archived branches are
+	// skipped unless includeArchived is true. The result is empty, not nil,
+	// for a branch without children.
+	GetChildBranches(ctx context.Context, parentID string, includeArchived bool) ([]*Branch, error)
+
+	// GetBranchesDigest returns a short string that changes whenever the
+	// result of GetBranches with the same includeArchived would, without
+	// loading the branches. It is meant for cache validators such as ETags.
+	GetBranchesDigest(ctx context.Context, includeArchived bool) (string, error)
 
 	// GetBranch retrieves a branch by its ID.
 	//
 	// Returns the branch and true if found, nil and false otherwise.
-	GetBranch(id string) (*Branch, bool)
+	GetBranch(ctx context.Context, id string) (*Branch, bool)
+
+	// SetBranchPinned sets or clears the pinned flag on a branch.
+	//
+	// Returns an error if the branch doesn't exist.
+	SetBranchPinned(ctx context.Context, id string, pinned bool) error
+
+	// SetBranchHead makes a version of the branch its current version, e.g.
+	// to return to an earlier one. Later versions are kept.
+	//
+	// Returns an error if the branch or version doesn't exist, or if the
+	// version belongs to another branch.
+	SetBranchHead(ctx context.Context, branchID, versionID string) error
+
+	// ArchiveBranch sets or clears the archived flag on a branch. Archived
+	// branches keep their versions but are hidden from GetBranches.
+	//
+	// Returns an error if the branch doesn't exist.
+	ArchiveBranch(ctx context.Context, id string, archived bool) error
+
+	// DeleteBranch removes a branch without versions, e.g. one whose
+	// creation couldn't be completed. Branches with versions are archived
+	// instead.
+	//
+	// Returns an error if the branch doesn't exist or has versions.
+	DeleteBranch(ctx context.Context, id string) error
+
+	// SetBranchExplainConfigs stores the EXPLAIN configs run for requests on
+	// the branch that don't specify any. An empty list reverts to the
+	// server-wide defaults.
+	//
+	// Returns an error wrapping ErrBranchNotFound if the branch doesn't exist.
+	SetBranchExplainConfigs(ctx context.Context, branchID string, configs []ExplainConfig) error
+
+	// SetBranchMaxExecutionTime stores the max_execution_time, in
+	// milliseconds, of EXPLAINs on the branch whose request doesn't set
+	// one. 0 reverts to the server-wide default.
+	//
+	// Returns an error wrapping ErrBranchNotFound if the branch doesn't exist.
+	SetBranchMaxExecutionTime(ctx context.Context, branchID string, maxExecutionTimeMs int) error
 
 	// GetVersion retrieves a query version by its ID.
 	//
@@ -38,21 +103,113 @@ type Storage interface {
 	// which includes tags.
 	//
 	// Returns the version and true if found, nil and false otherwise.
-	GetVersion(id string) (*QueryVersion, bool)
+	GetVersion(ctx context.Context, id string) (*QueryVersion, bool)
 
 	// SaveVersion persists a new query version.
 	//
 	// This also updates the branch's CurrentVersionID to point to this
 	// new version, making it the head of the branch.
 	//
-	// The version's ID must be set before calling this method.
-	SaveVersion(version *QueryVersion) error
+	// The version's ID must be set before calling this method. A
+	// ParentVersionID must be a version of the same branch or the version
+	// the branch was forked from; other parents are rejected.
+	SaveVersion(ctx context.Context, version *QueryVersion) error
+
+	// AmendVersion replaces the query and query hash of an existing version
+	// and clears its ExplainResults and ExecutionStats, which no longer
+	// describe the new query.
+	//
+	// Returns an error if the version doesn't exist.
+	AmendVersion(ctx context.Context, id, query, queryHash string) error
+
+	// UpdateVersionResults replaces the ExplainResults, Configs and
+	// ExecutionStats of a version, after its EXPLAINs ran again. The query
+	// and everything else are kept.
+	//
+	// Returns an error wrapping ErrVersionNotFound if the version doesn't exist.
+	UpdateVersionResults(ctx context.Context, versionID string, results []ExplainResult, configs []ExplainConfig, stats ExecutionStats) error
+
+	// SetVersionNotes replaces the notes of a version; empty notes clear
+	// them. Versions are otherwise immutable, apart from AmendVersion.
+	//
+	// Returns an error wrapping ErrVersionNotFound if the version doesn't exist.
+	SetVersionNotes(ctx context.Context, versionID, notes string) error
+
+	// DeleteVersion removes a version and its tags. Its children are
+	// re-parented onto its parent, and a branch whose head it was moves its
+	// head to the parent, or has no head when the parent is on another
+	// branch.
+	//
+	// Returns an error wrapping ErrVersionNotFound if the version doesn't exist.
+	DeleteVersion(ctx context.Context, id string) error
 
 	// GetBranchHistory returns all versions for a branch.
 	//
 	// Versions are ordered by timestamp (newest first) and include
 	// their associated tags.
-	GetBranchHistory(branchID string) ([]*QueryVersion, error)
+	GetBranchHistory(ctx context.Context, branchID string) ([]*QueryVersion, error)
+
+	// GetVersionsByHash returns all versions with the given QueryHash across
+	// every branch, i.e. every analysis of the same normalized query.
+	//
+	// Versions are ordered by timestamp (newest first) and include
+	// their associated tags.
+	GetVersionsByHash(ctx context.Context, hash string) ([]*QueryVersion, error)
+
+	// LookupQueryHash counts the versions with the given QueryHash and
+	// identifies the newest, reading only the indexed hash column and not
+	// the versions themselves.
+	LookupQueryHash(ctx context.Context, hash string) (*HashLookup, error)
+
+	// GetVersionAncestry returns the versions from the root down to the
+	// given version by following ParentVersionID and MergeParentVersionID.
+	// Every version comes after its parents, so a chain without merges is
+	// ordered oldest first; shared ancestors of a merge appear once.
+	//
+	// The walk stops at missing parents. Returns an error if the version
+	// doesn't exist or the ancestry contains a cycle.
+	GetVersionAncestry(ctx context.Context, versionID string) ([]*QueryVersion, error)
+
+	// GetRecentVersions returns the newest versions across all branches,
+	// with BranchName set.
+	//
+	// At most limit versions are returned; limit <= 0 returns all.
+	GetRecentVersions(ctx context.Context, limit int) ([]*QueryVersion, error)
+
+	// GetErroredVersions returns the versions with a failed EXPLAIN result,
+	// newest first, with BranchName set. Skipped results don't count. An
+	// empty branchID searches all branches.
+	//
+	// Returns an empty slice if no version failed.
+	GetErroredVersions(ctx context.Context, branchID string) ([]*QueryVersion, error)
+
+	// Ping verifies the storage is reachable by running a trivial query.
+	Ping(ctx context.Context) error
+
+	// CheckSchemaVersion returns an error if the stored schema is newer
+	// than the storage implementation, i.e. has migrations applied that
+	// it doesn't know.
+	CheckSchemaVersion(ctx context.Context) error
+
+	// GetMigrationStatus lists the known schema migrations, oldest first,
+	// and whether each is applied.
+	GetMigrationStatus(ctx context.Context) ([]MigrationStatus, error)
+
+	// ApplyMigrations applies the pending schema migrations in order and
+	// returns the ones applied, which is empty when none were pending.
+	ApplyMigrations(ctx context.Context) ([]MigrationStatus, error)
+
+	// Reset deletes all branches, versions and tags and recreates the
+	// schema with every migration applied and an empty main branch, as in
+	// a new database.
+	Reset(ctx context.Context) error
+
+	// Optimize refreshes the statistics used for planning storage queries
+	// and checkpoints the write-ahead log into the database file, releasing
+	// the space of deleted rows. It doesn't block or abort concurrent
+	// writes; when they keep the checkpoint from running it gives up and
+	// returns an error.
+	Optimize(ctx context.Context) (*OptimizeResult, error)
 
 	// Close releases any resources held by the storage.
 	//
@@ -65,23 +222,32 @@ type Storage interface {
 	//   - Simple tag: "tagname" (e.g., "production", "optimized")
 	//   - Key-value tag: "key=value" (e.g., "environment=staging")
 	//
-	// System tags (prefixed with "system:") are reserved for internal use.
+	// System tags (prefixed with "system:") and tags with the other
+	// reserved prefixes are reserved for internal use.
 	//
 	// Returns the created tag or an error if:
 	//   - Tag format is invalid
+	//   - Tag has a reserved prefix (ErrReservedTag)
 	//   - Version doesn't exist
 	//   - Tag already exists on this version
-	AddTag(versionID, tag string) (*VersionTag, error)
+	AddTag(ctx context.Context, versionID, tag string) (*VersionTag, error)
 
 	// RemoveTag removes a tag by its ID.
 	//
-	// Returns an error if the tag doesn't exist.
-	RemoveTag(tagID string) error
+	// Returns an error if the tag doesn't exist, or ErrReservedTag if it
+	// has a reserved prefix.
+	RemoveTag(ctx context.Context, tagID string) error
 
 	// GetVersionTags returns all tags for a specific version.
 	//
 	// Returns an empty slice if the version has no tags.
-	GetVersionTags(versionID string) ([]*VersionTag, error)
+	GetVersionTags(ctx context.Context, versionID string) ([]*VersionTag, error)
+
+	// GetVersionTagsFiltered returns a page of a version's tags, oldest
+	// first, and the number of tags matching filter across all pages.
+	//
+	// Returns an empty slice if no tag matches.
+	GetVersionTagsFiltered(ctx context.Context, versionID string, filter TagFilter) ([]*VersionTag, int, error)
 
 	// GetVersionsByTag returns versions matching a tag filter within a branch.
 	//
@@ -89,12 +255,20 @@ type Storage interface {
 	//   - "key": Matches any version with this tag key (any value)
 	//   - "key=value": Matches versions with exact key-value pair
 	//
-	// Results are ordered by timestamp (newest first).
-	GetVersionsByTag(branchID, tag string) ([]*QueryVersion, error)
+	// Each version's TaggedAt is set to when it got the tag. Results are
+	// ordered newest first by version timestamp, or by TaggedAt if
+	// byTaggedAt is set.
+	GetVersionsByTag(ctx context.Context, branchID, tag string, byTaggedAt bool) ([]*QueryVersion, error)
 
 	// ToggleStarred toggles the "system:starred" tag on a version.
 	//
 	// If the version is starred, it becomes unstarred and vice versa.
 	// Returns the new starred state (true if now starred).
-	ToggleStarred(versionID string) (bool, error)
+	ToggleStarred(ctx context.Context, versionID string) (bool, error)
+
+	// GetStarredVersions returns starred versions across all branches,
+	// most recently starred first, with BranchName set.
+	//
+	// At most limit versions are returned; limit <= 0 returns all.
+	GetStarredVersions(ctx context.Context, limit int) ([]*QueryVersion, error)
 }
@@ -1,6 +1,7 @@
 package models
 
 import (
+	"errors"
 	"fmt"
 	"strings"
 	"time"
@@ -47,6 +48,71 @@ func ParseTag(tag string) (key string, value string) {
 	return key, value
 }
 
+// TagFilter selects a page of a version's tags.
+type TagFilter struct {
+	// KeyPrefix keeps tags whose key starts with it, e.g. "env:".
+	KeyPrefix string
+
+	// ExcludeSystem drops tags with the SystemTagPrefix.
+	ExcludeSystem bool
+
+	// Limit caps the tags returned; <= 0 returns all. Offset skips that
+	// many matching tags first.
+	Limit  int
+	Offset int
+}
+
+// SystemTagPrefix marks tags reserved for internal use.
+const SystemTagPrefix = "system:"
+
+// ErrReservedTag is returned when a user adds or removes a tag with a
+// reserved prefix.
+var ErrReservedTag = errors.New("tag prefix is reserved")
+
+// ReservedTagPrefixes lists tag key prefixes owned by clicktelligence or
+// external automation, e.g. "ci:". Tags with them can't be added or removed
+// through the API. SystemTagPrefix is always reserved, also when the list
+// is empty.
+type ReservedTagPrefixes []string
+
+// ParseReservedTagPrefixes parses a comma-separated prefix list such as
+// "ci:,deploy:". Empty entries are ignored.
+func ParseReservedTagPrefixes(s string) ReservedTagPrefixes {
+	var prefixes ReservedTagPrefixes
+	for _, prefix := range strings.Split(s, ",") {
+		if prefix = strings.TrimSpace(prefix); prefix != "" {
+			prefixes = append(prefixes, prefix)
+		}
+	}
+	return prefixes
+}
+
+// Reserved returns the prefix reserving key, or "" if key isn't reserved.
+func (p ReservedTagPrefixes) Reserved(key string) string {
+	if strings.HasPrefix(key, SystemTagPrefix) {
+		return SystemTagPrefix
+	}
+	for _, prefix := range p {
+		if strings.HasPrefix(key, prefix) {
+			return prefix
+		}
+	}
+	return ""
+}
+
+// ValidateTag checks that a user-supplied tag has a non-empty key without a
+// reserved prefix. Reserved tags are reported with ErrReservedTag.
+func ValidateTag(tag string, reserved ReservedTagPrefixes) error {
+	key, _ := ParseTag(tag)
+	if key == "" {
+		return fmt.Errorf("invalid tag %q: key must not be empty", tag)
+	}
+	if prefix := reserved.Reserved(key); prefix != "" {
+		return fmt.Errorf("%w: tag %q uses the reserved prefix %s", ErrReservedTag, tag, prefix)
+	}
+	return nil
+}
+
 // FormatTag formats a tag back to its string representation.
 // Returns "key" for simple tags or "key=value" for key-value tags.
 func (t *VersionTag) FormatTag() string {
@@ -60,5 +126,11 @@ func (t *VersionTag) FormatTag() string {
 // System tags are prefixed with "system:" and are used for
 // internal functionality like starring versions.
 func (t *VersionTag) IsSystemTag() bool {
-	return strings.HasPrefix(t.TagKey, "system:")
+	return strings.HasPrefix(t.TagKey, SystemTagPrefix)
+}
+
+// IsReservedTag checks if a tag has one of the reserved prefixes. System
+// tags are always reserved.
+func (t *VersionTag) IsReservedTag(reserved ReservedTagPrefixes) bool {
+	return reserved.Reserved(t.TagKey) != ""
 }
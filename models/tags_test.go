@@ -0,0 +1,52 @@
+package models
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateTag(t *testing.T) {
+	reserved := ReservedTagPrefixes{"ci:"}
+	tests := []struct {
+		tag          string
+		wantErr      bool
+		wantReserved bool
+	}{
+		{tag: "production"},
+		{tag: "environment=staging"},
+		{tag: "note="},
+		{tag: "", wantErr: true},
+		{tag: "  ", wantErr: true},
+		{tag: "=value", wantErr: true},
+		{tag: "system:starred", wantErr: true, wantReserved: true},
+		{tag: "ci:build=42", wantErr: true, wantReserved: true},
+		{tag: "cinema"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.tag, func(t *testing.T) {
+			err := ValidateTag(tt.tag, reserved)
+			if tt.wantErr {
+				assert.Error(t, err)
+				assert.Equal(t, tt.wantReserved, errors.Is(err, ErrReservedTag))
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestParseReservedTagPrefixes(t *testing.T) {
+	assert.Equal(t, ReservedTagPrefixes{"ci:", "deploy:"}, ParseReservedTagPrefixes(" ci:, ,deploy: "))
+	assert.Empty(t, ParseReservedTagPrefixes(""))
+}
+
+func TestIsReservedTag(t *testing.T) {
+	reserved := ReservedTagPrefixes{"ci:"}
+	assert.True(t, (&VersionTag{TagKey: "system:starred"}).IsReservedTag(nil))
+	assert.True(t, (&VersionTag{TagKey: "ci:pipeline"}).IsReservedTag(reserved))
+	assert.False(t, (&VersionTag{TagKey: "ci:pipeline"}).IsReservedTag(nil))
+	assert.False(t, (&VersionTag{TagKey: "production"}).IsReservedTag(reserved))
+}
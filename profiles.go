@@ -0,0 +1,204 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+)
+
+// DefaultProfile is the connection profile configured by the unprefixed
+// CLICKHOUSE_* variables. Requests without a profile use it.
+const DefaultProfile = "default"
+
+// ErrUnknownProfile is returned when a request names a connection profile
+// that isn't configured.
+var ErrUnknownProfile = errors.New("unknown connection profile")
+
+// ConnProfile holds the settings of one ClickHouse connection profile.
+type ConnProfile struct {
+	Name     string
+	Host     string
+	Database string
+	User     string
+	Password string
+
+	// ReadHost, when set, is a read replica that EXPLAINs are sent to. It
+	// shares the profile's credentials and TLS settings; Host remains in use
+	// for server settings and pings.
+	ReadHost string
+
+	// Secure enables TLS, either explicitly or because Host uses port 9440.
+	Secure        bool
+	TLSSkipVerify bool
+	TLSCAFile     string
+	TLSServerName string
+}
+
+// profileKeys are the variables loadConnProfile reads, after the prefix.
+var profileKeys = []string{
+	"HOST", "DATABASE", "USER", "PASSWORD", "READ_HOST",
+	"SECURE", "TLS_SKIP_VERIFY", "TLS_CA_FILE", "TLS_SERVER_NAME",
+}
+
+// sharedVariables are the CLICKHOUSE_* variables that apply to all
+// profiles, read in main.
+var sharedVariables = []string{
+	"CLICKHOUSE_PROFILES",
+	"CLICKHOUSE_MAX_OPEN_CONNS", "CLICKHOUSE_MAX_IDLE_CONNS", "CLICKHOUSE_CONN_MAX_LIFETIME",
+	"CLICKHOUSE_RECONNECT_INTERVAL", "CLICKHOUSE_RETRY_MAX", "CLICKHOUSE_RETRY_BASE_DELAY",
+}
+
+// profileNamePattern restricts profile names to what can appear in an
+// environment variable name.
+var profileNamePattern = regexp.MustCompile(`^[a-z][a-z0-9_]*$`)
+
+// PoolSettings are the connection pool limits shared by all profiles.
+type PoolSettings struct {
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+}
+
+// parseProfileNames splits CLICKHOUSE_PROFILES into lower-case profile
+// names. The default profile is always present and listed first.
+func parseProfileNames(raw string) ([]string, error) {
+	names := []string{DefaultProfile}
+	seen := map[string]bool{DefaultProfile: true}
+	for _, name := range strings.Split(raw, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" || seen[name] {
+			continue
+		}
+		if !profileNamePattern.MatchString(name) {
+			return nil, fmt.Errorf("invalid profile name %q", name)
+		}
+		if variable := claimedVariable(names, name); variable != "" {
+			return nil, fmt.Errorf("invalid profile name %q: its prefix %s covers %s", name, profileEnvPrefix(name), variable)
+		}
+		seen[name] = true
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// profileEnvPrefix returns the environment variable prefix of a profile:
+// CLICKHOUSE_ for the default profile, CLICKHOUSE_<NAME>_ otherwise.
+func profileEnvPrefix(name string) string {
+	if name == DefaultProfile {
+		return "CLICKHOUSE_"
+	}
+	return "CLICKHOUSE_" + strings.ToUpper(name) + "_"
+}
+
+// claimedVariable returns a variable of one of the profiles names, or a
+// shared one, that starts with the prefix of profile name, or "" if there
+// is none. Such a name is refused since its variables would be mistaken
+// for others': a "read" profile would take CLICKHOUSE_READ_HOST of the
+// default profile, a "prod_read" one CLICKHOUSE_PROD_READ_HOST of "prod".
+func claimedVariable(names []string, name string) string {
+	prefix := profileEnvPrefix(name)
+	variables := slices.Clone(sharedVariables)
+	for _, other := range names {
+		for _, key := range profileKeys {
+			variables = append(variables, profileEnvPrefix(other)+key)
+		}
+	}
+	for _, variable := range variables {
+		if strings.HasPrefix(variable, prefix) {
+			return variable
+		}
+	}
+	return ""
+}
+
+// loadConnProfile reads a profile from the variables under its prefix, e.g.
+// CLICKHOUSE_PROD_HOST for the "prod" profile. getenv is os.Getenv outside
+// of tests.
+func loadConnProfile(name string, getenv func(string) string) (ConnProfile, error) {
+	prefix := profileEnvPrefix(name)
+	get := func(key, def string) string {
+		if v := getenv(prefix + key); v != "" {
+			return v
+		}
+		return def
+	}
+
+	profile := ConnProfile{
+		Name:          name,
+		Host:          get("HOST", "localhost:9000"),
+		Database:      get("DATABASE", "default"),
+		User:          get("USER", "default"),
+		Password:      get("PASSWORD", ""),
+		ReadHost:      get("READ_HOST", ""),
+		TLSCAFile:     get("TLS_CA_FILE", ""),
+		TLSServerName: get("TLS_SERVER_NAME", ""),
+	}
+	profile.Secure = strings.Contains(profile.Host, ":9440") || get("SECURE", "") == "true"
+
+	if v := get("TLS_SKIP_VERIFY", ""); v != "" {
+		skip, err := strconv.ParseBool(v)
+		if err != nil {
+			return ConnProfile{}, fmt.Errorf("invalid %sTLS_SKIP_VERIFY %q: %w", prefix, v, err)
+		}
+		profile.TLSSkipVerify = skip
+	}
+
+	return profile, nil
+}
+
+// ReadProfile returns the profile with Host replaced by ReadHost, or false
+// if no read replica is configured. Port 9440 enables TLS as for Host.
+func (p ConnProfile) ReadProfile() (ConnProfile, bool) {
+	if p.ReadHost == "" {
+		return ConnProfile{}, false
+	}
+	read := p
+	read.Host = p.ReadHost
+	read.Secure = p.Secure || strings.Contains(p.ReadHost, ":9440")
+	return read, true
+}
+
+// Options builds the clickhouse-go options for the profile.
+func (p ConnProfile) Options(pool PoolSettings) (*clickhouse.Options, error) {
+	options := &clickhouse.Options{
+		Addr: []string{p.Host},
+		Auth: clickhouse.Auth{
+			Database: p.Database,
+			Username: p.User,
+			Password: p.Password,
+		},
+		ClientInfo: clickhouse.ClientInfo{
+			Products: []struct {
+				Name    string
+				Version string
+			}{
+				{Name: "clicktelligence", Version: "1.0"},
+			},
+		},
+		// Disable debug logging which might expose workstation info
+		Debug: false,
+		// Disable sending workstation/OS metadata
+		Settings: clickhouse.Settings{
+			"send_logs_level": "none",
+		},
+		MaxOpenConns:    pool.MaxOpenConns,
+		MaxIdleConns:    pool.MaxIdleConns,
+		ConnMaxLifetime: pool.ConnMaxLifetime,
+	}
+
+	if p.Secure {
+		tlsConfig, err := buildTLSConfig(p.TLSSkipVerify, p.TLSCAFile, p.TLSServerName)
+		if err != nil {
+			return nil, fmt.Errorf("failed to configure TLS for profile %s: %w", p.Name, err)
+		}
+		options.TLS = tlsConfig
+	}
+
+	return options, nil
+}
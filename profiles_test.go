@@ -0,0 +1,108 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseProfileNames(t *testing.T) {
+	tests := []struct {
+		name    string
+		raw     string
+		want    []string
+		wantErr bool
+	}{
+		{name: "unset", raw: "", want: []string{"default"}},
+		{name: "named profiles", raw: "PROD, staging", want: []string{"default", "prod", "staging"}},
+		{name: "duplicates and default", raw: "prod,default,prod", want: []string{"default", "prod"}},
+		{name: "invalid name", raw: "prod-eu", wantErr: true},
+		{name: "covers default variables", raw: "read", wantErr: true},
+		{name: "covers tls variables", raw: "tls", wantErr: true},
+		{name: "covers shared variables", raw: "retry", wantErr: true},
+		{name: "covers another profile", raw: "prod,prod_read", wantErr: true},
+		{name: "covered by another profile", raw: "prod_read,prod", wantErr: true},
+		{name: "shares a word", raw: "prod,production", want: []string{"default", "prod", "production"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseProfileNames(tt.raw)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestLoadConnProfile(t *testing.T) {
+	env := map[string]string{
+		"CLICKHOUSE_HOST":                 "local:9000",
+		"CLICKHOUSE_PROD_HOST":            "prod:9440",
+		"CLICKHOUSE_PROD_DATABASE":        "analytics",
+		"CLICKHOUSE_PROD_USER":            "reader",
+		"CLICKHOUSE_PROD_READ_HOST":       "replica:9440",
+		"CLICKHOUSE_PROD_TLS_SKIP_VERIFY": "true",
+		"CLICKHOUSE_BAD_TLS_SKIP_VERIFY":  "maybe",
+	}
+	getenv := func(name string) string { return env[name] }
+
+	def, err := loadConnProfile(DefaultProfile, getenv)
+	require.NoError(t, err)
+	assert.Equal(t, ConnProfile{Name: "default", Host: "local:9000", Database: "default", User: "default"}, def)
+
+	prod, err := loadConnProfile("prod", getenv)
+	require.NoError(t, err)
+	assert.Equal(t, "prod:9440", prod.Host)
+	assert.Equal(t, "analytics", prod.Database)
+	assert.Equal(t, "reader", prod.User)
+	assert.True(t, prod.Secure, "port 9440 enables TLS")
+	assert.True(t, prod.TLSSkipVerify)
+
+	read, ok := prod.ReadProfile()
+	require.True(t, ok)
+	assert.Equal(t, "replica:9440", read.Host)
+	assert.Equal(t, prod.User, read.User)
+	assert.True(t, read.Secure)
+
+	_, ok = def.ReadProfile()
+	assert.False(t, ok, "no read replica configured")
+
+	staging, err := loadConnProfile("staging", getenv)
+	require.NoError(t, err)
+	assert.Equal(t, "localhost:9000", staging.Host, "named profiles don't inherit the default profile")
+
+	_, err = loadConnProfile("bad", getenv)
+	assert.ErrorContains(t, err, "CLICKHOUSE_BAD_TLS_SKIP_VERIFY")
+}
+
+func TestConnManagerUnknownProfile(t *testing.T) {
+	server := NewServer(newTestStorage(t), map[string]*ConnManager{DefaultProfile: nil}, nil)
+
+	_, err := server.connManager("")
+	assert.NoError(t, err)
+
+	_, err = server.connManager("prod")
+	assert.ErrorIs(t, err, ErrUnknownProfile)
+}
+
+func TestExplainConnManager(t *testing.T) {
+	primary, replica := &ConnManager{}, &ConnManager{}
+	server := NewServer(newTestStorage(t), map[string]*ConnManager{DefaultProfile: primary, "prod": primary}, nil)
+	server.readConns = map[string]*ConnManager{DefaultProfile: replica}
+
+	got, err := server.explainConnManager("")
+	require.NoError(t, err)
+	assert.Same(t, replica, got)
+
+	got, err = server.explainConnManager("prod")
+	require.NoError(t, err)
+	assert.Same(t, primary, got, "falls back to the primary connection")
+
+	_, err = server.explainConnManager("staging")
+	assert.ErrorIs(t, err, ErrUnknownProfile)
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/orian/clicktelligence/models"
+)
+
+// formatQuery reformats query with EXPLAIN SYNTAX oneline = 0, which prints
+// the query as ClickHouse parsed it, one clause per line. Errors from
+// ClickHouse rejecting the query are returned as *clickhouse.Exception.
+func formatQuery(ctx context.Context, executor *ExplainExecutor, query string, parameters map[string]string) (string, error) {
+	zero := 0
+	config := models.ExplainConfig{
+		Type:     models.ExplainSyntax,
+		Settings: models.ExplainSettings{OneLine: &zero},
+		Enabled:  true,
+	}
+	opts := ExplainOptions{MaxExecutionTimeMs: DefaultMaxExecutionTimeMs, Parameters: parameters}
+
+	var out strings.Builder
+	if _, err := executor.ExecuteConfigStream(ctx, config, query, opts, &out); err != nil {
+		return "", err
+	}
+	return strings.TrimRight(out.String(), "\n"), nil
+}
+
+// handleFormatQuery returns a query reformatted by ClickHouse, without
+// creating a version. Queries ClickHouse rejects, e.g. for a syntax error,
+// get a 400 with its error.
+func (s *Server) handleFormatQuery(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Query      string            `json:"query"`
+		Profile    string            `json:"profile,omitempty"`
+		Parameters map[string]string `json:"parameters,omitempty"`
+	}
+	if err := s.decodeBody(w, r, &req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := checkQueryLength(req.Query, s.maxQueryLength); err != nil {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err := validateExplainRequest(&ExplainRequest{Query: req.Query}, s.allowedStatements); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ch, err := s.explainConnManager(req.Profile)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	executor, err := ch.Executor(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	formatted, err := formatQuery(r.Context(), executor, req.Query, req.Parameters)
+	var exception *clickhouse.Exception
+	if errors.As(err, &exception) {
+		http.Error(w, s.errorMessage(exception), http.StatusBadRequest)
+		return
+	} else if err != nil {
+		log.Printf("Failed to format query: %v", err)
+		http.Error(w, fmt.Sprintf("failed to format query: %s", s.errorMessage(err)), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"query": formatted})
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFormatQuery(t *testing.T) {
+	rows := &fakeRows{rows: [][]any{{"SELECT a"}, {"FROM t"}, {"WHERE a = 1"}}}
+	formatted, err := formatQuery(context.Background(), NewExplainExecutor(&fakeConn{rows: rows}), "select a from t where a=1", nil)
+	require.NoError(t, err)
+	assert.Equal(t, "SELECT a\nFROM t\nWHERE a = 1", formatted)
+}
+
+func TestHandleFormatQuery(t *testing.T) {
+	format := func(rows driver.Rows, body string) *httptest.ResponseRecorder {
+		conn := NewConnManager(func() (driver.Conn, error) { return &fakeConn{rows: rows}, nil }, 0)
+		server := NewServer(newTestStorage(t), map[string]*ConnManager{DefaultProfile: conn}, nil)
+		rec := httptest.NewRecorder()
+		server.handleFormatQuery(rec, httptest.NewRequest(http.MethodPost, "/api/query/format", strings.NewReader(body)))
+		return rec
+	}
+
+	rec := format(&fakeRows{rows: [][]any{{"SELECT 1"}}}, `{"query":"select 1"}`)
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, `{"query":"SELECT 1"}`, rec.Body.String())
+
+	syntaxErr := &clickhouse.Exception{Code: 62, Name: "SYNTAX_ERROR", Message: "Syntax error: failed at position 8"}
+	rec = format(&fakeRows{err: syntaxErr}, `{"query":"select from"}`)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.Contains(t, rec.Body.String(), "Syntax error")
+
+	rec = format(&fakeRows{}, `{"query":"  "}`)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
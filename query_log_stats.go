@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/orian/clicktelligence/models"
+)
+
+// Polling parameters for system.query_log, which is flushed asynchronously.
+const (
+	queryLogPollAttempts = 5
+	queryLogPollInterval = 300 * time.Millisecond
+)
+
+// queryLogRow holds the columns we read from system.query_log.
+type queryLogRow struct {
+	QueryID         string
+	QueryDurationMs uint64
+	MemoryUsage     int64
+	ReadRows        uint64
+	ReadBytes       uint64
+	ResultRows      uint64
+}
+
+// CollectStats reads system.query_log entries for the given EXPLAIN results
+// and aggregates them into execution stats keyed by EXPLAIN type.
+//
+// Rows may not be flushed immediately, so it polls a bounded number of times
+// until every executed EXPLAIN has a row. Returns whatever was found; failures
+// are logged and never fail the request.
+func (e *ExplainExecutor) CollectStats(ctx context.Context, results []models.ExplainResult, logComment string) map[models.ExplainType]models.QueryLogStats {
+	var queryIDs []string
+	for _, result := range results {
+		if result.QueryID != "" {
+			queryIDs = append(queryIDs, result.QueryID)
+		}
+	}
+	if len(queryIDs) == 0 {
+		return nil
+	}
+
+	var rows []queryLogRow
+	for attempt := 1; attempt <= queryLogPollAttempts; attempt++ {
+		var err error
+		rows, err = e.fetchQueryLogRows(ctx, queryIDs, logComment)
+		if err != nil {
+			slog.WarnContext(ctx, "Failed to read query_log stats", "error", err)
+			break
+		}
+		if len(rows) >= len(queryIDs) || attempt == queryLogPollAttempts {
+			break
+		}
+
+		select {
+		case <-ctx.Done():
+			slog.DebugContext(ctx, "Stopped waiting for query_log stats", "error", ctx.Err())
+			return aggregateQueryLogStats(results, rows)
+		case <-time.After(queryLogPollInterval):
+		}
+	}
+
+	if len(rows) < len(queryIDs) {
+		slog.WarnContext(ctx, "query_log stats incomplete", "found", len(rows), "expected", len(queryIDs))
+	}
+	return aggregateQueryLogStats(results, rows)
+}
+
+// fetchQueryLogRows loads finished (or failed) query_log entries for the given query IDs.
+func (e *ExplainExecutor) fetchQueryLogRows(ctx context.Context, queryIDs []string, logComment string) ([]queryLogRow, error) {
+	rows, err := e.conn.Query(ctx, `
+		SELECT query_id, query_duration_ms, memory_usage, read_rows, read_bytes, result_rows
+		FROM system.query_log
+		WHERE log_comment = ? AND query_id IN (?) AND type != 'QueryStart'
+	`, logComment, queryIDs)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []queryLogRow
+	for rows.Next() {
+		var row queryLogRow
+		if err := rows.Scan(&row.QueryID, &row.QueryDurationMs, &row.MemoryUsage, &row.ReadRows, &row.ReadBytes, &row.ResultRows); err != nil {
+			return nil, err
+		}
+		result = append(result, row)
+	}
+
+	return result, rows.Err()
+}
+
+// aggregateQueryLogStats maps query_log rows back to EXPLAIN types via their
+// query IDs. Values for repeated EXPLAIN types are summed.
+func aggregateQueryLogStats(results []models.ExplainResult, rows []queryLogRow) map[models.ExplainType]models.QueryLogStats {
+	typeByQueryID := make(map[string]models.ExplainType, len(results))
+	for _, result := range results {
+		if result.QueryID != "" {
+			typeByQueryID[result.QueryID] = result.Type
+		}
+	}
+
+	totals := make(map[models.ExplainType]models.QueryLogStats)
+	for _, row := range rows {
+		explainType, ok := typeByQueryID[row.QueryID]
+		if !ok {
+			continue
+		}
+		stats := totals[explainType]
+		stats.QueryDurationMs += int64(row.QueryDurationMs)
+		stats.MemoryUsage += row.MemoryUsage
+		stats.ReadRows += int64(row.ReadRows)
+		stats.ReadBytes += int64(row.ReadBytes)
+		stats.ResultRows += int64(row.ResultRows)
+		totals[explainType] = stats
+	}
+	return totals
+}
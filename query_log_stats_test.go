@@ -0,0 +1,57 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/orian/clicktelligence/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAggregateQueryLogStats(t *testing.T) {
+	results := []models.ExplainResult{
+		{Type: models.ExplainPlan, QueryID: "q1"},
+		{Type: models.ExplainPipeline, QueryID: "q2"},
+		{Type: models.ExplainPlan, QueryID: "q3"},
+		{Type: models.ExplainAST},
+	}
+
+	tests := []struct {
+		name string
+		rows []queryLogRow
+		want map[models.ExplainType]models.QueryLogStats
+	}{
+		{
+			name: "no rows",
+			rows: nil,
+			want: map[models.ExplainType]models.QueryLogStats{},
+		},
+		{
+			name: "one row per type",
+			rows: []queryLogRow{
+				{QueryID: "q1", QueryDurationMs: 5, MemoryUsage: 1024, ReadRows: 0, ReadBytes: 0, ResultRows: 10},
+				{QueryID: "q2", QueryDurationMs: 2, MemoryUsage: 512, ResultRows: 3},
+			},
+			want: map[models.ExplainType]models.QueryLogStats{
+				models.ExplainPlan:     {QueryDurationMs: 5, MemoryUsage: 1024, ResultRows: 10},
+				models.ExplainPipeline: {QueryDurationMs: 2, MemoryUsage: 512, ResultRows: 3},
+			},
+		},
+		{
+			name: "repeated type is summed and unknown ids ignored",
+			rows: []queryLogRow{
+				{QueryID: "q1", QueryDurationMs: 5, MemoryUsage: 100, ResultRows: 1},
+				{QueryID: "q3", QueryDurationMs: 7, MemoryUsage: 200, ResultRows: 2},
+				{QueryID: "other", QueryDurationMs: 100},
+			},
+			want: map[models.ExplainType]models.QueryLogStats{
+				models.ExplainPlan: {QueryDurationMs: 12, MemoryUsage: 300, ResultRows: 3},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, aggregateQueryLogStats(results, tt.rows))
+		})
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+)
+
+// normalizedKeywords are the SQL keywords NormalizeQuery lowercases.
+// Identifiers are case-sensitive in ClickHouse, so only words that can't
+// also be a column, alias or function name, like end, left or any, are
+// touched.
+var normalizedKeywords = map[string]bool{
+	"and": true, "as": true, "asc": true, "between": true, "by": true,
+	"case": true, "cross": true, "desc": true, "distinct": true, "else": true,
+	"exists": true, "from": true, "full": true, "global": true, "group": true,
+	"having": true, "ilike": true, "in": true, "inner": true, "interval": true,
+	"is": true, "join": true, "like": true, "limit": true, "not": true,
+	"null": true, "on": true, "or": true, "order": true, "outer": true,
+	"prewhere": true, "select": true, "settings": true, "then": true,
+	"union": true, "using": true, "when": true, "where": true, "with": true,
+}
+
+// NormalizeQuery returns a canonical form of query for hashing.
+//
+// Runs of whitespace collapse to a single space, leading and trailing
+// whitespace is trimmed and known keywords are lowercased. String literals,
+// quoted identifiers and comments are kept verbatim; a line comment keeps
+// its terminating newline so it cannot swallow the code after it.
+func NormalizeQuery(query string) string {
+	var b strings.Builder
+	runes := []rune(query)
+	pendingSpace := false
+	afterNewline := false
+
+	emit := func(s string) {
+		if pendingSpace && b.Len() > 0 && !afterNewline {
+			b.WriteByte(' ')
+		}
+		afterNewline = false
+		pendingSpace = false
+		b.WriteString(s)
+	}
+
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			pendingSpace = true
+			i++
+
+		case r == '\'' || r == '"' || r == '`':
+			end := scanQuoted(runes, i)
+			emit(string(runes[i:end]))
+			i = end
+
+		case r == '-' && i+1 < len(runes) && runes[i+1] == '-':
+			end := i
+			for end < len(runes) && runes[end] != '\n' {
+				end++
+			}
+			emit(string(runes[i:end]))
+			if end < len(runes) {
+				b.WriteByte('\n')
+				afterNewline = true
+				end++
+			}
+			pendingSpace = false
+			i = end
+
+		case r == '/' && i+1 < len(runes) && runes[i+1] == '*':
+			end := i + 2
+			for end < len(runes) && !(runes[end-1] == '*' && runes[end] == '/' && end > i+2) {
+				end++
+			}
+			if end < len(runes) {
+				end++
+			}
+			emit(string(runes[i:end]))
+			i = end
+
+		case isWordRune(r):
+			end := i
+			for end < len(runes) && isWordRune(runes[end]) {
+				end++
+			}
+			word := string(runes[i:end])
+			if lower := strings.ToLower(word); normalizedKeywords[lower] {
+				word = lower
+			}
+			emit(word)
+			i = end
+
+		default:
+			emit(string(r))
+			i++
+		}
+	}
+
+	return strings.TrimSpace(b.String())
+}
+
+// scanQuoted returns the index just past the quoted section starting at
+// start. Backslash escapes and doubled quotes are honored; an unterminated
+// quote runs to the end of input.
+func scanQuoted(runes []rune, start int) int {
+	quote := runes[start]
+	i := start + 1
+	for i < len(runes) {
+		switch runes[i] {
+		case '\\':
+			i += 2
+			continue
+		case quote:
+			if i+1 < len(runes) && runes[i+1] == quote {
+				i += 2
+				continue
+			}
+			return i + 1
+		}
+		i++
+	}
+	return len(runes)
+}
+
+// isWordRune reports whether r can be part of a keyword or identifier.
+func isWordRune(r rune) bool {
+	return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNormalizeQuery(t *testing.T) {
+	tests := []struct {
+		name  string
+		query string
+		want  string
+	}{
+		{name: "empty", query: "", want: ""},
+		{name: "trims and collapses whitespace", query: "  SELECT\t 1\n\n", want: "select 1"},
+		{name: "lowercases keywords", query: "SELECT a FROM t WHERE b IN (1, 2)", want: "select a from t where b in (1, 2)"},
+		{name: "keeps identifier case", query: "SELECT MyColumn, toDate(ts) FROM Events", want: "select MyColumn, toDate(ts) from Events"},
+		{name: "keeps words that can be identifiers", query: "SELECT Any(x) AS Final, End FROM t", want: "select Any(x) as Final, End from t"},
+		{name: "keeps string literals verbatim", query: "SELECT 'A  B', 'it''s', 'a\\'b'", want: "select 'A  B', 'it''s', 'a\\'b'"},
+		{name: "keeps quoted identifiers", query: "SELECT \"Select\",  `FROM  x`", want: "select \"Select\", `FROM  x`"},
+		{name: "keeps line comment newline", query: "-- New query\n-- Start  here\n\nSELECT 1", want: "-- New query\n-- Start  here\nselect 1"},
+		{name: "trailing line comment", query: "SELECT 1 -- done\n", want: "select 1 -- done"},
+		{name: "keeps block comments", query: "SELECT /* Hint  HERE */ 1", want: "select /* Hint  HERE */ 1"},
+		{name: "unterminated string", query: "SELECT 'abc", want: "select 'abc"},
+		{name: "unterminated block comment", query: "SELECT /* abc", want: "select /* abc"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, NormalizeQuery(tt.query))
+		})
+	}
+}
+
+func TestHashQueryNormalization(t *testing.T) {
+	assert.Equal(t, hashQuery("SELECT 1"), hashQuery("select  1\n"))
+	assert.NotEqual(t, hashQuery("SELECT 'a'"), hashQuery("SELECT 'A'"))
+	assert.NotEqual(t, hashQuery("SELECT a"), hashQuery("SELECT A"))
+	assert.NotEqual(t, hashQuery("-- c\nSELECT 1"), hashQuery("-- c SELECT 1"))
+	assert.NotEqual(t, hashQuery("SELECT End FROM t"), hashQuery("SELECT end FROM t"))
+	assert.NotEqual(t, hashQuery("SELECT Left(s, 2) FROM t"), hashQuery("SELECT left(s, 2) FROM t"))
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
+	"github.com/go-chi/chi/v5"
+	"github.com/orian/clicktelligence/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// versionConn is a driver.Conn answering every EXPLAIN with output and
+// SELECT version() with serverVersion.
+type versionConn struct {
+	driver.Conn
+	output        string
+	serverVersion string
+}
+
+func (c *versionConn) Query(ctx context.Context, query string, args ...any) (driver.Rows, error) {
+	return &fakeRows{rows: [][]any{{c.output}}}, nil
+}
+
+func (c *versionConn) QueryRow(ctx context.Context, query string, args ...any) driver.Row {
+	return &fakeRow{value: c.serverVersion}
+}
+
+type fakeRow struct {
+	driver.Row
+	value string
+}
+
+func (r *fakeRow) Scan(dest ...any) error {
+	*dest[0].(*string) = r.value
+	return nil
+}
+
+func TestHandleReanalyzeVersion(t *testing.T) {
+	storage := newTestStorage(t)
+	conn := NewConnManager(func() (driver.Conn, error) {
+		return &versionConn{output: "new plan", serverVersion: "25.3"}, nil
+	}, 0)
+	server := NewServer(storage, map[string]*ConnManager{DefaultProfile: conn}, nil)
+
+	branch, err := storage.CreateBranch(t.Context(), "reanalyze", "", "")
+	require.NoError(t, err)
+	configs := []models.ExplainConfig{{Type: models.ExplainPlan, Enabled: true}}
+	version := createVersion(branch.ID, &ExplainRequest{Query: "SELECT 1"}, hashQuery("SELECT 1"), configs,
+		[]models.ExplainResult{{Type: models.ExplainPlan, Output: "old plan"}})
+	version.ExecutionStats.ClickHouseVersion = "23.8"
+	require.NoError(t, storage.SaveVersion(t.Context(), version))
+	_, err = storage.AddTag(t.Context(), version.ID, "baseline")
+	require.NoError(t, err)
+
+	reanalyze := func(target string) *models.QueryVersion {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodPost, target, nil)
+		rctx := chi.NewRouteContext()
+		rctx.URLParams.Add("versionId", version.ID)
+		req = req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, rctx))
+		rec := httptest.NewRecorder()
+		server.handleReanalyzeVersion(rec, req)
+		require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+		var response struct {
+			Version *models.QueryVersion `json:"version"`
+		}
+		require.NoError(t, json.NewDecoder(rec.Body).Decode(&response))
+		return response.Version
+	}
+
+	child := reanalyze("/api/versions/" + version.ID + "/reanalyze")
+	assert.NotEqual(t, version.ID, child.ID)
+	assert.Equal(t, version.ID, child.ParentVersionID)
+	assert.Equal(t, branch.ID, child.BranchID)
+	require.Len(t, child.ExplainResults, 1)
+	assert.Equal(t, "new plan", child.ExplainResults[0].Output)
+	assert.Equal(t, "25.3", child.ExecutionStats.ClickHouseVersion)
+
+	// The version isn't the head anymore, but in place doesn't branch
+	updated := reanalyze("/api/versions/" + version.ID + "/reanalyze?inPlace=true")
+	assert.Equal(t, version.ID, updated.ID)
+	assert.Equal(t, "new plan", updated.ExplainResults[0].Output)
+	assert.Equal(t, "25.3", updated.ExecutionStats.ClickHouseVersion)
+	assert.False(t, updated.ExecutionStats.ReanalyzedAt.IsZero())
+	require.Len(t, updated.Tags, 1)
+
+	stored, ok := storage.GetVersion(t.Context(), version.ID)
+	require.True(t, ok)
+	assert.Equal(t, "new plan", stored.ExplainResults[0].Output)
+	assert.Equal(t, configs, stored.Configs)
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// DefaultMaxRequestBodyBytes caps the size of JSON request bodies.
+const DefaultMaxRequestBodyBytes = 1 << 20
+
+// errEmptyBody is returned for a request without a body.
+var errEmptyBody = fmt.Errorf("request body required: %w", io.EOF)
+
+// decodeJSONBody decodes the request body into dst, reading at most
+// maxBytes. Unknown fields and trailing data are rejected. An empty body
+// returns errEmptyBody, which wraps io.EOF so handlers with optional bodies
+// can accept it; all errors are descriptive enough to return as a 400.
+func decodeJSONBody(w http.ResponseWriter, r *http.Request, maxBytes int64, dst any) error {
+	if maxBytes > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, maxBytes)
+	}
+	return decodeStrictJSON(r.Body, dst)
+}
+
+// decodeBody decodes a JSON request body into dst with the server's size
+// limit; see decodeJSONBody.
+func (s *Server) decodeBody(w http.ResponseWriter, r *http.Request, dst any) error {
+	return decodeJSONBody(w, r, s.maxBodyBytes, dst)
+}
+
+// decodeStrictJSON decodes a single JSON value from src into dst, rejecting
+// unknown fields and trailing data.
+func decodeStrictJSON(src io.Reader, dst any) error {
+	dec := json.NewDecoder(src)
+	dec.DisallowUnknownFields()
+
+	if err := dec.Decode(dst); err != nil {
+		return describeDecodeError(err)
+	}
+	if err := dec.Decode(&struct{}{}); err != io.EOF {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			return describeDecodeError(err)
+		}
+		return errors.New("request body must contain a single JSON value")
+	}
+	return nil
+}
+
+// describeDecodeError turns json.Decoder errors into messages that name
+// the offending field or position.
+func describeDecodeError(err error) error {
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	var maxBytesErr *http.MaxBytesError
+
+	switch {
+	case err == io.EOF:
+		return errEmptyBody
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		return errors.New("malformed JSON: unexpected end of body")
+	case errors.As(err, &syntaxErr):
+		return fmt.Errorf("malformed JSON at offset %d: %v", syntaxErr.Offset, err)
+	case errors.As(err, &typeErr):
+		return fmt.Errorf("invalid value for field %q: expected %s", typeErr.Field, typeErr.Type)
+	case errors.As(err, &maxBytesErr):
+		return fmt.Errorf("request body too large (limit %d bytes)", maxBytesErr.Limit)
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		// encoding/json has no typed error for unknown fields
+		return fmt.Errorf("unknown field %s", strings.TrimPrefix(err.Error(), "json: unknown field "))
+	default:
+		return err
+	}
+}
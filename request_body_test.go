@@ -0,0 +1,78 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDecodeJSONBody(t *testing.T) {
+	type payload struct {
+		Name  string `json:"name"`
+		Count int    `json:"count"`
+	}
+
+	tests := []struct {
+		name    string
+		body    string
+		want    payload
+		wantErr string
+	}{
+		{name: "valid", body: `{"name": "a", "count": 2}`, want: payload{Name: "a", Count: 2}},
+		{name: "empty", body: "", wantErr: "request body required"},
+		{name: "unknown field", body: `{"name": "a", "cuont": 2}`, wantErr: `unknown field "cuont"`},
+		{name: "wrong type", body: `{"count": "two"}`, wantErr: `invalid value for field "count"`},
+		{name: "malformed", body: `{"name": }`, wantErr: "malformed JSON at offset"},
+		{name: "truncated", body: `{"name": "a"`, wantErr: "unexpected end of body"},
+		{name: "trailing data", body: `{"name": "a"} {"name": "b"}`, wantErr: "single JSON value"},
+		{name: "too large", body: `{"name": "` + strings.Repeat("x", 100) + `"}`, wantErr: "request body too large (limit 64 bytes)"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(tt.body))
+			var got payload
+			err := decodeJSONBody(httptest.NewRecorder(), r, 64, &got)
+			if tt.wantErr != "" {
+				assert.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestDecodeJSONBodyEmptyIsEOF(t *testing.T) {
+	r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(""))
+	var req struct{}
+	assert.ErrorIs(t, decodeJSONBody(httptest.NewRecorder(), r, 64, &req), io.EOF)
+}
+
+func TestHandleExplainQueryRejectsBadBodies(t *testing.T) {
+	server := NewServer(newTestStorage(t), nil, nil)
+	server.maxBodyBytes = 128
+
+	tests := []struct {
+		name    string
+		body    string
+		wantErr string
+	}{
+		{name: "extra field", body: `{"query": "SELECT 1", "forceAnalyser": true}`, wantErr: `unknown field "forceAnalyser"`},
+		{name: "oversized", body: `{"query": "SELECT '` + strings.Repeat("x", 200) + `'"}`, wantErr: "request body too large"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			server.handleExplainQuery(rec, httptest.NewRequest(http.MethodPost, "/api/query/explain", strings.NewReader(tt.body)))
+			assert.Equal(t, http.StatusBadRequest, rec.Code)
+			assert.Contains(t, rec.Body.String(), tt.wantErr)
+		})
+	}
+}
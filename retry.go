@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+)
+
+// Default retry policy for transient ClickHouse errors.
+const (
+	DefaultRetryMaxAttempts = 2
+	DefaultRetryBaseDelay   = 200 * time.Millisecond
+)
+
+// RetryPolicy controls retries of EXPLAIN queries that fail with transient
+// errors. Delays grow exponentially: BaseDelay, 2*BaseDelay, 4*BaseDelay...
+type RetryPolicy struct {
+	// MaxRetries is the number of retries after the first attempt (0 = no retries).
+	MaxRetries int
+
+	// BaseDelay is the wait before the first retry.
+	BaseDelay time.Duration
+}
+
+// Backoff returns the delay before the given retry (1-based).
+func (p RetryPolicy) Backoff(retry int) time.Duration {
+	if retry < 1 {
+		return 0
+	}
+	return p.BaseDelay << (retry - 1)
+}
+
+// transientExceptionCodes are ClickHouse server error codes worth retrying.
+var transientExceptionCodes = map[int32]bool{
+	202: true, // TOO_MANY_SIMULTANEOUS_QUERIES
+	209: true, // SOCKET_TIMEOUT
+	210: true, // NETWORK_ERROR
+}
+
+// isTransientError reports whether err is a connection-level failure that
+// may succeed on retry. Query errors reported by the server (syntax, unknown
+// table, timeouts from max_execution_time, ...) and cancellations are not.
+func isTransientError(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	var exception *clickhouse.Exception
+	if errors.As(err, &exception) {
+		return transientExceptionCodes[exception.Code]
+	}
+
+	if errors.Is(err, clickhouse.ErrAcquireConnTimeout) ||
+		errors.Is(err, driver.ErrBadConn) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.EPIPE) {
+		return true
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+// isConnectionError reports whether err is a failure of the connection to
+// ClickHouse itself, after which it is worth re-opening, rather than an
+// error reported by the server.
+func isConnectionError(err error) bool {
+	var exception *clickhouse.Exception
+	return !errors.As(err, &exception) && isTransientError(err)
+}
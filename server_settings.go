@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
+	"github.com/orian/clicktelligence/models"
+)
+
+// DefaultServerSettingNames are the system.settings rows reported when a
+// request doesn't name any.
+var DefaultServerSettingNames = []string{
+	"enable_analyzer",
+	"allow_experimental_analyzer",
+	"max_threads",
+	"max_memory_usage",
+	"max_execution_time",
+}
+
+// ServerSettings is the response of /api/server/settings.
+//
+// The flat profile, host, database and enable_analyzer fields predate
+// Settings and are what clients pass back as ExplainRequest.ServerSettings.
+type ServerSettings struct {
+	Profile        string `json:"profile"`
+	Host           string `json:"host"`
+	Database       string `json:"database"`
+	EnableAnalyzer string `json:"enable_analyzer"`
+
+	// Settings maps each requested setting found in system.settings to its
+	// value.
+	Settings map[string]string `json:"settings"`
+
+	// NotFound lists requested settings the server doesn't have.
+	NotFound []string `json:"notFound"`
+
+	// Error is set when the settings couldn't be read; EnableAnalyzer then
+	// defaults to "0".
+	Error string `json:"error,omitempty"`
+
+	// FetchedAt is when the values were read from the server. They may be
+	// up to SERVER_SETTINGS_TTL old.
+	FetchedAt *time.Time `json:"fetchedAt,omitempty"`
+}
+
+// DefaultServerSettingsTTL is how long fetched settings are reused.
+const DefaultServerSettingsTTL = 30 * time.Second
+
+// serverSettingsCache keeps fetched system.settings values per profile and
+// list of names for ttl. Concurrent requests for the same entry share one
+// fetch.
+type serverSettingsCache struct {
+	ttl time.Duration
+	now func() time.Time
+
+	mu      sync.Mutex
+	entries map[string]*serverSettingsEntry
+}
+
+type serverSettingsEntry struct {
+	// done is closed once the fetch finished; the fields below are set
+	// by then. Failed fetches are dropped from the cache right away.
+	done      chan struct{}
+	settings  map[string]string
+	notFound  []string
+	err       error
+	fetchedAt time.Time
+}
+
+func newServerSettingsCache(ttl time.Duration) *serverSettingsCache {
+	return &serverSettingsCache{
+		ttl:     ttl,
+		now:     time.Now,
+		entries: make(map[string]*serverSettingsEntry),
+	}
+}
+
+// serverSettingsKey identifies the settings of names on profile, regardless
+// of their order.
+func serverSettingsKey(profile string, names []string) string {
+	sorted := slices.Clone(names)
+	slices.Sort(sorted)
+	return profile + "\x00" + strings.Join(slices.Compact(sorted), ",")
+}
+
+// get returns the cached result of fetching names on profile, calling fetch
+// when there is none or it is older than the ttl. fetch runs detached from
+// ctx's cancellation, as other requests may be waiting for it.
+func (c *serverSettingsCache) get(ctx context.Context, profile string, names []string, fetch func(ctx context.Context) (map[string]string, []string, error)) (map[string]string, []string, time.Time, error) {
+	key := serverSettingsKey(profile, names)
+
+	c.mu.Lock()
+	entry, ok := c.entries[key]
+	if ok {
+		select {
+		case <-entry.done:
+			if c.now().Sub(entry.fetchedAt) >= c.ttl {
+				ok = false
+			}
+		default:
+			// still fetching
+		}
+	}
+	if !ok {
+		c.sweepLocked()
+		entry = &serverSettingsEntry{done: make(chan struct{})}
+		c.entries[key] = entry
+		c.mu.Unlock()
+
+		entry.settings, entry.notFound, entry.err = fetch(context.WithoutCancel(ctx))
+		entry.fetchedAt = c.now()
+
+		c.mu.Lock()
+		if entry.err != nil && c.entries[key] == entry {
+			delete(c.entries, key)
+		}
+		close(entry.done)
+		c.mu.Unlock()
+		return entry.settings, entry.notFound, entry.fetchedAt, entry.err
+	}
+	c.mu.Unlock()
+
+	select {
+	case <-entry.done:
+	case <-ctx.Done():
+		return nil, nil, time.Time{}, ctx.Err()
+	}
+	return entry.settings, entry.notFound, entry.fetchedAt, entry.err
+}
+
+// sweepLocked drops expired entries. Callers hold mu.
+func (c *serverSettingsCache) sweepLocked() {
+	now := c.now()
+	for key, entry := range c.entries {
+		select {
+		case <-entry.done:
+			if now.Sub(entry.fetchedAt) >= c.ttl {
+				delete(c.entries, key)
+			}
+		default:
+		}
+	}
+}
+
+// invalidate drops the cached settings of profile, so that the next get
+// fetches them again. Fetches in flight are left to finish.
+func (c *serverSettingsCache) invalidate(profile string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key := range c.entries {
+		if strings.HasPrefix(key, profile+"\x00") {
+			delete(c.entries, key)
+		}
+	}
+}
+
+// clear drops the cached settings of every profile.
+func (c *serverSettingsCache) clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	clear(c.entries)
+}
+
+// maxSettingNames bounds how many settings one request can ask for.
+const maxSettingNames = 100
+
+// parseSettingNames splits a comma-separated list of setting names,
+// returning DefaultServerSettingNames for an empty list. Names are
+// validated, as they end up in a query.
+func parseSettingNames(raw string) ([]string, error) {
+	names := parseIDList(raw)
+	if len(names) == 0 {
+		return DefaultServerSettingNames, nil
+	}
+	if len(names) > maxSettingNames {
+		return nil, fmt.Errorf("too many setting names: %d (max %d)", len(names), maxSettingNames)
+	}
+	if err := models.ValidateSettingNames(names); err != nil {
+		return nil, err
+	}
+	return names, nil
+}
+
+// fetchServerSettings reads the named rows of system.settings. Names not
+// found are returned in the order requested.
+func fetchServerSettings(ctx context.Context, conn driver.Conn, names []string) (map[string]string, []string, error) {
+	if err := models.ValidateSettingNames(names); err != nil {
+		return nil, nil, err
+	}
+
+	placeholders := make([]string, len(names))
+	args := make([]any, len(names))
+	for i, name := range names {
+		placeholders[i] = "?"
+		args[i] = name
+	}
+	rows, err := conn.Query(ctx,
+		fmt.Sprintf("SELECT name, value FROM system.settings WHERE name IN (%s)", strings.Join(placeholders, ", ")),
+		args...,
+	)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to query system.settings: %w", err)
+	}
+	defer rows.Close()
+
+	settings := make(map[string]string, len(names))
+	for rows.Next() {
+		var name, value string
+		if err := rows.Scan(&name, &value); err != nil {
+			return nil, nil, fmt.Errorf("failed to scan setting: %w", err)
+		}
+		settings[name] = value
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	notFound := []string{}
+	for _, name := range names {
+		if _, ok := settings[name]; !ok && !slices.Contains(notFound, name) {
+			notFound = append(notFound, name)
+		}
+	}
+	return settings, notFound, nil
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseSettingNames(t *testing.T) {
+	tests := []struct {
+		name    string
+		raw     string
+		want    []string
+		wantErr bool
+	}{
+		{name: "empty uses defaults", raw: "", want: DefaultServerSettingNames},
+		{name: "explicit", raw: "max_threads, use_query_cache", want: []string{"max_threads", "use_query_cache"}},
+		{name: "injection", raw: "max_threads,x') OR 1=1 --", wantErr: true},
+		{name: "too many", raw: strings.Repeat("a,", maxSettingNames+1), wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseSettingNames(tt.raw)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestFetchServerSettings(t *testing.T) {
+	rows := &fakeRows{
+		columns: []string{"name", "value"},
+		rows:    [][]any{{"max_threads", "'auto(8)'"}, {"enable_analyzer", "1"}},
+	}
+
+	settings, notFound, err := fetchServerSettings(context.Background(), &fakeConn{rows: rows},
+		[]string{"max_threads", "no_such_setting", "enable_analyzer"})
+
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"max_threads": "'auto(8)'", "enable_analyzer": "1"}, settings)
+	assert.Equal(t, []string{"no_such_setting"}, notFound)
+
+	_, _, err = fetchServerSettings(context.Background(), &fakeConn{rows: rows}, []string{"bad name"})
+	assert.Error(t, err)
+}
+
+func TestServerSettingsCache(t *testing.T) {
+	cache := newServerSettingsCache(30 * time.Second)
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	cache.now = func() time.Time { return now }
+
+	fetches := 0
+	fetch := func(ctx context.Context) (map[string]string, []string, error) {
+		fetches++
+		return map[string]string{"max_threads": "8"}, nil, nil
+	}
+
+	settings, _, fetchedAt, err := cache.get(t.Context(), "default", []string{"max_threads", "enable_analyzer"}, fetch)
+	require.NoError(t, err)
+	assert.Equal(t, "8", settings["max_threads"])
+	assert.Equal(t, now, fetchedAt)
+
+	now = now.Add(10 * time.Second)
+	_, _, fetchedAt, err = cache.get(t.Context(), "default", []string{"enable_analyzer", "max_threads"}, fetch)
+	require.NoError(t, err)
+	assert.Equal(t, 1, fetches, "same names in another order hit the cache")
+	assert.Equal(t, now.Add(-10*time.Second), fetchedAt)
+
+	_, _, _, err = cache.get(t.Context(), "other", []string{"max_threads", "enable_analyzer"}, fetch)
+	require.NoError(t, err)
+	assert.Equal(t, 2, fetches, "profiles are cached separately")
+
+	now = now.Add(30 * time.Second)
+	_, _, _, err = cache.get(t.Context(), "default", []string{"max_threads", "enable_analyzer"}, fetch)
+	require.NoError(t, err)
+	assert.Equal(t, 3, fetches, "expired entries are fetched again")
+
+	cache.invalidate("default")
+	_, _, _, err = cache.get(t.Context(), "default", []string{"max_threads", "enable_analyzer"}, fetch)
+	require.NoError(t, err)
+	assert.Equal(t, 4, fetches)
+}
+
+func TestServerSettingsCacheErrorsNotCached(t *testing.T) {
+	cache := newServerSettingsCache(time.Minute)
+
+	_, _, _, err := cache.get(t.Context(), "default", []string{"max_threads"}, func(ctx context.Context) (map[string]string, []string, error) {
+		return nil, nil, errors.New("connection refused")
+	})
+	require.Error(t, err)
+
+	settings, _, _, err := cache.get(t.Context(), "default", []string{"max_threads"}, func(ctx context.Context) (map[string]string, []string, error) {
+		return map[string]string{"max_threads": "8"}, nil, nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "8", settings["max_threads"])
+}
+
+func TestServerSettingsCacheSingleFlight(t *testing.T) {
+	cache := newServerSettingsCache(time.Minute)
+
+	var fetches atomic.Int32
+	release := make(chan struct{})
+	fetch := func(ctx context.Context) (map[string]string, []string, error) {
+		fetches.Add(1)
+		<-release
+		return map[string]string{"max_threads": "8"}, nil, nil
+	}
+
+	var wg sync.WaitGroup
+	for range 5 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			settings, _, _, err := cache.get(t.Context(), "default", []string{"max_threads"}, fetch)
+			assert.NoError(t, err)
+			assert.Equal(t, "8", settings["max_threads"])
+		}()
+	}
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	assert.Equal(t, int32(1), fetches.Load())
+}
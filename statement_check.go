@@ -0,0 +1,174 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// DefaultAllowedStatements are the statement kinds accepted for EXPLAIN.
+// INSERT is only accepted in its INSERT ... SELECT form. Queries starting
+// with WITH are of the kind of the statement after their WITH clause.
+var DefaultAllowedStatements = []string{"SELECT", "INSERT"}
+
+// statementKeywords are the words that start a statement, used to find the
+// statement following a WITH clause.
+var statementKeywords = map[string]bool{
+	"ALTER": true, "ATTACH": true, "CHECK": true, "CREATE": true, "DELETE": true,
+	"DESC": true, "DESCRIBE": true, "DETACH": true, "DROP": true, "EXCHANGE": true,
+	"EXISTS": true, "EXPLAIN": true, "GRANT": true, "INSERT": true, "KILL": true,
+	"OPTIMIZE": true, "RENAME": true, "REVOKE": true, "SELECT": true, "SET": true,
+	"SHOW": true, "SYSTEM": true, "TRUNCATE": true, "UNDROP": true, "UPDATE": true,
+	"USE": true,
+}
+
+// statementToken is an upper-cased word or a "(", ")" or "," of a query,
+// with the number of parentheses enclosing it. Parentheses count as
+// enclosed by the ones outside them only.
+type statementToken struct {
+	text  string
+	depth int
+}
+
+// statementWords returns the upper-cased words of query outside string
+// literals, quoted identifiers and comments, in order.
+func statementWords(query string) []string {
+	var words []string
+	for _, token := range statementTokens(query) {
+		if isWordToken(token) {
+			words = append(words, token.text)
+		}
+	}
+	return words
+}
+
+// statementTokens returns the words, parentheses and commas of query
+// outside string literals, quoted identifiers and comments, in order.
+func statementTokens(query string) []statementToken {
+	var tokens []statementToken
+	depth := 0
+	runes := []rune(query)
+
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case r == '\'' || r == '"' || r == '`':
+			i = scanQuoted(runes, i)
+
+		case r == '-' && i+1 < len(runes) && runes[i+1] == '-':
+			for i < len(runes) && runes[i] != '\n' {
+				i++
+			}
+
+		case r == '/' && i+1 < len(runes) && runes[i+1] == '*':
+			end := i + 2
+			for end < len(runes) && !(runes[end-1] == '*' && runes[end] == '/' && end > i+2) {
+				end++
+			}
+			i = end + 1
+
+		case isWordRune(r):
+			end := i
+			for end < len(runes) && isWordRune(runes[end]) {
+				end++
+			}
+			tokens = append(tokens, statementToken{text: strings.ToUpper(string(runes[i:end])), depth: depth})
+			i = end
+
+		case r == '(':
+			tokens = append(tokens, statementToken{text: "(", depth: depth})
+			depth++
+			i++
+
+		case r == ')':
+			if depth > 0 {
+				depth--
+			}
+			tokens = append(tokens, statementToken{text: ")", depth: depth})
+			i++
+
+		case r == ',':
+			tokens = append(tokens, statementToken{text: ",", depth: depth})
+			i++
+
+		default:
+			i++
+		}
+	}
+
+	return tokens
+}
+
+// statementStart returns the index of the keyword starting the statement
+// of tokens: the first word, or for a leading WITH the statement following
+// its clause. Statement keywords naming a CTE or alias, i.e. right after
+// WITH, "," or AS or right before AS, are skipped, so
+// "WITH drop AS (...) SELECT" is a SELECT. Returns -1 if there is none.
+func statementStart(tokens []statementToken) int {
+	first := slices.IndexFunc(tokens, isWordToken)
+	if first < 0 || tokens[first].text != "WITH" {
+		return first
+	}
+
+	depth := tokens[first].depth
+	prev := tokens[first].text
+	for i := first + 1; i < len(tokens); i++ {
+		token := tokens[i]
+		if token.depth < depth {
+			break
+		}
+		if token.depth > depth {
+			continue
+		}
+		next := ""
+		if i+1 < len(tokens) {
+			next = tokens[i+1].text
+		}
+		if statementKeywords[token.text] && prev != "WITH" && prev != "," && prev != "AS" && next != "AS" {
+			return i
+		}
+		prev = token.text
+	}
+	return -1
+}
+
+func isWordToken(token statementToken) bool {
+	return isWordRune([]rune(token.text)[0])
+}
+
+// checkStatementKind rejects queries whose statement keyword is not in
+// allowed; see statementStart. An INSERT must also contain a SELECT.
+// Queries without any keyword pass, leaving emptiness checks to the caller.
+func checkStatementKind(query string, allowed []string) error {
+	tokens := statementTokens(query)
+	if !slices.ContainsFunc(tokens, isWordToken) {
+		return nil
+	}
+
+	start := statementStart(tokens)
+	if start < 0 {
+		return fmt.Errorf("WITH clause is not followed by a statement")
+	}
+	kind := tokens[start].text
+	if !slices.Contains(allowed, kind) {
+		return fmt.Errorf("%s statements are not allowed, expected one of: %s", kind, strings.Join(allowed, ", "))
+	}
+
+	if kind == "INSERT" && !slices.ContainsFunc(tokens[start+1:], func(t statementToken) bool { return t.text == "SELECT" }) {
+		return fmt.Errorf("only INSERT ... SELECT statements are allowed")
+	}
+
+	return nil
+}
+
+// parseStatementList parses a comma-separated list of statement keywords,
+// upper-casing them.
+func parseStatementList(raw string) []string {
+	var kinds []string
+	for _, kind := range strings.Split(raw, ",") {
+		if kind = strings.ToUpper(strings.TrimSpace(kind)); kind != "" {
+			kinds = append(kinds, kind)
+		}
+	}
+	return kinds
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStatementWords(t *testing.T) {
+	tests := []struct {
+		name  string
+		query string
+		want  []string
+	}{
+		{name: "empty", query: "", want: nil},
+		{name: "simple", query: "select a from t", want: []string{"SELECT", "A", "FROM", "T"}},
+		{name: "skips comments", query: "-- DROP\n/* ALTER */ SELECT 1", want: []string{"SELECT", "1"}},
+		{name: "skips literals", query: "SELECT 'drop table' AS `insert`", want: []string{"SELECT", "AS"}},
+		{name: "parenthesized", query: "(SELECT 1)", want: []string{"SELECT", "1"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, statementWords(tt.query))
+		})
+	}
+}
+
+func TestCheckStatementKind(t *testing.T) {
+	tests := []struct {
+		name    string
+		query   string
+		allowed []string
+		wantErr bool
+	}{
+		{name: "select", query: "SELECT 1", allowed: DefaultAllowedStatements},
+		{name: "lowercase select", query: "  select 1", allowed: DefaultAllowedStatements},
+		{name: "with", query: "WITH x AS (SELECT 1) SELECT * FROM x", allowed: DefaultAllowedStatements},
+		{name: "placeholder with comments", query: "-- New query branch\n-- Start writing\n\nSELECT 1", allowed: DefaultAllowedStatements},
+		{name: "insert select", query: "INSERT INTO t SELECT * FROM s", allowed: DefaultAllowedStatements},
+		{name: "insert values", query: "INSERT INTO t VALUES (1)", allowed: DefaultAllowedStatements, wantErr: true},
+		{name: "insert with select in literal", query: "INSERT INTO t VALUES ('SELECT')", allowed: DefaultAllowedStatements, wantErr: true},
+		{name: "drop", query: "DROP TABLE t", allowed: DefaultAllowedStatements, wantErr: true},
+		{name: "drop hidden behind comment", query: "/* SELECT */ DROP TABLE t", allowed: DefaultAllowedStatements, wantErr: true},
+		{name: "alter", query: "ALTER TABLE t DELETE WHERE 1", allowed: DefaultAllowedStatements, wantErr: true},
+		{name: "truncate", query: "truncate table t", allowed: DefaultAllowedStatements, wantErr: true},
+		{name: "custom allowlist", query: "INSERT INTO t SELECT 1", allowed: []string{"SELECT"}, wantErr: true},
+		{name: "with is a select", query: "WITH x AS (SELECT 1) SELECT 1", allowed: []string{"SELECT"}},
+		{name: "multiple ctes", query: "WITH a AS (SELECT 1 AS n), b AS (SELECT n + 1 FROM a WHERE n IN (1, 2)) SELECT * FROM a, b", allowed: []string{"SELECT"}},
+		{name: "expression aliases", query: "WITH 1 AS x, toDate(now()) AS d, (SELECT max(n) FROM t) AS m SELECT x, d, m", allowed: []string{"SELECT"}},
+		{name: "statement keywords as cte names", query: "with drop AS (SELECT 1), delete AS (SELECT 2), select AS (SELECT 3) select * from drop, delete, select", allowed: []string{"SELECT"}},
+		{name: "statement keyword as alias", query: "WITH 1 AS insert SELECT insert", allowed: []string{"SELECT"}},
+		{name: "recursive", query: "WITH RECURSIVE r AS (SELECT 1 AS n UNION ALL SELECT n + 1 FROM r WHERE n < 3) SELECT * FROM r", allowed: []string{"SELECT"}},
+		{name: "parenthesized with", query: "(WITH x AS (SELECT 1) SELECT * FROM x)", allowed: []string{"SELECT"}},
+		{name: "with before ddl", query: "WITH x AS (SELECT 1) DROP TABLE t", allowed: DefaultAllowedStatements, wantErr: true},
+		{name: "with without statement", query: "WITH x AS (SELECT 1)", allowed: DefaultAllowedStatements, wantErr: true},
+		{name: "empty query passes", query: "  -- nothing\n", allowed: DefaultAllowedStatements},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkStatementKind(tt.query, tt.allowed)
+			if tt.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestParseStatementList(t *testing.T) {
+	assert.Equal(t, []string{"SELECT", "WITH"}, parseStatementList(" select, With ,,"))
+	assert.Nil(t, parseStatementList(""))
+}
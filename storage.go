@@ -1,9 +1,16 @@
 package main
 
 import (
+	"context"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"slices"
+	"strings"
+	"sync"
 	"time"
 
 	_ "github.com/duckdb/duckdb-go/v2"
@@ -11,24 +18,113 @@ import (
 	"github.com/orian/clicktelligence/models"
 )
 
+var (
+	// ErrBranchNotFound is returned when a referenced branch does not exist.
+	ErrBranchNotFound = errors.New("branch not found")
+
+	// ErrVersionNotFound is returned when a referenced version does not exist.
+	ErrVersionNotFound = errors.New("version not found")
+
+	// ErrVersionNotOnBranch is returned when a version is used as the head
+	// of a branch it doesn't belong to.
+	ErrVersionNotOnBranch = errors.New("version does not belong to the branch")
+
+	// ErrInvalidParentVersion is returned when a version's parent doesn't
+	// exist, or is neither on the version's branch nor the version the
+	// branch was forked from.
+	ErrInvalidParentVersion = errors.New("invalid parent version")
+
+	// ErrDatabaseLocked is returned when the DuckDB file is held open by
+	// another process.
+	ErrDatabaseLocked = errors.New("database file is in use by another process")
+
+	// ErrSchemaAhead is returned when the database has migrations applied
+	// that this binary doesn't know, e.g. after a downgrade.
+	ErrSchemaAhead = errors.New("database schema is newer than this binary")
+
+	// ErrCheckpointBusy is returned by Optimize when writes kept the
+	// checkpoint from running.
+	ErrCheckpointBusy = errors.New("checkpoint skipped: write transactions are active")
+)
+
+// DefaultStorageTimeout bounds each storage operation, on top of any
+// deadline of the caller's context.
+const DefaultStorageTimeout = 10 * time.Second
+
+// DuckDBStorage implements models.Storage on DuckDB.
+//
+// Concurrency: *sql.DB is safe for concurrent use and DuckDB serializes
+// conflicting writes itself (a conflicting transaction fails rather than
+// corrupting data), so single statements and transactions need no extra
+// locking. Operations spanning several statements outside one transaction
+// are serialized with tagMu: the tag existence check and insert in
+// AddTag/ToggleStarred, and the tag detach/reattach in AmendVersion,
+// DeleteVersion and migration rewrites.
 type DuckDBStorage struct {
 	db *sql.DB
+
+	// path is the database file, for reporting its size.
+	path string
+
+	// timeout bounds each operation; 0 disables the limit.
+	timeout time.Duration
+
+	// compress stores the large version columns compressed, see
+	// SetCompression.
+	compress bool
+
+	// reservedTags are the tag prefixes AddTag and RemoveTag refuse, see
+	// SetReservedTagPrefixes.
+	reservedTags models.ReservedTagPrefixes
+
+	tagMu sync.Mutex
+
+	// migrateMu serializes ApplyMigrations, Reset and Optimize calls.
+	migrateMu sync.Mutex
 }
 
 func NewDuckDBStorage(dbPath string) (*DuckDBStorage, error) {
-	db, err := sql.Open("duckdb", dbPath)
+	return newDuckDBStorage(dbPath, true)
+}
+
+// NewDuckDBStorageWithoutMigrations opens the database like
+// NewDuckDBStorage but leaves pending migrations to ApplyMigrations. Until
+// they are applied, operations using columns they add fail.
+func NewDuckDBStorageWithoutMigrations(dbPath string) (*DuckDBStorage, error) {
+	return newDuckDBStorage(dbPath, false)
+}
+
+func newDuckDBStorage(dbPath string, migrate bool) (*DuckDBStorage, error) {
+	db, err := openDuckDB(dbPath, dbPath)
 	if err != nil {
-		return nil, fmt.Errorf("failed to open duckdb: %w", err)
+		return nil, err
 	}
 
-	storage := &DuckDBStorage{db: db}
+	storage := &DuckDBStorage{db: db, path: dbPath, timeout: DefaultStorageTimeout}
 	if err := storage.initSchema(); err != nil {
 		return nil, fmt.Errorf("failed to initialize schema: %w", err)
 	}
 
 	// Run migrations
-	if err := RunMigrations(db); err != nil {
-		return nil, fmt.Errorf("failed to run migrations: %w", err)
+	if migrate {
+		if err := RunMigrations(db); err != nil {
+			return nil, fmt.Errorf("failed to run migrations: %w", err)
+		}
+	} else if err := ensureMigrationsTable(context.Background(), db); err != nil {
+		return nil, err
+	}
+
+	if err := checkSchemaVersion(context.Background(), db); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	// Reattach tags left detached by a rewrite that didn't finish
+	if migrate {
+		if err := reattachTags(context.Background(), db); err != nil {
+			db.Close()
+			return nil, err
+		}
 	}
 
 	// Create default main branch if it doesn't exist
@@ -39,6 +135,122 @@ func NewDuckDBStorage(dbPath string) (*DuckDBStorage, error) {
 	return storage, nil
 }
 
+// NewReadOnlyDuckDBStorage opens an existing database without write access.
+// Schema initialization and migrations are skipped, so the file must have
+// been opened by a current read-write instance before; writes fail.
+//
+// DuckDB allows either a single read-write process or any number of
+// read-only ones on a file, so this doesn't work alongside a running
+// read-write instance.
+func NewReadOnlyDuckDBStorage(dbPath string) (*DuckDBStorage, error) {
+	db, err := openDuckDB(dbPath, dbPath+"?access_mode=read_only")
+	if err != nil {
+		return nil, err
+	}
+	if err := checkSchemaVersion(context.Background(), db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &DuckDBStorage{db: db, path: dbPath, timeout: DefaultStorageTimeout}, nil
+}
+
+// openDuckDB opens the database at dbPath using dsn. The DuckDB driver
+// opens the file right away, so a lock held by another process is reported
+// here, as ErrDatabaseLocked.
+func openDuckDB(dbPath, dsn string) (*sql.DB, error) {
+	db, err := sql.Open("duckdb", dsn)
+	if err == nil {
+		err = db.Ping()
+	}
+	if isDuckDBLockError(err) {
+		return nil, fmt.Errorf("%w: %s: %v", ErrDatabaseLocked, dbPath, err)
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to open duckdb: %w", err)
+	}
+	return db, nil
+}
+
+// isDuckDBLockError reports whether err is DuckDB failing to lock the
+// database file because another process holds it. DuckDB has no error code
+// for it, so the message is matched.
+func isDuckDBLockError(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "Could not set lock on file")
+}
+
+func (s *DuckDBStorage) GetMigrationStatus(ctx context.Context) ([]models.MigrationStatus, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	return migrationStatus(ctx, s.db)
+}
+
+// ApplyMigrations isn't bounded by the storage timeout, since migrations
+// may rewrite whole tables.
+func (s *DuckDBStorage) ApplyMigrations(ctx context.Context) ([]models.MigrationStatus, error) {
+	s.migrateMu.Lock()
+	defer s.migrateMu.Unlock()
+	// A migration's Rewrite may detach tags
+	s.tagMu.Lock()
+	defer s.tagMu.Unlock()
+
+	applied, err := applyMigrations(ctx, s.db)
+	if err != nil {
+		return nil, err
+	}
+
+	statuses, err := migrationStatus(ctx, s.db)
+	if err != nil {
+		return nil, err
+	}
+	result := []models.MigrationStatus{}
+	for _, status := range statuses {
+		if slices.ContainsFunc(applied, func(m Migration) bool { return m.Version == status.Version }) {
+			result = append(result, status)
+		}
+	}
+	return result, nil
+}
+
+// Reset drops every table and initializes the schema again. It isn't
+// bounded by the storage timeout, like ApplyMigrations.
+func (s *DuckDBStorage) Reset(ctx context.Context) error {
+	s.migrateMu.Lock()
+	defer s.migrateMu.Unlock()
+	s.tagMu.Lock()
+	defer s.tagMu.Unlock()
+
+	// version_tags references query_versions, so it goes first.
+	for _, table := range []string{"version_tags", "detached_tags", "query_versions", "branches", "schema_migrations"} {
+		if _, err := s.db.ExecContext(ctx, "DROP TABLE IF EXISTS "+table); err != nil {
+			return fmt.Errorf("failed to drop %s: %w", table, err)
+		}
+	}
+
+	if err := s.initSchema(); err != nil {
+		return fmt.Errorf("failed to initialize schema: %w", err)
+	}
+	if _, err := applyMigrations(ctx, s.db); err != nil {
+		return fmt.Errorf("failed to run migrations: %w", err)
+	}
+	if err := s.ensureMainBranch(); err != nil {
+		return fmt.Errorf("failed to create main branch: %w", err)
+	}
+	return nil
+}
+
+// SetTimeout changes the per-operation timeout; 0 disables it.
+func (s *DuckDBStorage) SetTimeout(timeout time.Duration) {
+	s.timeout = timeout
+}
+
+// withTimeout derives the context of a single storage operation.
+func (s *DuckDBStorage) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if s.timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, s.timeout)
+}
+
 func (s *DuckDBStorage) initSchema() error {
 	schema := `
 		CREATE TABLE IF NOT EXISTS branches (
@@ -93,7 +305,10 @@ func (s *DuckDBStorage) ensureMainBranch() error {
 	return nil
 }
 
-func (s *DuckDBStorage) CreateBranch(name, parentBranchID, branchFromVersionID string) (*models.Branch, error) {
+func (s *DuckDBStorage) CreateBranch(ctx context.Context, name, parentBranchID, branchFromVersionID string) (*models.Branch, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
 	branch := &models.Branch{
 		ID:                  generateID(),
 		Name:                name,
@@ -102,7 +317,7 @@ func (s *DuckDBStorage) CreateBranch(name, parentBranchID, branchFromVersionID s
 		CreatedAt:           time.Now(),
 	}
 
-	_, err := s.db.Exec(
+	_, err := s.db.ExecContext(ctx,
 		"INSERT INTO branches (id, name, parent_branch_id, branch_from_version_id, current_version_id, created_at) VALUES (?, ?, ?, ?, NULL, ?)",
 		branch.ID, branch.Name, nullString(branch.ParentBranchID), nullString(branch.BranchFromVersionID), branch.CreatedAt,
 	)
@@ -113,78 +328,357 @@ func (s *DuckDBStorage) CreateBranch(name, parentBranchID, branchFromVersionID s
 	return branch, nil
 }
 
-func (s *DuckDBStorage) GetBranches() ([]*models.Branch, error) {
-	rows, err := s.db.Query(`
-		SELECT id, name, COALESCE(parent_branch_id, ''), COALESCE(branch_from_version_id, ''), COALESCE(current_version_id, ''), created_at
-		FROM branches
-		ORDER BY created_at DESC
-	`)
+func (s *DuckDBStorage) GetBranches(ctx context.Context, includeArchived bool) ([]*models.Branch, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	return s.queryBranches(ctx, `
+		WHERE ? OR NOT COALESCE(b.archived, false)
+		ORDER BY COALESCE(b.pinned, false) DESC, b.created_at DESC
+	`, includeArchived)
+}
+
+func (s *DuckDBStorage) GetChildBranches(ctx context.Context, parentID string, includeArchived bool) ([]*models.Branch, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	return s.queryBranches(ctx, `
+		WHERE b.parent_branch_id = ? AND (? OR NOT COALESCE(b.archived, false))
+		ORDER BY b.created_at, b.id
+	`, parentID, includeArchived)
+}
+
+// queryBranches loads the branches selected by filter, a WHERE and ORDER BY
+// clause over branches b, with VersionCount set. The result is never nil.
+func (s *DuckDBStorage) queryBranches(ctx context.Context, filter string, args ...any) ([]*models.Branch, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT b.id, b.name, COALESCE(b.parent_branch_id, ''), COALESCE(b.branch_from_version_id, ''), COALESCE(b.current_version_id, ''),
+		       COALESCE(b.pinned, false), COALESCE(b.archived, false), COALESCE(b.explain_configs, ''), COALESCE(b.max_execution_time_ms, 0), b.created_at, COALESCE(vc.version_count, 0)
+		FROM branches b
+		LEFT JOIN (
+			SELECT branch_id, COUNT(*) AS version_count
+			FROM query_versions
+			GROUP BY branch_id
+		) vc ON vc.branch_id = b.id
+	`+filter, args...)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	var branches []*models.Branch
+	branches := []*models.Branch{}
 	for rows.Next() {
 		var b models.Branch
-		if err := rows.Scan(&b.ID, &b.Name, &b.ParentBranchID, &b.BranchFromVersionID, &b.CurrentVersionID, &b.CreatedAt); err != nil {
+		var configsJSON string
+		if err := rows.Scan(&b.ID, &b.Name, &b.ParentBranchID, &b.BranchFromVersionID, &b.CurrentVersionID, &b.Pinned, &b.Archived, &configsJSON, &b.DefaultMaxExecutionTimeMs, &b.CreatedAt, &b.VersionCount); err != nil {
 			return nil, err
 		}
+		decodeBranchExplainConfigs(&b, configsJSON)
 		branches = append(branches, &b)
 	}
 
 	return branches, rows.Err()
 }
 
-func (s *DuckDBStorage) GetBranch(id string) (*models.Branch, bool) {
+func (s *DuckDBStorage) GetBranchesDigest(ctx context.Context, includeArchived bool) (string, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	// The count and newest created_at catch added branches; the XOR of row
+	// hashes catches edits to existing ones, and the version total catches
+	// changed VersionCounts.
+	var count, rowsHash, versionCount uint64
+	var newest string
+	err := s.db.QueryRowContext(ctx, `
+		SELECT COUNT(*), COALESCE(MAX(created_at)::VARCHAR, ''),
+		       COALESCE(BIT_XOR(hash(id, name, COALESCE(parent_branch_id, ''), COALESCE(branch_from_version_id, ''),
+		                             COALESCE(current_version_id, ''), COALESCE(pinned, false), COALESCE(archived, false),
+		                             COALESCE(explain_configs, ''), COALESCE(max_execution_time_ms, 0))), 0),
+		       (SELECT COUNT(*) FROM query_versions)
+		FROM branches
+		WHERE ? OR NOT COALESCE(archived, false)
+	`, includeArchived).Scan(&count, &newest, &rowsHash, &versionCount)
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(fmt.Appendf(nil, "%d|%s|%d|%d", count, newest, rowsHash, versionCount))
+	return hex.EncodeToString(sum[:8]), nil
+}
+
+func (s *DuckDBStorage) GetBranch(ctx context.Context, id string) (*models.Branch, bool) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
 	var b models.Branch
-	err := s.db.QueryRow(
-		"SELECT id, name, COALESCE(parent_branch_id, ''), COALESCE(branch_from_version_id, ''), COALESCE(current_version_id, ''), created_at FROM branches WHERE id = ?",
+	var configsJSON string
+	err := s.db.QueryRowContext(ctx,
+		"SELECT id, name, COALESCE(parent_branch_id, ''), COALESCE(branch_from_version_id, ''), COALESCE(current_version_id, ''), COALESCE(pinned, false), COALESCE(archived, false), COALESCE(explain_configs, ''), COALESCE(max_execution_time_ms, 0), created_at FROM branches WHERE id = ?",
 		id,
-	).Scan(&b.ID, &b.Name, &b.ParentBranchID, &b.BranchFromVersionID, &b.CurrentVersionID, &b.CreatedAt)
+	).Scan(&b.ID, &b.Name, &b.ParentBranchID, &b.BranchFromVersionID, &b.CurrentVersionID, &b.Pinned, &b.Archived, &configsJSON, &b.DefaultMaxExecutionTimeMs, &b.CreatedAt)
 
 	if err != nil {
 		return nil, false
 	}
+	decodeBranchExplainConfigs(&b, configsJSON)
 
 	return &b, true
 }
 
-func (s *DuckDBStorage) GetVersion(id string) (*models.QueryVersion, bool) {
+func (s *DuckDBStorage) SetBranchPinned(ctx context.Context, id string, pinned bool) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	result, err := s.db.ExecContext(ctx, "UPDATE branches SET pinned = ? WHERE id = ?", pinned, id)
+	if err != nil {
+		return fmt.Errorf("failed to update branch: %w", err)
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get rows affected: %w", err)
+	}
+	if rows == 0 {
+		return fmt.Errorf("%w: %s", ErrBranchNotFound, id)
+	}
+
+	return nil
+}
+
+func (s *DuckDBStorage) SetBranchHead(ctx context.Context, branchID, versionID string) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	if _, exists := s.GetBranch(ctx, branchID); !exists {
+		return fmt.Errorf("%w: %s", ErrBranchNotFound, branchID)
+	}
+	var versionBranchID string
+	err := s.db.QueryRowContext(ctx, "SELECT branch_id FROM query_versions WHERE id = ?", versionID).Scan(&versionBranchID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("%w: %s", ErrVersionNotFound, versionID)
+	} else if err != nil {
+		return fmt.Errorf("failed to get version: %w", err)
+	}
+	if versionBranchID != branchID {
+		return fmt.Errorf("%w: version %s is on branch %s", ErrVersionNotOnBranch, versionID, versionBranchID)
+	}
+
+	if _, err := s.db.ExecContext(ctx, "UPDATE branches SET current_version_id = ? WHERE id = ?", versionID, branchID); err != nil {
+		return fmt.Errorf("failed to update branch: %w", err)
+	}
+	return nil
+}
+
+func (s *DuckDBStorage) ArchiveBranch(ctx context.Context, id string, archived bool) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	result, err := s.db.ExecContext(ctx, "UPDATE branches SET archived = ? WHERE id = ?", archived, id)
+	if err != nil {
+		return fmt.Errorf("failed to update branch: %w", err)
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get rows affected: %w", err)
+	}
+	if rows == 0 {
+		return fmt.Errorf("%w: %s", ErrBranchNotFound, id)
+	}
+
+	return nil
+}
+
+// DeleteBranch implements models.Storage.
+func (s *DuckDBStorage) DeleteBranch(ctx context.Context, id string) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	result, err := s.db.ExecContext(ctx, `
+		DELETE FROM branches
+		WHERE id = ? AND NOT EXISTS (SELECT 1 FROM query_versions WHERE branch_id = ?)
+	`, id, id)
+	if err != nil {
+		return fmt.Errorf("failed to delete branch: %w", err)
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get rows affected: %w", err)
+	}
+	if rows == 0 {
+		if _, exists := s.GetBranch(ctx, id); !exists {
+			return fmt.Errorf("%w: %s", ErrBranchNotFound, id)
+		}
+		return fmt.Errorf("branch %s has versions", id)
+	}
+
+	return nil
+}
+
+// SetBranchExplainConfigs stores the default EXPLAIN configs of a branch.
+// An empty list clears them.
+func (s *DuckDBStorage) SetBranchExplainConfigs(ctx context.Context, branchID string, configs []models.ExplainConfig) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	var configsJSON any
+	if len(configs) > 0 {
+		encoded, err := json.Marshal(configs)
+		if err != nil {
+			return fmt.Errorf("failed to marshal explain configs: %w", err)
+		}
+		configsJSON = string(encoded)
+	}
+
+	result, err := s.db.ExecContext(ctx, "UPDATE branches SET explain_configs = ? WHERE id = ?", configsJSON, branchID)
+	if err != nil {
+		return fmt.Errorf("failed to update branch: %w", err)
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get rows affected: %w", err)
+	}
+	if rows == 0 {
+		return fmt.Errorf("%w: %s", ErrBranchNotFound, branchID)
+	}
+
+	return nil
+}
+
+// SetBranchMaxExecutionTime stores the default max_execution_time of a
+// branch in milliseconds. 0 clears it.
+func (s *DuckDBStorage) SetBranchMaxExecutionTime(ctx context.Context, branchID string, maxExecutionTimeMs int) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	var value any
+	if maxExecutionTimeMs > 0 {
+		value = maxExecutionTimeMs
+	}
+
+	result, err := s.db.ExecContext(ctx, "UPDATE branches SET max_execution_time_ms = ? WHERE id = ?", value, branchID)
+	if err != nil {
+		return fmt.Errorf("failed to update branch: %w", err)
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get rows affected: %w", err)
+	}
+	if rows == 0 {
+		return fmt.Errorf("%w: %s", ErrBranchNotFound, branchID)
+	}
+
+	return nil
+}
+
+// decodeBranchExplainConfigs sets DefaultExplainConfigs from its stored
+// JSON. Undecodable values are logged and left empty.
+func decodeBranchExplainConfigs(b *models.Branch, configsJSON string) {
+	if configsJSON == "" {
+		return
+	}
+	if err := json.Unmarshal([]byte(configsJSON), &b.DefaultExplainConfigs); err != nil {
+		fmt.Printf("Warning: failed to unmarshal explain configs for branch %s: %v\n", b.ID, err)
+		b.DefaultExplainConfigs = nil
+	}
+}
+
+func (s *DuckDBStorage) GetVersion(ctx context.Context, id string) (*models.QueryVersion, bool) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
 	var v models.QueryVersion
-	var explainResultsJSON string
-	var statsJSON string
+	var explainResultsJSON, statsJSON, configsJSON string
 
-	err := s.db.QueryRow(`
-		SELECT id, branch_id, query, query_hash, COALESCE(explain_results, '[]'), COALESCE(execution_stats, '{}'), timestamp, COALESCE(parent_version_id, '')
+	err := s.db.QueryRowContext(ctx, `
+		SELECT id, branch_id, query, query_hash, COALESCE(explain_results, '[]'), COALESCE(execution_stats, '{}'), timestamp, COALESCE(parent_version_id, ''), COALESCE(merge_parent_version_id, ''), COALESCE(explain_configs, ''), COALESCE(notes, '')
 		FROM query_versions
 		WHERE id = ?
-	`, id).Scan(&v.ID, &v.BranchID, &v.Query, &v.QueryHash, &explainResultsJSON, &statsJSON, &v.Timestamp, &v.ParentVersionID)
+	`, id).Scan(&v.ID, &v.BranchID, &v.Query, &v.QueryHash, &explainResultsJSON, &statsJSON, &v.Timestamp, &v.ParentVersionID, &v.MergeParentVersionID, &configsJSON, &v.Notes)
 
 	if err != nil {
 		return nil, false
 	}
 
-	// Unmarshal explain results
-	v.ExplainResults = []models.ExplainResult{}
-	if explainResultsJSON != "" && explainResultsJSON != "[]" {
-		if err := json.Unmarshal([]byte(explainResultsJSON), &v.ExplainResults); err != nil {
-			fmt.Printf("Warning: failed to unmarshal explain results for version %s: %v\n", v.ID, err)
+	decodeVersionJSON(&v, explainResultsJSON, statsJSON, configsJSON)
+	return &v, true
+}
+
+func (s *DuckDBStorage) UpdateVersionResults(ctx context.Context, versionID string, results []models.ExplainResult, configs []models.ExplainConfig, stats models.ExecutionStats) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	explainResultsJSON, err := json.Marshal(results)
+	if err != nil {
+		return fmt.Errorf("failed to marshal explain results: %w", err)
+	}
+	statsJSON, err := json.Marshal(stats)
+	if err != nil {
+		return fmt.Errorf("failed to marshal execution stats: %w", err)
+	}
+	var configsJSON any
+	if len(configs) > 0 {
+		data, err := json.Marshal(configs)
+		if err != nil {
+			return fmt.Errorf("failed to marshal explain configs: %w", err)
 		}
+		configsJSON = string(data)
+	}
+	storedResults, err := s.encodeColumn(string(explainResultsJSON))
+	if err != nil {
+		return err
+	}
+	storedStats, err := s.encodeColumn(string(statsJSON))
+	if err != nil {
+		return err
 	}
 
-	// Initialize empty map if unmarshaling fails
-	v.ExecutionStats = make(map[string]interface{})
-	if statsJSON != "" && statsJSON != "{}" {
-		if err := json.Unmarshal([]byte(statsJSON), &v.ExecutionStats); err != nil {
-			fmt.Printf("Warning: failed to unmarshal stats for version %s: %v\n", v.ID, err)
-		}
+	hasError, resultCount := resultColumns(results)
+
+	result, err := s.db.ExecContext(ctx,
+		"UPDATE query_versions SET explain_results = ?, execution_stats = ?, explain_configs = ?, has_error = ?, result_count = ? WHERE id = ?",
+		storedResults, storedStats, configsJSON, hasError, resultCount, versionID,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to update version: %w", err)
 	}
 
-	return &v, true
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get rows affected: %w", err)
+	}
+	if rows == 0 {
+		return fmt.Errorf("%w: %s", ErrVersionNotFound, versionID)
+	}
+	return nil
 }
 
-func (s *DuckDBStorage) SaveVersion(version *models.QueryVersion) error {
+func (s *DuckDBStorage) SetVersionNotes(ctx context.Context, versionID, notes string) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	result, err := s.db.ExecContext(ctx, "UPDATE query_versions SET notes = ? WHERE id = ?", nullString(notes), versionID)
+	if err != nil {
+		return fmt.Errorf("failed to update version: %w", err)
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get rows affected: %w", err)
+	}
+	if rows == 0 {
+		return fmt.Errorf("%w: %s", ErrVersionNotFound, versionID)
+	}
+	return nil
+}
+
+func (s *DuckDBStorage) SaveVersion(ctx context.Context, version *models.QueryVersion) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
 	statsJSON, err := json.Marshal(version.ExecutionStats)
 	if err != nil {
 		return fmt.Errorf("failed to marshal execution stats: %w", err)
@@ -195,25 +689,55 @@ func (s *DuckDBStorage) SaveVersion(version *models.QueryVersion) error {
 		return fmt.Errorf("failed to marshal explain results: %w", err)
 	}
 
-	tx, err := s.db.Begin()
+	var configsJSON any
+	if len(version.Configs) > 0 {
+		data, err := json.Marshal(version.Configs)
+		if err != nil {
+			return fmt.Errorf("failed to marshal explain configs: %w", err)
+		}
+		configsJSON = string(data)
+	}
+
+	storedQuery, err := s.encodeColumn(version.Query)
+	if err != nil {
+		return err
+	}
+	storedResults, err := s.encodeColumn(string(explainResultsJSON))
+	if err != nil {
+		return err
+	}
+	storedStats, err := s.encodeColumn(string(statsJSON))
+	if err != nil {
+		return err
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
 	if err != nil {
 		return err
 	}
 	defer tx.Rollback()
 
+	if version.ParentVersionID != "" {
+		if err := checkParentVersion(ctx, tx, version.BranchID, version.ParentVersionID); err != nil {
+			return err
+		}
+	}
+
 	// Insert version
-	_, err = tx.Exec(
-		`INSERT INTO query_versions (id, branch_id, query, query_hash, explain_results, execution_stats, timestamp, parent_version_id)
-		 VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
-		version.ID, version.BranchID, version.Query, version.QueryHash, string(explainResultsJSON),
-		string(statsJSON), version.Timestamp, nullString(version.ParentVersionID),
+	hasError, resultCount := resultColumns(version.ExplainResults)
+	_, err = tx.ExecContext(ctx,
+		`INSERT INTO query_versions (id, branch_id, query, query_hash, explain_results, execution_stats, timestamp, parent_version_id, merge_parent_version_id, explain_configs, notes, has_error, result_count)
+		 VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		version.ID, version.BranchID, storedQuery, version.QueryHash, storedResults,
+		storedStats, version.Timestamp, nullString(version.ParentVersionID), nullString(version.MergeParentVersionID),
+		configsJSON, nullString(version.Notes), hasError, resultCount,
 	)
 	if err != nil {
 		return err
 	}
 
 	// Update branch's current version
-	_, err = tx.Exec(
+	_, err = tx.ExecContext(ctx,
 		"UPDATE branches SET current_version_id = ? WHERE id = ?",
 		version.ID, version.BranchID,
 	)
@@ -224,9 +748,222 @@ func (s *DuckDBStorage) SaveVersion(version *models.QueryVersion) error {
 	return tx.Commit()
 }
 
-func (s *DuckDBStorage) GetBranchHistory(branchID string) ([]*models.QueryVersion, error) {
-	rows, err := s.db.Query(`
-		SELECT id, branch_id, query, query_hash, COALESCE(explain_results, '[]'), COALESCE(execution_stats, '{}'), timestamp, COALESCE(parent_version_id, '')
+// checkParentVersion checks that parentID exists and is on branchID or is
+// the version branchID was forked from, so ancestry walks stay within a
+// branch and the branches it was forked from.
+func checkParentVersion(ctx context.Context, tx *sql.Tx, branchID, parentID string) error {
+	var parentBranchID, forkedFromID string
+	err := tx.QueryRowContext(ctx, `
+		SELECT v.branch_id, COALESCE(b.branch_from_version_id, '')
+		FROM query_versions v
+		LEFT JOIN branches b ON b.id = ?
+		WHERE v.id = ?
+	`, branchID, parentID).Scan(&parentBranchID, &forkedFromID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("%w: %s does not exist", ErrInvalidParentVersion, parentID)
+	} else if err != nil {
+		return fmt.Errorf("failed to check parent version: %w", err)
+	}
+	if parentBranchID != branchID && forkedFromID != parentID {
+		return fmt.Errorf("%w: %s is on branch %s, not %s", ErrInvalidParentVersion, parentID, parentBranchID, branchID)
+	}
+	return nil
+}
+
+func (s *DuckDBStorage) AmendVersion(ctx context.Context, id, query, queryHash string) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	if _, exists := s.GetVersion(ctx, id); !exists {
+		return fmt.Errorf("%w: %s", ErrVersionNotFound, id)
+	}
+	storedQuery, err := s.encodeColumn(query)
+	if err != nil {
+		return err
+	}
+
+	s.tagMu.Lock()
+	defer s.tagMu.Unlock()
+
+	// DuckDB rewrites rows whose indexed columns (query_hash) change as a
+	// delete plus insert, which trips the version_tags foreign key, and it
+	// doesn't see deletes from the same transaction when checking it. The
+	// tags are therefore detached in a transaction of their own and
+	// reattached afterwards, also when the update fails.
+	if err := detachTags(ctx, s.db, []string{id}); err != nil {
+		return err
+	}
+
+	_, updateErr := s.db.ExecContext(ctx, `
+		UPDATE query_versions
+		SET query = ?, query_hash = ?, explain_results = '[]', execution_stats = '{}', explain_configs = NULL,
+		    has_error = false, result_count = 0
+		WHERE id = ?
+	`, storedQuery, queryHash, id)
+
+	// Reattach even if ctx was canceled meanwhile
+	if err := reattachTags(context.WithoutCancel(ctx), s.db); err != nil {
+		return err
+	}
+	if updateErr != nil {
+		return fmt.Errorf("failed to amend version: %w", updateErr)
+	}
+	return nil
+}
+
+// DeleteVersion removes a version and its tags. Children, including merges
+// of it, are re-parented onto the version's parent, and branches whose head
+// or fork point was the version move to the parent as well. A head whose
+// parent is on another branch is cleared instead. The row changes happen in
+// one transaction.
+func (s *DuckDBStorage) DeleteVersion(ctx context.Context, id string) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	version, exists := s.GetVersion(ctx, id)
+	if !exists {
+		return fmt.Errorf("%w: %s", ErrVersionNotFound, id)
+	}
+	parentID := nullString(version.ParentVersionID)
+
+	s.tagMu.Lock()
+	defer s.tagMu.Unlock()
+
+	// Re-parenting updates the indexed parent_version_id column, which
+	// trips the version_tags foreign key just like in AmendVersion, so the
+	// tags of the version and its children are detached first. Reattaching
+	// drops the version's own tags once it is deleted.
+	affected, err := s.childVersionIDs(ctx, id)
+	if err != nil {
+		return err
+	}
+	if err := detachTags(ctx, s.db, append(affected, id)); err != nil {
+		return err
+	}
+
+	deleteErr := s.deleteVersionRows(ctx, id, parentID)
+
+	// Reattach even if ctx was canceled meanwhile
+	if err := reattachTags(context.WithoutCancel(ctx), s.db); err != nil {
+		return err
+	}
+	if deleteErr != nil {
+		return fmt.Errorf("failed to delete version: %w", deleteErr)
+	}
+	return nil
+}
+
+// deleteVersionRows re-links references to version id onto parentID and
+// deletes the version, in one transaction. Branch heads only move to
+// parentID on its own branch and become NULL elsewhere.
+func (s *DuckDBStorage) deleteVersionRows(ctx context.Context, id string, parentID any) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	statements := []string{
+		"UPDATE query_versions SET parent_version_id = ? WHERE parent_version_id = ?",
+		"UPDATE query_versions SET merge_parent_version_id = ? WHERE merge_parent_version_id = ?",
+		// A head whose parent is on another branch, the fork point, is
+		// cleared like the head of a new branch
+		"UPDATE branches SET current_version_id = (SELECT v.id FROM query_versions v WHERE v.id = ? AND v.branch_id = branches.id) WHERE current_version_id = ?",
+		"UPDATE branches SET branch_from_version_id = ? WHERE branch_from_version_id = ?",
+	}
+	for _, stmt := range statements {
+		if _, err := tx.ExecContext(ctx, stmt, parentID, id); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM query_versions WHERE id = ?", id); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// childVersionIDs returns the IDs of the versions whose parent is id.
+func (s *DuckDBStorage) childVersionIDs(ctx context.Context, id string) ([]string, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT id FROM query_versions WHERE parent_version_id = ?", id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query child versions: %w", err)
+	}
+	defer rows.Close()
+
+	var ids []string
+	for rows.Next() {
+		var childID string
+		if err := rows.Scan(&childID); err != nil {
+			return nil, err
+		}
+		ids = append(ids, childID)
+	}
+	return ids, rows.Err()
+}
+
+// detachTags moves the tags of versionIDs from version_tags to
+// detached_tags in one transaction, so that the versions' indexed columns
+// can be changed. The tags stay in the database throughout: if reattaching
+// fails or the process dies before, reattachTags picks them up on the next
+// rewrite or at startup. Callers hold tagMu, or run before the storage serves
+// requests.
+func detachTags(ctx context.Context, db *sql.DB, versionIDs []string) error {
+	// Leftovers of an earlier failed rewrite go back first
+	if err := reattachTags(ctx, db); err != nil {
+		return err
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	placeholders, args := placeholderArgs(versionIDs)
+	in := joinPlaceholders(placeholders)
+	if _, err := tx.ExecContext(ctx, fmt.Sprintf(`
+		INSERT INTO detached_tags (id, version_id, tag_key, tag_value, created_at)
+		SELECT id, version_id, tag_key, tag_value, created_at FROM version_tags WHERE version_id IN (%s)
+	`, in), args...); err != nil {
+		return fmt.Errorf("failed to detach tags: %w", err)
+	}
+	if _, err := tx.ExecContext(ctx, fmt.Sprintf("DELETE FROM version_tags WHERE version_id IN (%s)", in), args...); err != nil {
+		return fmt.Errorf("failed to detach tags: %w", err)
+	}
+
+	return tx.Commit()
+}
+
+// reattachTags moves every detached tag back to version_tags, keeping its
+// ID, in one transaction. Tags of versions deleted meanwhile are dropped.
+func reattachTags(ctx context.Context, db *sql.DB) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `
+		INSERT INTO version_tags (id, version_id, tag_key, tag_value, created_at)
+		SELECT id, version_id, tag_key, tag_value, created_at FROM detached_tags
+		WHERE version_id IN (SELECT id FROM query_versions)
+	`); err != nil {
+		return fmt.Errorf("failed to reattach tags: %w", err)
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM detached_tags"); err != nil {
+		return fmt.Errorf("failed to reattach tags: %w", err)
+	}
+
+	return tx.Commit()
+}
+
+func (s *DuckDBStorage) GetBranchHistory(ctx context.Context, branchID string) ([]*models.QueryVersion, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT id, branch_id, query, query_hash, COALESCE(explain_results, '[]'), COALESCE(execution_stats, '{}'), timestamp, COALESCE(parent_version_id, ''), COALESCE(merge_parent_version_id, ''), COALESCE(explain_configs, ''), COALESCE(notes, '')
 		FROM query_versions
 		WHERE branch_id = ?
 		ORDER BY timestamp DESC
@@ -236,98 +973,329 @@ func (s *DuckDBStorage) GetBranchHistory(branchID string) ([]*models.QueryVersio
 	}
 	defer rows.Close()
 
+	versions, err := scanVersionRows(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.attachTags(ctx, versions); err != nil {
+		return nil, err
+	}
+
+	return versions, nil
+}
+
+// GetVersionsByHash returns every version whose QueryHash equals hash, across
+// all branches, newest first and with tags attached.
+func (s *DuckDBStorage) GetVersionsByHash(ctx context.Context, hash string) ([]*models.QueryVersion, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT id, branch_id, query, query_hash, COALESCE(explain_results, '[]'), COALESCE(execution_stats, '{}'), timestamp, COALESCE(parent_version_id, ''), COALESCE(merge_parent_version_id, ''), COALESCE(explain_configs, ''), COALESCE(notes, '')
+		FROM query_versions
+		WHERE query_hash = ?
+		ORDER BY timestamp DESC
+	`, hash)
+	if err != nil {
+		return nil, fmt.Errorf("query failed: %w", err)
+	}
+	defer rows.Close()
+
+	versions, err := scanVersionRows(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.attachTags(ctx, versions); err != nil {
+		return nil, err
+	}
+
+	return versions, nil
+}
+
+// LookupQueryHash counts the versions whose QueryHash equals hash and
+// returns the newest one's ID and branch.
+func (s *DuckDBStorage) LookupQueryHash(ctx context.Context, hash string) (*models.HashLookup, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	lookup := &models.HashLookup{QueryHash: hash}
+	var timestamp time.Time
+	err := s.db.QueryRowContext(ctx, `
+		SELECT COUNT(*) OVER (), id, branch_id, timestamp
+		FROM query_versions
+		WHERE query_hash = ?
+		ORDER BY timestamp DESC
+		LIMIT 1
+	`, hash).Scan(&lookup.Count, &lookup.LatestVersionID, &lookup.LatestBranchID, &timestamp)
+	if errors.Is(err, sql.ErrNoRows) {
+		return lookup, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to look up query hash: %w", err)
+	}
+	lookup.LatestTimestamp = &timestamp
+	return lookup, nil
+}
+
+// GetRecentVersions returns the newest versions across all branches with
+// BranchName set. limit <= 0 returns all.
+func (s *DuckDBStorage) GetRecentVersions(ctx context.Context, limit int) ([]*models.QueryVersion, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	query := `
+		SELECT qv.id, qv.branch_id, qv.query, qv.query_hash,
+		       COALESCE(qv.explain_results, '[]'),
+		       COALESCE(qv.execution_stats, '{}'), qv.timestamp,
+		       COALESCE(qv.parent_version_id, ''), COALESCE(qv.merge_parent_version_id, ''), COALESCE(qv.explain_configs, ''), COALESCE(qv.notes, ''),
+		       COALESCE(b.name, '')
+		FROM query_versions qv
+		LEFT JOIN branches b ON b.id = qv.branch_id
+		ORDER BY qv.timestamp DESC
+	`
+	args := []any{}
+	if limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, limit)
+	}
+
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query recent versions: %w", err)
+	}
+	defer rows.Close()
+
+	versions, err := scanVersionRowsWithBranch(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.attachTags(ctx, versions); err != nil {
+		return nil, err
+	}
+
+	return versions, nil
+}
+
+// resultColumns derives the has_error and result_count columns of a
+// version from its results: whether an executed one failed, and how many
+// are stored, skipped ones included.
+func resultColumns(results []models.ExplainResult) (hasError bool, resultCount int) {
+	return hasFailedResult(results), len(results)
+}
+
+// GetErroredVersions returns versions with a failed EXPLAIN, newest first,
+// with BranchName set.
+func (s *DuckDBStorage) GetErroredVersions(ctx context.Context, branchID string) ([]*models.QueryVersion, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT qv.id, qv.branch_id, qv.query, qv.query_hash,
+		       COALESCE(qv.explain_results, '[]'),
+		       COALESCE(qv.execution_stats, '{}'), qv.timestamp,
+		       COALESCE(qv.parent_version_id, ''), COALESCE(qv.merge_parent_version_id, ''), COALESCE(qv.explain_configs, ''), COALESCE(qv.notes, ''),
+		       COALESCE(b.name, '')
+		FROM query_versions qv
+		LEFT JOIN branches b ON b.id = qv.branch_id
+		WHERE qv.has_error AND (? = '' OR qv.branch_id = ?)
+		ORDER BY qv.timestamp DESC
+	`, branchID, branchID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query errored versions: %w", err)
+	}
+	defer rows.Close()
+
+	versions, err := scanVersionRowsWithBranch(rows)
+	if err != nil {
+		return nil, err
+	}
+	if versions == nil {
+		versions = []*models.QueryVersion{}
+	}
+
+	if err := s.attachTags(ctx, versions); err != nil {
+		return nil, err
+	}
+
+	return versions, nil
+}
+
+// scanVersionRows reads versions selected as id, branch_id, query, query_hash,
+// explain_results, execution_stats, timestamp, parent_version_id,
+// merge_parent_version_id, explain_configs, notes.
+// Undecodable JSON columns are logged and left empty.
+func scanVersionRows(rows *sql.Rows) ([]*models.QueryVersion, error) {
 	var versions []*models.QueryVersion
-	var versionIDs []string
 	for rows.Next() {
-		var v models.QueryVersion
-		var explainResultsJSON string
-		var statsJSON string
-		if err := rows.Scan(&v.ID, &v.BranchID, &v.Query, &v.QueryHash, &explainResultsJSON, &statsJSON, &v.Timestamp, &v.ParentVersionID); err != nil {
-			return nil, fmt.Errorf("scan failed: %w", err)
+		v, err := scanVersionRow(rows)
+		if err != nil {
+			return nil, err
 		}
+		versions = append(versions, v)
+	}
 
-		// Unmarshal explain results
-		v.ExplainResults = []models.ExplainResult{}
-		if explainResultsJSON != "" && explainResultsJSON != "[]" {
-			if err := json.Unmarshal([]byte(explainResultsJSON), &v.ExplainResults); err != nil {
-				fmt.Printf("Warning: failed to unmarshal explain results for version %s: %v\n", v.ID, err)
-			}
-		}
+	return versions, rows.Err()
+}
 
-		// Initialize empty map if unmarshaling fails
-		v.ExecutionStats = make(map[string]interface{})
-		if statsJSON != "" && statsJSON != "{}" {
-			if err := json.Unmarshal([]byte(statsJSON), &v.ExecutionStats); err != nil {
-				// Log error but continue with empty stats
-				fmt.Printf("Warning: failed to unmarshal stats for version %s: %v\n", v.ID, err)
-			}
+// scanVersionRowsWithBranch reads versions like scanVersionRows, followed by
+// a branch name column that is stored in BranchName.
+func scanVersionRowsWithBranch(rows *sql.Rows) ([]*models.QueryVersion, error) {
+	var versions []*models.QueryVersion
+	for rows.Next() {
+		var branchName string
+		version, err := scanVersionRow(rows, &branchName)
+		if err != nil {
+			return nil, err
 		}
+		version.BranchName = branchName
+		versions = append(versions, version)
+	}
+
+	return versions, rows.Err()
+}
 
-		v.Tags = []*models.VersionTag{}
-		versions = append(versions, &v)
-		versionIDs = append(versionIDs, v.ID)
+// scanVersionRow reads the current row like scanVersionRows. Columns
+// selected after the version columns are scanned into extra.
+func scanVersionRow(rows *sql.Rows, extra ...any) (*models.QueryVersion, error) {
+	var v models.QueryVersion
+	var explainResultsJSON, statsJSON, configsJSON string
+	dest := append([]any{&v.ID, &v.BranchID, &v.Query, &v.QueryHash, &explainResultsJSON, &statsJSON, &v.Timestamp, &v.ParentVersionID, &v.MergeParentVersionID, &configsJSON, &v.Notes}, extra...)
+	if err := rows.Scan(dest...); err != nil {
+		return nil, fmt.Errorf("scan failed: %w", err)
 	}
 
-	if err := rows.Err(); err != nil {
-		return nil, err
+	decodeVersionJSON(&v, explainResultsJSON, statsJSON, configsJSON)
+	return &v, nil
+}
+
+// decodeVersionJSON fills the JSON-encoded fields of v and decompresses
+// v.Query. Undecodable columns are logged and left empty.
+func decodeVersionJSON(v *models.QueryVersion, explainResultsJSON, statsJSON, configsJSON string) {
+	v.Query = decompressVersionColumn(v.ID, "query", v.Query)
+	explainResultsJSON = decompressVersionColumn(v.ID, "explain_results", explainResultsJSON)
+	statsJSON = decompressVersionColumn(v.ID, "execution_stats", statsJSON)
+
+	// Unmarshal explain results
+	v.ExplainResults = []models.ExplainResult{}
+	if explainResultsJSON != "" && explainResultsJSON != "[]" {
+		if err := json.Unmarshal([]byte(explainResultsJSON), &v.ExplainResults); err != nil {
+			fmt.Printf("Warning: failed to unmarshal explain results for version %s: %v\n", v.ID, err)
+		}
 	}
 
-	// Load all tags for these versions in one query
-	if len(versionIDs) > 0 {
-		tags, err := s.getTagsForVersions(versionIDs)
-		if err != nil {
-			return nil, fmt.Errorf("failed to load tags: %w", err)
+	// Leave the stats empty if unmarshaling fails
+	v.ExecutionStats = models.ExecutionStats{}
+	if statsJSON != "" && statsJSON != "{}" {
+		if err := json.Unmarshal([]byte(statsJSON), &v.ExecutionStats); err != nil {
+			// Log error but continue with empty stats
+			fmt.Printf("Warning: failed to unmarshal stats for version %s: %v\n", v.ID, err)
 		}
+	}
 
-		// Map tags to versions
-		tagsByVersion := make(map[string][]*models.VersionTag)
-		for _, tag := range tags {
-			tagsByVersion[tag.VersionID] = append(tagsByVersion[tag.VersionID], tag)
+	if configsJSON != "" {
+		if err := json.Unmarshal([]byte(configsJSON), &v.Configs); err != nil {
+			fmt.Printf("Warning: failed to unmarshal explain configs for version %s: %v\n", v.ID, err)
+			v.Configs = nil
 		}
+	}
+}
 
-		// Attach tags to versions
-		for _, version := range versions {
-			if tags, ok := tagsByVersion[version.ID]; ok {
-				version.Tags = tags
+// attachTags loads the tags of all given versions in one query and sets
+// their Tags field.
+func (s *DuckDBStorage) attachTags(ctx context.Context, versions []*models.QueryVersion) error {
+	if len(versions) == 0 {
+		return nil
+	}
+
+	versionIDs := make([]string, len(versions))
+	for i, version := range versions {
+		versionIDs[i] = version.ID
+	}
+
+	tags, err := s.getTagsForVersions(ctx, versionIDs)
+	if err != nil {
+		return fmt.Errorf("failed to load tags: %w", err)
+	}
+
+	// Map tags to versions
+	tagsByVersion := make(map[string][]*models.VersionTag)
+	for _, tag := range tags {
+		tagsByVersion[tag.VersionID] = append(tagsByVersion[tag.VersionID], tag)
+	}
+
+	for _, version := range versions {
+		version.Tags = tagsByVersion[version.ID]
+		if version.Tags == nil {
+			version.Tags = []*models.VersionTag{}
+		}
+	}
+	return nil
+}
+
+func (s *DuckDBStorage) GetVersionAncestry(ctx context.Context, versionID string) ([]*models.QueryVersion, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	version, ok := s.GetVersion(ctx, versionID)
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrVersionNotFound, versionID)
+	}
+
+	// Depth-first over both parent links, appending each version after its
+	// ancestors. inProgress marks the versions on the current path: reaching
+	// one again is a cycle, while reaching a done version is a shared
+	// ancestor of a merge.
+	inProgress := make(map[string]bool)
+	done := make(map[string]bool)
+	var chain []*models.QueryVersion
+	var walk func(version *models.QueryVersion) error
+	walk = func(version *models.QueryVersion) error {
+		inProgress[version.ID] = true
+		for _, parentID := range []string{version.ParentVersionID, version.MergeParentVersionID} {
+			if parentID == "" || done[parentID] {
+				continue
+			}
+			if inProgress[parentID] {
+				return fmt.Errorf("cycle detected in ancestry of version %s at %s", versionID, parentID)
+			}
+			parent, ok := s.GetVersion(ctx, parentID)
+			if !ok {
+				// Parent was removed or never stored; this line ends here
+				continue
+			}
+			if err := walk(parent); err != nil {
+				return err
 			}
 		}
+		delete(inProgress, version.ID)
+		done[version.ID] = true
+		chain = append(chain, version)
+		return nil
+	}
+	if err := walk(version); err != nil {
+		return nil, err
 	}
 
-	return versions, nil
+	return chain, nil
 }
 
 // Helper function to get tags for multiple versions in one query
-func (s *DuckDBStorage) getTagsForVersions(versionIDs []string) ([]*models.VersionTag, error) {
+func (s *DuckDBStorage) getTagsForVersions(ctx context.Context, versionIDs []string) ([]*models.VersionTag, error) {
 	if len(versionIDs) == 0 {
 		return []*models.VersionTag{}, nil
 	}
 
-	// Build placeholders for IN clause
-	placeholders := make([]string, len(versionIDs))
-	args := make([]interface{}, len(versionIDs))
-	for i, id := range versionIDs {
-		placeholders[i] = "?"
-		args[i] = id
-	}
-
+	placeholders, args := placeholderArgs(versionIDs)
 	query := fmt.Sprintf(`
 		SELECT id, version_id, tag_key, COALESCE(tag_value, ''), created_at
 		FROM version_tags
 		WHERE version_id IN (%s)
 		ORDER BY created_at ASC
-	`, string(placeholders[0]))
+	`, joinPlaceholders(placeholders))
 
-	// For multiple placeholders, we need to construct the query properly
-	if len(versionIDs) > 1 {
-		query = fmt.Sprintf(`
-			SELECT id, version_id, tag_key, COALESCE(tag_value, ''), created_at
-			FROM version_tags
-			WHERE version_id IN (%s)
-			ORDER BY created_at ASC
-		`, joinPlaceholders(placeholders))
-	}
-
-	rows, err := s.db.Query(query, args...)
+	rows, err := s.db.QueryContext(ctx, query, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -345,16 +1313,36 @@ func (s *DuckDBStorage) getTagsForVersions(versionIDs []string) ([]*models.Versi
 	return tags, rows.Err()
 }
 
+// placeholderArgs returns a "?" placeholder and a query argument per value,
+// for binding values in an IN clause built with joinPlaceholders.
+func placeholderArgs(values []string) ([]string, []interface{}) {
+	placeholders := make([]string, len(values))
+	args := make([]interface{}, len(values))
+	for i, value := range values {
+		placeholders[i] = "?"
+		args[i] = value
+	}
+	return placeholders, args
+}
+
 // Helper to join placeholders for SQL IN clause
 func joinPlaceholders(placeholders []string) string {
-	result := ""
-	for i, p := range placeholders {
-		if i > 0 {
-			result += ", "
-		}
-		result += p
-	}
-	return result
+	return strings.Join(placeholders, ", ")
+}
+
+func (s *DuckDBStorage) Ping(ctx context.Context) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	var one int
+	return s.db.QueryRowContext(ctx, "SELECT 1").Scan(&one)
+}
+
+func (s *DuckDBStorage) CheckSchemaVersion(ctx context.Context) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	return checkSchemaVersion(ctx, s.db)
 }
 
 func (s *DuckDBStorage) Close() error {
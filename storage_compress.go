@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+)
+
+// compressedPrefix marks a column value stored gzip-compressed and base64
+// encoded. Uncompressed values never start with it: queries start with a
+// statement keyword and the JSON columns with "[" or "{".
+const compressedPrefix = "gz:"
+
+// SetCompression enables gzip compression of the query, explain_results and
+// execution_stats columns of versions saved from now on. Rows are read
+// correctly either way, so it can be toggled on an existing database.
+func (s *DuckDBStorage) SetCompression(enabled bool) {
+	s.compress = enabled
+}
+
+// encodeColumn returns text as stored: compressed when compression is on
+// and makes it smaller, as is when it doesn't, e.g. for short queries.
+func (s *DuckDBStorage) encodeColumn(text string) (string, error) {
+	if !s.compress {
+		return text, nil
+	}
+	compressed, err := compressColumn(text)
+	if err != nil || len(compressed) >= len(text) {
+		return text, err
+	}
+	return compressed, nil
+}
+
+// compressColumn gzips text and base64 encodes it behind compressedPrefix.
+func compressColumn(text string) (string, error) {
+	var buf bytes.Buffer
+	buf.WriteString(compressedPrefix)
+	enc := base64.NewEncoder(base64.StdEncoding, &buf)
+	zw := gzip.NewWriter(enc)
+	if _, err := io.WriteString(zw, text); err != nil {
+		return "", fmt.Errorf("failed to compress column: %w", err)
+	}
+	if err := zw.Close(); err != nil {
+		return "", fmt.Errorf("failed to compress column: %w", err)
+	}
+	if err := enc.Close(); err != nil {
+		return "", fmt.Errorf("failed to compress column: %w", err)
+	}
+	return buf.String(), nil
+}
+
+// decompressColumn reverses compressColumn. Values without
+// compressedPrefix are returned unchanged.
+func decompressColumn(stored string) (string, error) {
+	encoded, ok := strings.CutPrefix(stored, compressedPrefix)
+	if !ok {
+		return stored, nil
+	}
+	zr, err := gzip.NewReader(base64.NewDecoder(base64.StdEncoding, strings.NewReader(encoded)))
+	if err != nil {
+		return "", fmt.Errorf("failed to decompress column: %w", err)
+	}
+	defer zr.Close()
+	data, err := io.ReadAll(zr)
+	if err != nil {
+		return "", fmt.Errorf("failed to decompress column: %w", err)
+	}
+	return string(data), nil
+}
+
+// decompressVersionColumn decompresses a column of version versionID,
+// logging failures and returning "" for them.
+func decompressVersionColumn(versionID, column, stored string) string {
+	text, err := decompressColumn(stored)
+	if err != nil {
+		slog.Warn("Failed to read version column", "version_id", versionID, "column", column, "error", err)
+		return ""
+	}
+	return text
+}
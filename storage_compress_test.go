@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/orian/clicktelligence/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// largePlan builds a PLAN output shaped like ClickHouse's for a query
+// joining n tables.
+func largePlan(n int) string {
+	var b strings.Builder
+	for i := range n {
+		fmt.Fprintf(&b, "Expression ((Project names + Projection))\n  Join (JOIN FillRightFirst)\n    Expression (Before JOIN)\n      ReadFromMergeTree (default.table_%d)\n      Indexes:\n        PrimaryKey\n          Keys:\n            id\n          Condition: (id in [1, +Inf))\n          Parts: 12/12\n          Granules: 4096/4096\n", i)
+	}
+	return b.String()
+}
+
+func TestCompressColumn(t *testing.T) {
+	for _, text := range []string{"", "SELECT 1", `[{"type":"PLAN"}]`, largePlan(20)} {
+		stored, err := compressColumn(text)
+		require.NoError(t, err)
+		assert.True(t, strings.HasPrefix(stored, compressedPrefix))
+
+		got, err := decompressColumn(stored)
+		require.NoError(t, err)
+		assert.Equal(t, text, got)
+	}
+
+	got, err := decompressColumn("SELECT 1")
+	require.NoError(t, err)
+	assert.Equal(t, "SELECT 1", got, "uncompressed values are returned as is")
+
+	_, err = decompressColumn(compressedPrefix + "not base64!")
+	assert.Error(t, err)
+}
+
+func TestStorageCompression(t *testing.T) {
+	storage := newTestStorage(t)
+
+	branch, err := storage.CreateBranch(t.Context(), "compressed", "", "")
+	require.NoError(t, err)
+	plain := saveTestVersion(t, storage, branch.ID, "", "SELECT 1")
+
+	storage.SetCompression(true)
+	version := createVersion(branch.ID, &ExplainRequest{Query: "SELECT 2", ParentVersionID: plain.ID}, hashQuery("SELECT 2"), nil,
+		[]models.ExplainResult{{Type: models.ExplainPlan, Output: largePlan(5)}})
+	version.ExecutionStats.ClickHouseVersion = "25.3"
+	require.NoError(t, storage.SaveVersion(t.Context(), version))
+
+	var storedQuery, storedResults string
+	require.NoError(t, storage.db.QueryRow("SELECT query, explain_results FROM query_versions WHERE id = ?", version.ID).Scan(&storedQuery, &storedResults))
+	assert.Equal(t, "SELECT 2", storedQuery, "short values that don't shrink are stored as is")
+	assert.True(t, strings.HasPrefix(storedResults, compressedPrefix))
+
+	got, ok := storage.GetVersion(t.Context(), version.ID)
+	require.True(t, ok)
+	assert.Equal(t, "SELECT 2", got.Query)
+	assert.Equal(t, largePlan(5), got.ExplainResults[0].Output)
+	assert.Equal(t, "25.3", got.ExecutionStats.ClickHouseVersion)
+
+	// Rows saved before and after enabling compression read alike
+	history, err := storage.GetBranchHistory(t.Context(), branch.ID)
+	require.NoError(t, err)
+	require.Len(t, history, 2)
+	assert.ElementsMatch(t, []string{"SELECT 1", "SELECT 2"}, []string{history[0].Query, history[1].Query})
+
+	require.NoError(t, storage.UpdateVersionResults(t.Context(), plain.ID, []models.ExplainResult{{Type: models.ExplainPlan, Output: "plan"}}, nil, models.ExecutionStats{}))
+	got, ok = storage.GetVersion(t.Context(), plain.ID)
+	require.True(t, ok)
+	assert.Equal(t, "plan", got.ExplainResults[0].Output)
+
+	require.NoError(t, storage.AmendVersion(t.Context(), version.ID, "SELECT 3", hashQuery("SELECT 3")))
+	got, ok = storage.GetVersion(t.Context(), version.ID)
+	require.True(t, ok)
+	assert.Equal(t, "SELECT 3", got.Query)
+}
+
+// BenchmarkCompressColumn compresses the JSON explain_results column of a
+// version with a large plan and reports the stored size relative to the
+// uncompressed one.
+func BenchmarkCompressColumn(b *testing.B) {
+	for _, tables := range []int{1, 10, 100} {
+		b.Run(fmt.Sprintf("tables=%d", tables), func(b *testing.B) {
+			results, err := json.Marshal([]models.ExplainResult{{Type: models.ExplainPlan, Output: largePlan(tables)}})
+			require.NoError(b, err)
+
+			var stored string
+			for b.Loop() {
+				stored, err = compressColumn(string(results))
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(len(results)), "raw-bytes")
+			b.ReportMetric(float64(len(stored)), "stored-bytes")
+			b.ReportMetric(float64(len(stored))/float64(len(results)), "ratio")
+		})
+	}
+}
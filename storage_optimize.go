@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/orian/clicktelligence/models"
+)
+
+// Checkpoint retries: a plain CHECKPOINT fails while another connection has
+// a write transaction open, and FORCE CHECKPOINT would abort it, so
+// Optimize retries a few times before giving up.
+const (
+	checkpointAttempts   = 5
+	checkpointRetryDelay = 200 * time.Millisecond
+)
+
+// Optimize implements models.Storage. DuckDB has no PRAGMA optimize;
+// ANALYZE refreshes the statistics and CHECKPOINT merges the WAL into the
+// file. It isn't bound by the per-operation timeout since checkpointing a
+// large file can take a while.
+func (s *DuckDBStorage) Optimize(ctx context.Context) (*models.OptimizeResult, error) {
+	s.migrateMu.Lock()
+	defer s.migrateMu.Unlock()
+
+	start := time.Now()
+	result := &models.OptimizeResult{SizeBefore: s.fileSize()}
+
+	if _, err := s.db.ExecContext(ctx, "ANALYZE"); err != nil {
+		return nil, fmt.Errorf("failed to analyze: %w", err)
+	}
+	if err := s.checkpoint(ctx); err != nil {
+		return nil, err
+	}
+
+	result.SizeAfter = s.fileSize()
+	result.DurationMs = time.Since(start).Milliseconds()
+	return result, nil
+}
+
+// checkpoint runs CHECKPOINT, retrying while concurrent write transactions
+// prevent it. It returns ErrCheckpointBusy if they never finish in time.
+func (s *DuckDBStorage) checkpoint(ctx context.Context) error {
+	for attempt := 1; ; attempt++ {
+		_, err := s.db.ExecContext(ctx, "CHECKPOINT")
+		if !isCheckpointBusyError(err) {
+			if err != nil {
+				return fmt.Errorf("failed to checkpoint: %w", err)
+			}
+			return nil
+		}
+		if attempt == checkpointAttempts {
+			return fmt.Errorf("%w: %v", ErrCheckpointBusy, err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(checkpointRetryDelay):
+		}
+	}
+}
+
+// isCheckpointBusyError reports whether err is DuckDB refusing a checkpoint
+// because of active write transactions. As with isDuckDBLockError, there is
+// no error code for it.
+func isCheckpointBusyError(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "Cannot CHECKPOINT")
+}
+
+// fileSize returns the size of the database file plus its write-ahead log,
+// or 0 if the file can't be read, e.g. for an in-memory database.
+func (s *DuckDBStorage) fileSize() int64 {
+	var size int64
+	for _, path := range []string{s.path, s.path + ".wal"} {
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		size += info.Size()
+	}
+	return size
+}
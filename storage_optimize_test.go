@@ -0,0 +1,42 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOptimize(t *testing.T) {
+	storage := newTestStorage(t)
+	branch, err := storage.CreateBranch(t.Context(), "feature", "", "")
+	require.NoError(t, err)
+	saveTestVersion(t, storage, branch.ID, "", "SELECT 1")
+
+	result, err := storage.Optimize(t.Context())
+	require.NoError(t, err)
+	assert.Positive(t, result.SizeBefore)
+	assert.Positive(t, result.SizeAfter)
+
+	history, err := storage.GetBranchHistory(t.Context(), branch.ID)
+	require.NoError(t, err)
+	assert.Len(t, history, 1)
+}
+
+func TestOptimizeWithActiveWrite(t *testing.T) {
+	storage := newTestStorage(t)
+	tx, err := storage.db.BeginTx(t.Context(), nil)
+	require.NoError(t, err)
+	_, err = tx.Exec("INSERT INTO branches (id, name, created_at) VALUES ('pending', 'pending', now())")
+	require.NoError(t, err)
+
+	_, err = storage.Optimize(t.Context())
+	assert.ErrorIs(t, err, ErrCheckpointBusy)
+
+	// The write wasn't aborted and the next run succeeds.
+	require.NoError(t, tx.Commit())
+	_, ok := storage.GetBranch(t.Context(), "pending")
+	assert.True(t, ok)
+	_, err = storage.Optimize(t.Context())
+	assert.NoError(t, err)
+}
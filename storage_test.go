@@ -0,0 +1,1018 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/orian/clicktelligence/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestStorage opens a fresh DuckDB storage in a temporary directory.
+func newTestStorage(t *testing.T) *DuckDBStorage {
+	t.Helper()
+	storage, err := NewDuckDBStorage(filepath.Join(t.TempDir(), "test.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() { storage.Close() })
+	return storage
+}
+
+// saveTestVersion stores a version with the given query on a branch.
+func saveTestVersion(t *testing.T, storage *DuckDBStorage, branchID, parentVersionID, query string) *models.QueryVersion {
+	t.Helper()
+	version := &models.QueryVersion{
+		ID:              uuid.New().String(),
+		BranchID:        branchID,
+		Query:           query,
+		QueryHash:       hashQuery(query),
+		ExplainResults:  []models.ExplainResult{},
+		Timestamp:       time.Now(),
+		ParentVersionID: parentVersionID,
+	}
+	require.NoError(t, storage.SaveVersion(t.Context(), version))
+	return version
+}
+
+func TestIsDuckDBLockError(t *testing.T) {
+	lockErr := errors.New(`could not connect to database: IO Error: Could not set lock on file "/data/x.db": Conflicting lock is held in /usr/bin/clicktelligence (PID 42)`)
+	assert.True(t, isDuckDBLockError(lockErr))
+	assert.False(t, isDuckDBLockError(errors.New("IO Error: No such file or directory")))
+	assert.False(t, isDuckDBLockError(nil))
+}
+
+func TestReadOnlyDuckDBStorage(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	storage, err := NewDuckDBStorage(path)
+	require.NoError(t, err)
+	branch, err := storage.CreateBranch(t.Context(), "feature", "", "")
+	require.NoError(t, err)
+	require.NoError(t, storage.Close())
+
+	readOnly, err := NewReadOnlyDuckDBStorage(path)
+	require.NoError(t, err)
+	t.Cleanup(func() { readOnly.Close() })
+
+	got, ok := readOnly.GetBranch(t.Context(), branch.ID)
+	require.True(t, ok)
+	assert.Equal(t, "feature", got.Name)
+
+	_, err = readOnly.CreateBranch(t.Context(), "other", "", "")
+	assert.Error(t, err)
+}
+
+func TestSaveVersionUpdatesBranchHead(t *testing.T) {
+	storage := newTestStorage(t)
+
+	branch, err := storage.CreateBranch(t.Context(), "feature", "", "")
+	require.NoError(t, err)
+
+	first := saveTestVersion(t, storage, branch.ID, "", "SELECT 1")
+	second := saveTestVersion(t, storage, branch.ID, first.ID, "SELECT 2")
+
+	got, ok := storage.GetBranch(t.Context(), branch.ID)
+	require.True(t, ok)
+	assert.Equal(t, second.ID, got.CurrentVersionID)
+
+	history, err := storage.GetBranchHistory(t.Context(), branch.ID)
+	require.NoError(t, err)
+	assert.Len(t, history, 2)
+}
+
+func TestSaveVersionConfigs(t *testing.T) {
+	storage := newTestStorage(t)
+
+	branch, err := storage.CreateBranch(t.Context(), "configs", "", "")
+	require.NoError(t, err)
+
+	indexes := 1
+	configs := []models.ExplainConfig{
+		{Type: models.ExplainPlan, Enabled: true, Settings: models.ExplainSettings{Indexes: &indexes}},
+		{Type: models.ExplainEstimate, Enabled: true},
+	}
+	version := createVersion(branch.ID, &ExplainRequest{Query: "SELECT 1"}, hashQuery("SELECT 1"), configs, nil)
+	require.NoError(t, storage.SaveVersion(t.Context(), version))
+	legacy := saveTestVersion(t, storage, branch.ID, version.ID, "SELECT 2")
+
+	got, ok := storage.GetVersion(t.Context(), version.ID)
+	require.True(t, ok)
+	assert.Equal(t, configs, got.Configs)
+
+	history, err := storage.GetBranchHistory(t.Context(), branch.ID)
+	require.NoError(t, err)
+	require.Len(t, history, 2)
+	assert.Equal(t, legacy.ID, history[0].ID)
+	assert.Empty(t, history[0].Configs, "versions without configs load as empty")
+	assert.Equal(t, configs, history[1].Configs)
+}
+
+func TestSetVersionNotes(t *testing.T) {
+	storage := newTestStorage(t)
+
+	branch, err := storage.CreateBranch(t.Context(), "notes", "", "")
+	require.NoError(t, err)
+	version := saveTestVersion(t, storage, branch.ID, "", "SELECT 1")
+
+	require.NoError(t, storage.SetVersionNotes(t.Context(), version.ID, "dropped scan from 10B to 2B rows"))
+	got, ok := storage.GetVersion(t.Context(), version.ID)
+	require.True(t, ok)
+	assert.Equal(t, "dropped scan from 10B to 2B rows", got.Notes)
+	assert.Equal(t, "SELECT 1", got.Query)
+
+	history, err := storage.GetBranchHistory(t.Context(), branch.ID)
+	require.NoError(t, err)
+	require.Len(t, history, 1)
+	assert.Equal(t, got.Notes, history[0].Notes)
+
+	require.NoError(t, storage.SetVersionNotes(t.Context(), version.ID, ""))
+	got, _ = storage.GetVersion(t.Context(), version.ID)
+	assert.Empty(t, got.Notes)
+
+	err = storage.SetVersionNotes(t.Context(), "missing", "x")
+	assert.ErrorIs(t, err, ErrVersionNotFound)
+}
+
+func TestPing(t *testing.T) {
+	storage := newTestStorage(t)
+	assert.NoError(t, storage.Ping(t.Context()))
+
+	require.NoError(t, storage.Close())
+	assert.Error(t, storage.Ping(t.Context()))
+}
+
+func TestGetVersionAncestry(t *testing.T) {
+	storage := newTestStorage(t)
+
+	branch, err := storage.CreateBranch(t.Context(), "feature", "", "")
+	require.NoError(t, err)
+
+	root := saveTestVersion(t, storage, branch.ID, "", "SELECT 1")
+	middle := saveTestVersion(t, storage, branch.ID, root.ID, "SELECT 2")
+	head := saveTestVersion(t, storage, branch.ID, middle.ID, "SELECT 3")
+
+	t.Run("oldest first", func(t *testing.T) {
+		chain, err := storage.GetVersionAncestry(t.Context(), head.ID)
+		require.NoError(t, err)
+		require.Len(t, chain, 3)
+		assert.Equal(t, root.ID, chain[0].ID)
+		assert.Equal(t, middle.ID, chain[1].ID)
+		assert.Equal(t, head.ID, chain[2].ID)
+	})
+
+	t.Run("root only", func(t *testing.T) {
+		chain, err := storage.GetVersionAncestry(t.Context(), root.ID)
+		require.NoError(t, err)
+		require.Len(t, chain, 1)
+	})
+
+	t.Run("missing parent stops gracefully", func(t *testing.T) {
+		// SaveVersion rejects missing parents, so dangle it afterwards
+		orphan := saveTestVersion(t, storage, branch.ID, "", "SELECT 4")
+		_, err := storage.db.Exec("UPDATE query_versions SET parent_version_id = 'does-not-exist' WHERE id = ?", orphan.ID)
+		require.NoError(t, err)
+		chain, err := storage.GetVersionAncestry(t.Context(), orphan.ID)
+		require.NoError(t, err)
+		require.Len(t, chain, 1)
+		assert.Equal(t, orphan.ID, chain[0].ID)
+	})
+
+	t.Run("unknown version", func(t *testing.T) {
+		_, err := storage.GetVersionAncestry(t.Context(), "does-not-exist")
+		assert.ErrorIs(t, err, ErrVersionNotFound)
+	})
+
+	t.Run("follows both parents of a merge", func(t *testing.T) {
+		other, err := storage.CreateBranch(t.Context(), "other", branch.ID, root.ID)
+		require.NoError(t, err)
+		otherHead := saveTestVersion(t, storage, other.ID, root.ID, "SELECT 7")
+
+		merge := &models.QueryVersion{
+			ID:                   uuid.New().String(),
+			BranchID:             branch.ID,
+			Query:                otherHead.Query,
+			QueryHash:            otherHead.QueryHash,
+			Timestamp:            time.Now(),
+			ParentVersionID:      head.ID,
+			MergeParentVersionID: otherHead.ID,
+		}
+		require.NoError(t, storage.SaveVersion(t.Context(), merge))
+
+		got, ok := storage.GetVersion(t.Context(), merge.ID)
+		require.True(t, ok)
+		assert.Equal(t, otherHead.ID, got.MergeParentVersionID)
+
+		chain, err := storage.GetVersionAncestry(t.Context(), merge.ID)
+		require.NoError(t, err)
+		ids := make([]string, len(chain))
+		for i, version := range chain {
+			ids[i] = version.ID
+		}
+		assert.Equal(t, []string{root.ID, middle.ID, head.ID, otherHead.ID, merge.ID}, ids, "shared root appears once")
+	})
+
+	t.Run("cycle", func(t *testing.T) {
+		a := saveTestVersion(t, storage, branch.ID, "", "SELECT 5")
+		b := saveTestVersion(t, storage, branch.ID, a.ID, "SELECT 6")
+		_, err := storage.db.Exec("UPDATE query_versions SET parent_version_id = ? WHERE id = ?", b.ID, a.ID)
+		require.NoError(t, err)
+
+		_, err = storage.GetVersionAncestry(t.Context(), b.ID)
+		assert.ErrorContains(t, err, "cycle")
+	})
+}
+
+func TestSetBranchPinned(t *testing.T) {
+	storage := newTestStorage(t)
+
+	older, err := storage.CreateBranch(t.Context(), "older", "", "")
+	require.NoError(t, err)
+	time.Sleep(time.Millisecond)
+	newer, err := storage.CreateBranch(t.Context(), "newer", "", "")
+	require.NoError(t, err)
+
+	require.NoError(t, storage.SetBranchPinned(t.Context(), older.ID, true))
+
+	branches, err := storage.GetBranches(t.Context(), false)
+	require.NoError(t, err)
+	require.Len(t, branches, 3) // includes main
+	assert.Equal(t, older.ID, branches[0].ID)
+	assert.True(t, branches[0].Pinned)
+	assert.Equal(t, newer.ID, branches[1].ID)
+
+	require.NoError(t, storage.SetBranchPinned(t.Context(), older.ID, false))
+	got, ok := storage.GetBranch(t.Context(), older.ID)
+	require.True(t, ok)
+	assert.False(t, got.Pinned)
+
+	assert.ErrorIs(t, storage.SetBranchPinned(t.Context(), "missing", true), ErrBranchNotFound)
+}
+
+func TestSaveVersionChecksParent(t *testing.T) {
+	storage := newTestStorage(t)
+
+	branch, err := storage.CreateBranch(t.Context(), "main-line", "", "")
+	require.NoError(t, err)
+	root := saveTestVersion(t, storage, branch.ID, "", "SELECT 1")
+	saveTestVersion(t, storage, branch.ID, root.ID, "SELECT 2")
+
+	// The first version of a fork is parented on the version it was forked from
+	fork, err := storage.CreateBranch(t.Context(), "fork", branch.ID, root.ID)
+	require.NoError(t, err)
+	saveTestVersion(t, storage, fork.ID, root.ID, "SELECT 3")
+
+	unrelated, err := storage.CreateBranch(t.Context(), "unrelated", "", "")
+	require.NoError(t, err)
+	for name, parentID := range map[string]string{"other branch": root.ID, "missing": "does-not-exist"} {
+		version := &models.QueryVersion{
+			ID:              uuid.New().String(),
+			BranchID:        unrelated.ID,
+			Query:           "SELECT 4",
+			QueryHash:       hashQuery("SELECT 4"),
+			Timestamp:       time.Now(),
+			ParentVersionID: parentID,
+		}
+		assert.ErrorIs(t, storage.SaveVersion(t.Context(), version), ErrInvalidParentVersion, name)
+		_, ok := storage.GetVersion(t.Context(), version.ID)
+		assert.False(t, ok, name)
+	}
+	got, ok := storage.GetBranch(t.Context(), unrelated.ID)
+	require.True(t, ok)
+	assert.Empty(t, got.CurrentVersionID)
+}
+
+func TestSetBranchHead(t *testing.T) {
+	storage := newTestStorage(t)
+
+	branch, err := storage.CreateBranch(t.Context(), "head", "", "")
+	require.NoError(t, err)
+	first := saveTestVersion(t, storage, branch.ID, "", "SELECT 1")
+	second := saveTestVersion(t, storage, branch.ID, first.ID, "SELECT 2")
+	other, err := storage.CreateBranch(t.Context(), "other", "", "")
+	require.NoError(t, err)
+	foreign := saveTestVersion(t, storage, other.ID, "", "SELECT 3")
+
+	require.NoError(t, storage.SetBranchHead(t.Context(), branch.ID, first.ID))
+	got, ok := storage.GetBranch(t.Context(), branch.ID)
+	require.True(t, ok)
+	assert.Equal(t, first.ID, got.CurrentVersionID)
+
+	// Later versions are kept, and editing the new head doesn't auto-branch
+	_, ok = storage.GetVersion(t.Context(), second.ID)
+	assert.True(t, ok)
+	result, err := checkAutoBranch(t.Context(), storage, branch.ID, first.ID, "")
+	require.NoError(t, err)
+	assert.False(t, result.AutoBranched)
+
+	assert.ErrorIs(t, storage.SetBranchHead(t.Context(), branch.ID, foreign.ID), ErrVersionNotOnBranch)
+	assert.ErrorIs(t, storage.SetBranchHead(t.Context(), branch.ID, "missing"), ErrVersionNotFound)
+	assert.ErrorIs(t, storage.SetBranchHead(t.Context(), "missing", first.ID), ErrBranchNotFound)
+
+	got, ok = storage.GetBranch(t.Context(), branch.ID)
+	require.True(t, ok)
+	assert.Equal(t, first.ID, got.CurrentVersionID)
+}
+
+func TestSetBranchExplainConfigs(t *testing.T) {
+	storage := newTestStorage(t)
+
+	branch, err := storage.CreateBranch(t.Context(), "configs", "", "")
+	require.NoError(t, err)
+
+	configs := []models.ExplainConfig{{Type: models.ExplainPipeline, Enabled: true}}
+	require.NoError(t, storage.SetBranchExplainConfigs(t.Context(), branch.ID, configs))
+
+	got, ok := storage.GetBranch(t.Context(), branch.ID)
+	require.True(t, ok)
+	assert.Equal(t, configs, got.DefaultExplainConfigs)
+
+	require.NoError(t, storage.SetBranchExplainConfigs(t.Context(), branch.ID, nil))
+	got, ok = storage.GetBranch(t.Context(), branch.ID)
+	require.True(t, ok)
+	assert.Empty(t, got.DefaultExplainConfigs)
+
+	assert.ErrorIs(t, storage.SetBranchExplainConfigs(t.Context(), "missing", configs), ErrBranchNotFound)
+}
+
+func TestSetBranchMaxExecutionTime(t *testing.T) {
+	storage := newTestStorage(t)
+
+	branch, err := storage.CreateBranch(t.Context(), "heavy", "", "")
+	require.NoError(t, err)
+
+	require.NoError(t, storage.SetBranchMaxExecutionTime(t.Context(), branch.ID, 30000))
+	got, ok := storage.GetBranch(t.Context(), branch.ID)
+	require.True(t, ok)
+	assert.Equal(t, 30000, got.DefaultMaxExecutionTimeMs)
+
+	require.NoError(t, storage.SetBranchMaxExecutionTime(t.Context(), branch.ID, 0))
+	got, ok = storage.GetBranch(t.Context(), branch.ID)
+	require.True(t, ok)
+	assert.Zero(t, got.DefaultMaxExecutionTimeMs)
+
+	assert.ErrorIs(t, storage.SetBranchMaxExecutionTime(t.Context(), "missing", 2000), ErrBranchNotFound)
+}
+
+func TestArchiveBranch(t *testing.T) {
+	storage := newTestStorage(t)
+
+	branch, err := storage.CreateBranch(t.Context(), "old-experiment", "", "")
+	require.NoError(t, err)
+	saveTestVersion(t, storage, branch.ID, "", "SELECT 1")
+
+	require.NoError(t, storage.ArchiveBranch(t.Context(), branch.ID, true))
+
+	branches, err := storage.GetBranches(t.Context(), false)
+	require.NoError(t, err)
+	for _, b := range branches {
+		assert.NotEqual(t, branch.ID, b.ID)
+	}
+
+	branches, err = storage.GetBranches(t.Context(), true)
+	require.NoError(t, err)
+	var archived *models.Branch
+	for _, b := range branches {
+		if b.ID == branch.ID {
+			archived = b
+		}
+	}
+	require.NotNil(t, archived)
+	assert.True(t, archived.Archived)
+	assert.Equal(t, 1, archived.VersionCount)
+
+	history, err := storage.GetBranchHistory(t.Context(), branch.ID)
+	require.NoError(t, err)
+	assert.Len(t, history, 1)
+
+	require.NoError(t, storage.ArchiveBranch(t.Context(), branch.ID, false))
+	got, ok := storage.GetBranch(t.Context(), branch.ID)
+	require.True(t, ok)
+	assert.False(t, got.Archived)
+
+	assert.ErrorIs(t, storage.ArchiveBranch(t.Context(), "missing", true), ErrBranchNotFound)
+}
+
+func TestDeleteBranch(t *testing.T) {
+	storage := newTestStorage(t)
+
+	used, err := storage.CreateBranch(t.Context(), "used", "", "")
+	require.NoError(t, err)
+	saveTestVersion(t, storage, used.ID, "", "SELECT 1")
+	assert.Error(t, storage.DeleteBranch(t.Context(), used.ID))
+
+	empty, err := storage.CreateBranch(t.Context(), "empty", "", "")
+	require.NoError(t, err)
+	require.NoError(t, storage.DeleteBranch(t.Context(), empty.ID))
+	_, ok := storage.GetBranch(t.Context(), empty.ID)
+	assert.False(t, ok)
+
+	assert.ErrorIs(t, storage.DeleteBranch(t.Context(), empty.ID), ErrBranchNotFound)
+}
+
+func TestGetBranchesVersionCount(t *testing.T) {
+	storage := newTestStorage(t)
+
+	busy, err := storage.CreateBranch(t.Context(), "busy", "", "")
+	require.NoError(t, err)
+	idle, err := storage.CreateBranch(t.Context(), "idle", "", "")
+	require.NoError(t, err)
+
+	first := saveTestVersion(t, storage, busy.ID, "", "SELECT 1")
+	saveTestVersion(t, storage, busy.ID, first.ID, "SELECT 2")
+
+	branches, err := storage.GetBranches(t.Context(), false)
+	require.NoError(t, err)
+
+	counts := make(map[string]int)
+	for _, b := range branches {
+		counts[b.ID] = b.VersionCount
+	}
+	assert.Len(t, counts, 3) // includes main
+	assert.Equal(t, 2, counts[busy.ID])
+	assert.Equal(t, 0, counts[idle.ID])
+}
+
+func TestGetBranchesDigest(t *testing.T) {
+	storage := newTestStorage(t)
+
+	digest := func() string {
+		t.Helper()
+		d, err := storage.GetBranchesDigest(t.Context(), false)
+		require.NoError(t, err)
+		return d
+	}
+
+	initial := digest()
+	assert.Equal(t, initial, digest())
+
+	branch, err := storage.CreateBranch(t.Context(), "feature", "", "")
+	require.NoError(t, err)
+	created := digest()
+	assert.NotEqual(t, initial, created)
+
+	require.NoError(t, storage.SetBranchPinned(t.Context(), branch.ID, true))
+	pinned := digest()
+	assert.NotEqual(t, created, pinned)
+
+	saveTestVersion(t, storage, branch.ID, "", "SELECT 1")
+	saved := digest()
+	assert.NotEqual(t, pinned, saved)
+
+	archivedBefore, err := storage.GetBranchesDigest(t.Context(), true)
+	require.NoError(t, err)
+	require.NoError(t, storage.ArchiveBranch(t.Context(), branch.ID, true))
+	assert.NotEqual(t, saved, digest())
+	archivedAfter, err := storage.GetBranchesDigest(t.Context(), true)
+	require.NoError(t, err)
+	assert.NotEqual(t, archivedBefore, archivedAfter)
+}
+
+func TestGetChildBranches(t *testing.T) {
+	storage := newTestStorage(t)
+
+	parent, err := storage.CreateBranch(t.Context(), "parent", "", "")
+	require.NoError(t, err)
+	first, err := storage.CreateBranch(t.Context(), "first", parent.ID, "")
+	require.NoError(t, err)
+	time.Sleep(time.Millisecond)
+	second, err := storage.CreateBranch(t.Context(), "second", parent.ID, "")
+	require.NoError(t, err)
+	_, err = storage.CreateBranch(t.Context(), "grandchild", first.ID, "")
+	require.NoError(t, err)
+	saveTestVersion(t, storage, second.ID, "", "SELECT 1")
+
+	children, err := storage.GetChildBranches(t.Context(), parent.ID, false)
+	require.NoError(t, err)
+	require.Len(t, children, 2)
+	assert.Equal(t, first.ID, children[0].ID)
+	assert.Equal(t, second.ID, children[1].ID)
+	assert.Equal(t, 1, children[1].VersionCount)
+
+	require.NoError(t, storage.ArchiveBranch(t.Context(), first.ID, true))
+	children, err = storage.GetChildBranches(t.Context(), parent.ID, false)
+	require.NoError(t, err)
+	assert.Len(t, children, 1)
+	children, err = storage.GetChildBranches(t.Context(), parent.ID, true)
+	require.NoError(t, err)
+	assert.Len(t, children, 2)
+
+	leaf, err := storage.GetChildBranches(t.Context(), second.ID, false)
+	require.NoError(t, err)
+	assert.NotNil(t, leaf)
+	assert.Empty(t, leaf)
+}
+
+func TestGetVersionsByTagAttachesTags(t *testing.T) {
+	storage := newTestStorage(t)
+
+	branch, err := storage.CreateBranch(t.Context(), "feature", "", "")
+	require.NoError(t, err)
+
+	first := saveTestVersion(t, storage, branch.ID, "", "SELECT 1")
+	second := saveTestVersion(t, storage, branch.ID, first.ID, "SELECT 2")
+	saveTestVersion(t, storage, branch.ID, second.ID, "SELECT 3")
+
+	_, err = storage.AddTag(t.Context(), first.ID, "optimized")
+	require.NoError(t, err)
+	_, err = storage.AddTag(t.Context(), second.ID, "optimized")
+	require.NoError(t, err)
+	_, err = storage.AddTag(t.Context(), second.ID, "reviewer=alice")
+	require.NoError(t, err)
+
+	versions, err := storage.GetVersionsByTag(t.Context(), branch.ID, "optimized", false)
+	require.NoError(t, err)
+	require.Len(t, versions, 2)
+	assert.Equal(t, second.ID, versions[0].ID)
+	assert.Len(t, versions[0].Tags, 2)
+	assert.Len(t, versions[1].Tags, 1)
+
+	versions, err = storage.GetVersionsByTag(t.Context(), branch.ID, "reviewer=alice", false)
+	require.NoError(t, err)
+	require.Len(t, versions, 1)
+	assert.Equal(t, second.ID, versions[0].ID)
+
+	versions, err = storage.GetVersionsByTag(t.Context(), branch.ID, "reviewer=bob", false)
+	require.NoError(t, err)
+	assert.Empty(t, versions)
+}
+
+func TestGetVersionsByTagTaggedAt(t *testing.T) {
+	storage := newTestStorage(t)
+
+	branch, err := storage.CreateBranch(t.Context(), "feature", "", "")
+	require.NoError(t, err)
+
+	first := saveTestVersion(t, storage, branch.ID, "", "SELECT 1")
+	time.Sleep(time.Millisecond)
+	second := saveTestVersion(t, storage, branch.ID, first.ID, "SELECT 2")
+
+	// The older version is released last
+	_, err = storage.AddTag(t.Context(), second.ID, "released")
+	require.NoError(t, err)
+	time.Sleep(time.Millisecond)
+	_, err = storage.AddTag(t.Context(), first.ID, "released")
+	require.NoError(t, err)
+
+	versions, err := storage.GetVersionsByTag(t.Context(), branch.ID, "released", false)
+	require.NoError(t, err)
+	require.Len(t, versions, 2)
+	assert.Equal(t, second.ID, versions[0].ID)
+	require.NotNil(t, versions[0].TaggedAt)
+	assert.Equal(t, versions[0].Tags[0].CreatedAt, *versions[0].TaggedAt)
+
+	versions, err = storage.GetVersionsByTag(t.Context(), branch.ID, "released", true)
+	require.NoError(t, err)
+	require.Len(t, versions, 2)
+	assert.Equal(t, first.ID, versions[0].ID)
+	assert.True(t, versions[0].TaggedAt.After(*versions[1].TaggedAt))
+}
+
+func TestGetVersionsByHash(t *testing.T) {
+	storage := newTestStorage(t)
+
+	mainBranch, err := storage.CreateBranch(t.Context(), "main", "", "")
+	require.NoError(t, err)
+	feature, err := storage.CreateBranch(t.Context(), "feature", "", "")
+	require.NoError(t, err)
+
+	first := saveTestVersion(t, storage, mainBranch.ID, "", "SELECT 1")
+	saveTestVersion(t, storage, mainBranch.ID, first.ID, "SELECT 2")
+	second := saveTestVersion(t, storage, feature.ID, "", "select  1")
+	_, err = storage.AddTag(t.Context(), second.ID, "optimized")
+	require.NoError(t, err)
+
+	versions, err := storage.GetVersionsByHash(t.Context(), first.QueryHash)
+	require.NoError(t, err)
+	require.Len(t, versions, 2)
+	assert.Equal(t, second.ID, versions[0].ID)
+	assert.Equal(t, feature.ID, versions[0].BranchID)
+	assert.Len(t, versions[0].Tags, 1)
+	assert.Equal(t, first.ID, versions[1].ID)
+	assert.Empty(t, versions[1].Tags)
+
+	versions, err = storage.GetVersionsByHash(t.Context(), "missing")
+	require.NoError(t, err)
+	assert.Empty(t, versions)
+}
+
+func TestGetErroredVersions(t *testing.T) {
+	storage := newTestStorage(t)
+	storage.SetCompression(true)
+
+	feature, err := storage.CreateBranch(t.Context(), "nightly", "", "")
+	require.NoError(t, err)
+	other, err := storage.CreateBranch(t.Context(), "other", "", "")
+	require.NoError(t, err)
+
+	save := func(branchID, query string, results ...models.ExplainResult) *models.QueryVersion {
+		t.Helper()
+		version := saveTestVersion(t, storage, branchID, "", query)
+		require.NoError(t, storage.UpdateVersionResults(t.Context(), version.ID, results, nil, models.ExecutionStats{}))
+		return version
+	}
+	failed := save(feature.ID, "SELECT broken", models.ExplainResult{Type: models.ExplainPlan, Error: "Query error: unknown table"})
+	save(feature.ID, "SELECT 1", models.ExplainResult{Type: models.ExplainPlan, Output: "plan"})
+	save(feature.ID, "SELECT 2",
+		models.ExplainResult{Type: models.ExplainPlan, Output: "plan"},
+		models.ExplainResult{Type: models.ExplainQueryTree, Error: skippedAnalyzerDisabled, Skipped: true})
+	time.Sleep(time.Millisecond)
+	otherFailed := save(other.ID, "SELECT x", models.ExplainResult{Type: models.ExplainEstimate, Error: "Query error: timeout"})
+
+	versions, err := storage.GetErroredVersions(t.Context(), "")
+	require.NoError(t, err)
+	require.Len(t, versions, 2)
+	assert.Equal(t, otherFailed.ID, versions[0].ID)
+	assert.Equal(t, "other", versions[0].BranchName)
+	assert.Equal(t, failed.ID, versions[1].ID)
+
+	versions, err = storage.GetErroredVersions(t.Context(), feature.ID)
+	require.NoError(t, err)
+	require.Len(t, versions, 1)
+	assert.Equal(t, failed.ID, versions[0].ID)
+
+	versions, err = storage.GetErroredVersions(t.Context(), "missing")
+	require.NoError(t, err)
+	assert.NotNil(t, versions)
+	assert.Empty(t, versions)
+}
+
+func TestGetStarredVersions(t *testing.T) {
+	storage := newTestStorage(t)
+
+	mainBranch, err := storage.CreateBranch(t.Context(), "main", "", "")
+	require.NoError(t, err)
+	feature, err := storage.CreateBranch(t.Context(), "feature", "", "")
+	require.NoError(t, err)
+
+	first := saveTestVersion(t, storage, mainBranch.ID, "", "SELECT 1")
+	saveTestVersion(t, storage, mainBranch.ID, first.ID, "SELECT 2")
+	other := saveTestVersion(t, storage, feature.ID, "", "SELECT 3")
+
+	for _, id := range []string{first.ID, other.ID} {
+		starred, err := storage.ToggleStarred(t.Context(), id)
+		require.NoError(t, err)
+		require.True(t, starred)
+	}
+
+	versions, err := storage.GetStarredVersions(t.Context(), 0)
+	require.NoError(t, err)
+	require.Len(t, versions, 2)
+	assert.Equal(t, other.ID, versions[0].ID, "most recently starred first")
+	assert.Equal(t, "feature", versions[0].BranchName)
+	assert.Equal(t, first.ID, versions[1].ID)
+	assert.Equal(t, "main", versions[1].BranchName)
+	assert.Len(t, versions[1].Tags, 1)
+
+	versions, err = storage.GetStarredVersions(t.Context(), 1)
+	require.NoError(t, err)
+	require.Len(t, versions, 1)
+	assert.Equal(t, other.ID, versions[0].ID)
+}
+
+func TestStorageHonorsContext(t *testing.T) {
+	storage := newTestStorage(t)
+
+	ctx, cancel := context.WithCancel(t.Context())
+	cancel()
+
+	_, err := storage.GetBranches(ctx, true)
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.ErrorIs(t, storage.Ping(ctx), context.Canceled)
+	_, err = storage.CreateBranch(ctx, "canceled", "", "")
+	assert.Error(t, err)
+
+	branches, err := storage.GetBranches(t.Context(), true)
+	require.NoError(t, err)
+	for _, branch := range branches {
+		assert.NotEqual(t, "canceled", branch.Name)
+	}
+}
+
+func TestStorageTimeout(t *testing.T) {
+	storage := newTestStorage(t)
+	storage.SetTimeout(time.Nanosecond)
+
+	assert.ErrorIs(t, storage.Ping(t.Context()), context.DeadlineExceeded)
+
+	storage.SetTimeout(0)
+	assert.NoError(t, storage.Ping(t.Context()))
+}
+
+func TestAddTagConcurrent(t *testing.T) {
+	storage := newTestStorage(t)
+
+	branch, err := storage.CreateBranch(t.Context(), "concurrent", "", "")
+	require.NoError(t, err)
+	version := saveTestVersion(t, storage, branch.ID, "", "SELECT 1")
+
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			storage.AddTag(t.Context(), version.ID, "candidate")
+		}()
+	}
+	wg.Wait()
+
+	tags, err := storage.GetVersionTags(t.Context(), version.ID)
+	require.NoError(t, err)
+	assert.Len(t, tags, 1, "concurrent adds of the same tag store it once")
+}
+
+func TestGetVersionTagsFiltered(t *testing.T) {
+	storage := newTestStorage(t)
+
+	branch, err := storage.CreateBranch(t.Context(), "tags", "", "")
+	require.NoError(t, err)
+	version := saveTestVersion(t, storage, branch.ID, "", "SELECT 1")
+	for _, tag := range []string{"env:prod", "env:staging", "candidate", "owner=alice"} {
+		_, err := storage.AddTag(t.Context(), version.ID, tag)
+		require.NoError(t, err)
+	}
+	_, err = storage.ToggleStarred(t.Context(), version.ID)
+	require.NoError(t, err)
+
+	keys := func(tags []*models.VersionTag) []string {
+		var keys []string
+		for _, tag := range tags {
+			keys = append(keys, tag.TagKey)
+		}
+		return keys
+	}
+
+	tags, total, err := storage.GetVersionTagsFiltered(t.Context(), version.ID, models.TagFilter{})
+	require.NoError(t, err)
+	assert.Equal(t, 5, total)
+	assert.Len(t, tags, 5)
+
+	tags, total, err = storage.GetVersionTagsFiltered(t.Context(), version.ID, models.TagFilter{KeyPrefix: "env:"})
+	require.NoError(t, err)
+	assert.Equal(t, 2, total)
+	assert.ElementsMatch(t, []string{"env:prod", "env:staging"}, keys(tags))
+
+	tags, total, err = storage.GetVersionTagsFiltered(t.Context(), version.ID, models.TagFilter{ExcludeSystem: true})
+	require.NoError(t, err)
+	assert.Equal(t, 4, total)
+	assert.NotContains(t, keys(tags), models.SystemTagPrefix+"starred")
+
+	var paged []string
+	for offset := 0; offset < 4; offset += 3 {
+		page, total, err := storage.GetVersionTagsFiltered(t.Context(), version.ID, models.TagFilter{ExcludeSystem: true, Limit: 3, Offset: offset})
+		require.NoError(t, err)
+		assert.Equal(t, 4, total)
+		paged = append(paged, keys(page)...)
+	}
+	assert.ElementsMatch(t, []string{"env:prod", "env:staging", "candidate", "owner"}, paged)
+
+	tags, total, err = storage.GetVersionTagsFiltered(t.Context(), version.ID, models.TagFilter{KeyPrefix: "missing"})
+	require.NoError(t, err)
+	assert.Zero(t, total)
+	assert.NotNil(t, tags)
+}
+
+func TestReservedTags(t *testing.T) {
+	storage := newTestStorage(t)
+	storage.SetReservedTagPrefixes(models.ReservedTagPrefixes{"ci:"})
+
+	branch, err := storage.CreateBranch(t.Context(), "reserved", "", "")
+	require.NoError(t, err)
+	version := saveTestVersion(t, storage, branch.ID, "", "SELECT 1")
+
+	for _, tag := range []string{"ci:build=42", "system:starred"} {
+		_, err = storage.AddTag(t.Context(), version.ID, tag)
+		assert.ErrorIs(t, err, models.ErrReservedTag, tag)
+	}
+
+	ciTag, err := storage.addTagLocked(t.Context(), version.ID, "ci:build=42")
+	require.NoError(t, err)
+	assert.ErrorIs(t, storage.RemoveTag(t.Context(), ciTag.ID), models.ErrReservedTag)
+
+	starred, err := storage.ToggleStarred(t.Context(), version.ID)
+	require.NoError(t, err)
+	assert.True(t, starred)
+	starred, err = storage.ToggleStarred(t.Context(), version.ID)
+	require.NoError(t, err)
+	assert.False(t, starred)
+
+	tags, err := storage.GetVersionTags(t.Context(), version.ID)
+	require.NoError(t, err)
+	require.Len(t, tags, 1)
+	assert.True(t, tags[0].IsReservedTag(storage.reservedTags))
+}
+
+func TestPlaceholderArgs(t *testing.T) {
+	for _, values := range [][]string{nil, {"a"}, {"a", "b", "c"}} {
+		placeholders, args := placeholderArgs(values)
+		in := joinPlaceholders(placeholders)
+		assert.Equal(t, len(values), strings.Count(in, "?"), in)
+		require.Len(t, args, len(values))
+		for i, value := range values {
+			assert.Equal(t, value, args[i])
+		}
+	}
+	placeholders, _ := placeholderArgs([]string{"a", "b", "c"})
+	assert.Equal(t, "?, ?, ?", joinPlaceholders(placeholders))
+}
+
+func TestGetTagsForVersions(t *testing.T) {
+	storage := newTestStorage(t)
+
+	branch, err := storage.CreateBranch(t.Context(), "tags-in", "", "")
+	require.NoError(t, err)
+	var ids []string
+	for i := range 3 {
+		version := saveTestVersion(t, storage, branch.ID, "", fmt.Sprintf("SELECT %d", i))
+		_, err := storage.AddTag(t.Context(), version.ID, "candidate")
+		require.NoError(t, err)
+		ids = append(ids, version.ID)
+	}
+
+	for _, n := range []int{0, 1, 3} {
+		tags, err := storage.getTagsForVersions(t.Context(), ids[:n])
+		require.NoError(t, err)
+		assert.Len(t, tags, n)
+	}
+}
+
+func TestGetRecentVersions(t *testing.T) {
+	storage := newTestStorage(t)
+
+	mainBranch, err := storage.CreateBranch(t.Context(), "main", "", "")
+	require.NoError(t, err)
+	feature, err := storage.CreateBranch(t.Context(), "feature", "", "")
+	require.NoError(t, err)
+
+	first := saveTestVersion(t, storage, mainBranch.ID, "", "SELECT 1")
+	second := saveTestVersion(t, storage, feature.ID, "", "SELECT 2")
+	third := saveTestVersion(t, storage, mainBranch.ID, first.ID, "SELECT 3")
+	_, err = storage.AddTag(t.Context(), second.ID, "candidate")
+	require.NoError(t, err)
+
+	versions, err := storage.GetRecentVersions(t.Context(), 0)
+	require.NoError(t, err)
+	require.Len(t, versions, 3)
+	assert.Equal(t, []string{third.ID, second.ID, first.ID}, []string{versions[0].ID, versions[1].ID, versions[2].ID})
+	assert.Equal(t, "main", versions[0].BranchName)
+	assert.Equal(t, "feature", versions[1].BranchName)
+	assert.Len(t, versions[1].Tags, 1)
+	assert.Empty(t, versions[0].Tags)
+
+	versions, err = storage.GetRecentVersions(t.Context(), 2)
+	require.NoError(t, err)
+	assert.Len(t, versions, 2)
+}
+
+func TestDeleteVersion(t *testing.T) {
+	storage := newTestStorage(t)
+
+	branch, err := storage.CreateBranch(t.Context(), "feature", "", "")
+	require.NoError(t, err)
+
+	first := saveTestVersion(t, storage, branch.ID, "", "SELECT 1")
+	middle := saveTestVersion(t, storage, branch.ID, first.ID, "SELECT 2")
+	child := saveTestVersion(t, storage, branch.ID, middle.ID, "SELECT 3")
+	forked, err := storage.CreateBranch(t.Context(), "forked", branch.ID, middle.ID)
+	require.NoError(t, err)
+	sibling := saveTestVersion(t, storage, forked.ID, middle.ID, "SELECT 4")
+
+	_, err = storage.AddTag(t.Context(), middle.ID, "broken")
+	require.NoError(t, err)
+	_, err = storage.AddTag(t.Context(), child.ID, "keep")
+	require.NoError(t, err)
+
+	require.NoError(t, storage.DeleteVersion(t.Context(), middle.ID))
+
+	_, ok := storage.GetVersion(t.Context(), middle.ID)
+	assert.False(t, ok)
+
+	for _, id := range []string{child.ID, sibling.ID} {
+		got, ok := storage.GetVersion(t.Context(), id)
+		require.True(t, ok)
+		assert.Equal(t, first.ID, got.ParentVersionID, "children are re-linked to the parent")
+	}
+
+	tags, err := storage.GetVersionTags(t.Context(), child.ID)
+	require.NoError(t, err)
+	assert.Len(t, tags, 1, "children keep their tags")
+
+	got, ok := storage.GetBranch(t.Context(), forked.ID)
+	require.True(t, ok)
+	assert.Equal(t, first.ID, got.BranchFromVersionID)
+
+	// Deleting the head moves it to the parent
+	require.NoError(t, storage.DeleteVersion(t.Context(), child.ID))
+	got, ok = storage.GetBranch(t.Context(), branch.ID)
+	require.True(t, ok)
+	assert.Equal(t, first.ID, got.CurrentVersionID)
+
+	// Deleting a root version leaves its children without a parent
+	require.NoError(t, storage.DeleteVersion(t.Context(), first.ID))
+	got2, ok := storage.GetVersion(t.Context(), sibling.ID)
+	require.True(t, ok)
+	assert.Empty(t, got2.ParentVersionID)
+	got, ok = storage.GetBranch(t.Context(), branch.ID)
+	require.True(t, ok)
+	assert.Empty(t, got.CurrentVersionID)
+
+	assert.ErrorIs(t, storage.DeleteVersion(t.Context(), "missing"), ErrVersionNotFound)
+}
+
+func TestDeleteVersionClearsForkedHead(t *testing.T) {
+	storage := newTestStorage(t)
+
+	branch, err := storage.CreateBranch(t.Context(), "main", "", "")
+	require.NoError(t, err)
+	forkPoint := saveTestVersion(t, storage, branch.ID, "", "SELECT 1")
+	forked, err := storage.CreateBranch(t.Context(), "forked", branch.ID, forkPoint.ID)
+	require.NoError(t, err)
+	first := saveTestVersion(t, storage, forked.ID, forkPoint.ID, "SELECT 2")
+
+	require.NoError(t, storage.DeleteVersion(t.Context(), first.ID))
+
+	got, ok := storage.GetBranch(t.Context(), forked.ID)
+	require.True(t, ok)
+	assert.Empty(t, got.CurrentVersionID, "the fork point stays the head of its own branch only")
+	assert.Equal(t, forkPoint.ID, got.BranchFromVersionID)
+
+	got, ok = storage.GetBranch(t.Context(), branch.ID)
+	require.True(t, ok)
+	assert.Equal(t, forkPoint.ID, got.CurrentVersionID)
+}
+
+func TestDetachedTagsSurviveInterruptedRewrite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	storage, err := NewDuckDBStorage(path)
+	require.NoError(t, err)
+
+	branch, err := storage.CreateBranch(t.Context(), "feature", "", "")
+	require.NoError(t, err)
+	parent := saveTestVersion(t, storage, branch.ID, "", "SELECT 1")
+	child := saveTestVersion(t, storage, branch.ID, parent.ID, "SELECT 2")
+	tag, err := storage.AddTag(t.Context(), child.ID, "keep")
+	require.NoError(t, err)
+
+	// DeleteVersion stops after detaching the tags, as if the process died
+	require.NoError(t, detachTags(t.Context(), storage.db, []string{parent.ID, child.ID}))
+	tags, err := storage.GetVersionTags(t.Context(), child.ID)
+	require.NoError(t, err)
+	assert.Empty(t, tags)
+	require.NoError(t, storage.Close())
+
+	storage, err = NewDuckDBStorage(path)
+	require.NoError(t, err)
+	defer storage.Close()
+	tags, err = storage.GetVersionTags(t.Context(), child.ID)
+	require.NoError(t, err)
+	require.Len(t, tags, 1, "reattached at startup")
+	assert.Equal(t, tag.ID, tags[0].ID)
+
+	// A rewrite whose reattach failed is recovered by the next one
+	require.NoError(t, detachTags(t.Context(), storage.db, []string{child.ID}))
+	require.NoError(t, storage.DeleteVersion(t.Context(), parent.ID))
+	tags, err = storage.GetVersionTags(t.Context(), child.ID)
+	require.NoError(t, err)
+	assert.Len(t, tags, 1)
+}
+
+func TestDeleteVersionRelinksMergeChildren(t *testing.T) {
+	storage := newTestStorage(t)
+
+	branch, err := storage.CreateBranch(t.Context(), "feature", "", "")
+	require.NoError(t, err)
+	other, err := storage.CreateBranch(t.Context(), "other", "", "")
+	require.NoError(t, err)
+
+	root := saveTestVersion(t, storage, other.ID, "", "SELECT 1")
+	source := saveTestVersion(t, storage, other.ID, root.ID, "SELECT 2")
+	head := saveTestVersion(t, storage, branch.ID, "", "SELECT 3")
+	merge := &models.QueryVersion{
+		ID:                   uuid.New().String(),
+		BranchID:             branch.ID,
+		Query:                source.Query,
+		QueryHash:            source.QueryHash,
+		Timestamp:            time.Now(),
+		ParentVersionID:      head.ID,
+		MergeParentVersionID: source.ID,
+	}
+	require.NoError(t, storage.SaveVersion(t.Context(), merge))
+	_, err = storage.AddTag(t.Context(), merge.ID, "merged")
+	require.NoError(t, err)
+
+	require.NoError(t, storage.DeleteVersion(t.Context(), source.ID))
+
+	got, ok := storage.GetVersion(t.Context(), merge.ID)
+	require.True(t, ok)
+	assert.Equal(t, head.ID, got.ParentVersionID)
+	assert.Equal(t, root.ID, got.MergeParentVersionID, "merge parent is re-linked to its parent")
+
+	tags, err := storage.GetVersionTags(t.Context(), merge.ID)
+	require.NoError(t, err)
+	assert.Len(t, tags, 1)
+}
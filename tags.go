@@ -1,8 +1,9 @@
 package main
 
 import (
+	"context"
 	"database/sql"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"time"
 
@@ -12,13 +13,39 @@ import (
 
 // Tag management methods for DuckDBStorage
 
-// AddTag adds a tag to a version
-func (s *DuckDBStorage) AddTag(versionID, tag string) (*models.VersionTag, error) {
+// ErrTagExists is returned when adding a tag a version already has.
+var ErrTagExists = errors.New("tag already exists on this version")
+
+// SetReservedTagPrefixes sets the tag prefixes, besides
+// models.SystemTagPrefix, that AddTag and RemoveTag refuse.
+func (s *DuckDBStorage) SetReservedTagPrefixes(prefixes models.ReservedTagPrefixes) {
+	s.reservedTags = prefixes
+}
+
+// AddTag adds a tag to a version. Reserved tags are rejected; they are only
+// added internally through addTagLocked.
+func (s *DuckDBStorage) AddTag(ctx context.Context, versionID, tag string) (*models.VersionTag, error) {
+	if err := models.ValidateTag(tag, s.reservedTags); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	s.tagMu.Lock()
+	defer s.tagMu.Unlock()
+
+	return s.addTagLocked(ctx, versionID, tag)
+}
+
+// addTagLocked adds a tag unless the version already has it. Callers hold
+// tagMu so the existence check and the insert can't interleave.
+func (s *DuckDBStorage) addTagLocked(ctx context.Context, versionID, tag string) (*models.VersionTag, error) {
 	key, value := models.ParseTag(tag)
 
 	// Check if tag already exists
 	var count int
-	err := s.db.QueryRow(`
+	err := s.db.QueryRowContext(ctx, `
 		SELECT COUNT(*) FROM version_tags
 		WHERE version_id = ? AND tag_key = ? AND COALESCE(tag_value, '') = ?
 	`, versionID, key, value).Scan(&count)
@@ -27,7 +54,7 @@ func (s *DuckDBStorage) AddTag(versionID, tag string) (*models.VersionTag, error
 	}
 
 	if count > 0 {
-		return nil, fmt.Errorf("tag already exists on this version")
+		return nil, ErrTagExists
 	}
 
 	// Create new tag
@@ -39,7 +66,7 @@ func (s *DuckDBStorage) AddTag(versionID, tag string) (*models.VersionTag, error
 		CreatedAt: time.Now(),
 	}
 
-	_, err = s.db.Exec(`
+	_, err = s.db.ExecContext(ctx, `
 		INSERT INTO version_tags (id, version_id, tag_key, tag_value, created_at)
 		VALUES (?, ?, ?, ?, ?)
 	`, tagObj.ID, tagObj.VersionID, tagObj.TagKey, nullString(tagObj.TagValue), tagObj.CreatedAt)
@@ -51,9 +78,29 @@ func (s *DuckDBStorage) AddTag(versionID, tag string) (*models.VersionTag, error
 	return tagObj, nil
 }
 
-// RemoveTag removes a tag from a version
-func (s *DuckDBStorage) RemoveTag(tagID string) error {
-	result, err := s.db.Exec("DELETE FROM version_tags WHERE id = ?", tagID)
+// RemoveTag removes a tag from a version. Reserved tags are rejected; they
+// are only removed internally through removeTag.
+func (s *DuckDBStorage) RemoveTag(ctx context.Context, tagID string) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	var key string
+	err := s.db.QueryRowContext(ctx, "SELECT tag_key FROM version_tags WHERE id = ?", tagID).Scan(&key)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("tag not found")
+	} else if err != nil {
+		return fmt.Errorf("failed to get tag: %w", err)
+	}
+	if prefix := s.reservedTags.Reserved(key); prefix != "" {
+		return fmt.Errorf("%w: tag %q uses the reserved prefix %s", models.ErrReservedTag, key, prefix)
+	}
+
+	return s.removeTag(ctx, tagID)
+}
+
+// removeTag deletes a tag regardless of its prefix.
+func (s *DuckDBStorage) removeTag(ctx context.Context, tagID string) error {
+	result, err := s.db.ExecContext(ctx, "DELETE FROM version_tags WHERE id = ?", tagID)
 	if err != nil {
 		return fmt.Errorf("failed to delete tag: %w", err)
 	}
@@ -71,8 +118,11 @@ func (s *DuckDBStorage) RemoveTag(tagID string) error {
 }
 
 // GetVersionTags gets all tags for a version
-func (s *DuckDBStorage) GetVersionTags(versionID string) ([]*models.VersionTag, error) {
-	rows, err := s.db.Query(`
+func (s *DuckDBStorage) GetVersionTags(ctx context.Context, versionID string) ([]*models.VersionTag, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx, `
 		SELECT id, version_id, tag_key, COALESCE(tag_value, ''), created_at
 		FROM version_tags
 		WHERE version_id = ?
@@ -95,22 +145,89 @@ func (s *DuckDBStorage) GetVersionTags(versionID string) ([]*models.VersionTag,
 	return tags, rows.Err()
 }
 
-// GetVersionsByTag finds versions that have a specific tag
-func (s *DuckDBStorage) GetVersionsByTag(branchID, tag string) ([]*models.QueryVersion, error) {
+// GetVersionTagsFiltered gets a page of the tags of a version matching
+// filter and the total number of matching tags.
+func (s *DuckDBStorage) GetVersionTagsFiltered(ctx context.Context, versionID string, filter models.TagFilter) ([]*models.VersionTag, int, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	where := "WHERE version_id = ?"
+	args := []any{versionID}
+	if filter.KeyPrefix != "" {
+		where += " AND starts_with(tag_key, ?)"
+		args = append(args, filter.KeyPrefix)
+	}
+	if filter.ExcludeSystem {
+		where += " AND NOT starts_with(tag_key, ?)"
+		args = append(args, models.SystemTagPrefix)
+	}
+
+	var total int
+	if err := s.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM version_tags "+where, args...).Scan(&total); err != nil {
+		return nil, 0, fmt.Errorf("failed to count tags: %w", err)
+	}
+
+	query := `
+		SELECT id, version_id, tag_key, COALESCE(tag_value, ''), created_at
+		FROM version_tags
+		` + where + `
+		ORDER BY created_at ASC, id ASC`
+	if filter.Limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, filter.Limit)
+	}
+	if filter.Offset > 0 {
+		query += " OFFSET ?"
+		args = append(args, filter.Offset)
+	}
+
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to query tags: %w", err)
+	}
+	defer rows.Close()
+
+	tags := []*models.VersionTag{}
+	for rows.Next() {
+		var tag models.VersionTag
+		if err := rows.Scan(&tag.ID, &tag.VersionID, &tag.TagKey, &tag.TagValue, &tag.CreatedAt); err != nil {
+			return nil, 0, fmt.Errorf("failed to scan tag: %w", err)
+		}
+		tags = append(tags, &tag)
+	}
+
+	return tags, total, rows.Err()
+}
+
+// GetVersionsByTag finds versions that have a specific tag, with the time
+// they were tagged
+func (s *DuckDBStorage) GetVersionsByTag(ctx context.Context, branchID, tag string, byTaggedAt bool) ([]*models.QueryVersion, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
 	key, value := models.ParseTag(tag)
 
+	orderBy := "qv.timestamp DESC"
+	if byTaggedAt {
+		orderBy = "vt.tagged_at DESC, qv.timestamp DESC"
+	}
 	query := `
-		SELECT DISTINCT qv.id, qv.branch_id, qv.query, qv.query_hash,
+		SELECT qv.id, qv.branch_id, qv.query, qv.query_hash,
 		       COALESCE(qv.explain_results, '[]'),
 		       COALESCE(qv.execution_stats, '{}'), qv.timestamp,
-		       COALESCE(qv.parent_version_id, '')
+		       COALESCE(qv.parent_version_id, ''), COALESCE(qv.merge_parent_version_id, ''), COALESCE(qv.explain_configs, ''), COALESCE(qv.notes, ''),
+		       vt.tagged_at
 		FROM query_versions qv
-		JOIN version_tags vt ON qv.id = vt.version_id
-		WHERE qv.branch_id = ? AND vt.tag_key = ? AND COALESCE(vt.tag_value, '') = ?
-		ORDER BY qv.timestamp DESC
-	`
+		JOIN (
+			SELECT version_id, MIN(created_at) AS tagged_at
+			FROM version_tags
+			WHERE tag_key = ? AND COALESCE(tag_value, '') = ?
+			GROUP BY version_id
+		) vt ON qv.id = vt.version_id
+		WHERE qv.branch_id = ?
+		ORDER BY ` + orderBy
 
-	rows, err := s.db.Query(query, branchID, key, value)
+	rows, err := s.db.QueryContext(ctx, query, key, value, branchID)
 	if err != nil {
 		return nil, fmt.Errorf("failed to query versions by tag: %w", err)
 	}
@@ -118,46 +235,85 @@ func (s *DuckDBStorage) GetVersionsByTag(branchID, tag string) ([]*models.QueryV
 
 	var versions []*models.QueryVersion
 	for rows.Next() {
-		var v models.QueryVersion
-		var explainResultsJSON string
-		var statsJSON string
-		if err := rows.Scan(&v.ID, &v.BranchID, &v.Query, &v.QueryHash, &explainResultsJSON, &statsJSON, &v.Timestamp, &v.ParentVersionID); err != nil {
-			return nil, fmt.Errorf("failed to scan version: %w", err)
+		var taggedAt time.Time
+		version, err := scanVersionRow(rows, &taggedAt)
+		if err != nil {
+			return nil, err
 		}
+		version.TaggedAt = &taggedAt
+		versions = append(versions, version)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
 
-		// Unmarshal JSON fields (same as GetBranchHistory)
-		v.ExplainResults = []models.ExplainResult{}
-		if explainResultsJSON != "" && explainResultsJSON != "[]" {
-			if err := json.Unmarshal([]byte(explainResultsJSON), &v.ExplainResults); err != nil {
-				fmt.Printf("Warning: failed to unmarshal explain results for version %s: %v\n", v.ID, err)
-			}
-		}
+	if err := s.attachTags(ctx, versions); err != nil {
+		return nil, err
+	}
 
-		v.ExecutionStats = make(map[string]interface{})
-		if statsJSON != "" && statsJSON != "{}" {
-			if err := json.Unmarshal([]byte(statsJSON), &v.ExecutionStats); err != nil {
-				fmt.Printf("Warning: failed to unmarshal stats for version %s: %v\n", v.ID, err)
-			}
-		}
+	return versions, nil
+}
+
+// GetStarredVersions returns starred versions across all branches, most
+// recently starred first, with BranchName set. limit <= 0 returns all.
+func (s *DuckDBStorage) GetStarredVersions(ctx context.Context, limit int) ([]*models.QueryVersion, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
 
-		versions = append(versions, &v)
+	query := `
+		SELECT qv.id, qv.branch_id, qv.query, qv.query_hash,
+		       COALESCE(qv.explain_results, '[]'),
+		       COALESCE(qv.execution_stats, '{}'), qv.timestamp,
+		       COALESCE(qv.parent_version_id, ''), COALESCE(qv.merge_parent_version_id, ''), COALESCE(qv.explain_configs, ''), COALESCE(qv.notes, ''),
+		       COALESCE(b.name, '')
+		FROM version_tags vt
+		JOIN query_versions qv ON qv.id = vt.version_id
+		LEFT JOIN branches b ON b.id = qv.branch_id
+		WHERE vt.tag_key = 'system:starred'
+		ORDER BY vt.created_at DESC
+	`
+	args := []any{}
+	if limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, limit)
 	}
 
-	return versions, rows.Err()
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query starred versions: %w", err)
+	}
+	defer rows.Close()
+
+	versions, err := scanVersionRowsWithBranch(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.attachTags(ctx, versions); err != nil {
+		return nil, err
+	}
+
+	return versions, nil
 }
 
 // ToggleStarred toggles the system:starred tag on a version
-func (s *DuckDBStorage) ToggleStarred(versionID string) (bool, error) {
+func (s *DuckDBStorage) ToggleStarred(ctx context.Context, versionID string) (bool, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	s.tagMu.Lock()
+	defer s.tagMu.Unlock()
+
 	// Check if starred tag exists
 	var tagID string
-	err := s.db.QueryRow(`
+	err := s.db.QueryRowContext(ctx, `
 		SELECT id FROM version_tags
 		WHERE version_id = ? AND tag_key = 'system:starred'
 	`, versionID).Scan(&tagID)
 
 	if err == sql.ErrNoRows {
 		// Not starred, add the star
-		_, err := s.AddTag(versionID, "system:starred")
+		_, err := s.addTagLocked(ctx, versionID, "system:starred")
 		if err != nil {
 			return false, fmt.Errorf("failed to star version: %w", err)
 		}
@@ -167,7 +323,7 @@ func (s *DuckDBStorage) ToggleStarred(versionID string) (bool, error) {
 	}
 
 	// Already starred, remove the star
-	if err := s.RemoveTag(tagID); err != nil {
+	if err := s.removeTag(ctx, tagID); err != nil {
 		return false, fmt.Errorf("failed to unstar version: %w", err)
 	}
 	return false, nil
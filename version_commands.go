@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"net"
+	"slices"
+	"strings"
+
+	"github.com/orian/clicktelligence/models"
+)
+
+// VersionCommand is a clickhouse-client invocation reproducing one EXPLAIN
+// of a version.
+type VersionCommand struct {
+	Type models.ExplainType `json:"type"`
+
+	// Query is the EXPLAIN statement, including its SETTINGS clause.
+	Query string `json:"query"`
+
+	// Command is Query wrapped in a ready-to-paste clickhouse-client call.
+	Command string `json:"command"`
+
+	// Reconstructed is true when the result didn't record the statement it
+	// ran, so Query was rebuilt from the EXPLAIN config of its type. The
+	// original settings may have differed.
+	Reconstructed bool `json:"reconstructed,omitempty"`
+}
+
+// buildVersionCommands returns a command per executed EXPLAIN result of
+// version, connecting with profile. Results that were skipped are left out.
+// configs supplies the configs used to reconstruct statements that weren't
+// recorded; a bare config of the result's type is used when none matches.
+func buildVersionCommands(version *models.QueryVersion, profile ConnProfile, configs []models.ExplainConfig) []VersionCommand {
+	params := version.ExecutionStats.Parameters
+
+	commands := []VersionCommand{}
+	for _, result := range executedResults(version.ExplainResults) {
+		command := VersionCommand{Type: result.Type, Query: result.ExecutedQuery}
+		if command.Query == "" {
+			config := models.ExplainConfig{Type: result.Type, Enabled: true}
+			if i := slices.IndexFunc(configs, func(c models.ExplainConfig) bool { return c.Type == result.Type }); i >= 0 {
+				config = configs[i]
+			}
+			command.Query = config.BuildExplainQuery(version.Query, "", false, 0, nil)
+			command.Reconstructed = true
+		}
+		command.Command = clientCommand(profile, params, command.Query)
+		commands = append(commands, command)
+	}
+	return commands
+}
+
+// clientCommand formats a clickhouse-client call running query against
+// profile. The password is never included: --password makes the client
+// prompt for it.
+func clientCommand(profile ConnProfile, params map[string]string, query string) string {
+	args := []string{"clickhouse-client"}
+	if profile.Host != "" {
+		host, port, err := net.SplitHostPort(profile.Host)
+		if err != nil {
+			host, port = profile.Host, ""
+		}
+		args = append(args, "--host", shellQuote(host))
+		if port != "" {
+			args = append(args, "--port", shellQuote(port))
+		}
+	}
+	if profile.Secure {
+		args = append(args, "--secure")
+	}
+	if profile.User != "" {
+		args = append(args, "--user", shellQuote(profile.User))
+	}
+	if profile.Password != "" {
+		args = append(args, "--password")
+	}
+	if profile.Database != "" {
+		args = append(args, "--database", shellQuote(profile.Database))
+	}
+	for _, name := range slices.Sorted(maps.Keys(params)) {
+		args = append(args, shellQuote(fmt.Sprintf("--param_%s=%s", name, params[name])))
+	}
+	args = append(args, "--query", shellQuote(query))
+	return strings.Join(args, " ")
+}
+
+// shellQuote quotes s for POSIX shells, leaving simple words as they are.
+func shellQuote(s string) string {
+	if s != "" && strings.IndexFunc(s, func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("-_.,:/=@%+", r))
+	}) < 0 {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/orian/clicktelligence/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestShellQuote(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{in: "localhost", want: "localhost"},
+		{in: "--param_id=1", want: "--param_id=1"},
+		{in: "", want: "''"},
+		{in: "SELECT 1", want: "'SELECT 1'"},
+		{in: "it's", want: `'it'\''s'`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			assert.Equal(t, tt.want, shellQuote(tt.in))
+		})
+	}
+}
+
+func TestBuildVersionCommands(t *testing.T) {
+	profile := ConnProfile{Host: "ch.example.com:9440", Database: "analytics", User: "reader", Password: "secret", Secure: true}
+	version := &models.QueryVersion{
+		Query: "SELECT * FROM t WHERE id = {id:UInt64}",
+		ExplainResults: []models.ExplainResult{
+			{Type: models.ExplainPlan, ExecutedQuery: "EXPLAIN PLAN indexes = 1 SELECT * FROM t WHERE id = {id:UInt64} SETTINGS log_comment = 'x'"},
+			{Type: models.ExplainAST},
+			{Type: models.ExplainQueryTree, Skipped: true, Error: skippedAnalyzerDisabled},
+		},
+		ExecutionStats: models.ExecutionStats{Parameters: map[string]string{"id": "7"}},
+	}
+
+	commands := buildVersionCommands(version, profile, nil)
+	require.Len(t, commands, 2, "skipped results have no command")
+
+	assert.Equal(t, models.ExplainPlan, commands[0].Type)
+	assert.False(t, commands[0].Reconstructed)
+	assert.Equal(t,
+		`clickhouse-client --host ch.example.com --port 9440 --secure --user reader --password --database analytics --param_id=7 `+
+			`--query 'EXPLAIN PLAN indexes = 1 SELECT * FROM t WHERE id = {id:UInt64} SETTINGS log_comment = '\''x'\'''`,
+		commands[0].Command)
+	assert.NotContains(t, commands[0].Command, "secret")
+
+	assert.True(t, commands[1].Reconstructed)
+	assert.Equal(t, "EXPLAIN AST SELECT * FROM t WHERE id = {id:UInt64}", commands[1].Query)
+}
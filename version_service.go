@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/orian/clicktelligence/models"
+)
+
+// ErrVersionNotHead is returned when amending a version that is not the
+// current head of its branch.
+var ErrVersionNotHead = errors.New("version is not the head of its branch; create a branch from it instead")
+
+// VersionDetail is a single version with its tags and its parent's query
+// hash, so clients can tell whether the query changed from the parent.
+type VersionDetail struct {
+	*models.QueryVersion
+
+	// ParentQueryHash is empty when the version has no (existing) parent.
+	ParentQueryHash string `json:"parentQueryHash,omitempty"`
+}
+
+// getVersionDetail loads a version with its tags and parent query hash.
+func getVersionDetail(ctx context.Context, storage models.Storage, versionID string) (*VersionDetail, error) {
+	version, exists := storage.GetVersion(ctx, versionID)
+	if !exists {
+		return nil, fmt.Errorf("%w: %s", ErrVersionNotFound, versionID)
+	}
+
+	tags, err := storage.GetVersionTags(ctx, versionID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load tags: %w", err)
+	}
+	version.Tags = tags
+
+	detail := &VersionDetail{QueryVersion: version}
+	if version.ParentVersionID != "" {
+		if parent, ok := storage.GetVersion(ctx, version.ParentVersionID); ok {
+			detail.ParentQueryHash = parent.QueryHash
+		}
+	}
+
+	return detail, nil
+}
+
+// amendVersion replaces the query of a branch head in place, like
+// git commit --amend. Explain results are cleared so they are re-run on the
+// next explain. Returns ErrVersionNotHead for any other version.
+func amendVersion(ctx context.Context, storage models.Storage, versionID, query string) (*models.QueryVersion, error) {
+	version, exists := storage.GetVersion(ctx, versionID)
+	if !exists {
+		return nil, fmt.Errorf("%w: %s", ErrVersionNotFound, versionID)
+	}
+
+	branch, exists := storage.GetBranch(ctx, version.BranchID)
+	if !exists {
+		return nil, fmt.Errorf("%w: %s", ErrBranchNotFound, version.BranchID)
+	}
+	if branch.CurrentVersionID != version.ID {
+		return nil, fmt.Errorf("%w: %s", ErrVersionNotHead, versionID)
+	}
+
+	queryHash := hashQuery(query)
+	if err := storage.AmendVersion(ctx, versionID, query, queryHash); err != nil {
+		return nil, err
+	}
+
+	version.Query = query
+	version.QueryHash = queryHash
+	version.ExplainResults = []models.ExplainResult{}
+	version.ExecutionStats = models.ExecutionStats{}
+	return version, nil
+}
+
+// prepareReanalyze builds the explain request that runs the EXPLAINs of a
+// version again: its query, parameters, profile and recorded configs
+// (empty, i.e. the defaults, for versions without recorded configs),
+// parented on the version itself.
+func prepareReanalyze(ctx context.Context, storage models.Storage, versionID string) (*models.QueryVersion, *ExplainRequest, error) {
+	version, exists := storage.GetVersion(ctx, versionID)
+	if !exists {
+		return nil, nil, fmt.Errorf("%w: %s", ErrVersionNotFound, versionID)
+	}
+
+	req := &ExplainRequest{
+		BranchID:        version.BranchID,
+		Query:           version.Query,
+		ParentVersionID: version.ID,
+		ExplainConfigs:  version.Configs,
+		Parameters:      version.ExecutionStats.Parameters,
+		CustomSettings:  version.ExecutionStats.CustomSettings,
+		Database:        version.ExecutionStats.Database,
+		rerun:           true,
+	}
+	if profile := profileFromStats(version.ExecutionStats); profile != DefaultProfile {
+		req.Profile = profile
+	}
+	return version, req, nil
+}
+
+// reanalyzedStats returns the execution stats of a version whose EXPLAINs
+// ran again at now: the parameters, custom settings, profile and database
+// of old, which the EXPLAINs ran again with, with fresh added on top.
+func reanalyzedStats(old, fresh models.ExecutionStats, now time.Time) models.ExecutionStats {
+	stats := models.ExecutionStats{Parameters: old.Parameters, CustomSettings: old.CustomSettings, Profile: old.Profile, Database: old.Database}
+	stats.Merge(fresh)
+	stats.ReanalyzedAt = now.UTC().Truncate(time.Second)
+	return stats
+}
+
+// ErrNoPlanJSON is returned when a version has no successful EXPLAIN PLAN
+// result in JSON.
+var ErrNoPlanJSON = errors.New("version has no JSON plan; run EXPLAIN PLAN with json = 1")
+
+// versionPlanAnalysis analyzes the first successful JSON EXPLAIN PLAN
+// result of a version.
+func versionPlanAnalysis(ctx context.Context, storage models.Storage, versionID string) (*models.PlanAnalysis, error) {
+	version, exists := storage.GetVersion(ctx, versionID)
+	if !exists {
+		return nil, fmt.Errorf("%w: %s", ErrVersionNotFound, versionID)
+	}
+
+	for _, result := range executedResults(version.ExplainResults) {
+		if result.Type != models.ExplainPlan || result.Error != "" || len(result.Structured) == 0 {
+			continue
+		}
+		root, err := models.ParsePlanJSON(result.Structured)
+		if err != nil {
+			continue
+		}
+		analysis := models.AnalyzePlan(root)
+		return &analysis, nil
+	}
+	return nil, fmt.Errorf("%w: %s", ErrNoPlanJSON, versionID)
+}
+
+// ErrNoParentVersion is returned when diffing a version without an
+// (existing) parent.
+var ErrNoParentVersion = errors.New("version has no parent")
+
+// ParentDiff is the EXPLAIN diff of a version against its parent.
+type ParentDiff struct {
+	VersionID       string               `json:"versionId"`
+	ParentVersionID string               `json:"parentVersionId"`
+	QueryChanged    bool                 `json:"queryChanged"`
+	Diffs           []models.ExplainDiff `json:"diffs"`
+}
+
+// versionParentDiff diffs the EXPLAIN results of a version against those
+// of its parent, see models.DiffExplainResults.
+func versionParentDiff(ctx context.Context, storage models.Storage, versionID string) (*ParentDiff, error) {
+	version, exists := storage.GetVersion(ctx, versionID)
+	if !exists {
+		return nil, fmt.Errorf("%w: %s", ErrVersionNotFound, versionID)
+	}
+	if version.ParentVersionID == "" {
+		return nil, fmt.Errorf("%w: %s", ErrNoParentVersion, versionID)
+	}
+	parent, exists := storage.GetVersion(ctx, version.ParentVersionID)
+	if !exists {
+		return nil, fmt.Errorf("%w: %s", ErrNoParentVersion, versionID)
+	}
+
+	return &ParentDiff{
+		VersionID:       version.ID,
+		ParentVersionID: parent.ID,
+		QueryChanged:    version.QueryHash != parent.QueryHash,
+		Diffs:           models.DiffExplainResults(parent.ExplainResults, version.ExplainResults),
+	}, nil
+}
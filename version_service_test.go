@@ -0,0 +1,203 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/orian/clicktelligence/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetVersionDetail(t *testing.T) {
+	storage := newTestStorage(t)
+
+	branch, err := storage.CreateBranch(t.Context(), "detail", "", "")
+	require.NoError(t, err)
+
+	parent := saveTestVersion(t, storage, branch.ID, "", "SELECT 1")
+	child := saveTestVersion(t, storage, branch.ID, parent.ID, "SELECT 2")
+	_, err = storage.AddTag(t.Context(), child.ID, "optimized")
+	require.NoError(t, err)
+
+	t.Run("with parent and tags", func(t *testing.T) {
+		detail, err := getVersionDetail(t.Context(), storage, child.ID)
+		require.NoError(t, err)
+		assert.Equal(t, child.ID, detail.ID)
+		assert.Equal(t, parent.QueryHash, detail.ParentQueryHash)
+		require.Len(t, detail.Tags, 1)
+		assert.Equal(t, "optimized", detail.Tags[0].TagKey)
+
+		// Version fields are flattened next to parentQueryHash
+		jsonBytes, err := json.Marshal(detail)
+		require.NoError(t, err)
+		var parsed map[string]interface{}
+		require.NoError(t, json.Unmarshal(jsonBytes, &parsed))
+		assert.Equal(t, child.ID, parsed["id"])
+		assert.Equal(t, parent.QueryHash, parsed["parentQueryHash"])
+	})
+
+	t.Run("root version", func(t *testing.T) {
+		detail, err := getVersionDetail(t.Context(), storage, parent.ID)
+		require.NoError(t, err)
+		assert.Empty(t, detail.ParentQueryHash)
+		assert.Empty(t, detail.Tags)
+	})
+
+	t.Run("unknown version", func(t *testing.T) {
+		_, err := getVersionDetail(t.Context(), storage, "missing")
+		assert.ErrorIs(t, err, ErrVersionNotFound)
+	})
+}
+
+func TestAmendVersion(t *testing.T) {
+	storage := newTestStorage(t)
+
+	branch, err := storage.CreateBranch(t.Context(), "feature", "", "")
+	require.NoError(t, err)
+	first := saveTestVersion(t, storage, branch.ID, "", "SELECT 1")
+	head := &models.QueryVersion{
+		ID:              uuid.New().String(),
+		BranchID:        branch.ID,
+		Query:           "SELECT 2 -- tpyo",
+		QueryHash:       hashQuery("SELECT 2 -- tpyo"),
+		ExplainResults:  []models.ExplainResult{{Type: models.ExplainPlan, Output: "stale"}},
+		ExecutionStats:  models.ExecutionStats{Extra: map[string]interface{}{"read_rows": 10}},
+		Timestamp:       time.Now(),
+		ParentVersionID: first.ID,
+	}
+	require.NoError(t, storage.SaveVersion(t.Context(), head))
+	_, err = storage.AddTag(t.Context(), head.ID, "optimized")
+	require.NoError(t, err)
+
+	t.Run("amends head in place", func(t *testing.T) {
+		amended, err := amendVersion(t.Context(), storage, head.ID, "SELECT 2 -- typo")
+		require.NoError(t, err)
+		assert.Equal(t, hashQuery("SELECT 2 -- typo"), amended.QueryHash)
+
+		got, ok := storage.GetVersion(t.Context(), head.ID)
+		require.True(t, ok)
+		assert.Equal(t, "SELECT 2 -- typo", got.Query)
+		assert.Equal(t, amended.QueryHash, got.QueryHash)
+		assert.Empty(t, got.ExplainResults)
+		assert.Empty(t, got.ExecutionStats)
+		assert.Equal(t, first.ID, got.ParentVersionID)
+
+		tags, err := storage.GetVersionTags(t.Context(), head.ID)
+		require.NoError(t, err)
+		assert.Len(t, tags, 1)
+
+		history, err := storage.GetBranchHistory(t.Context(), branch.ID)
+		require.NoError(t, err)
+		assert.Len(t, history, 2)
+	})
+
+	t.Run("rejects non-head version", func(t *testing.T) {
+		_, err := amendVersion(t.Context(), storage, first.ID, "SELECT 3")
+		assert.ErrorIs(t, err, ErrVersionNotHead)
+
+		got, ok := storage.GetVersion(t.Context(), first.ID)
+		require.True(t, ok)
+		assert.Equal(t, "SELECT 1", got.Query)
+	})
+
+	t.Run("unknown version", func(t *testing.T) {
+		_, err := amendVersion(t.Context(), storage, "missing", "SELECT 3")
+		assert.ErrorIs(t, err, ErrVersionNotFound)
+	})
+}
+
+func TestPrepareReanalyze(t *testing.T) {
+	storage := newTestStorage(t)
+
+	branch, err := storage.CreateBranch(t.Context(), "reanalyze", "", "")
+	require.NoError(t, err)
+	configs := []models.ExplainConfig{{Type: models.ExplainPlan, Enabled: true}}
+	version := createVersion(branch.ID, &ExplainRequest{Query: "SELECT {id:UInt64}", Parameters: map[string]string{"id": "1"}, Profile: "staging"}, hashQuery("SELECT {id:UInt64}"), configs, nil)
+	require.NoError(t, storage.SaveVersion(t.Context(), version))
+
+	_, req, err := prepareReanalyze(t.Context(), storage, version.ID)
+	require.NoError(t, err)
+	assert.Equal(t, branch.ID, req.BranchID)
+	assert.Equal(t, version.ID, req.ParentVersionID)
+	assert.Equal(t, version.Query, req.Query)
+	assert.Equal(t, configs, req.ExplainConfigs)
+	assert.Equal(t, map[string]string{"id": "1"}, req.Parameters)
+	assert.Equal(t, "staging", req.Profile)
+	assert.True(t, req.rerun)
+
+	_, _, err = prepareReanalyze(t.Context(), storage, "missing")
+	assert.ErrorIs(t, err, ErrVersionNotFound)
+}
+
+func TestReanalyzedStats(t *testing.T) {
+	old := models.ExecutionStats{
+		Parameters:        map[string]string{"id": "1"},
+		ClickHouseVersion: "23.8",
+		BorrowedFrom:      "v0",
+		Extra:             map[string]interface{}{"read_rows": float64(10)},
+	}
+	now := time.Date(2026, 5, 1, 12, 0, 0, 500, time.FixedZone("CEST", 2*3600))
+
+	stats := reanalyzedStats(old, models.ExecutionStats{ClickHouseVersion: "25.3"}, now)
+	assert.Equal(t, models.ExecutionStats{
+		Parameters:        map[string]string{"id": "1"},
+		ClickHouseVersion: "25.3",
+		ReanalyzedAt:      time.Date(2026, 5, 1, 10, 0, 0, 0, time.UTC),
+	}, stats)
+}
+
+func TestVersionPlanAnalysis(t *testing.T) {
+	storage := newTestStorage(t)
+
+	branch, err := storage.CreateBranch(t.Context(), "plan-analysis", "", "")
+	require.NoError(t, err)
+	results := []models.ExplainResult{
+		{Type: models.ExplainSyntax, Output: "SELECT 1"},
+		{Type: models.ExplainPlan, Structured: json.RawMessage(`[{"Plan": {"Node Type": "Expression", "Plans": [{"Node Type": "ReadFromStorage"}]}}]`)},
+	}
+	version := createVersion(branch.ID, &ExplainRequest{Query: "SELECT 1"}, hashQuery("SELECT 1"), nil, results)
+	require.NoError(t, storage.SaveVersion(t.Context(), version))
+
+	analysis, err := versionPlanAnalysis(t.Context(), storage, version.ID)
+	require.NoError(t, err)
+	assert.Equal(t, 2, analysis.NodeCount)
+	require.Len(t, analysis.FullScans, 1)
+	assert.Equal(t, "ReadFromStorage", analysis.FullScans[0].NodeType)
+
+	textOnly := createVersion(branch.ID, &ExplainRequest{Query: "SELECT 2"}, hashQuery("SELECT 2"), nil, []models.ExplainResult{{Type: models.ExplainPlan, Output: "Expression"}})
+	require.NoError(t, storage.SaveVersion(t.Context(), textOnly))
+	_, err = versionPlanAnalysis(t.Context(), storage, textOnly.ID)
+	assert.ErrorIs(t, err, ErrNoPlanJSON)
+
+	_, err = versionPlanAnalysis(t.Context(), storage, "missing")
+	assert.ErrorIs(t, err, ErrVersionNotFound)
+}
+
+func TestVersionParentDiff(t *testing.T) {
+	storage := newTestStorage(t)
+
+	branch, err := storage.CreateBranch(t.Context(), "parent-diff", "", "")
+	require.NoError(t, err)
+	parent := createVersion(branch.ID, &ExplainRequest{Query: "SELECT 1"}, hashQuery("SELECT 1"), nil, []models.ExplainResult{{Type: models.ExplainPlan, Output: "Expression\n  ReadFromStorage"}})
+	require.NoError(t, storage.SaveVersion(t.Context(), parent))
+	child := createVersion(branch.ID, &ExplainRequest{Query: "SELECT 2", ParentVersionID: parent.ID}, hashQuery("SELECT 2"), nil, []models.ExplainResult{{Type: models.ExplainPlan, Output: "Expression\n  Filter\n  ReadFromStorage"}})
+	require.NoError(t, storage.SaveVersion(t.Context(), child))
+
+	diff, err := versionParentDiff(t.Context(), storage, child.ID)
+	require.NoError(t, err)
+	assert.Equal(t, parent.ID, diff.ParentVersionID)
+	assert.True(t, diff.QueryChanged)
+	require.Len(t, diff.Diffs, 1)
+	assert.True(t, diff.Diffs[0].Changed)
+	assert.Contains(t, diff.Diffs[0].Lines, models.DiffLine{Op: models.DiffInsert, Text: "  Filter"})
+
+	_, err = versionParentDiff(t.Context(), storage, parent.ID)
+	assert.ErrorIs(t, err, ErrNoParentVersion)
+
+	_, err = versionParentDiff(t.Context(), storage, "missing")
+	assert.ErrorIs(t, err, ErrVersionNotFound)
+}